@@ -1,16 +1,19 @@
 package main
 
 import (
-	"fmt"
+	"log/slog"
+	"os"
 
 	"orderservice/config"
 	"orderservice/internal/app"
+	"orderservice/internal/logger"
 )
 
 func main() {
 	// читаем конфиг из env
 	startConfig := config.GetConfig()
-	fmt.Println("Start config values:", startConfig)
+	logger.Setup(os.Stdout, startConfig.LogLevel, startConfig.LogFormat)
+	slog.Info("Start config loaded", "config", startConfig)
 
 	// запускаем приложение
 	application := app.NewApplication(startConfig)
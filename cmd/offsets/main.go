@@ -0,0 +1,203 @@
+// Command offsets - consumer group administration of the service: offsets and lag by partition, offset reset
+// and replay of historical orders. Settings are read from the same env as the service
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"orderservice/config"
+	"orderservice/internal/app"
+	"orderservice/internal/kafka"
+	"orderservice/internal/kafkaconn"
+	"orderservice/internal/logger"
+)
+
+const usage = `usage: offsets <command> [flags]
+
+commands:
+  describe                                        committed offsets and lag of the consumer group
+  reset -to earliest|latest [-execute]            move the group to the start or the end of partitions
+  reset -to timestamp -at TIME [-execute]         move the group to the first messages written at or after TIME
+  reset -to explicit -offsets P=N,... [-execute]  move the group on the listed partitions
+  replay -from TIME [-until TIME]                 re-ingest orders written in [from, until) without touching the group
+
+reset prints the plan and changes nothing without -execute, the service must be stopped to apply it.
+TIME is RFC 3339, e.g. 2025-10-01T00:00:00Z. -group and -topic default to KAFKA_GROUP_ID and KAFKA_TOPIC.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	cfg := config.GetConfig()
+	// лог - в stderr, чтобы не смешивался с таблицей смещений
+	logger.Setup(os.Stderr, cfg.LogLevel, cfg.LogFormat)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var err error
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "describe":
+		err = describe(ctx, cfg, args)
+	case "reset":
+		err = reset(ctx, cfg, args)
+	case "replay":
+		err = replay(ctx, cfg, args)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		slog.Error("Command failed", "command", os.Args[1], "error", err)
+		os.Exit(1)
+	}
+}
+
+// groupFlags - группа и топик, общие для describe и reset
+func groupFlags(fs *flag.FlagSet, cfg config.Config) (group, topic *string) {
+	return fs.String("group", cfg.Consumer.GroupID, "consumer group"), fs.String("topic", cfg.Topic, "topic of orders")
+}
+
+func describe(ctx context.Context, cfg config.Config, args []string) error {
+	fs := flag.NewFlagSet("describe", flag.ExitOnError)
+	group, topic := groupFlags(fs, cfg)
+	fs.Parse(args)
+
+	kc, err := kafkaconn.New(cfg.Kafka)
+	if err != nil {
+		return err
+	}
+	positions, err := kafka.DescribeGroup(ctx, kc, *group, *topic)
+	if err != nil {
+		return err
+	}
+	printPositions(positions, false)
+	return nil
+}
+
+func reset(ctx context.Context, cfg config.Config, args []string) error {
+	fs := flag.NewFlagSet("reset", flag.ExitOnError)
+	group, topic := groupFlags(fs, cfg)
+	mode := fs.String("to", "", "earliest, latest, timestamp or explicit")
+	at := fs.String("at", "", "time for -to timestamp, RFC 3339")
+	offsets := fs.String("offsets", "", "partition=offset pairs for -to explicit, comma separated")
+	execute := fs.Bool("execute", false, "commit the new offsets, otherwise only print the plan")
+	fs.Parse(args)
+
+	target := kafka.OffsetReset{Mode: *mode}
+	var err error
+	switch *mode {
+	case kafka.OffsetEarliest, kafka.OffsetLatest:
+	case kafka.OffsetTimestamp:
+		if target.Timestamp, err = time.Parse(time.RFC3339, *at); err != nil {
+			return fmt.Errorf("-at: %w", err)
+		}
+	case kafka.OffsetExplicit:
+		if target.Offsets, err = parseOffsets(*offsets); err != nil {
+			return fmt.Errorf("-offsets: %w", err)
+		}
+	default:
+		return fmt.Errorf("-to must be earliest, latest, timestamp or explicit, got %q", *mode)
+	}
+
+	kc, err := kafkaconn.New(cfg.Kafka)
+	if err != nil {
+		return err
+	}
+	positions, err := kafka.ResetOffsets(ctx, kc, *group, *topic, target, !*execute)
+	if errors.Is(err, kafka.ErrGroupActive) {
+		return fmt.Errorf("%w, stop the service before resetting offsets", err)
+	}
+	if err != nil {
+		return err
+	}
+	printPositions(positions, true)
+	if *execute {
+		slog.Info("Offsets of the consumer group reset", "group", *group, "topic", *topic, "to", *mode)
+	} else {
+		fmt.Println("\ndry run, add -execute to commit the new offsets")
+	}
+	return nil
+}
+
+func replay(ctx context.Context, cfg config.Config, args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	from := fs.String("from", "", "replay messages written at or after this time, RFC 3339")
+	until := fs.String("until", "", "replay messages written before this time, RFC 3339; empty - up to now")
+	fs.Parse(args)
+
+	start, err := time.Parse(time.RFC3339, *from)
+	if err != nil {
+		return fmt.Errorf("-from: %w", err)
+	}
+	var end time.Time
+	if *until != "" {
+		if end, err = time.Parse(time.RFC3339, *until); err != nil {
+			return fmt.Errorf("-until: %w", err)
+		}
+		if !end.After(start) {
+			return errors.New("-until must be after -from")
+		}
+	}
+	n, err := app.Replay(ctx, cfg, start, end)
+	slog.Info("Replay finished", "messages", n)
+	return err
+}
+
+// parseOffsets - "0=120,2=15" -> смещения по партициям
+func parseOffsets(s string) (map[int]int64, error) {
+	offsets := make(map[int]int64)
+	for _, pair := range strings.Split(s, ",") {
+		partition, offset, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return nil, fmt.Errorf("partition=offset expected, got %q", pair)
+		}
+		p, err := strconv.Atoi(partition)
+		if err != nil || p < 0 {
+			return nil, fmt.Errorf("invalid partition %q", partition)
+		}
+		o, err := strconv.ParseInt(offset, 10, 64)
+		if err != nil || o < 0 {
+			return nil, fmt.Errorf("invalid offset %q", offset)
+		}
+		offsets[p] = o
+	}
+	return offsets, nil
+}
+
+func printPositions(positions []kafka.PartitionPosition, withTarget bool) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	header := "PARTITION\tEARLIEST\tLATEST\tCOMMITTED\tLAG"
+	if withTarget {
+		header += "\tNEW OFFSET"
+	}
+	fmt.Fprintln(w, header)
+	// -1 - группа по партиции ничего не коммитила
+	offset := func(o int64) string {
+		if o < 0 {
+			return "-"
+		}
+		return strconv.FormatInt(o, 10)
+	}
+	for _, p := range positions {
+		line := fmt.Sprintf("%d\t%d\t%d\t%s\t%d", p.Partition, p.Earliest, p.Latest, offset(p.Committed), p.Lag())
+		if withTarget {
+			line += "\t" + offset(p.Target)
+		}
+		fmt.Fprintln(w, line)
+	}
+	w.Flush()
+}
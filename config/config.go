@@ -2,12 +2,24 @@
 package config
 
 import (
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
+	"orderservice/internal/auth"
+	"orderservice/internal/cache"
+	"orderservice/internal/cloudevents"
+	"orderservice/internal/codec"
+	"orderservice/internal/kafka"
+	"orderservice/internal/kafkaconn"
+	"orderservice/internal/logger"
+	"orderservice/internal/service"
+	"orderservice/internal/signature"
+	"orderservice/internal/tracing"
+
 	"github.com/joho/godotenv"
 )
 
@@ -15,11 +27,90 @@ import (
 type Config struct {
 	DSN                 string
 	AppPort             string
-	KafkaBroker         string
+	Kafka               kafkaconn.Config
 	Topic               string
+	Consumer            kafka.ConsumerConfig
 	DLQTopic            string
+	ConflictTopic       string
+	TopicSpecs          []kafka.TopicSpec
+	SchemaRegistry      codec.RegistryConfig
+	CloudEvents         cloudevents.Emitter
+	Idempotency         service.IdempotencyConfig
+	GrowPartitions      bool
 	LaunchMockGenerator bool
-	CacheSize           int
+	Cache               cache.Config
+	NotFoundCacheTTL    time.Duration
+	Shutdown            ShutdownConfig
+	AccessFlushInterval time.Duration
+	AuditFlushInterval  time.Duration
+	LogLevel            string
+	LogFormat           string
+	Tracing             tracing.Config
+	ReplicaID           string
+	Auth                auth.Config
+	PIIKeyfile          string
+	SignatureKeys       signature.Keys
+	SignatureVerify     bool
+}
+
+// ShutdownConfig - time limits of the shutdown stages: stopping HTTP-server, finishing in-flight messages
+// with their DLQ and conflict topic writes, flushing and closing Kafka writers
+type ShutdownConfig struct {
+	HTTPTimeout  time.Duration
+	DrainTimeout time.Duration
+	FlushTimeout time.Duration
+}
+
+// LogValue implements slog.LogValuer so that secrets from DSN never get into logs
+func (c Config) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("dsn", logger.RedactDSN(c.DSN)),
+		slog.String("app_port", c.AppPort),
+		slog.Any("kafka_brokers", c.Kafka.Brokers),
+		slog.Bool("kafka_tls", c.Kafka.TLS.Enabled),
+		slog.String("kafka_sasl_mechanism", c.Kafka.SASL.Mechanism),
+		slog.String("topic", c.Topic),
+		slog.String("consumer_group", c.Consumer.GroupID),
+		slog.String("consumer_start_offset", c.Consumer.StartOffset),
+		slog.Int("consumer_min_bytes", c.Consumer.MinBytes),
+		slog.Int("consumer_max_bytes", c.Consumer.MaxBytes),
+		slog.Duration("consumer_max_wait", c.Consumer.MaxWait),
+		slog.Duration("consumer_status_interval", c.Consumer.StatusInterval),
+		slog.String("dlq_topic", c.DLQTopic),
+		slog.String("conflict_topic", c.ConflictTopic),
+		slog.Any("topic_specs", c.TopicSpecs),
+		slog.Bool("grow_partitions", c.GrowPartitions),
+		slog.String("schema_registry_url", c.SchemaRegistry.URL),
+		slog.String("schema_registry_file", c.SchemaRegistry.File),
+		slog.String("cloudevents_source", c.CloudEvents.Source),
+		slog.String("cloudevents_mode", c.CloudEvents.Mode),
+		slog.Bool("idempotency_message_key", c.Idempotency.MessageKey),
+		slog.String("idempotency_identical_policy", string(c.Idempotency.Identical)),
+		slog.String("idempotency_conflict_policy", string(c.Idempotency.Conflicting)),
+		slog.Bool("mock_generator", c.LaunchMockGenerator),
+		slog.Int("cache_size", c.Cache.Size),
+		slog.String("cache_policy", c.Cache.Policy),
+		slog.Duration("cache_ttl", c.Cache.TTL),
+		slog.Int64("cache_max_bytes", c.Cache.MaxBytes),
+		slog.String("cache_snapshot_path", c.Cache.SnapshotPath),
+		slog.String("warmup_strategy", c.Cache.WarmupStrategy),
+		slog.Bool("warmup_async", c.Cache.WarmupAsync),
+		slog.String("redis_addr", c.Cache.Shared.Addr),
+		slog.String("replica_id", c.ReplicaID),
+		slog.Bool("auth_disabled", c.Auth.Disabled),
+		slog.Int("auth_api_keys", len(c.Auth.APIKeys)),
+		slog.String("auth_jwks_file", c.Auth.JWKSFile),
+		slog.String("pii_keyfile", c.PIIKeyfile),
+		slog.Any("signature_entries", c.SignatureKeys.Entries()),
+		slog.Bool("signature_verify", c.SignatureVerify),
+		slog.Duration("not_found_cache_ttl", c.NotFoundCacheTTL),
+		slog.Duration("shutdown_http_timeout", c.Shutdown.HTTPTimeout),
+		slog.Duration("shutdown_drain_timeout", c.Shutdown.DrainTimeout),
+		slog.Duration("shutdown_flush_timeout", c.Shutdown.FlushTimeout),
+		slog.String("log_level", c.LogLevel),
+		slog.String("log_format", c.LogFormat),
+		slog.String("tracing_exporter", c.Tracing.Exporter),
+	)
 }
 
 // LoadSrvConfig -
@@ -36,7 +127,7 @@ func LoadSrvConfig(r http.Handler, appPort string) *http.Server {
 // GetConfig -
 func GetConfig() Config {
 	if err := godotenv.Load(); err != nil {
-		log.Println("Warning while loading .env:", err)
+		slog.Warn("Failed to load .env", "error", err)
 	}
 
 	dbUser := os.Getenv("POSTGRES_USER")
@@ -45,50 +136,393 @@ func GetConfig() Config {
 	dbContName := os.Getenv("DB_CONTAINER_NAME")
 
 	if dbUser == "" || dbName == "" || dbPass == "" || dbContName == "" {
-		log.Fatal("DB connection credentials, db name or DB container name are not set in env")
+		fatal("DB connection credentials, db name or DB container name are not set in env")
 	}
 	dsn := "postgresql://" + dbUser + ":" + dbPass + "@" + dbContName + ":5432/" + dbName + "?sslmode=disable"
 
 	port := os.Getenv("APP_PORT")
 	if port == "" {
-		log.Fatal("APP_PORT is not set in env")
+		fatal("APP_PORT is not set in env")
 	}
 
-	broker := os.Getenv("KAFKA_BROKER")
-	if broker == "" {
-		log.Fatal("KAFKA_BROKER is not set in env")
+	brokers := splitList(os.Getenv("KAFKA_BROKER"))
+	if len(brokers) == 0 {
+		fatal("KAFKA_BROKER is not set in env")
+	}
+	kafkaTLS, err := strconv.ParseBool(getEnvDefault("KAFKA_TLS_ENABLED", "false"))
+	if err != nil {
+		fatal("Failed to parse KAFKA_TLS_ENABLED from env", "error", err)
+	}
+	kafkaTLSInsecure, err := strconv.ParseBool(getEnvDefault("KAFKA_TLS_INSECURE_SKIP_VERIFY", "false"))
+	if err != nil {
+		fatal("Failed to parse KAFKA_TLS_INSECURE_SKIP_VERIFY from env", "error", err)
+	}
+	// пароль SASL можно передать файлом(docker/k8s secret), чтобы он не попадал в окружение процесса
+	saslPassword := os.Getenv("KAFKA_SASL_PASSWORD")
+	if file := os.Getenv("KAFKA_SASL_PASSWORD_FILE"); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			fatal("Failed to read KAFKA_SASL_PASSWORD_FILE", "error", err)
+		}
+		saslPassword = strings.TrimSpace(string(data))
 	}
 
 	topic := os.Getenv("KAFKA_TOPIC")
 	if topic == "" {
-		log.Fatal("KAFKA_TOPIC is not set in env")
+		fatal("KAFKA_TOPIC is not set in env")
 	}
 
 	mockStart, err := strconv.ParseBool(os.Getenv("START_MOCK_PRODUCER"))
 	if err != nil {
-		log.Fatalf("Failed to parse START_MOCK_PRODUCER from .env: %v", err)
+		fatal("Failed to parse START_MOCK_PRODUCER from env", "error", err)
 	}
 
 	cacheSize, err := strconv.ParseInt(os.Getenv("CACHE_SIZE"), 10, 0)
 	if err != nil {
-		log.Fatalf("Failed to parse CACHE_SIZE from .env: %v", err)
+		fatal("Failed to parse CACHE_SIZE from env", "error", err)
+	}
+
+	cacheTTL, err := time.ParseDuration(getEnvDefault("CACHE_TTL", "0s"))
+	if err != nil {
+		fatal("Failed to parse CACHE_TTL from env", "error", err)
+	}
+
+	cacheMaxBytes, err := strconv.ParseInt(getEnvDefault("CACHE_MAX_BYTES", "0"), 10, 64)
+	if err != nil {
+		fatal("Failed to parse CACHE_MAX_BYTES from env", "error", err)
+	}
+
+	snapshotInterval, err := time.ParseDuration(getEnvDefault("CACHE_SNAPSHOT_INTERVAL", "5m"))
+	if err != nil {
+		fatal("Failed to parse CACHE_SNAPSHOT_INTERVAL from env", "error", err)
+	}
+
+	snapshotMaxAge, err := time.ParseDuration(getEnvDefault("CACHE_SNAPSHOT_MAX_AGE", "24h"))
+	if err != nil {
+		fatal("Failed to parse CACHE_SNAPSHOT_MAX_AGE from env", "error", err)
+	}
+
+	warmupAsync, err := strconv.ParseBool(getEnvDefault("WARMUP_ASYNC", "false"))
+	if err != nil {
+		fatal("Failed to parse WARMUP_ASYNC from env", "error", err)
+	}
+
+	warmupStrategy := strings.ToLower(getEnvDefault("WARMUP_STRATEGY", cache.WarmupNewest))
+	warmupCustomers := splitList(os.Getenv("WARMUP_CUSTOMERS"))
+	switch warmupStrategy {
+	case cache.WarmupNewest, cache.WarmupFrequent, cache.WarmupNone:
+	case cache.WarmupCustomers:
+		if len(warmupCustomers) == 0 {
+			fatal("WARMUP_CUSTOMERS must be set for WARMUP_STRATEGY=customers")
+		}
+	default:
+		fatal("Unknown WARMUP_STRATEGY", "strategy", warmupStrategy)
+	}
+
+	accessFlush, err := time.ParseDuration(getEnvDefault("ACCESS_FLUSH_INTERVAL", "30s"))
+	if err != nil || accessFlush <= 0 {
+		fatal("Failed to parse ACCESS_FLUSH_INTERVAL from env, positive duration expected", "error", err)
+	}
+
+	auditFlush, err := time.ParseDuration(getEnvDefault("AUDIT_FLUSH_INTERVAL", "5s"))
+	if err != nil || auditFlush <= 0 {
+		fatal("Failed to parse AUDIT_FLUSH_INTERVAL from env, positive duration expected", "error", err)
+	}
+
+	var shutdown ShutdownConfig
+	for _, t := range []struct {
+		name, def string
+		dst       *time.Duration
+	}{
+		{"SHUTDOWN_HTTP_TIMEOUT", "5s", &shutdown.HTTPTimeout},
+		{"SHUTDOWN_DRAIN_TIMEOUT", "30s", &shutdown.DrainTimeout},
+		{"SHUTDOWN_FLUSH_TIMEOUT", "10s", &shutdown.FlushTimeout},
+	} {
+		d, err := time.ParseDuration(getEnvDefault(t.name, t.def))
+		if err != nil || d <= 0 {
+			fatal("Failed to parse "+t.name+" from env, positive duration expected", "error", err)
+		}
+		*t.dst = d
+	}
+
+	notFoundTTL, err := time.ParseDuration(getEnvDefault("NOT_FOUND_CACHE_TTL", "30s"))
+	if err != nil {
+		fatal("Failed to parse NOT_FOUND_CACHE_TTL from env", "error", err)
+	}
+
+	tracingInsecure, err := strconv.ParseBool(getEnvDefault("TRACING_OTLP_INSECURE", "true"))
+	if err != nil {
+		fatal("Failed to parse TRACING_OTLP_INSECURE from env", "error", err)
+	}
+
+	redisDB, err := strconv.Atoi(getEnvDefault("REDIS_DB", "0"))
+	if err != nil {
+		fatal("Failed to parse REDIS_DB from env", "error", err)
+	}
+
+	redisTTL, err := time.ParseDuration(getEnvDefault("REDIS_TTL", "1h"))
+	if err != nil {
+		fatal("Failed to parse REDIS_TTL from env", "error", err)
+	}
+
+	redisTimeout, err := time.ParseDuration(getEnvDefault("REDIS_TIMEOUT", "200ms"))
+	if err != nil || redisTimeout <= 0 {
+		fatal("Failed to parse REDIS_TIMEOUT from env, positive duration expected", "error", err)
+	}
+
+	// по умолчанию - имя хоста, в Docker это уникальный id контейнера
+	replicaID := os.Getenv("REPLICA_ID")
+	if replicaID == "" {
+		if replicaID, err = os.Hostname(); err != nil {
+			fatal("REPLICA_ID is not set and hostname is unavailable", "error", err)
+		}
+	}
+
+	authDisabled, err := strconv.ParseBool(getEnvDefault("AUTH_DISABLED", "false"))
+	if err != nil {
+		fatal("Failed to parse AUTH_DISABLED from env", "error", err)
+	}
+	apiKeys, err := auth.ParseAPIKeys(os.Getenv("AUTH_API_KEYS"))
+	if err != nil {
+		fatal("Failed to parse AUTH_API_KEYS from env", "error", err)
+	}
+	jwksFile := os.Getenv("AUTH_JWKS_FILE")
+	if authDisabled {
+		slog.Warn("AUTH_DISABLED=true: HTTP endpoints are open to everyone, use only for local development")
+	} else if len(apiKeys) == 0 && jwksFile == "" {
+		fatal("No authentication configured: set AUTH_API_KEYS and/or AUTH_JWKS_FILE, or AUTH_DISABLED=true for local development")
+	}
+
+	signatureKeys, err := signature.ParseKeys(os.Getenv("SIGNATURE_KEYS"))
+	if err != nil {
+		fatal("Failed to parse SIGNATURE_KEYS from env", "error", err)
+	}
+	signatureVerify, err := strconv.ParseBool(getEnvDefault("SIGNATURE_VERIFY", "false"))
+	if err != nil {
+		fatal("Failed to parse SIGNATURE_VERIFY from env", "error", err)
+	}
+	if signatureVerify && len(signatureKeys) == 0 {
+		fatal("SIGNATURE_VERIFY=true requires SIGNATURE_KEYS")
 	}
 
 	dlqTopic := os.Getenv("DLQ_TOPIC")
 	switch dlqTopic {
 	case "":
-		log.Fatal("DLQ_TOPIC is not set in env")
+		fatal("DLQ_TOPIC is not set in env")
 	case topic:
-		log.Fatal("DLQ_TOPIC cannot be equal to KAFKA_TOPIC")
+		fatal("DLQ_TOPIC cannot be equal to KAFKA_TOPIC")
+	}
+	conflictTopic := getEnvDefault("CONFLICT_TOPIC", "orders-conflicts")
+	if conflictTopic == topic || conflictTopic == dlqTopic {
+		fatal("CONFLICT_TOPIC must differ from KAFKA_TOPIC and DLQ_TOPIC")
+	}
+
+	// DLQ сжимается по ключу: хранится последнее отклоненное сообщение с каждым ключом, но не дольше срока хранения
+	topicSpecs := []kafka.TopicSpec{
+		loadTopicSpec("KAFKA_TOPIC", kafka.TopicSpec{Name: topic, Partitions: 3, ReplicationFactor: 1, CleanupPolicy: kafka.CleanupDelete}),
+		loadTopicSpec("DLQ_TOPIC", kafka.TopicSpec{Name: dlqTopic, Partitions: 3, ReplicationFactor: 1, Retention: 7 * 24 * time.Hour, CleanupPolicy: kafka.CleanupCompactDelete}),
+		loadTopicSpec("CONFLICT_TOPIC", kafka.TopicSpec{Name: conflictTopic, Partitions: 3, ReplicationFactor: 1, Retention: 7 * 24 * time.Hour, CleanupPolicy: kafka.CleanupDelete}),
+	}
+	consumer := kafka.ConsumerConfig{
+		GroupID:     getEnvDefault("KAFKA_GROUP_ID", "order-service"),
+		StartOffset: getEnvDefault("KAFKA_START_OFFSET", kafka.OffsetEarliest),
+		ClientID:    replicaID,
+	}
+	if consumer.StartOffset != kafka.OffsetEarliest && consumer.StartOffset != kafka.OffsetLatest {
+		fatal("Invalid KAFKA_START_OFFSET in env, earliest or latest expected", "value", consumer.StartOffset)
+	}
+	if consumer.MinBytes, err = strconv.Atoi(getEnvDefault("KAFKA_FETCH_MIN_BYTES", "10000")); err != nil || consumer.MinBytes <= 0 {
+		fatal("Failed to parse KAFKA_FETCH_MIN_BYTES from env, positive number expected", "error", err)
+	}
+	if consumer.MaxBytes, err = strconv.Atoi(getEnvDefault("KAFKA_FETCH_MAX_BYTES", "10000000")); err != nil || consumer.MaxBytes < consumer.MinBytes {
+		fatal("Failed to parse KAFKA_FETCH_MAX_BYTES from env, number not less than KAFKA_FETCH_MIN_BYTES expected", "error", err)
+	}
+	if consumer.MaxWait, err = time.ParseDuration(getEnvDefault("KAFKA_FETCH_MAX_WAIT", "1s")); err != nil || consumer.MaxWait <= 0 {
+		fatal("Failed to parse KAFKA_FETCH_MAX_WAIT from env, positive duration expected", "error", err)
+	}
+	if consumer.StatusInterval, err = time.ParseDuration(getEnvDefault("KAFKA_STATUS_INTERVAL", "15s")); err != nil || consumer.StatusInterval <= 0 {
+		fatal("Failed to parse KAFKA_STATUS_INTERVAL from env, positive duration expected", "error", err)
 	}
 
+	growPartitions, err := strconv.ParseBool(getEnvDefault("KAFKA_TOPICS_GROW_PARTITIONS", "false"))
+	if err != nil {
+		fatal("Failed to parse KAFKA_TOPICS_GROW_PARTITIONS from env", "error", err)
+	}
+
+	registryTimeout, err := time.ParseDuration(getEnvDefault("SCHEMA_REGISTRY_TIMEOUT", "5s"))
+	if err != nil || registryTimeout <= 0 {
+		fatal("Invalid SCHEMA_REGISTRY_TIMEOUT in env", "error", err)
+	}
+	registryURL, registryFile := os.Getenv("SCHEMA_REGISTRY_URL"), os.Getenv("SCHEMA_REGISTRY_FILE")
+	if registryURL != "" && registryFile != "" {
+		fatal("SCHEMA_REGISTRY_URL and SCHEMA_REGISTRY_FILE cannot be set together")
+	}
+
+	eventsMode := getEnvDefault("CLOUDEVENTS_MODE", cloudevents.ModeBinary)
+	if eventsMode != cloudevents.ModeBinary && eventsMode != cloudevents.ModeStructured {
+		fatal("Unknown CLOUDEVENTS_MODE", "mode", eventsMode)
+	}
+
+	idempotencyMessageKey, err := strconv.ParseBool(getEnvDefault("IDEMPOTENCY_MESSAGE_KEY", "false"))
+	if err != nil {
+		fatal("Failed to parse IDEMPOTENCY_MESSAGE_KEY from env", "error", err)
+	}
+	identicalPolicy := loadDuplicatePolicy("IDEMPOTENCY_IDENTICAL_POLICY", service.DuplicateSkip)
+	conflictPolicy := loadDuplicatePolicy("IDEMPOTENCY_CONFLICT_POLICY", service.DuplicateConflict)
+
 	return Config{
-		DSN:                 dsn,
-		AppPort:             port,
-		KafkaBroker:         broker,
-		Topic:               topic,
-		DLQTopic:            dlqTopic,
+		DSN:     dsn,
+		AppPort: port,
+		Kafka: kafkaconn.Config{
+			Brokers: brokers,
+			TLS: kafkaconn.TLSConfig{
+				Enabled:            kafkaTLS,
+				CAFile:             os.Getenv("KAFKA_TLS_CA_FILE"),
+				CertFile:           os.Getenv("KAFKA_TLS_CERT_FILE"),
+				KeyFile:            os.Getenv("KAFKA_TLS_KEY_FILE"),
+				ServerName:         os.Getenv("KAFKA_TLS_SERVER_NAME"),
+				InsecureSkipVerify: kafkaTLSInsecure,
+			},
+			SASL: kafkaconn.SASLConfig{
+				Mechanism: os.Getenv("KAFKA_SASL_MECHANISM"),
+				Username:  os.Getenv("KAFKA_SASL_USERNAME"),
+				Password:  saslPassword,
+			},
+		},
+		Topic:          topic,
+		Consumer:       consumer,
+		DLQTopic:       dlqTopic,
+		ConflictTopic:  conflictTopic,
+		TopicSpecs:     topicSpecs,
+		GrowPartitions: growPartitions,
+		SchemaRegistry: codec.RegistryConfig{
+			URL:      registryURL,
+			File:     registryFile,
+			Username: os.Getenv("SCHEMA_REGISTRY_USERNAME"),
+			Password: os.Getenv("SCHEMA_REGISTRY_PASSWORD"),
+			Timeout:  registryTimeout,
+		},
+		CloudEvents: cloudevents.Emitter{
+			Source: getEnvDefault("CLOUDEVENTS_SOURCE", "orderservice"),
+			Mode:   eventsMode,
+		},
+		Idempotency: service.IdempotencyConfig{
+			MessageKey:  idempotencyMessageKey,
+			Identical:   identicalPolicy,
+			Conflicting: conflictPolicy,
+		},
 		LaunchMockGenerator: mockStart,
-		CacheSize:           int(cacheSize),
+		Cache: cache.Config{
+			Size:     int(cacheSize),
+			Policy:   getEnvDefault("CACHE_POLICY", cache.PolicyLRU),
+			TTL:      cacheTTL,
+			MaxBytes: cacheMaxBytes,
+
+			SnapshotPath:     os.Getenv("CACHE_SNAPSHOT_PATH"),
+			SnapshotInterval: snapshotInterval,
+			SnapshotMaxAge:   snapshotMaxAge,
+
+			WarmupStrategy:  warmupStrategy,
+			WarmupCustomers: warmupCustomers,
+			WarmupAsync:     warmupAsync,
+
+			Shared: cache.SharedConfig{
+				Addr:      os.Getenv("REDIS_ADDR"),
+				Password:  os.Getenv("REDIS_PASSWORD"),
+				DB:        redisDB,
+				TTL:       redisTTL,
+				KeyPrefix: getEnvDefault("REDIS_KEY_PREFIX", "orderservice:order:"),
+				Channel:   getEnvDefault("REDIS_INVALIDATION_CHANNEL", "orderservice:cache-invalidation"),
+				Timeout:   redisTimeout,
+				ReplicaID: replicaID,
+			},
+		},
+		AccessFlushInterval: accessFlush,
+		AuditFlushInterval:  auditFlush,
+		NotFoundCacheTTL:    notFoundTTL,
+		Shutdown:            shutdown,
+		LogLevel:            getEnvDefault("LOG_LEVEL", "info"),
+		LogFormat:           getEnvDefault("LOG_FORMAT", "text"),
+		Tracing: tracing.Config{
+			Exporter:     getEnvDefault("TRACING_EXPORTER", tracing.ExporterNone),
+			File:         os.Getenv("TRACING_FILE"),
+			OTLPEndpoint: os.Getenv("TRACING_OTLP_ENDPOINT"),
+			OTLPInsecure: tracingInsecure,
+		},
+		ReplicaID: replicaID,
+		Auth: auth.Config{
+			Disabled: authDisabled,
+			APIKeys:  apiKeys,
+			JWKSFile: jwksFile,
+			Issuer:   os.Getenv("AUTH_JWT_ISSUER"),
+			Audience: os.Getenv("AUTH_JWT_AUDIENCE"),
+		},
+		PIIKeyfile:      os.Getenv("PII_KEYFILE"),
+		SignatureKeys:   signatureKeys,
+		SignatureVerify: signatureVerify,
+	}
+}
+
+// splitList - список через запятую, пустые элементы отбрасываются
+func splitList(s string) []string {
+	var res []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// loadTopicSpec - настройки топика из <prefix>_PARTITIONS, <prefix>_REPLICATION_FACTOR, <prefix>_RETENTION и <prefix>_CLEANUP_POLICY
+func loadTopicSpec(prefix string, def kafka.TopicSpec) kafka.TopicSpec {
+	spec := def
+	var err error
+	if v := os.Getenv(prefix + "_PARTITIONS"); v != "" {
+		if spec.Partitions, err = strconv.Atoi(v); err != nil || spec.Partitions < 1 {
+			fatal("Invalid "+prefix+"_PARTITIONS in env, expected positive integer", "value", v)
+		}
 	}
+	if v := os.Getenv(prefix + "_REPLICATION_FACTOR"); v != "" {
+		if spec.ReplicationFactor, err = strconv.Atoi(v); err != nil || spec.ReplicationFactor < 1 {
+			fatal("Invalid "+prefix+"_REPLICATION_FACTOR in env, expected positive integer", "value", v)
+		}
+	}
+	if v := os.Getenv(prefix + "_RETENTION"); v != "" {
+		if spec.Retention, err = time.ParseDuration(v); err != nil || spec.Retention < 0 {
+			fatal("Invalid "+prefix+"_RETENTION in env", "value", v)
+		}
+	}
+	switch v := os.Getenv(prefix + "_CLEANUP_POLICY"); v {
+	case "":
+	case kafka.CleanupDelete, kafka.CleanupCompact, kafka.CleanupCompactDelete, "delete,compact":
+		spec.CleanupPolicy = v
+	default:
+		fatal("Invalid "+prefix+"_CLEANUP_POLICY in env, expected delete, compact or compact,delete", "value", v)
+	}
+	return spec
+}
+
+// loadDuplicatePolicy - политика обработки дубликатов: skip или conflict
+func loadDuplicatePolicy(key string, def service.DuplicatePolicy) service.DuplicatePolicy {
+	switch p := service.DuplicatePolicy(getEnvDefault(key, string(def))); p {
+	case service.DuplicateSkip, service.DuplicateConflict:
+		return p
+	default:
+		fatal("Invalid "+key+" in env, expected skip or conflict", "value", p)
+		return def
+	}
+}
+
+// getEnvDefault - для необязательных параметров
+func getEnvDefault(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
 }
@@ -0,0 +1,105 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"orderservice/internal/cache"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// CacheAdmin - cache operations available to administrators, implemented by cache.OrderMap
+type CacheAdmin interface {
+	Stats() cache.Stats
+	Contains(uid string) bool
+	Remove(uid string)
+	Purge()
+	Resize(size int) error
+	StartWarmup(ctx context.Context, wg *sync.WaitGroup) bool
+}
+
+// CacheAdminHandler provides JSON endpoints for inspecting and managing the order cache
+type CacheAdminHandler struct {
+	Cache CacheAdmin
+	// BaseCtx - контекст фоновых задач приложения: прогрев не должен обрываться вместе с запросом
+	BaseCtx context.Context
+	// Background - фоновые задачи приложения, которых оно дожидается при остановке перед закрытием БД
+	Background *sync.WaitGroup
+}
+
+// Routes returns router with admin endpoints, to be mounted under /admin/cache
+func (AH *CacheAdminHandler) Routes() chi.Router {
+	r := chi.NewRouter()
+	r.Get("/stats", AH.Stats)
+	r.Get("/orders/{uid}", AH.Contains)
+	r.Delete("/orders/{uid}", AH.Evict)
+	r.Delete("/", AH.Purge)
+	r.Post("/warmup", AH.Warmup)
+	r.Put("/size", AH.Resize)
+	return r
+}
+
+// Stats returns cache size, capacity, memory usage and hit ratio
+func (AH *CacheAdminHandler) Stats(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, AH.Cache.Stats())
+}
+
+// Contains reports whether the order is cached without affecting its eviction order
+func (AH *CacheAdminHandler) Contains(w http.ResponseWriter, r *http.Request) {
+	uid := chi.URLParam(r, "uid")
+	writeJSON(w, http.StatusOK, map[string]any{"order_uid": uid, "cached": AH.Cache.Contains(uid)})
+}
+
+// Evict removes a single order from cache
+func (AH *CacheAdminHandler) Evict(w http.ResponseWriter, r *http.Request) {
+	uid := chi.URLParam(r, "uid")
+	AH.Cache.Remove(uid)
+	slog.InfoContext(r.Context(), "Order evicted from cache by admin", "order_uid", uid)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Purge removes all orders from cache
+func (AH *CacheAdminHandler) Purge(w http.ResponseWriter, r *http.Request) {
+	AH.Cache.Purge()
+	slog.InfoContext(r.Context(), "Cache purged by admin")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Warmup starts warming up the cache in background by the configured strategy
+func (AH *CacheAdminHandler) Warmup(w http.ResponseWriter, r *http.Request) {
+	if !AH.Cache.StartWarmup(AH.BaseCtx, AH.Background) {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "warm-up is already in progress"})
+		return
+	}
+	slog.InfoContext(r.Context(), "Cache warm-up started by admin")
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "warm-up started"})
+}
+
+// Resize changes cache capacity, body: {"size": N}
+func (AH *CacheAdminHandler) Resize(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Size int `json:"size"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON: " + err.Error()})
+		return
+	}
+	if err := AH.Cache.Resize(req.Size); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	slog.InfoContext(r.Context(), "Cache resized by admin", "size", req.Size)
+	writeJSON(w, http.StatusOK, AH.Cache.Stats())
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Failed to write JSON response", "error", err)
+	}
+}
@@ -0,0 +1,108 @@
+package handler_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	handler "orderservice/internal/api"
+	"orderservice/internal/auth"
+	"orderservice/internal/cache"
+	"orderservice/internal/model"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func newAdminServer(t *testing.T) (*httptest.Server, *cache.OrderMap) {
+	t.Helper()
+	m, err := cache.NewOrderMap(nil, cache.Config{Size: 10})
+	if err != nil {
+		t.Fatalf("NewOrderMap: %v", err)
+	}
+	m.Add("a", model.Order{OrderUID: "a"})
+	m.Add("b", model.Order{OrderUID: "b"})
+
+	admin := handler.CacheAdminHandler{Cache: m, BaseCtx: context.Background(), Background: &sync.WaitGroup{}}
+	authenticator, err := auth.New(auth.Config{APIKeys: []auth.APIKey{
+		{ID: "admin", Hash: hashKey("secret"), Scopes: []string{auth.ScopeCacheAdmin}},
+		{ID: "reader", Hash: hashKey("reader"), Scopes: []string{auth.ScopeOrdersRead}},
+	}})
+	if err != nil {
+		t.Fatalf("auth.New: %v", err)
+	}
+	r := chi.NewRouter()
+	r.Use(authenticator.Middleware)
+	r.With(auth.Require(auth.ScopeCacheAdmin)).Mount("/admin/cache", admin.Routes())
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	return srv, m
+}
+
+func hashKey(key string) []byte {
+	sum := sha256.Sum256([]byte(key))
+	return sum[:]
+}
+
+func adminRequest(t *testing.T, method, url, token, body string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	if token != "" {
+		req.Header.Set(auth.APIKeyHeader, token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+	return resp.StatusCode, string(data)
+}
+
+func TestCacheAdmin(t *testing.T) {
+	srv, m := newAdminServer(t)
+	base := srv.URL + "/admin/cache"
+
+	if code, _ := adminRequest(t, http.MethodGet, base+"/stats", "", ""); code != http.StatusUnauthorized {
+		t.Errorf("without token status = %d, want 401", code)
+	}
+	if code, _ := adminRequest(t, http.MethodGet, base+"/stats", "wrong", ""); code != http.StatusUnauthorized {
+		t.Errorf("with wrong token status = %d, want 401", code)
+	}
+	if code, _ := adminRequest(t, http.MethodGet, base+"/stats", "reader", ""); code != http.StatusForbidden {
+		t.Errorf("without admin scope status = %d, want 403", code)
+	}
+
+	code, body := adminRequest(t, http.MethodGet, base+"/stats", "secret", "")
+	if code != http.StatusOK || !strings.Contains(body, `"size":2`) || !strings.Contains(body, `"capacity":10`) {
+		t.Errorf("stats = %d %s", code, body)
+	}
+
+	if _, body := adminRequest(t, http.MethodGet, base+"/orders/a", "secret", ""); !strings.Contains(body, `"cached":true`) {
+		t.Errorf("contains a = %s", body)
+	}
+	if code, _ := adminRequest(t, http.MethodDelete, base+"/orders/a", "secret", ""); code != http.StatusNoContent || m.Contains("a") {
+		t.Errorf("evict status = %d, still cached = %v", code, m.Contains("a"))
+	}
+
+	if code, body := adminRequest(t, http.MethodPut, base+"/size", "secret", `{"size":0}`); code != http.StatusBadRequest {
+		t.Errorf("resize to 0 = %d %s, want 400", code, body)
+	}
+	if code, body := adminRequest(t, http.MethodPut, base+"/size", "secret", `{"size":3}`); code != http.StatusOK || !strings.Contains(body, `"capacity":3`) {
+		t.Errorf("resize = %d %s", code, body)
+	}
+
+	if code, _ := adminRequest(t, http.MethodDelete, base, "secret", ""); code != http.StatusNoContent || m.Len() != 0 {
+		t.Errorf("purge status = %d, Len = %d", code, m.Len())
+	}
+}
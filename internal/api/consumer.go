@@ -0,0 +1,22 @@
+package handler
+
+import (
+	"net/http"
+
+	"orderservice/internal/kafka"
+)
+
+// ConsumerStatusSource - status of the orders consumer group, implemented by kafka.ConsumerMonitor
+type ConsumerStatusSource interface {
+	Status() kafka.ConsumerStatus
+}
+
+// ConsumerHandler provides the status endpoint of the orders consumer
+type ConsumerHandler struct {
+	Monitor ConsumerStatusSource
+}
+
+// Status returns assignment, committed offset, high watermark, lag and processing rate of every partition
+func (CH *ConsumerHandler) Status(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, CH.Monitor.Status())
+}
@@ -0,0 +1,54 @@
+package handler_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	handler "orderservice/internal/api"
+	"orderservice/internal/auth"
+	"orderservice/internal/kafka"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type staticStatus kafka.ConsumerStatus
+
+func (s staticStatus) Status() kafka.ConsumerStatus { return kafka.ConsumerStatus(s) }
+
+func TestConsumerStatus(t *testing.T) {
+	h := handler.ConsumerHandler{Monitor: staticStatus{
+		Group:   "order-service",
+		Topic:   "orders",
+		Replica: "replica-1",
+		Partitions: []kafka.PartitionStatus{
+			{Partition: 0, AssignedReplica: "replica-1", AssignedHere: true, CommittedOffset: 12, HighWatermark: 20, Lag: 8, Rate: 1.5},
+		},
+	}}
+	authenticator, err := auth.New(auth.Config{APIKeys: []auth.APIKey{
+		{ID: "ops", Hash: hashKey("ops"), Scopes: []string{auth.ScopeConsumerRead}},
+		{ID: "reader", Hash: hashKey("reader"), Scopes: []string{auth.ScopeOrdersRead}},
+	}})
+	if err != nil {
+		t.Fatalf("auth.New: %v", err)
+	}
+	r := chi.NewRouter()
+	r.Use(authenticator.Middleware)
+	r.With(auth.Require(auth.ScopeConsumerRead)).Get("/admin/consumer", h.Status)
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+
+	if code, _ := adminRequest(t, http.MethodGet, srv.URL+"/admin/consumer", "reader", ""); code != http.StatusForbidden {
+		t.Errorf("without consumer scope status = %d, want 403", code)
+	}
+	code, body := adminRequest(t, http.MethodGet, srv.URL+"/admin/consumer", "ops", "")
+	if code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", code, body)
+	}
+	for _, want := range []string{`"group":"order-service"`, `"assigned_replica":"replica-1"`, `"committed_offset":12`, `"high_watermark":20`, `"lag":8`, `"rate":1.5`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("body %s does not contain %s", body, want)
+		}
+	}
+}
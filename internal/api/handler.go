@@ -4,7 +4,10 @@ package handler
 import (
 	"context"
 	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"net/url"
 
 	"orderservice/internal/service"
 	"orderservice/internal/web"
@@ -35,6 +38,7 @@ func (OH *OrderHandler) GetOrderInfo(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), http.StatusRequestTimeout)
 			return
 		default:
+			slog.ErrorContext(r.Context(), "Failed to get order info", "order_uid", uid, "error", err)
 			web.Render(w, "error", "Ошибка при поиске заказа: "+err.Error())
 			return
 		}
@@ -42,3 +46,55 @@ func (OH *OrderHandler) GetOrderInfo(w http.ResponseWriter, r *http.Request) {
 	// Успех
 	web.Render(w, "order", order)
 }
+
+// GetOrderJSON provides order info by its ID from URL as JSON, personal data is masked by the service for the caller's role
+func (OH *OrderHandler) GetOrderJSON(w http.ResponseWriter, r *http.Request) {
+	uid := chi.URLParam(r, "uid")
+	order, err := OH.Service.GetOrderInfo(r.Context(), uid)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrRecordNotFound):
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		case errors.Is(err, context.DeadlineExceeded):
+			writeJSON(w, http.StatusGatewayTimeout, map[string]string{"error": err.Error()})
+		default:
+			slog.ErrorContext(r.Context(), "Failed to get order info", "order_uid", uid, "error", err)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal error"})
+		}
+		return
+	}
+	writeJSON(w, http.StatusOK, order)
+}
+
+// ExportCustomer returns all orders of a customer as a downloadable JSON archive
+func (OH *OrderHandler) ExportCustomer(w http.ResponseWriter, r *http.Request) {
+	customerID := chi.URLParam(r, "customerID")
+	export, err := OH.Service.ExportCustomerData(r.Context(), customerID)
+	if err != nil {
+		writeCustomerError(w, r, customerID, err)
+		return
+	}
+	filename := fmt.Sprintf("customer-%s-%s.json", url.PathEscape(customerID), export.ExportedAt.Format("20060102T150405Z"))
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	writeJSON(w, http.StatusOK, export)
+}
+
+// EraseCustomer anonymizes personal data in all orders of a customer
+func (OH *OrderHandler) EraseCustomer(w http.ResponseWriter, r *http.Request) {
+	customerID := chi.URLParam(r, "customerID")
+	uids, err := OH.Service.EraseCustomerData(r.Context(), customerID)
+	if err != nil {
+		writeCustomerError(w, r, customerID, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"customer_id": customerID, "erased_orders": uids})
+}
+
+func writeCustomerError(w http.ResponseWriter, r *http.Request, customerID string, err error) {
+	if errors.Is(err, service.ErrCustomerNotFound) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	slog.ErrorContext(r.Context(), "Customer data request failed", "customer_id", customerID, "error", err)
+	writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal error"})
+}
@@ -2,32 +2,50 @@ package handler_test
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"net/http"
 	"net/http/httptest"
 	handler "orderservice/internal/api"
+	"orderservice/internal/messaging"
 	"orderservice/internal/model"
 	"orderservice/internal/service"
 	"orderservice/internal/web"
 	"strings"
 	"testing"
 
-	"github.com/segmentio/kafka-go"
+	"github.com/go-chi/chi/v5"
 )
 
 // MockOrderService реализует интерфейс service.OrderService
 type MockOrderService struct {
 	GetOrderInfoFn func(ctx context.Context, uid string) (*model.Order, error)
+	ExportFn       func(ctx context.Context, customerID string) (*service.CustomerExport, error)
+	EraseFn        func(ctx context.Context, customerID string) ([]string, error)
 }
 
 func (m *MockOrderService) GetOrderInfo(ctx context.Context, uid string) (*model.Order, error) {
 	return m.GetOrderInfoFn(ctx, uid)
 }
 
-func (m *MockOrderService) AddNewOrder(msg *kafka.Message) {
+func (m *MockOrderService) AddNewOrder(ctx context.Context, msg *messaging.Message) {
 	// просто пустышка
 }
 
+func (m *MockOrderService) ExportCustomerData(ctx context.Context, customerID string) (*service.CustomerExport, error) {
+	if m.ExportFn != nil {
+		return m.ExportFn(ctx, customerID)
+	}
+	return nil, service.ErrCustomerNotFound
+}
+
+func (m *MockOrderService) EraseCustomerData(ctx context.Context, customerID string) ([]string, error) {
+	if m.EraseFn != nil {
+		return m.EraseFn(ctx, customerID)
+	}
+	return nil, service.ErrCustomerNotFound
+}
+
 func TestGetOrderInfo(t *testing.T) {
 	web.LoadTemplates()
 
@@ -87,7 +105,10 @@ func TestGetOrderInfo(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			req := httptest.NewRequest(http.MethodGet, "/?uid="+tt.uid, nil)
+			req := httptest.NewRequest(http.MethodGet, "/order/"+tt.uid, nil)
+			rctx := chi.NewRouteContext()
+			rctx.URLParams.Add("uid", tt.uid)
+			req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
 			w := httptest.NewRecorder()
 
 			h := &handler.OrderHandler{
@@ -108,3 +129,41 @@ func TestGetOrderInfo(t *testing.T) {
 		})
 	}
 }
+
+func TestCustomerDataEndpoints(t *testing.T) {
+	h := &handler.OrderHandler{Service: &MockOrderService{
+		ExportFn: func(ctx context.Context, customerID string) (*service.CustomerExport, error) {
+			return &service.CustomerExport{CustomerID: customerID, Orders: []model.Order{{OrderUID: "u1"}}}, nil
+		},
+	}}
+	r := chi.NewRouter()
+	r.Get("/admin/customers/{customerID}/export", h.ExportCustomer)
+	r.Delete("/admin/customers/{customerID}", h.EraseCustomer)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/customers/c1/export", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"order_uid":"u1"`) {
+		t.Errorf("export = %d %s", w.Code, w.Body.String())
+	}
+	if cd := w.Header().Get("Content-Disposition"); !strings.HasPrefix(cd, `attachment; filename="customer-c1-`) {
+		t.Errorf("Content-Disposition = %q", cd)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/admin/customers/c2", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("erase of unknown customer = %d, want 404", w.Code)
+	}
+}
+
+func TestOrderSchema(t *testing.T) {
+	w := httptest.NewRecorder()
+	handler.OrderSchema(w, httptest.NewRequest(http.MethodGet, "/schemas/order.json", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/schema+json" {
+		t.Fatalf("status %d, content-type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	var schema map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &schema); err != nil || schema["title"] != "Order" {
+		t.Errorf("schema %v, err %v", schema, err)
+	}
+}
@@ -0,0 +1,20 @@
+package handler
+
+import (
+	"log/slog"
+	"net/http"
+
+	"orderservice/internal/codec"
+)
+
+// OrderSchema serves JSON Schema of order messages for producers, it is generated from the model
+func OrderSchema(w http.ResponseWriter, r *http.Request) {
+	schema, err := codec.OrderJSONSchema()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to generate order JSON Schema", "error", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "internal error"})
+		return
+	}
+	w.Header().Set("Content-Type", "application/schema+json")
+	_, _ = w.Write(schema)
+}
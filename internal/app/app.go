@@ -4,25 +4,36 @@ package app
 import (
 	"context"
 	"errors"
-	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"orderservice/config"
 	handler "orderservice/internal/api"
+	"orderservice/internal/audit"
+	"orderservice/internal/auth"
 	"orderservice/internal/cache"
+	"orderservice/internal/codec"
 	"orderservice/internal/db"
 	"orderservice/internal/kafka"
+	"orderservice/internal/kafkaconn"
+	"orderservice/internal/logger"
+	"orderservice/internal/messaging"
+	"orderservice/internal/metrics"
+	"orderservice/internal/pii"
 	"orderservice/internal/repository"
 	"orderservice/internal/service"
+	"orderservice/internal/signature"
+	"orderservice/internal/tracing"
 	"orderservice/internal/web"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
 )
 
 // App -
@@ -39,35 +50,145 @@ func NewApplication(conf config.Config) *App {
 
 // Run -
 func (a *App) Run() {
+	// трейсинг настраиваем первым, чтобы спаны были у всех слоев
+	shutdownTracing, err := tracing.Setup(context.Background(), a.cfg.Tracing)
+	if err != nil {
+		slog.Error("Failed to set up tracing", "error", err)
+		os.Exit(1)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			slog.Error("Failed to flush traces", "error", err)
+		}
+	}()
+
+	// ключи JWKS читаем до подключения к базе, чтобы ошибка конфигурации была видна сразу
+	authenticator, err := auth.New(a.cfg.Auth)
+	if err != nil {
+		slog.Error("Failed to set up authentication", "error", err)
+		os.Exit(1)
+	}
+
+	// сертификаты и настройки SASL Kafka тоже проверяем при старте
+	kafkaConn, err := kafkaconn.New(a.cfg.Kafka)
+	if err != nil {
+		slog.Error("Failed to set up Kafka connection", "error", err)
+		os.Exit(1)
+	}
+
+	// реестр схем нужен для сообщений Protobuf/Avro в формате Confluent
+	registry, err := codec.NewRegistry(a.cfg.SchemaRegistry)
+	if err != nil {
+		slog.Error("Failed to set up schema registry", "error", err)
+		os.Exit(1)
+	}
+
+	// ключи шифрования персональных данных должны быть установлены до первого запроса к deliveries
+	if err := setupPII(a.cfg.PIIKeyfile); err != nil {
+		slog.Error("Failed to load PII keyfile", "error", err)
+		os.Exit(1)
+	}
+
 	// подключаемся к базе
 	db := db.ConnectPostgres(a.cfg.DSN)
 	sqlDB, err := db.DB()
 	if err != nil {
-		log.Fatalf("Failed to retrieve sql.DB: %v", err)
+		slog.Error("Failed to retrieve sql.DB", "error", err)
+		os.Exit(1)
 	}
 	defer func() {
 		if err := sqlDB.Close(); err != nil {
-			log.Println("Failed to close DB-connection:", err)
+			slog.Error("Failed to close DB-connection", "error", err)
 		}
 	}()
 
+	// контекст фоновых обработчиков(консюмер, снапшоты кэша) - отменяется слушателем прерываний
+	ctx, stopWorkers := context.WithCancel(context.Background())
+	// контекст обработки прочитанных сообщений - отменяется, только если они не успели обработаться за SHUTDOWN_DRAIN_TIMEOUT
+	drainCtx, abortDrain := context.WithCancel(context.Background())
+	defer abortDrain()
+
 	// создаем экземпляр repository и прогреваем кэш
 	repo := repository.NewOrderRepository(db, a.cfg.DSN)
-	orderMap, err := cache.CreateAndWarmUpOrderCache(repo, a.cfg.CacheSize)
+	if pii.Current() != nil {
+		a.Add(1)
+		go func() {
+			defer a.Done()
+			reencryptDeliveries(ctx, repo)
+		}()
+	}
+	orderMap, err := cache.CreateAndWarmUpOrderCache(ctx, repo, a.cfg.Cache, &a.WaitGroup)
 	if err != nil {
-		log.Fatalf("Failed to load cache: %v", err)
+		slog.Error("Failed to load cache", "error", err)
+		os.Exit(1)
+	}
+	defer func() {
+		if err := orderMap.Close(); err != nil {
+			slog.Error("Failed to close shared cache", "error", err)
+		}
+	}()
+	if a.cfg.Cache.Shared.Addr != "" {
+		a.Add(1)
+		go func() {
+			defer a.Done()
+			orderMap.RunInvalidation(ctx)
+		}()
+	}
+	if a.cfg.Cache.SnapshotPath != "" {
+		a.Add(1)
+		go func() {
+			defer a.Done()
+			orderMap.RunSnapshots(ctx)
+		}()
+	}
+
+	// учет обращений к заказам нужен только для прогрева самыми запрашиваемыми
+	svcCfg := newServiceConfig(a.cfg, kafkaConn, registry)
+	if a.cfg.Cache.WarmupStrategy == cache.WarmupFrequent {
+		tracker := cache.NewAccessTracker(repo, a.cfg.AccessFlushInterval)
+		svcCfg.Accesses = tracker
+		a.Add(1)
+		go func() {
+			defer a.Done()
+			tracker.Run(ctx)
+		}()
 	}
 
+	// журнал просмотров персональных данных пишется в БД пачками
+	auditLog := audit.NewLog(repo, a.cfg.AuditFlushInterval)
+	svcCfg.Audit = auditLog
+	a.Add(1)
+	go func() {
+		defer a.Done()
+		auditLog.Run(ctx)
+	}()
+
 	// создаем экземпляры слоя сервиса и хэндлера
-	svc := service.NewOrderService(repo, orderMap, a.cfg.KafkaBroker, a.cfg.DLQTopic)
+	svc := service.NewOrderService(repo, orderMap, svcCfg)
 	hndlr := handler.OrderHandler{
 		Service: svc,
 	}
 
+	// читатель создается до роутера: статус консюмера отдает монитор его группы
+	reader := kafka.NewKafkaReader(kafkaConn, a.cfg.Topic, a.cfg.Consumer)
+	monitor := kafka.NewConsumerMonitor(kafkaConn, a.cfg.Topic, a.cfg.Consumer, reader)
+	consumerHndlr := handler.ConsumerHandler{Monitor: monitor}
+
 	// настраиваем роутер и грузим настройки сервера
 	r := chi.NewRouter()
-	r.Get("/order/{uid}", hndlr.GetOrderInfo)
-	r.Get("/order/", hndlr.GetOrderInfo)
+	r.Use(middleware.RequestID, tracing.HTTPMiddleware, logger.HTTPMiddleware, metrics.HTTPMiddleware, authenticator.Middleware)
+	r.With(auth.Require(auth.ScopeMetricsRead)).Handle("/metrics", metrics.Handler())
+	r.Get("/schemas/order.json", handler.OrderSchema)
+	r.With(auth.Require(auth.ScopeOrdersRead)).Get("/order/{uid}", hndlr.GetOrderInfo)
+	r.With(auth.Require(auth.ScopeOrdersRead)).Get("/order/", hndlr.GetOrderInfo)
+	r.With(auth.Require(auth.ScopeOrdersRead)).Get("/api/order/{uid}", hndlr.GetOrderJSON)
+	admin := handler.CacheAdminHandler{Cache: orderMap, BaseCtx: ctx, Background: &a.WaitGroup}
+	r.With(auth.Require(auth.ScopeCacheAdmin)).Mount("/admin/cache", admin.Routes())
+	r.With(auth.Require(auth.ScopeConsumerRead)).Get("/admin/consumer", consumerHndlr.Status)
+	r.With(auth.Require(auth.ScopePrivacy)).Get("/admin/customers/{customerID}/export", hndlr.ExportCustomer)
+	r.With(auth.Require(auth.ScopePrivacy)).Delete("/admin/customers/{customerID}", hndlr.EraseCustomer)
 	a.srv = config.LoadSrvConfig(r, a.cfg.AppPort)
 
 	// запускаем сервер в отдельной горутине, чтобы можно было:
@@ -80,20 +201,32 @@ func (a *App) Run() {
 	web.LoadTemplates()
 
 	// ждем пока кафка запустится
-	kafka.WaitKafkaReady(a.cfg.KafkaBroker)
+	kafka.WaitKafkaReady(kafkaConn)
 
 	// Cоздаем топики
-	kafka.InitKafkaTopics(a.cfg.KafkaBroker, a.cfg.Topic, a.cfg.DLQTopic)
+	kafka.InitKafkaTopics(kafkaConn, a.cfg.TopicSpecs, a.cfg.GrowPartitions)
 
 	// запускаем консюмер для чтения из кафки
-	ctx, kafkaCancel := context.WithCancel(context.Background())
+	// консюмер сам сообщает, бросил ли он сообщение по SHUTDOWN_DRAIN_TIMEOUT: остальные этапы остановки могут идти дольше
+	var drainTimedOut atomic.Bool
+	consumerDone := make(chan struct{})
+	a.Add(1)
+	go func() {
+		defer a.Done()
+		defer close(consumerDone)
+		drainTimedOut.Store(kafka.StartConsumer(ctx, drainCtx, hndlr.Service, monitor.Observe(messaging.NewKafkaSource(reader))))
+	}()
 	a.Add(1)
-	go kafka.StartConsumer(ctx, hndlr.Service, a.cfg.KafkaBroker, a.cfg.Topic, &a.WaitGroup)
+	go func() {
+		defer a.Done()
+		monitor.Run(ctx, a.cfg.Consumer.StatusInterval)
+	}()
 	time.Sleep(3 * time.Second)
 
 	// запуск мокового писателя в кафку для теста
 	if a.cfg.LaunchMockGenerator {
-		go kafka.EmulateMsgSending(a.cfg.KafkaBroker, a.cfg.Topic)
+		mockSink := messaging.NewKafkaSink(kafkaConn.Writer(a.cfg.Topic))
+		go kafka.EmulateMsgSending(mockSink, a.cfg.SignatureKeys)
 	}
 
 	// Starting shutdown signal listener
@@ -102,40 +235,144 @@ func (a *App) Run() {
 	defer close(sig)
 
 	a.Add(1)
-	go launchInterruptListener(&a.WaitGroup, sig, kafkaCancel, a.srv)
+	go launchInterruptListener(&a.WaitGroup, sig, stopWorkers, abortDrain, consumerDone, a.srv, a.cfg.Shutdown)
 
 	a.Wait()
-	log.Println("Exiting application...")
+	// консюмер остановлен, в DLQ и топик конфликтов больше никто не пишет; БД закрывается после писателей
+	unflushed := closeWriters(a.cfg.Shutdown.FlushTimeout, svcCfg.DLQ, svcCfg.Conflicts)
+	if !drainTimedOut.Load() && len(unflushed) == 0 {
+		slog.Info("Graceful shutdown completed, exiting application...")
+		return
+	}
+	// брошенные сообщения и записи перечислены в логах выше и в orderservice_shutdown_abandoned_total
+	slog.Warn("Shutdown completed with abandoned work, exiting application...", "drain_timed_out", drainTimedOut.Load(), "unflushed_writers", unflushed)
+}
+
+// closeWriters закрывает писателей Kafka(Close дописывает отправляемые сообщения) не дольше timeout
+// и возвращает топики писателей, которые не успели закрыться
+func closeWriters(timeout time.Duration, sinks ...messaging.MessageSink) []string {
+	done := make(chan string, len(sinks))
+	for _, sink := range sinks {
+		go func() {
+			if err := sink.Close(); err != nil {
+				slog.Error("Failed to close Kafka writer", "topic", sink.Topic(), "error", err)
+			}
+			done <- sink.Topic()
+		}()
+	}
+
+	pending := make(map[string]bool, len(sinks))
+	for _, sink := range sinks {
+		pending[sink.Topic()] = true
+	}
+	deadline := time.After(timeout)
+	for len(pending) > 0 {
+		select {
+		case topic := <-done:
+			delete(pending, topic)
+		case <-deadline:
+			unflushed := make([]string, 0, len(pending))
+			for topic := range pending {
+				slog.Warn("Kafka writer was not closed in time, buffered messages may be lost", "topic", topic)
+				unflushed = append(unflushed, topic)
+			}
+			return unflushed
+		}
+	}
+	return nil
+}
+
+// setupPII устанавливает ключи шифрования персональных данных, без keyfile данные пишутся открытым текстом
+func setupPII(keyfile string) error {
+	if keyfile == "" {
+		slog.Warn("PII_KEYFILE is not set, delivery personal data is stored unencrypted")
+		return nil
+	}
+	keyring, err := pii.LoadKeyring(keyfile)
+	if err != nil {
+		return err
+	}
+	pii.SetKeyring(keyring)
+	slog.Info("PII encryption enabled", "active_key_id", keyring.ActiveKeyID())
+	return nil
+}
+
+// newServiceConfig - настройки приема заказов из Kafka: DLQ, топик конфликтов, декодер, подписи и идемпотентность
+func newServiceConfig(cfg config.Config, kafkaConn *kafkaconn.Connector, registry codec.Registry) service.Config {
+	svcCfg := service.Config{
+		DLQ:         messaging.NewKafkaSink(kafkaConn.Writer(cfg.DLQTopic)),
+		NotFoundTTL: cfg.NotFoundCacheTTL,
+		Decoder:     codec.NewDecoder(registry),
+		Events:      cfg.CloudEvents,
+		Conflicts:   messaging.NewKafkaSink(kafkaConn.Writer(cfg.ConflictTopic)),
+		Idempotency: cfg.Idempotency,
+	}
+	if cfg.SignatureVerify {
+		svcCfg.Signatures = signature.NewVerifier(cfg.SignatureKeys)
+		slog.Info("Order signature verification enabled", "entries", cfg.SignatureKeys.Entries())
+	}
+	return svcCfg
+}
+
+// reencryptDeliveries - фоновая ротация: строки в открытом виде или под старым ключом перешифровываются активным ключом
+func reencryptDeliveries(ctx context.Context, repo repository.OrderRepository) {
+	const batch = 500
+	total := 0
+	for ctx.Err() == nil {
+		n, err := repo.ReencryptDeliveries(ctx, batch)
+		if err != nil {
+			slog.Error("Failed to re-encrypt delivery PII", "done", total, "error", err)
+			return
+		}
+		total += n
+		if n < batch {
+			break
+		}
+	}
+	if total > 0 {
+		slog.Info("Delivery PII re-encrypted with the active key", "rows", total)
+	}
 }
 
 func launchServer(wg *sync.WaitGroup, srv *http.Server) {
 	defer wg.Done()
-	fmt.Printf("Server running on http://localhost%s\n", srv.Addr)
+	slog.Info("Server running", "addr", "http://localhost"+srv.Addr)
 	err := srv.ListenAndServe()
 	if err != nil {
 		switch {
 		case errors.Is(err, http.ErrServerClosed):
-			log.Println("Server gracefully stopping...")
+			slog.Info("Server gracefully stopping...")
 		default:
-			log.Fatalf("Server stopped: %v", err)
+			slog.Error("Server stopped", "error", err)
+			os.Exit(1)
 		}
 	}
 }
 
-func launchInterruptListener(wg *sync.WaitGroup, sig chan os.Signal, kafkaCancel context.CancelFunc, srv *http.Server) {
-	log.Print("Interruption listener is running...")
+func launchInterruptListener(wg *sync.WaitGroup, sig chan os.Signal, stopWorkers, abortDrain context.CancelFunc,
+	consumerDone <-chan struct{}, srv *http.Server, cfg config.ShutdownConfig) {
+	slog.Info("Interruption listener is running...")
 	defer wg.Done()
 	<-sig
-	log.Println("Interrupt received!!! Starting shutdown sequence...")
-	// stop Kafka consumer:
-	kafkaCancel()
-	log.Println("Kafka consumer stopping...")
-	// 5 seconds to stop HTTP-server:
-	ctx, httpCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	slog.Warn("Interrupt received, starting shutdown sequence...")
+	// stop fetching from Kafka and cache snapshots(final snapshot is written on stop):
+	stopWorkers()
+	slog.Info("Kafka consumer stopping, finishing in-flight messages...", "timeout", cfg.DrainTimeout)
+	// in-flight messages and their DLQ writes are aborted when drain timeout runs out:
+	drainTimer := time.AfterFunc(cfg.DrainTimeout, abortDrain)
+	// the timer is stopped as soon as the consumer returns, so a clean drain is never aborted afterwards:
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-consumerDone
+		drainTimer.Stop()
+	}()
+	// HTTP-server is stopped meanwhile:
+	ctx, httpCancel := context.WithTimeout(context.Background(), cfg.HTTPTimeout)
 	defer httpCancel()
 	if err := srv.Shutdown(ctx); err != nil {
-		log.Printf("Server shutdown error: %v", err)
+		slog.Error("Server shutdown error", "error", err)
 		return
 	}
-	log.Println("HTTP server stopped")
+	slog.Info("HTTP server stopped")
 }
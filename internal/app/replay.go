@@ -0,0 +1,65 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"orderservice/config"
+	"orderservice/internal/cache"
+	"orderservice/internal/codec"
+	"orderservice/internal/db"
+	"orderservice/internal/kafka"
+	"orderservice/internal/kafkaconn"
+	"orderservice/internal/repository"
+	"orderservice/internal/service"
+)
+
+// Replay re-ingests orders written to the orders topic between from and until(zero - up to now) for backfills:
+// messages go through the same service layer as in the consumer, orders already in DB are handled by idempotency
+// policies, invalid messages are sent to DLQ again. Cancelling ctx stops the replay after the message in progress
+func Replay(ctx context.Context, cfg config.Config, from, until time.Time) (int, error) {
+	kafkaConn, err := kafkaconn.New(cfg.Kafka)
+	if err != nil {
+		return 0, fmt.Errorf("kafka connection: %w", err)
+	}
+	registry, err := codec.NewRegistry(cfg.SchemaRegistry)
+	if err != nil {
+		return 0, fmt.Errorf("schema registry: %w", err)
+	}
+	if err := setupPII(cfg.PIIKeyfile); err != nil {
+		return 0, fmt.Errorf("PII keyfile: %w", err)
+	}
+
+	gormDB := db.ConnectPostgres(cfg.DSN)
+	sqlDB, err := gormDB.DB()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := sqlDB.Close(); err != nil {
+			slog.Error("Failed to close DB-connection", "error", err)
+		}
+	}()
+	repo := repository.NewOrderRepository(gormDB, cfg.DSN)
+
+	// без прогрева и снапшотов: локальный кэш процесса не нужен, но общий кэш реплик получает новые заказы
+	orderMap, err := cache.NewOrderMap(repo, cache.Config{Size: cfg.Cache.Size, Policy: cfg.Cache.Policy, Shared: cfg.Cache.Shared})
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := orderMap.Close(); err != nil {
+			slog.Error("Failed to close shared cache", "error", err)
+		}
+	}()
+
+	svcCfg := newServiceConfig(cfg, kafkaConn, registry)
+	// незакрытые писатели closeWriters пишет в лог сам
+	defer closeWriters(cfg.Shutdown.FlushTimeout, svcCfg.DLQ, svcCfg.Conflicts)
+	svc := service.NewOrderService(repo, orderMap, svcCfg)
+
+	slog.Info("Replaying orders", "topic", cfg.Topic, "from", from, "until", until)
+	return kafka.Replay(ctx, kafkaConn, cfg.Topic, cfg.Consumer, from, until, svc)
+}
@@ -0,0 +1,90 @@
+// Package audit - journal of access to personal data of orders, written to DB in batches
+package audit
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"orderservice/internal/metrics"
+	"orderservice/internal/model"
+	"orderservice/internal/repository"
+)
+
+// Actions recorded in the journal
+const (
+	ActionView = "order.view"
+)
+
+// maxPending - сколько событий держим в памяти, пока БД недоступна; дальше самые старые отбрасываются
+const maxPending = 100000
+
+// Log accumulates audit events in memory and periodically flushes them to DB,
+// so that viewing an order does not wait for an extra insert
+type Log struct {
+	repo     repository.OrderRepository
+	interval time.Duration
+
+	sync.Mutex
+	pending []model.AuditEvent
+}
+
+// NewLog - flushes events every interval
+func NewLog(repo repository.OrderRepository, interval time.Duration) *Log {
+	return &Log{repo: repo, interval: interval}
+}
+
+// Record queues event for writing, time is set if missing
+func (l *Log) Record(ev model.AuditEvent) {
+	if ev.At.IsZero() {
+		ev.At = time.Now().UTC()
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.pending = append(l.pending, ev)
+	l.trimLocked()
+}
+
+// Run flushes events until ctx is done, then flushes the rest once more
+func (l *Log) Run(ctx context.Context) {
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.Flush(ctx)
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+			l.Flush(flushCtx)
+			cancel()
+			return
+		}
+	}
+}
+
+// Flush writes queued events to DB, on failure they are kept for the next attempt
+func (l *Log) Flush(ctx context.Context) {
+	l.Lock()
+	events := l.pending
+	l.pending = nil
+	l.Unlock()
+	if len(events) == 0 {
+		return
+	}
+
+	if err := l.repo.AddAuditEvents(ctx, events); err != nil {
+		slog.ErrorContext(ctx, "Failed to save audit events", "events", len(events), "error", err)
+		l.Lock()
+		l.pending = append(events, l.pending...)
+		l.trimLocked()
+		l.Unlock()
+	}
+}
+
+func (l *Log) trimLocked() {
+	if over := len(l.pending) - maxPending; over > 0 {
+		l.pending = l.pending[over:]
+		metrics.AuditEventsDropped.Add(float64(over))
+	}
+}
@@ -0,0 +1,268 @@
+// Package auth - authentication of HTTP requests by static API keys or JWT bearer tokens and per-route scope checks
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Scopes required by HTTP routes
+const (
+	ScopeOrdersRead   = "orders:read"
+	ScopeCacheAdmin   = "cache:admin"
+	ScopeConsumerRead = "consumer:read"     // статус партиций и лаг консюмера
+	ScopePrivacy      = "customers:privacy" // выгрузка и удаление данных клиента
+	ScopeMetricsRead  = "metrics:read"      // метрики Prometheus: лаг, ошибки реестра, объемы заказов
+	ScopeAll          = "*"                 // выдается только в режиме без аутентификации
+)
+
+// Authentication methods
+const (
+	MethodAPIKey = "api_key"
+	MethodJWT    = "jwt"
+	MethodNone   = "none"
+)
+
+// APIKeyHeader - header carrying a static API key
+const APIKeyHeader = "X-API-Key"
+
+// Config - settings of authentication
+type Config struct {
+	Disabled bool     // режим локальной разработки: все запросы разрешены без учетных данных
+	APIKeys  []APIKey // статические ключи, в конфиге только их хэши
+	JWKSFile string   // пусто - JWT не принимаются
+	Issuer   string   // пусто - не проверяется
+	Audience string   // пусто - не проверяется
+}
+
+// APIKey - static key known by its SHA-256 hash
+type APIKey struct {
+	ID     string
+	Hash   []byte
+	Scopes []string
+}
+
+// RoleScopePrefix - scopes like "role:support" grant roles, so API keys can carry roles without extra config
+const RoleScopePrefix = "role:"
+
+// Principal - authenticated caller
+type Principal struct {
+	Subject string
+	Method  string
+	Scopes  []string
+	Roles   []string // из claim "roles" JWT и скоупов с префиксом role:
+}
+
+func newPrincipal(subject, method string, scopes, roles []string) *Principal {
+	for _, s := range scopes {
+		if r, ok := strings.CutPrefix(s, RoleScopePrefix); ok && r != "" {
+			roles = append(roles, r)
+		}
+	}
+	return &Principal{Subject: subject, Method: method, Scopes: scopes, Roles: roles}
+}
+
+// HasScope reports whether the principal was granted scope
+func (p *Principal) HasScope(scope string) bool {
+	return slices.Contains(p.Scopes, scope) || slices.Contains(p.Scopes, ScopeAll)
+}
+
+type ctxKey struct{}
+
+// WithPrincipal returns ctx carrying p
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, ctxKey{}, p)
+}
+
+// FromContext returns principal authenticated for the request, nil if there is none
+func FromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(ctxKey{}).(*Principal)
+	return p
+}
+
+var (
+	ErrNoCredentials      = errors.New("no credentials")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Authenticator checks credentials of incoming requests
+type Authenticator struct {
+	cfg  Config
+	keys map[string]any // kid -> открытый ключ из JWKS
+}
+
+// New creates Authenticator, reading JWKS file if configured
+func New(cfg Config) (*Authenticator, error) {
+	a := &Authenticator{cfg: cfg}
+	if cfg.JWKSFile != "" {
+		keys, err := LoadJWKS(cfg.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		a.keys = keys
+	}
+	return a, nil
+}
+
+// Middleware authenticates request if it has credentials and puts Principal into its context;
+// requests without credentials pass through, routes reject them with Require
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := a.Authenticate(r)
+		switch {
+		case errors.Is(err, ErrNoCredentials):
+			next.ServeHTTP(w, r)
+			return
+		case err != nil:
+			slog.WarnContext(r.Context(), "Authentication failed", "error", err)
+			writeError(w, http.StatusUnauthorized, "invalid credentials")
+			return
+		}
+		trace.SpanFromContext(r.Context()).SetAttributes(
+			attribute.String("enduser.id", p.Subject),
+			attribute.String("enduser.auth_method", p.Method),
+		)
+		next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), p)))
+	})
+}
+
+// Authenticate extracts and verifies credentials: X-API-Key header or Authorization: Bearer JWT
+func (a *Authenticator) Authenticate(r *http.Request) (*Principal, error) {
+	if a.cfg.Disabled {
+		return &Principal{Subject: "anonymous", Method: MethodNone, Scopes: []string{ScopeAll}}, nil
+	}
+	if key := r.Header.Get(APIKeyHeader); key != "" {
+		return a.checkAPIKey(key)
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return a.checkJWT(token)
+	}
+	return nil, ErrNoCredentials
+}
+
+// checkAPIKey - сравниваем хэш со всеми ключами за постоянное время, чтобы не подсказывать перебором
+func (a *Authenticator) checkAPIKey(key string) (*Principal, error) {
+	sum := sha256.Sum256([]byte(key))
+	var found *APIKey
+	for i := range a.cfg.APIKeys {
+		if subtle.ConstantTimeCompare(sum[:], a.cfg.APIKeys[i].Hash) == 1 {
+			found = &a.cfg.APIKeys[i]
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%w: unknown API key", ErrInvalidCredentials)
+	}
+	return newPrincipal(found.ID, MethodAPIKey, found.Scopes, nil), nil
+}
+
+// tokenClaims - registered claims, roles and scopes in either "scope"(строка через пробел) or "scp"(массив) form
+type tokenClaims struct {
+	jwt.RegisteredClaims
+	Scope string   `json:"scope,omitempty"`
+	SCP   []string `json:"scp,omitempty"`
+	Roles []string `json:"roles,omitempty"`
+}
+
+func (a *Authenticator) checkJWT(token string) (*Principal, error) {
+	if a.keys == nil {
+		return nil, fmt.Errorf("%w: JWT authentication is not configured", ErrInvalidCredentials)
+	}
+
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}),
+		jwt.WithExpirationRequired(),
+	}
+	if a.cfg.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(a.cfg.Issuer))
+	}
+	if a.cfg.Audience != "" {
+		opts = append(opts, jwt.WithAudience(a.cfg.Audience))
+	}
+
+	var claims tokenClaims
+	_, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, ok := a.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown key id %q", kid)
+		}
+		return key, nil
+	}, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidCredentials, err)
+	}
+
+	scopes := append(strings.Fields(claims.Scope), claims.SCP...)
+	return newPrincipal(claims.Subject, MethodJWT, scopes, claims.Roles), nil
+}
+
+// Require rejects requests without principal(401) or without any of the scopes(403)
+func Require(scopes ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p := FromContext(r.Context())
+			if p == nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="orderservice"`)
+				writeError(w, http.StatusUnauthorized, "authentication required")
+				return
+			}
+			for _, s := range scopes {
+				if !p.HasScope(s) {
+					slog.WarnContext(r.Context(), "Access denied", "subject", p.Subject, "required_scope", s)
+					writeError(w, http.StatusForbidden, "missing scope "+s)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ParseAPIKeys parses comma-separated "id:sha256hex:scope1 scope2" entries;
+// scopes go last, so they may contain colons themselves
+func ParseAPIKeys(s string) ([]APIKey, error) {
+	var keys []APIKey
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 || parts[0] == "" {
+			return nil, fmt.Errorf("API key entry %q: expected id:sha256hex:scopes", entry)
+		}
+		hash, err := hex.DecodeString(parts[1])
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("API key %q: hash must be hex-encoded SHA-256", parts[0])
+		}
+		keys = append(keys, APIKey{ID: parts[0], Hash: hash, Scopes: strings.Fields(parts[2])})
+	}
+	return keys, nil
+}
+
+// HashAPIKey returns hex-encoded SHA-256 of key in the form expected by ParseAPIKeys
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(map[string]string{"error": msg}); err != nil {
+		slog.Error("Failed to write auth error response", "error", err)
+	}
+}
@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+// writeJWKS - JWKS-файл с одним RSA и одним EC ключом
+func writeJWKS(t *testing.T, rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey) string {
+	t.Helper()
+	set := map[string]any{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa1", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec1", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+	}}
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, kid string, key any, claims jwt.MapClaims) string {
+	t.Helper()
+	tok := jwt.NewWithClaims(method, claims)
+	tok.Header["kid"] = kid
+	s, err := tok.SignedString(key)
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	return s
+}
+
+func TestAuthenticator(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := ParseAPIKeys("ops:" + HashAPIKey("s3cret") + ":orders:read cache:admin, reader:" + HashAPIKey("r") + ":orders:read")
+	if err != nil {
+		t.Fatalf("ParseAPIKeys: %v", err)
+	}
+	a, err := New(Config{APIKeys: keys, JWKSFile: writeJWKS(t, rsaKey, ecKey), Issuer: "https://issuer", Audience: "orderservice"})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	exp := time.Now().Add(time.Hour).Unix()
+	valid := jwt.MapClaims{"sub": "alice", "iss": "https://issuer", "aud": "orderservice", "exp": exp, "scope": "orders:read"}
+
+	tests := []struct {
+		name        string
+		header      string
+		value       string
+		wantStatus  int
+		wantSubject string
+	}{
+		{"no credentials", "", "", http.StatusUnauthorized, ""},
+		{"api key with scope", APIKeyHeader, "s3cret", http.StatusOK, "ops"},
+		{"api key without scope", APIKeyHeader, "r", http.StatusForbidden, ""},
+		{"unknown api key", APIKeyHeader, "nope", http.StatusUnauthorized, ""},
+		{"rsa jwt with scp", "Authorization", "Bearer " + sign(t, jwt.SigningMethodRS256, "rsa1", rsaKey,
+			jwt.MapClaims{"sub": "bob", "iss": "https://issuer", "aud": "orderservice", "exp": exp, "scp": []string{"cache:admin"}}), http.StatusOK, "bob"},
+		{"ec jwt without scope", "Authorization", "Bearer " + sign(t, jwt.SigningMethodES256, "ec1", ecKey, valid), http.StatusForbidden, ""},
+		{"expired jwt", "Authorization", "Bearer " + sign(t, jwt.SigningMethodRS256, "rsa1", rsaKey,
+			jwt.MapClaims{"sub": "alice", "iss": "https://issuer", "aud": "orderservice", "exp": time.Now().Add(-time.Minute).Unix(), "scope": "cache:admin"}), http.StatusUnauthorized, ""},
+		{"wrong issuer", "Authorization", "Bearer " + sign(t, jwt.SigningMethodRS256, "rsa1", rsaKey,
+			jwt.MapClaims{"sub": "alice", "iss": "https://evil", "aud": "orderservice", "exp": exp, "scope": "cache:admin"}), http.StatusUnauthorized, ""},
+		{"unknown kid", "Authorization", "Bearer " + sign(t, jwt.SigningMethodRS256, "other", rsaKey, valid), http.StatusUnauthorized, ""},
+		{"hmac with public key", "Authorization", "Bearer " + sign(t, jwt.SigningMethodHS256, "rsa1", []byte("x"), valid), http.StatusUnauthorized, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var subject string
+			h := a.Middleware(Require(ScopeCacheAdmin)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				subject = FromContext(r.Context()).Subject
+			})))
+			req := httptest.NewRequest(http.MethodGet, "/admin/cache/stats", nil)
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d (%s)", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if subject != tt.wantSubject {
+				t.Errorf("subject = %q, want %q", subject, tt.wantSubject)
+			}
+		})
+	}
+}
+
+func TestAuthenticator_Disabled(t *testing.T) {
+	a, err := New(Config{Disabled: true})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	h := a.Middleware(Require(ScopeCacheAdmin, ScopeOrdersRead)(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, want 200 in login-free mode", w.Code)
+	}
+}
+
+func TestParseAPIKeys_Invalid(t *testing.T) {
+	for _, s := range []string{"noscopes", ":" + HashAPIKey("k") + ":a", "id:nothex:a", "id:abcd:a"} {
+		if _, err := ParseAPIKeys(s); err == nil {
+			t.Errorf("ParseAPIKeys(%q): expected error", s)
+		}
+	}
+}
@@ -1,39 +1,478 @@
+// Package cache - in-memory cache of orders in front of DB with selectable eviction policy, TTL and memory budget
 package cache
 
 import (
+	"container/list"
 	"context"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"orderservice/internal/metrics"
+	"orderservice/internal/model"
 	"orderservice/internal/repository"
 
 	lru "github.com/hashicorp/golang-lru"
 )
 
-// OrderMap provides access to cache-map, contains embedded mutex features
+// Eviction policies from golang-lru
+const (
+	PolicyLRU = "lru"
+	Policy2Q  = "2q"
+	PolicyARC = "arc"
+)
+
+// Config - cache settings
+type Config struct {
+	Size     int           // максимальное число заказов
+	Policy   string        // lru, 2q, arc
+	TTL      time.Duration // 0 - записи не устаревают
+	MaxBytes int64         // 0 - без ограничения по оценочному объему заказов
+
+	SnapshotPath     string        // пусто - снапшоты отключены
+	SnapshotInterval time.Duration // 0 - снапшот только при остановке
+	SnapshotMaxAge   time.Duration // более старый снапшот игнорируется, 0 - без ограничения
+
+	WarmupStrategy  string   // newest, frequent, customers, none
+	WarmupCustomers []string // для стратегии customers
+	WarmupAsync     bool     // прогрев в фоне, сервис отвечает сразу(промахи идут в БД)
+
+	Shared SharedConfig // общий для реплик уровень в Redis
+}
+
+// store - common subset of golang-lru caches
+type store interface {
+	Add(key, value interface{})
+	Get(key interface{}) (interface{}, bool)
+	Peek(key interface{}) (interface{}, bool)
+	Contains(key interface{}) bool
+	Remove(key interface{})
+	Keys() []interface{}
+	Len() int
+	Purge()
+}
+
+// lruStore adapts lru.Cache, whose Add and Remove return flags, to store
+type lruStore struct {
+	*lru.Cache
+}
+
+func (s lruStore) Add(key, value interface{}) { s.Cache.Add(key, value) }
+func (s lruStore) Remove(key interface{})     { s.Cache.Remove(key) }
+
+// entry - value kept in store
+type entry struct {
+	order     model.Order
+	size      int64
+	expiresAt time.Time // нулевое значение - без срока
+}
+
+// tracked - учет записи рядом со store: оценочный объем и место в порядке использования
+type tracked struct {
+	uid  string
+	size int64
+}
+
+// OrderMap provides access to cached orders and to DB for warming up
 type OrderMap struct {
-	CacheMap *lru.Cache
-	Repo     repository.OrderRepository
+	Repo repository.OrderRepository
+
+	cfg   Config
+	store store
+	sync.Mutex
+	// golang-lru 2Q/ARC не сообщают о вытеснении и отдают Keys() не по давности использования,
+	// поэтому объем и порядок использования записей ведутся здесь
+	tracked   map[string]*list.Element // uid -> элемент recency со значением *tracked
+	recency   *list.List               // от недавно использованных(Front) к давно использованным(Back)
+	usedBytes int64
+	erasures  uint64 // счетчик вызовов eraseLocal: прогрев по нему узнает, что прочитанные из БД копии могли устареть
+
+	shared *sharedTier // nil - только локальный кэш
+
+	// сохранения снапшота по очереди: иначе снапшот, собранный до Erase, мог бы записаться после него
+	snapshotMu sync.Mutex
+
+	hits, misses atomic.Int64 // для доли попаданий в статистике
+	warming      atomic.Bool  // идет прогрев, повторный не запускаем
+}
+
+// Stats - current state of the cache for administration
+type Stats struct {
+	Policy    string  `json:"policy"`
+	Size      int     `json:"size"`
+	Capacity  int     `json:"capacity"`
+	UsedBytes int64   `json:"used_bytes"`
+	MaxBytes  int64   `json:"max_bytes"`
+	TTL       string  `json:"ttl"`
+	Hits      int64   `json:"hits"`
+	Misses    int64   `json:"misses"`
+	HitRatio  float64 `json:"hit_ratio"`
+	Shared    bool    `json:"shared"`
+	Warming   bool    `json:"warming"`
 }
 
-// CreateAndWarmUpOrderCache returns a new map with warmed up cache, access to DB and embedded mutex
-func CreateAndWarmUpOrderCache(repo repository.OrderRepository, size int) (*OrderMap, error) {
-	cache, err := lru.New(size)
+// NewOrderMap creates an empty cache according to cfg
+func NewOrderMap(repo repository.OrderRepository, cfg Config) (*OrderMap, error) {
+	var (
+		st  store
+		err error
+	)
+	switch strings.ToLower(cfg.Policy) {
+	case "", PolicyLRU:
+		var c *lru.Cache
+		c, err = lru.New(cfg.Size)
+		st = lruStore{Cache: c}
+	case Policy2Q:
+		st, err = lru.New2Q(cfg.Size)
+	case PolicyARC:
+		st, err = lru.NewARC(cfg.Size)
+	default:
+		return nil, fmt.Errorf("unknown cache policy %q", cfg.Policy)
+	}
 	if err != nil {
-		log.Printf("Failed to create lru-cache: %v", err)
-		return nil, err
+		return nil, fmt.Errorf("failed to create %s cache: %w", cfg.Policy, err)
+	}
+	m := &OrderMap{Repo: repo, cfg: cfg, store: st, tracked: make(map[string]*list.Element), recency: list.New()}
+	if cfg.Shared.Addr != "" {
+		m.shared = newSharedTier(cfg.Shared)
 	}
-	orderMap := OrderMap{Repo: repo}
-	orders, err := orderMap.Repo.GetAllOrders(context.Background(), size)
+	return m, nil
+}
+
+// CreateAndWarmUpOrderCache returns a new cache warmed up from snapshot file (if configured and valid)
+// or from DB by the configured strategy, synchronously or in background; snapshot contents are reconciled with DB
+// in background until ctx is done; background reconciliation and warm-up are tracked by wg so that DB is not closed under them
+func CreateAndWarmUpOrderCache(ctx context.Context, repo repository.OrderRepository, cfg Config, wg *sync.WaitGroup) (*OrderMap, error) {
+	orderMap, err := NewOrderMap(repo, cfg)
 	if err != nil {
-		log.Printf("Failed to read orders from DB to warm up cahce: %v", err)
+		slog.Error("Failed to create cache", "error", err)
+		return nil, err
+	}
+
+	if cfg.SnapshotPath != "" {
+		orders, err := LoadSnapshot(cfg.SnapshotPath, cfg.SnapshotMaxAge)
+		if err == nil {
+			uids := make([]string, 0, len(orders))
+			for _, v := range orders {
+				orderMap.addLocal(v.OrderUID, v)
+				uids = append(uids, v.OrderUID)
+			}
+			slog.Info("Cache loaded from snapshot", "path", cfg.SnapshotPath, "orders", orderMap.Len())
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				orderMap.reconcile(ctx, uids)
+			}()
+			return orderMap, nil
+		}
+		slog.Warn("Cache snapshot not used, warming up from DB", "path", cfg.SnapshotPath, "error", err)
+	}
+
+	if cfg.WarmupAsync {
+		orderMap.StartWarmup(ctx, wg)
+		return orderMap, nil
+	}
+
+	if err := orderMap.Warmup(ctx); err != nil {
+		slog.Error("Failed to read orders from DB to warm up cache", "error", err)
 		return nil, err
 	}
+	return orderMap, nil
+}
+
+// Get returns a copy of cached order; expired entries are removed and reported as missing.
+// On local miss the shared tier is consulted and its hit is kept locally
+func (m *OrderMap) Get(uid string) (model.Order, bool) {
+	if order, ok := m.getLocal(uid); ok {
+		m.hits.Add(1)
+		return order, true
+	}
+	if m.shared != nil {
+		if order, ok := m.shared.get(uid); ok {
+			m.addLocal(uid, order)
+			m.hits.Add(1)
+			return order, true
+		}
+	}
+	m.misses.Add(1)
+	return model.Order{}, false
+}
+
+func (m *OrderMap) getLocal(uid string) (model.Order, bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	v, ok := m.store.Get(uid)
+	if !ok {
+		return model.Order{}, false
+	}
+	e := v.(*entry)
+	if !e.expiresAt.IsZero() && time.Now().After(e.expiresAt) {
+		m.removeLocked(uid)
+		metrics.CacheEvictions.Inc()
+		return model.Order{}, false
+	}
+	m.recency.MoveToFront(m.tracked[uid])
+	return e.order.Clone(), true
+}
+
+// Add puts a copy of order into cache, evicting entries by policy and memory budget if necessary;
+// with shared tier the order is also written to Redis and other replicas drop their local copies
+func (m *OrderMap) Add(uid string, order model.Order) {
+	m.addLocal(uid, order)
+	if m.shared != nil {
+		m.shared.set(&order, true)
+	}
+}
+
+// Fill caches an unchanged order read from DB: it is written to Redis too, but copies of other replicas are still valid
+// and are not invalidated, otherwise every miss would evict the order from all replicas
+func (m *OrderMap) Fill(uid string, order model.Order) {
+	m.addLocal(uid, order)
+	if m.shared != nil {
+		m.shared.set(&order, false)
+	}
+}
+
+// addLocal - только локальный уровень: прогрев, снапшоты и подтягивание из Redis не должны инвалидировать другие реплики
+func (m *OrderMap) addLocal(uid string, order model.Order) {
+	m.Lock()
+	defer m.Unlock()
+	m.addLocked(uid, order)
+}
+
+func (m *OrderMap) addLocked(uid string, order model.Order) {
+	e := &entry{order: order.Clone(), size: estimateSize(&order)}
+	if m.cfg.TTL > 0 {
+		e.expiresAt = time.Now().Add(m.cfg.TTL)
+	}
+
+	if el, exists := m.tracked[uid]; exists {
+		t := el.Value.(*tracked)
+		m.usedBytes += e.size - t.size
+		t.size = e.size
+		m.recency.MoveToFront(el)
+		m.store.Add(uid, e)
+	} else {
+		prevLen := m.store.Len()
+		m.tracked[uid] = m.recency.PushFront(&tracked{uid: uid, size: e.size})
+		m.usedBytes += e.size
+		m.store.Add(uid, e)
+		if evicted := prevLen + 1 - m.store.Len(); evicted > 0 { // политика вытеснила что-то ради новой записи
+			m.dropEvictedLocked(evicted)
+		}
+	}
 
-	for _, v := range orders {
-		cache.Add(v.OrderUID, v)
+	// бюджет по памяти: вытесняем давно использованные записи, последнюю добавленную не трогаем
+	for m.cfg.MaxBytes > 0 && m.usedBytes > m.cfg.MaxBytes && m.recency.Len() > 1 {
+		m.removeLocked(m.recency.Back().Value.(*tracked).uid)
+		metrics.CacheEvictions.Inc()
+	}
+}
+
+// Remove deletes order from cache of all replicas
+func (m *OrderMap) Remove(uid string) {
+	m.removeLocal(uid)
+	if m.shared != nil {
+		m.shared.delete(uid)
+	}
+}
+
+func (m *OrderMap) removeLocal(uid string) {
+	m.Lock()
+	defer m.Unlock()
+	m.removeLocked(uid)
+}
+
+// Erase removes orders whose personal data was erased from every copy: local cache and snapshot file of this
+// and other replicas and Redis. Snapshots are rewritten at once instead of waiting for the next periodic save.
+// An error means some copy may remain
+func (m *OrderMap) Erase(uids []string) error {
+	err := m.eraseLocal(uids)
+	if m.shared != nil {
+		err = errors.Join(err, m.shared.erase(uids))
+	}
+	return err
+}
+
+func (m *OrderMap) eraseLocal(uids []string) error {
+	m.Lock()
+	for _, uid := range uids {
+		m.removeLocked(uid)
+	}
+	m.erasures++
+	m.Unlock()
+	if m.cfg.SnapshotPath == "" {
+		return nil
+	}
+	return m.SaveSnapshot(m.cfg.SnapshotPath)
+}
+
+// Purge removes all orders from cache of all replicas
+func (m *OrderMap) Purge() {
+	m.purgeLocal()
+	if m.shared != nil {
+		m.shared.purge()
+	}
+}
+
+func (m *OrderMap) purgeLocal() {
+	m.Lock()
+	defer m.Unlock()
+	m.store.Purge()
+	m.tracked = make(map[string]*list.Element)
+	m.recency.Init()
+	m.usedBytes = 0
+}
+
+// Contains reports whether uid is cached locally without updating its recency; an expired entry is removed
+// and reported as missing, as in Get
+func (m *OrderMap) Contains(uid string) bool {
+	m.Lock()
+	defer m.Unlock()
+	return m.containsLocked(uid)
+}
+
+func (m *OrderMap) containsLocked(uid string) bool {
+	v, ok := m.store.Peek(uid)
+	if !ok {
+		return false
+	}
+	if e := v.(*entry); !e.expiresAt.IsZero() && time.Now().After(e.expiresAt) {
+		m.removeLocked(uid)
+		metrics.CacheEvictions.Inc()
+		return false
+	}
+	return true
+}
+
+// Resize changes the maximum number of cached orders at runtime;
+// when shrinking, least recently used entries are dropped
+func (m *OrderMap) Resize(size int) error {
+	if size <= 0 {
+		return fmt.Errorf("cache size must be positive, got %d", size)
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	// только lru.Cache умеет менять размер сам, 2Q и ARC пересоздаем с переносом записей
+	if s, ok := m.store.(lruStore); ok {
+		if evicted := s.Resize(size); evicted > 0 {
+			m.dropEvictedLocked(evicted)
+		}
+		m.cfg.Size = size
+		return nil
 	}
 
-	orderMap.CacheMap = cache
-	log.Println("Cache successfully loaded!")
-	return &orderMap, nil
+	rebuilt, err := NewOrderMap(nil, Config{Size: size, Policy: m.cfg.Policy})
+	if err != nil {
+		return err
+	}
+	// лишние давно использованные записи отбрасываем, остальные переносим от старых к недавним
+	for m.recency.Len() > size {
+		m.removeLocked(m.recency.Back().Value.(*tracked).uid)
+		metrics.CacheEvictions.Inc()
+	}
+	for el := m.recency.Back(); el != nil; el = el.Prev() {
+		uid := el.Value.(*tracked).uid
+		if v, ok := m.store.Peek(uid); ok {
+			rebuilt.store.Add(uid, v)
+		}
+	}
+	m.store = rebuilt.store
+	m.cfg.Size = size
+	return nil
+}
+
+// Stats returns cache counters and limits; hits and misses are counted since start
+func (m *OrderMap) Stats() Stats {
+	m.Lock()
+	st := Stats{
+		Policy:    strings.ToLower(m.cfg.Policy),
+		Size:      m.store.Len(),
+		Capacity:  m.cfg.Size,
+		UsedBytes: m.usedBytes,
+		MaxBytes:  m.cfg.MaxBytes,
+		TTL:       m.cfg.TTL.String(),
+		Shared:    m.shared != nil,
+		Warming:   m.warming.Load(),
+	}
+	m.Unlock()
+
+	if st.Policy == "" {
+		st.Policy = PolicyLRU
+	}
+	st.Hits, st.Misses = m.hits.Load(), m.misses.Load()
+	if total := st.Hits + st.Misses; total > 0 {
+		st.HitRatio = float64(st.Hits) / float64(total)
+	}
+	return st
+}
+
+// Len returns number of cached orders including not yet removed expired ones
+func (m *OrderMap) Len() int {
+	m.Lock()
+	defer m.Unlock()
+	return m.store.Len()
+}
+
+// UsedBytes returns estimated memory used by cached orders
+func (m *OrderMap) UsedBytes() int64 {
+	m.Lock()
+	defer m.Unlock()
+	return m.usedBytes
+}
+
+func (m *OrderMap) removeLocked(uid string) {
+	m.store.Remove(uid)
+	if el, ok := m.tracked[uid]; ok {
+		m.forgetLocked(el)
+	}
+}
+
+func (m *OrderMap) forgetLocked(el *list.Element) {
+	t := m.recency.Remove(el).(*tracked)
+	m.usedBytes -= t.size
+	delete(m.tracked, t.uid)
+}
+
+// dropEvictedLocked updates accounting after the store silently evicted n entries. Policies evict entries
+// they consider cold, and those are close to the back of recency, so the scan from there usually stops after a few steps
+func (m *OrderMap) dropEvictedLocked(n int) {
+	for el := m.recency.Back(); el != nil && n > 0; {
+		prev := el.Prev()
+		if !m.store.Contains(el.Value.(*tracked).uid) {
+			m.forgetLocked(el)
+			metrics.CacheEvictions.Inc()
+			n--
+		}
+		el = prev
+	}
+}
+
+// estimateSize - приблизительный объем заказа в памяти: строки плюс фиксированные накладные расходы структур
+func estimateSize(o *model.Order) int64 {
+	const (
+		structOverhead = 256 // заголовки строк, числа и указатели одной структуры
+		itemOverhead   = 160
+	)
+	size := int64(structOverhead*3) +
+		int64(len(o.OrderUID)+len(o.TrackNumber)+len(o.Entry)+len(o.Locale)+len(o.InternalSignature)+
+			len(o.CustomerID)+len(o.DeliveryService)+len(o.ShardKey)+len(o.DateCreated)+len(o.OofShard))
+
+	d := &o.Delivery
+	size += int64(len(d.OrderUID) + len(d.Name) + len(d.Phone) + len(d.Zip) + len(d.City) + len(d.Address) + len(d.Region) + len(d.Email))
+
+	p := &o.Payment
+	size += int64(len(p.OrderUID) + len(p.Transaction) + len(p.RequestID) + len(p.Currency) + len(p.Provider) + len(p.Bank))
+
+	for i := range o.Items {
+		it := &o.Items[i]
+		size += itemOverhead + int64(len(it.OrderUID)+len(it.TrackNumber)+len(it.RID)+len(it.Name)+len(it.Size)+len(it.Brand))
+	}
+	return size
 }
@@ -0,0 +1,275 @@
+package cache
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"orderservice/internal/model"
+)
+
+func testOrder(uid string, items int) model.Order {
+	o := model.Order{OrderUID: uid, TrackNumber: "T", Items: make([]model.Item, items)}
+	for i := range o.Items {
+		o.Items[i] = model.Item{Name: strings.Repeat("n", 100), OrderUID: uid}
+	}
+	return o
+}
+
+func TestOrderMap_Policies(t *testing.T) {
+	for _, policy := range []string{PolicyLRU, Policy2Q, PolicyARC} {
+		t.Run(policy, func(t *testing.T) {
+			m, err := NewOrderMap(nil, Config{Size: 3, Policy: policy})
+			if err != nil {
+				t.Fatalf("NewOrderMap: %v", err)
+			}
+			for _, uid := range []string{"a", "b", "c", "d", "e"} {
+				m.Add(uid, testOrder(uid, 1))
+			}
+			if m.Len() != 3 {
+				t.Fatalf("Len() = %d, want 3", m.Len())
+			}
+			if _, ok := m.Get("e"); !ok {
+				t.Errorf("the last added order must be cached")
+			}
+
+			// учет объема должен совпадать с содержимым после вытеснений
+			var want int64
+			for _, k := range m.store.Keys() {
+				o := testOrder(k.(string), 1)
+				want += estimateSize(&o)
+			}
+			if got := m.UsedBytes(); got != want {
+				t.Errorf("UsedBytes() = %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestOrderMap_UnknownPolicy(t *testing.T) {
+	if _, err := NewOrderMap(nil, Config{Size: 3, Policy: "fifo"}); err == nil {
+		t.Fatal("expected error for unknown policy")
+	}
+}
+
+func TestOrderMap_TTL(t *testing.T) {
+	m, err := NewOrderMap(nil, Config{Size: 10, TTL: 30 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewOrderMap: %v", err)
+	}
+	m.Add("a", testOrder("a", 1))
+	m.Add("b", testOrder("b", 1))
+	if _, ok := m.Get("a"); !ok || !m.Contains("b") {
+		t.Fatal("fresh entry must be returned")
+	}
+	time.Sleep(40 * time.Millisecond)
+	if _, ok := m.Get("a"); ok {
+		t.Fatal("expired entry must not be returned")
+	}
+	if m.Contains("b") {
+		t.Fatal("expired entry must not be reported as cached")
+	}
+	if m.Len() != 0 || m.UsedBytes() != 0 {
+		t.Errorf("expired entry must be removed, Len=%d UsedBytes=%d", m.Len(), m.UsedBytes())
+	}
+}
+
+func TestOrderMap_MaxBytes(t *testing.T) {
+	small, big := testOrder("small", 1), testOrder("big", 50)
+	budget := estimateSize(&big) + estimateSize(&small)
+
+	m, err := NewOrderMap(nil, Config{Size: 100, MaxBytes: budget})
+	if err != nil {
+		t.Fatalf("NewOrderMap: %v", err)
+	}
+	m.Add("small", small)
+	m.Add("big", big)
+	if m.Len() != 2 {
+		t.Fatalf("both orders fit into budget, Len() = %d", m.Len())
+	}
+
+	// второй большой заказ вытесняет самые старые записи, пока не уложится в бюджет
+	m.Add("big2", testOrder("big2", 50))
+	if m.UsedBytes() > budget {
+		t.Errorf("UsedBytes() = %d exceeds budget %d", m.UsedBytes(), budget)
+	}
+	if _, ok := m.Get("big2"); !ok {
+		t.Error("the last added order must stay cached")
+	}
+	if _, ok := m.Get("small"); ok {
+		t.Error("the oldest order must be evicted")
+	}
+}
+
+func TestOrderMap_MaxBytesEvictsLeastRecent(t *testing.T) {
+	for _, policy := range []string{PolicyLRU, Policy2Q, PolicyARC} {
+		t.Run(policy, func(t *testing.T) {
+			small, big := testOrder("a", 1), testOrder("d", 50)
+			m, err := NewOrderMap(nil, Config{Size: 100, Policy: policy, MaxBytes: estimateSize(&big) + 2*estimateSize(&small)})
+			if err != nil {
+				t.Fatalf("NewOrderMap: %v", err)
+			}
+			for _, uid := range []string{"a", "b", "c"} {
+				m.Add(uid, testOrder(uid, 1))
+			}
+			// "a" прочитан и стал самым горячим, давно использованным остается "b"
+			m.Get("a")
+			m.Get("a")
+			m.Add("d", big)
+			for uid, want := range map[string]bool{"a": true, "b": false, "c": true, "d": true} {
+				if m.Contains(uid) != want {
+					t.Errorf("Contains(%q) = %v, want %v", uid, !want, want)
+				}
+			}
+		})
+	}
+}
+
+func TestOrderMap_StoresCopies(t *testing.T) {
+	m, err := NewOrderMap(nil, Config{Size: 10})
+	if err != nil {
+		t.Fatalf("NewOrderMap: %v", err)
+	}
+	order := testOrder("a", 2)
+	m.Add("a", order)
+
+	// изменение исходного заказа после Add не влияет на кэш
+	order.Items[0].Name = "changed by producer"
+
+	got, ok := m.Get("a")
+	if !ok {
+		t.Fatal("order must be cached")
+	}
+	if got.Items[0].Name == "changed by producer" {
+		t.Fatal("cache shares Items with the order passed to Add")
+	}
+
+	// изменение полученного заказа тоже не влияет на кэш
+	got.Items[1].Name = "changed by reader"
+	got.Items = append(got.Items, model.Item{})
+
+	again, _ := m.Get("a")
+	if again.Items[1].Name == "changed by reader" || len(again.Items) != 2 {
+		t.Fatal("cache shares Items with the order returned from Get")
+	}
+}
+
+func TestOrderMap_Purge(t *testing.T) {
+	m, err := NewOrderMap(nil, Config{Size: 10})
+	if err != nil {
+		t.Fatalf("NewOrderMap: %v", err)
+	}
+	m.Add("a", testOrder("a", 1))
+	m.Add("b", testOrder("b", 1))
+	m.Purge()
+	if m.Len() != 0 || m.UsedBytes() != 0 {
+		t.Fatalf("after Purge Len=%d UsedBytes=%d, want 0", m.Len(), m.UsedBytes())
+	}
+}
+
+func TestOrderMap_Resize(t *testing.T) {
+	for _, policy := range []string{PolicyLRU, Policy2Q, PolicyARC} {
+		t.Run(policy, func(t *testing.T) {
+			m, err := NewOrderMap(nil, Config{Size: 5, Policy: policy})
+			if err != nil {
+				t.Fatalf("NewOrderMap: %v", err)
+			}
+			for _, uid := range []string{"a", "b", "c", "d", "e"} {
+				m.Add(uid, testOrder(uid, 1))
+			}
+			m.Get("a")
+			if err := m.Resize(2); err != nil {
+				t.Fatalf("Resize: %v", err)
+			}
+			if m.Len() != 2 || m.Stats().Capacity != 2 {
+				t.Fatalf("after shrink Len=%d Capacity=%d, want 2", m.Len(), m.Stats().Capacity)
+			}
+			if !m.Contains("e") || !m.Contains("a") {
+				t.Error("the most recently used orders must survive shrinking")
+			}
+			o := testOrder("e", 1)
+			if got, want := m.UsedBytes(), 2*estimateSize(&o); got != want {
+				t.Errorf("UsedBytes() = %d, want %d", got, want)
+			}
+
+			if err := m.Resize(4); err != nil {
+				t.Fatalf("Resize: %v", err)
+			}
+			for _, uid := range []string{"x", "y"} {
+				m.Add(uid, testOrder(uid, 1))
+			}
+			if m.Len() != 4 {
+				t.Errorf("after grow Len=%d, want 4", m.Len())
+			}
+			if err := m.Resize(0); err == nil {
+				t.Error("expected error for non-positive size")
+			}
+		})
+	}
+}
+
+func TestOrderMap_ResizeConcurrentReads(t *testing.T) {
+	// store подменяется при Resize - под -race чтение без блокировки дает гонку
+	for _, policy := range []string{PolicyLRU, Policy2Q, PolicyARC} {
+		t.Run(policy, func(t *testing.T) {
+			m, err := NewOrderMap(nil, Config{Size: 50, Policy: policy})
+			if err != nil {
+				t.Fatalf("NewOrderMap: %v", err)
+			}
+			for i := range 50 {
+				uid := fmt.Sprint(i)
+				m.Add(uid, testOrder(uid, 1))
+			}
+
+			var wg, started sync.WaitGroup
+			stop := make(chan struct{})
+			for range 4 {
+				wg.Add(1)
+				started.Add(1)
+				go func() {
+					defer wg.Done()
+					started.Done()
+					for i := 0; ; i++ {
+						select {
+						case <-stop:
+							return
+						default:
+						}
+						m.Contains(fmt.Sprint(i % 50))
+						if n := m.Len(); n > 50 {
+							t.Errorf("Len() = %d exceeds capacity", n)
+						}
+					}
+				}()
+			}
+			started.Wait()
+			for i := range 200 {
+				if err := m.Resize(10 + i%2*30); err != nil {
+					t.Errorf("Resize: %v", err)
+				}
+			}
+			close(stop)
+			wg.Wait()
+		})
+	}
+}
+
+func TestOrderMap_Stats(t *testing.T) {
+	m, err := NewOrderMap(nil, Config{Size: 10})
+	if err != nil {
+		t.Fatalf("NewOrderMap: %v", err)
+	}
+	m.Add("a", testOrder("a", 1))
+	m.Get("a")
+	m.Get("a")
+	m.Get("b")
+	st := m.Stats()
+	if st.Hits != 2 || st.Misses != 1 || st.Size != 1 || st.Capacity != 10 || st.Policy != PolicyLRU {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+	if st.HitRatio < 0.66 || st.HitRatio > 0.67 {
+		t.Errorf("HitRatio = %v, want 2/3", st.HitRatio)
+	}
+}
@@ -0,0 +1,23 @@
+package cache
+
+import "orderservice/internal/model"
+
+// Cache - type-safe cache abstraction; implementations store values by copy,
+// so neither the caller of Add nor the caller of Get can mutate what is cached
+type Cache[K comparable, V any] interface {
+	Get(key K) (V, bool)
+	Add(key K, value V)
+	Remove(key K)
+	Len() int
+	Purge()
+}
+
+// OrderCache - cache of orders by their UID used by service layer: Add for new or changed orders,
+// Fill for orders read from DB on a miss, Erase for orders whose personal data must not remain anywhere
+type OrderCache interface {
+	Cache[string, model.Order]
+	Fill(key string, value model.Order)
+	Erase(keys []string) error
+}
+
+var _ OrderCache = (*OrderMap)(nil)
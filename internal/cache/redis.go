@@ -0,0 +1,238 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"orderservice/internal/metrics"
+	"orderservice/internal/model"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// SharedConfig - settings of the Redis tier shared by all replicas
+type SharedConfig struct {
+	Addr      string // пусто - общий уровень отключен
+	Password  string
+	DB        int
+	TTL       time.Duration // 0 - ключи не устаревают
+	KeyPrefix string
+	Channel   string        // канал pub/sub для инвалидации локальных кэшей
+	Timeout   time.Duration // ограничение на каждую операцию с Redis
+	ReplicaID string        // свои сообщения об инвалидации игнорируются
+}
+
+// invalidation operations
+const (
+	opSet    = "set"
+	opDelete = "del"
+	opPurge  = "purge"
+	opErase  = "erase" // персональные данные стерты: удалить локально и переписать снапшот
+)
+
+// invalidation - message published to other replicas when an order changes in the shared tier
+type invalidation struct {
+	Origin string   `json:"origin"`
+	Op     string   `json:"op"`
+	UID    string   `json:"uid,omitempty"`
+	UIDs   []string `json:"uids,omitempty"` // для opErase
+}
+
+// sharedTier - second cache level in Redis: orders are stored as JSON under KeyPrefix+uid
+type sharedTier struct {
+	client *redis.Client
+	cfg    SharedConfig
+}
+
+func newSharedTier(cfg SharedConfig) *sharedTier {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 200 * time.Millisecond
+	}
+	client := redis.NewClient(&redis.Options{
+		Addr:     cfg.Addr,
+		Password: cfg.Password,
+		DB:       cfg.DB,
+	})
+	return &sharedTier{client: client, cfg: cfg}
+}
+
+func (t *sharedTier) key(uid string) string {
+	return t.cfg.KeyPrefix + uid
+}
+
+// get - ошибки Redis не фатальны: заказ просто считается промахом и ищется в БД
+func (t *sharedTier) get(uid string) (model.Order, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), t.cfg.Timeout)
+	defer cancel()
+
+	data, err := t.client.Get(ctx, t.key(uid)).Bytes()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			metrics.CacheSharedErrors.Inc()
+			slog.Warn("Failed to read order from shared cache", "order_uid", uid, "error", err)
+		}
+		metrics.CacheSharedMisses.Inc()
+		return model.Order{}, false
+	}
+
+	var order model.Order
+	if err := json.Unmarshal(data, &order); err != nil {
+		metrics.CacheSharedErrors.Inc()
+		slog.Warn("Failed to decode order from shared cache", "order_uid", uid, "error", err)
+		return model.Order{}, false
+	}
+	metrics.CacheSharedHits.Inc()
+	return order, true
+}
+
+// set пишет заказ в Redis; publish - заказ новый или изменился, и копии других реплик устарели
+func (t *sharedTier) set(order *model.Order, publish bool) {
+	data, err := json.Marshal(order)
+	if err != nil {
+		metrics.CacheSharedErrors.Inc()
+		slog.Warn("Failed to encode order for shared cache", "order_uid", order.OrderUID, "error", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), t.cfg.Timeout)
+	defer cancel()
+	if err := t.client.Set(ctx, t.key(order.OrderUID), data, t.cfg.TTL).Err(); err != nil {
+		metrics.CacheSharedErrors.Inc()
+		slog.Warn("Failed to write order to shared cache", "order_uid", order.OrderUID, "error", err)
+		return
+	}
+	if publish {
+		t.publish(ctx, opSet, order.OrderUID)
+	}
+}
+
+func (t *sharedTier) delete(uid string) {
+	ctx, cancel := context.WithTimeout(context.Background(), t.cfg.Timeout)
+	defer cancel()
+	if err := t.client.Del(ctx, t.key(uid)).Err(); err != nil {
+		metrics.CacheSharedErrors.Inc()
+		slog.Warn("Failed to delete order from shared cache", "order_uid", uid, "error", err)
+	}
+	t.publish(ctx, opDelete, uid)
+}
+
+// erase deletes orders and asks other replicas to drop their copies including snapshots;
+// unlike delete, failures are returned - the caller has to report that personal data may remain
+func (t *sharedTier) erase(uids []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), t.cfg.Timeout)
+	defer cancel()
+	keys := make([]string, len(uids))
+	for i, uid := range uids {
+		keys[i] = t.key(uid)
+	}
+	if err := t.client.Del(ctx, keys...).Err(); err != nil {
+		metrics.CacheSharedErrors.Inc()
+		return fmt.Errorf("failed to delete erased orders from shared cache: %w", err)
+	}
+	if err := t.publishInvalidation(ctx, invalidation{Origin: t.cfg.ReplicaID, Op: opErase, UIDs: uids}); err != nil {
+		return fmt.Errorf("failed to notify replicas about erased orders: %w", err)
+	}
+	return nil
+}
+
+// purge removes all keys with KeyPrefix; SCAN instead of KEYS, чтобы не блокировать Redis
+func (t *sharedTier) purge() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*t.cfg.Timeout)
+	defer cancel()
+
+	iter := t.client.Scan(ctx, 0, t.cfg.KeyPrefix+"*", 500).Iterator()
+	var keys []string
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	err := iter.Err()
+	if err == nil && len(keys) > 0 {
+		err = t.client.Del(ctx, keys...).Err()
+	}
+	if err != nil {
+		metrics.CacheSharedErrors.Inc()
+		slog.Warn("Failed to purge shared cache", "error", err)
+	}
+	t.publish(ctx, opPurge, "")
+}
+
+func (t *sharedTier) publish(ctx context.Context, op, uid string) {
+	_ = t.publishInvalidation(ctx, invalidation{Origin: t.cfg.ReplicaID, Op: op, UID: uid})
+}
+
+func (t *sharedTier) publishInvalidation(ctx context.Context, inv invalidation) error {
+	data, _ := json.Marshal(inv) // структура из строк всегда сериализуется
+	if err := t.client.Publish(ctx, t.cfg.Channel, data).Err(); err != nil {
+		metrics.CacheSharedErrors.Inc()
+		slog.Warn("Failed to publish cache invalidation", "op", inv.Op, "order_uid", inv.UID, "error", err)
+		return err
+	}
+	return nil
+}
+
+// RunInvalidation listens for changes made by other replicas and drops stale local entries until ctx is cancelled;
+// does nothing if shared tier is disabled. Subscription is restored by go-redis after connection loss
+func (m *OrderMap) RunInvalidation(ctx context.Context) {
+	if m.shared == nil {
+		return
+	}
+	pubsub := m.shared.client.Subscribe(ctx, m.shared.cfg.Channel)
+	defer func() {
+		if err := pubsub.Close(); err != nil {
+			slog.Warn("Failed to close cache invalidation subscription", "error", err)
+		}
+	}()
+	slog.Info("Listening for cache invalidations", "channel", m.shared.cfg.Channel, "replica_id", m.shared.cfg.ReplicaID)
+
+	ch := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			m.applyInvalidation(msg.Payload)
+		}
+	}
+}
+
+func (m *OrderMap) applyInvalidation(payload string) {
+	var inv invalidation
+	if err := json.Unmarshal([]byte(payload), &inv); err != nil {
+		slog.Warn("Malformed cache invalidation message", "error", err)
+		return
+	}
+	if inv.Origin == m.shared.cfg.ReplicaID {
+		return
+	}
+	metrics.CacheInvalidations.WithLabelValues(inv.Op).Inc()
+	switch inv.Op {
+	case opSet, opDelete: // при изменении заказа локальная копия просто выбрасывается, свежая версия придет из Redis при следующем Get
+		m.removeLocal(inv.UID)
+	case opPurge:
+		m.purgeLocal()
+	case opErase:
+		if err := m.eraseLocal(inv.UIDs); err != nil {
+			slog.Error("Failed to erase orders from cache snapshot", "orders", len(inv.UIDs), "error", err)
+		}
+	default:
+		slog.Warn("Unknown cache invalidation operation", "op", inv.Op)
+	}
+}
+
+// Close releases connection to the shared tier, if any
+func (m *OrderMap) Close() error {
+	if m.shared == nil {
+		return nil
+	}
+	if err := m.shared.client.Close(); err != nil {
+		return fmt.Errorf("failed to close shared cache client: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package cache
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+const testChannel = "test:invalidation"
+
+func newSharedMap(t *testing.T, srv *miniredis.Miniredis, replica string) *OrderMap {
+	t.Helper()
+	m, err := NewOrderMap(nil, Config{Size: 10, Shared: SharedConfig{
+		Addr:      srv.Addr(),
+		TTL:       time.Minute,
+		KeyPrefix: "test:order:",
+		Channel:   testChannel,
+		Timeout:   time.Second,
+		ReplicaID: replica,
+	}})
+	if err != nil {
+		t.Fatalf("NewOrderMap: %v", err)
+	}
+	t.Cleanup(func() { _ = m.Close() })
+	return m
+}
+
+// waitFor - pub/sub асинхронный, ждем результата с ограничением по времени
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSharedTier_ReadThroughAndTTL(t *testing.T) {
+	srv := miniredis.RunT(t)
+	a := newSharedMap(t, srv, "a")
+	b := newSharedMap(t, srv, "b")
+
+	a.Add("x", testOrder("x", 2))
+	if !srv.Exists("test:order:x") {
+		t.Fatal("order must be written to shared tier")
+	}
+	if ttl := srv.TTL("test:order:x"); ttl != time.Minute {
+		t.Errorf("TTL = %v, want 1m", ttl)
+	}
+
+	got, ok := b.Get("x")
+	if !ok || got.OrderUID != "x" || len(got.Items) != 2 || got.Items[0].Name != testOrder("x", 2).Items[0].Name {
+		t.Fatalf("Get from shared tier = %+v, %v", got, ok)
+	}
+	if !b.Contains("x") {
+		t.Error("shared hit must be kept in local cache")
+	}
+
+	srv.FastForward(2 * time.Minute)
+	if _, ok := b.shared.get("x"); ok {
+		t.Error("expired key must not be served")
+	}
+}
+
+func TestSharedTier_Invalidation(t *testing.T) {
+	srv := miniredis.RunT(t)
+	a := newSharedMap(t, srv, "a")
+	b := newSharedMap(t, srv, "b")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.RunInvalidation(ctx)
+	go b.RunInvalidation(ctx)
+	waitFor(t, "subscriptions", func() bool { return srv.PubSubNumSub(testChannel)[testChannel] == 2 })
+
+	a.Add("x", testOrder("x", 1))
+	if _, ok := b.Get("x"); !ok {
+		t.Fatal("order must be found through shared tier")
+	}
+
+	// обновление на реплике a выбрасывает устаревшую копию на b, но не трогает собственную
+	updated := testOrder("x", 3)
+	a.Add("x", updated)
+	waitFor(t, "invalidation of b", func() bool { return !b.Contains("x") })
+	if !a.Contains("x") {
+		t.Error("own invalidation message must be ignored")
+	}
+	if got, ok := b.Get("x"); !ok || len(got.Items) != 3 {
+		t.Errorf("b must read updated order from shared tier, got %d items", len(got.Items))
+	}
+
+	b.Remove("x")
+	waitFor(t, "removal on a", func() bool { return !a.Contains("x") })
+	if srv.Exists("test:order:x") {
+		t.Error("Remove must delete order from shared tier")
+	}
+
+	a.Add("y", testOrder("y", 1))
+	waitFor(t, "y on b", func() bool { _, ok := b.Get("y"); return ok })
+	a.Purge()
+	waitFor(t, "purge on b", func() bool { return b.Len() == 0 })
+	if keys := srv.Keys(); len(keys) != 0 {
+		t.Errorf("Purge must clear shared tier, left %v", keys)
+	}
+}
+
+func TestSharedTier_FillDoesNotInvalidate(t *testing.T) {
+	srv := miniredis.RunT(t)
+	a := newSharedMap(t, srv, "a")
+	b := newSharedMap(t, srv, "b")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.RunInvalidation(ctx)
+	waitFor(t, "subscription", func() bool { return srv.PubSubNumSub(testChannel)[testChannel] == 1 })
+
+	b.Fill("x", testOrder("x", 1))
+	b.Fill("s", testOrder("s", 1))
+	// промах на a: заказ прочитан из БД и положен в кэш, он не менялся
+	a.Fill("x", testOrder("x", 1))
+	if !srv.Exists("test:order:x") {
+		t.Fatal("filled order must be written to shared tier")
+	}
+
+	// сообщения pub/sub приходят по порядку: после инвалидации "s" инвалидация "x" уже пришла бы
+	a.Add("s", testOrder("s", 2))
+	waitFor(t, "invalidation of s", func() bool { return !b.Contains("s") })
+	if !b.Contains("x") {
+		t.Error("order filled from DB must not evict copies of other replicas")
+	}
+}
+
+func TestSharedTier_Erase(t *testing.T) {
+	srv := miniredis.RunT(t)
+	a := newSharedMap(t, srv, "a")
+	b := newSharedMap(t, srv, "b")
+	b.cfg.SnapshotPath = filepath.Join(t.TempDir(), "b.json")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.RunInvalidation(ctx)
+	waitFor(t, "subscription", func() bool { return srv.PubSubNumSub(testChannel)[testChannel] == 1 })
+
+	b.Fill("x", testOrder("x", 1))
+	b.Fill("y", testOrder("y", 1))
+	if err := b.SaveSnapshot(b.cfg.SnapshotPath); err != nil {
+		t.Fatalf("SaveSnapshot: %v", err)
+	}
+
+	if err := a.Erase([]string{"x"}); err != nil {
+		t.Fatalf("Erase: %v", err)
+	}
+	if srv.Exists("test:order:x") {
+		t.Error("erased order must be deleted from shared tier")
+	}
+	waitFor(t, "erase on b", func() bool { return !b.Contains("x") })
+	// снапшот переписывается сразу после удаления из локального кэша
+	waitFor(t, "snapshot of b", func() bool {
+		orders, err := LoadSnapshot(b.cfg.SnapshotPath, 0)
+		return err == nil && len(orders) == 1 && orders[0].OrderUID == "y"
+	})
+
+	srv.Close()
+	if err := a.Erase([]string{"y"}); err == nil {
+		t.Error("erase must report that shared tier may keep the order")
+	}
+}
+
+func TestSharedTier_Unavailable(t *testing.T) {
+	srv := miniredis.RunT(t)
+	m := newSharedMap(t, srv, "a")
+	m.shared.cfg.Timeout = 50 * time.Millisecond
+	srv.Close()
+
+	// без Redis кэш работает как локальный
+	m.Add("x", testOrder("x", 1))
+	if _, ok := m.Get("x"); !ok {
+		t.Error("local tier must keep working without Redis")
+	}
+	if _, ok := m.Get("missing"); ok {
+		t.Error("unexpected hit")
+	}
+}
@@ -0,0 +1,186 @@
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"orderservice/internal/model"
+)
+
+// snapshotVersion is bumped whenever model.Order or the file layout changes incompatibly
+const snapshotVersion = 1
+
+// reconcileBatch - сколько UID сверяется с БД одним запросом
+const reconcileBatch = 500
+
+var (
+	ErrSnapshotVersion  = errors.New("cache snapshot has unsupported version")
+	ErrSnapshotChecksum = errors.New("cache snapshot checksum mismatch")
+	ErrSnapshotStale    = errors.New("cache snapshot is too old")
+)
+
+type snapshotFile struct {
+	Version   int             `json:"version"`
+	CreatedAt time.Time       `json:"created_at"`
+	Checksum  string          `json:"checksum"` // sha256 от Orders
+	Orders    json.RawMessage `json:"orders"`
+}
+
+// SaveSnapshot writes non-expired cached orders to path atomically, least recently used first
+func (m *OrderMap) SaveSnapshot(path string) error {
+	m.snapshotMu.Lock()
+	defer m.snapshotMu.Unlock()
+
+	orders := m.snapshotOrders()
+	payload, err := json.Marshal(orders)
+	if err != nil {
+		return fmt.Errorf("failed to marshal cache snapshot: %w", err)
+	}
+	sum := sha256.Sum256(payload)
+	data, err := json.Marshal(snapshotFile{
+		Version:   snapshotVersion,
+		CreatedAt: time.Now().UTC(),
+		Checksum:  hex.EncodeToString(sum[:]),
+		Orders:    payload,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal cache snapshot: %w", err)
+	}
+
+	// пишем во временный файл и переименовываем, чтобы при падении не оставить обрезанный снапшот
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create cache snapshot: %w", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write cache snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write cache snapshot: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace cache snapshot: %w", err)
+	}
+	return nil
+}
+
+// LoadSnapshot reads orders saved by SaveSnapshot verifying version, checksum and age (maxAge 0 - any age)
+func LoadSnapshot(path string, maxAge time.Duration) ([]model.Order, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache snapshot: %w", err)
+	}
+	var file snapshotFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to decode cache snapshot: %w", err)
+	}
+	if file.Version != snapshotVersion {
+		return nil, fmt.Errorf("%w: %d", ErrSnapshotVersion, file.Version)
+	}
+	sum := sha256.Sum256(file.Orders)
+	if hex.EncodeToString(sum[:]) != file.Checksum {
+		return nil, ErrSnapshotChecksum
+	}
+	if maxAge > 0 && time.Since(file.CreatedAt) > maxAge {
+		return nil, fmt.Errorf("%w: created at %s", ErrSnapshotStale, file.CreatedAt.Format(time.RFC3339))
+	}
+
+	var orders []model.Order
+	if err := json.Unmarshal(file.Orders, &orders); err != nil {
+		return nil, fmt.Errorf("failed to decode cached orders: %w", err)
+	}
+	return orders, nil
+}
+
+// RunSnapshots saves cache to cfg.SnapshotPath every cfg.SnapshotInterval (0 - only on exit) and once more when ctx is done
+func (m *OrderMap) RunSnapshots(ctx context.Context) {
+	var tick <-chan time.Time
+	if m.cfg.SnapshotInterval > 0 {
+		ticker := time.NewTicker(m.cfg.SnapshotInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-tick:
+			if err := m.SaveSnapshot(m.cfg.SnapshotPath); err != nil {
+				slog.Error("Failed to save cache snapshot", "error", err)
+			}
+		case <-ctx.Done():
+			if err := m.SaveSnapshot(m.cfg.SnapshotPath); err != nil {
+				slog.Error("Failed to save cache snapshot on shutdown", "error", err)
+				return
+			}
+			slog.Info("Cache snapshot saved", "path", m.cfg.SnapshotPath, "orders", m.Len())
+			return
+		}
+	}
+}
+
+// reconcile brings orders loaded from snapshot in line with DB: changed ones are replaced, deleted ones are removed;
+// stops between batches when ctx is done
+func (m *OrderMap) reconcile(ctx context.Context, uids []string) {
+	var updated, removed int
+	for start := 0; start < len(uids); start += reconcileBatch {
+		if ctx.Err() != nil {
+			slog.Info("Cache snapshot reconciliation interrupted", "checked", start, "of", len(uids), "refreshed", updated, "removed", removed)
+			return
+		}
+		batch := uids[start:min(start+reconcileBatch, len(uids))]
+		orders, err := m.Repo.GetOrdersByUIDs(ctx, batch)
+		if err != nil {
+			slog.Error("Failed to reconcile cache snapshot with DB", "error", err)
+			return
+		}
+
+		fresh := make(map[string]model.Order, len(orders))
+		for _, o := range orders {
+			fresh[o.OrderUID] = o
+		}
+		for _, uid := range batch {
+			o, ok := fresh[uid]
+			switch {
+			case !ok:
+				m.Remove(uid)
+				removed++
+			case m.Contains(uid): // вытесненные за время сверки обратно не добавляем; сверенный с БД заказ можно отдать и в Redis
+				m.Fill(uid, o)
+				updated++
+			}
+		}
+	}
+	slog.Info("Cache snapshot reconciled with DB", "checked", len(uids), "refreshed", updated, "removed", removed)
+}
+
+// snapshotOrders - живые записи от давно использованных к недавним,
+// чтобы при загрузке добавлением по порядку восстановить то же старшинство
+func (m *OrderMap) snapshotOrders() []model.Order {
+	m.Lock()
+	defer m.Unlock()
+
+	now := time.Now()
+	orders := make([]model.Order, 0, m.recency.Len())
+	for el := m.recency.Back(); el != nil; el = el.Prev() {
+		v, ok := m.store.Peek(el.Value.(*tracked).uid)
+		if !ok {
+			continue
+		}
+		e := v.(*entry)
+		if !e.expiresAt.IsZero() && now.After(e.expiresAt) {
+			continue
+		}
+		orders = append(orders, e.order)
+	}
+	return orders
+}
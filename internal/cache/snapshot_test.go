@@ -0,0 +1,210 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"orderservice/internal/model"
+)
+
+// snapshotRepo - фейковый репозиторий: заказы из БД по UID и из GetAllOrders
+type snapshotRepo struct {
+	db        map[string]model.Order
+	allCalled chan struct{}
+	reconcile chan struct{}
+}
+
+func (r *snapshotRepo) AddNewOrder(context.Context, *model.Order, ...model.IdempotencyKey) error {
+	return nil
+}
+
+func (r *snapshotRepo) GetOrderByUID(_ context.Context, uid string) (*model.Order, error) {
+	o, ok := r.db[uid]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return &o, nil
+}
+
+func (r *snapshotRepo) GetOrdersByUIDs(_ context.Context, uids []string) ([]model.Order, error) {
+	defer close(r.reconcile)
+	var res []model.Order
+	for _, uid := range uids {
+		if o, ok := r.db[uid]; ok {
+			res = append(res, o)
+		}
+	}
+	return res, nil
+}
+
+func (r *snapshotRepo) GetMostAccessedOrders(context.Context, int) ([]model.Order, error) {
+	return nil, nil
+}
+
+func (r *snapshotRepo) GetOrdersByCustomers(context.Context, []string, int) ([]model.Order, error) {
+	return nil, nil
+}
+
+func (r *snapshotRepo) IncrementOrderAccesses(context.Context, map[string]int64) error { return nil }
+
+func (r *snapshotRepo) AddAuditEvents(context.Context, []model.AuditEvent) error { return nil }
+
+func (r *snapshotRepo) GetOrdersByContact(context.Context, string, string) ([]model.Order, error) {
+	return nil, nil
+}
+
+func (r *snapshotRepo) ReencryptDeliveries(context.Context, int) (int, error) { return 0, nil }
+
+func (r *snapshotRepo) AnonymizeCustomer(context.Context, string) ([]string, error) { return nil, nil }
+
+func (r *snapshotRepo) GetAllOrders(context.Context, int) ([]model.Order, error) {
+	close(r.allCalled)
+	return []model.Order{testOrder("from-db", 1)}, nil
+}
+
+func TestSnapshot_RoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	m, err := NewOrderMap(nil, Config{Size: 10})
+	if err != nil {
+		t.Fatalf("NewOrderMap: %v", err)
+	}
+	m.Add("a", testOrder("a", 1))
+	m.Add("b", testOrder("b", 2))
+	m.Get("a") // "a" становится самым свежим
+
+	if err := m.SaveSnapshot(path); err != nil {
+		t.Fatalf("SaveSnapshot: %v", err)
+	}
+	orders, err := LoadSnapshot(path, time.Hour)
+	if err != nil {
+		t.Fatalf("LoadSnapshot: %v", err)
+	}
+	if len(orders) != 2 || orders[0].OrderUID != "b" || orders[1].OrderUID != "a" {
+		t.Fatalf("snapshot must keep LRU order, got %v", orders)
+	}
+	if len(orders[1].Items) != 1 {
+		t.Fatalf("order content lost: %+v", orders[1])
+	}
+}
+
+func TestSnapshot_Rejected(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cache.json")
+	m, err := NewOrderMap(nil, Config{Size: 10})
+	if err != nil {
+		t.Fatalf("NewOrderMap: %v", err)
+	}
+	m.Add("a", testOrder("a", 1))
+	if err := m.SaveSnapshot(path); err != nil {
+		t.Fatalf("SaveSnapshot: %v", err)
+	}
+
+	if _, err := LoadSnapshot(path, time.Nanosecond); !errors.Is(err, ErrSnapshotStale) {
+		t.Errorf("err = %v, want ErrSnapshotStale", err)
+	}
+
+	data, _ := os.ReadFile(path)
+	tampered := filepath.Join(dir, "tampered.json")
+	if err := os.WriteFile(tampered, []byte(strings.Replace(string(data), `"order_uid":"a"`, `"order_uid":"x"`, 1)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadSnapshot(tampered, 0); !errors.Is(err, ErrSnapshotChecksum) {
+		t.Errorf("err = %v, want ErrSnapshotChecksum", err)
+	}
+
+	if _, err := LoadSnapshot(filepath.Join(dir, "missing.json"), 0); err == nil {
+		t.Error("missing snapshot must be reported")
+	}
+}
+
+func TestCreateAndWarmUp_FromSnapshotWithReconcile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	old, err := NewOrderMap(nil, Config{Size: 10})
+	if err != nil {
+		t.Fatalf("NewOrderMap: %v", err)
+	}
+	old.Add("kept", testOrder("kept", 1))
+	old.Add("deleted", testOrder("deleted", 1))
+	if err := old.SaveSnapshot(path); err != nil {
+		t.Fatalf("SaveSnapshot: %v", err)
+	}
+
+	updated := testOrder("kept", 3)
+	repo := &snapshotRepo{
+		db:        map[string]model.Order{"kept": updated},
+		allCalled: make(chan struct{}),
+		reconcile: make(chan struct{}),
+	}
+	var wg sync.WaitGroup
+	m, err := CreateAndWarmUpOrderCache(context.Background(), repo, Config{Size: 10, SnapshotPath: path}, &wg)
+	if err != nil {
+		t.Fatalf("CreateAndWarmUpOrderCache: %v", err)
+	}
+
+	// сверка идет в фоне и учитывается в wg
+	wg.Wait()
+	select {
+	case <-repo.reconcile:
+	default:
+		t.Fatal("snapshot was not reconciled with DB")
+	}
+	select {
+	case <-repo.allCalled:
+		t.Fatal("DB warm-up must be skipped when snapshot is valid")
+	default:
+	}
+	if m.Contains("deleted") {
+		t.Error("order deleted from DB must be removed from cache")
+	}
+	if got, ok := m.Get("kept"); !ok || len(got.Items) != 3 {
+		t.Errorf("order must be refreshed from DB, got %+v", got)
+	}
+}
+
+func TestCreateAndWarmUp_ReconcileStopsOnShutdown(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	old, err := NewOrderMap(nil, Config{Size: 10})
+	if err != nil {
+		t.Fatalf("NewOrderMap: %v", err)
+	}
+	old.Add("a", testOrder("a", 1))
+	if err := old.SaveSnapshot(path); err != nil {
+		t.Fatalf("SaveSnapshot: %v", err)
+	}
+
+	// сервис уже останавливается: в БД, которую вот-вот закроют, сверка не ходит
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	repo := &snapshotRepo{allCalled: make(chan struct{}), reconcile: make(chan struct{})}
+	var wg sync.WaitGroup
+	m, err := CreateAndWarmUpOrderCache(ctx, repo, Config{Size: 10, SnapshotPath: path}, &wg)
+	if err != nil {
+		t.Fatalf("CreateAndWarmUpOrderCache: %v", err)
+	}
+	wg.Wait()
+	select {
+	case <-repo.reconcile:
+		t.Fatal("reconciliation must not query DB after ctx is done")
+	default:
+	}
+	if !m.Contains("a") {
+		t.Error("snapshot contents must stay cached")
+	}
+}
+
+func TestCreateAndWarmUp_FallbackToDB(t *testing.T) {
+	repo := &snapshotRepo{allCalled: make(chan struct{}), reconcile: make(chan struct{})}
+	m, err := CreateAndWarmUpOrderCache(context.Background(), repo, Config{Size: 10, SnapshotPath: filepath.Join(t.TempDir(), "none.json")}, &sync.WaitGroup{})
+	if err != nil {
+		t.Fatalf("CreateAndWarmUpOrderCache: %v", err)
+	}
+	if _, ok := m.Get("from-db"); !ok {
+		t.Fatal("cache must be warmed up from DB when snapshot is missing")
+	}
+}
@@ -0,0 +1,162 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"orderservice/internal/model"
+	"orderservice/internal/repository"
+)
+
+// Warm-up strategies
+const (
+	WarmupNewest    = "newest"    // последние по date_created
+	WarmupFrequent  = "frequent"  // чаще всего запрашиваемые через API
+	WarmupCustomers = "customers" // последние заказы указанных клиентов
+	WarmupNone      = "none"
+)
+
+// warmupAttempts - сколько раз прогрев перечитывает заказы из БД, если во время чтения стирались данные клиентов
+const warmupAttempts = 3
+
+// Warmup fills cache using cfg.WarmupStrategy; orders read from DB before a concurrent Erase are read again,
+// so erased personal data does not get back into cache
+func (m *OrderMap) Warmup(ctx context.Context) error {
+	for attempt := 1; ; attempt++ {
+		m.Lock()
+		erasures := m.erasures
+		m.Unlock()
+
+		orders, err := m.loadForWarmup(ctx)
+		if err != nil {
+			return err
+		}
+		if m.fillWarmup(orders, erasures) {
+			break
+		}
+		if attempt == warmupAttempts {
+			return fmt.Errorf("customer data was erased during each of %d warm-up attempts", warmupAttempts)
+		}
+		slog.InfoContext(ctx, "Customer data erased during cache warm-up, reading orders again", "attempt", attempt)
+	}
+	slog.InfoContext(ctx, "Cache successfully loaded", "strategy", m.strategy(), "orders", m.Len(), "policy", m.cfg.Policy, "bytes", m.UsedBytes())
+	return nil
+}
+
+// fillWarmup добавляет заказы, которых еще нет в кэше(при фоновом прогреве не затираем то, что уже положил консюмер или API);
+// false - после чтения заказов из БД прошло стирание, и они могут содержать стертые данные
+func (m *OrderMap) fillWarmup(orders []model.Order, erasures uint64) bool {
+	m.Lock()
+	defer m.Unlock()
+	if m.erasures != erasures {
+		return false
+	}
+	for _, v := range orders {
+		if !m.containsLocked(v.OrderUID) { // истекшие записи прогрев обновляет
+			m.addLocked(v.OrderUID, v)
+		}
+	}
+	return true
+}
+
+// StartWarmup runs Warmup in background unless another warm-up is in progress; returns false if it is.
+// The warm-up is tracked by wg, so that DB is not closed under it on shutdown
+func (m *OrderMap) StartWarmup(ctx context.Context, wg *sync.WaitGroup) bool {
+	if !m.warming.CompareAndSwap(false, true) {
+		return false
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer m.warming.Store(false)
+		if err := m.Warmup(ctx); err != nil {
+			slog.ErrorContext(ctx, "Failed to warm up cache in background", "error", err)
+		}
+	}()
+	return true
+}
+
+func (m *OrderMap) loadForWarmup(ctx context.Context) ([]model.Order, error) {
+	switch m.strategy() {
+	case WarmupNewest:
+		return m.Repo.GetAllOrders(ctx, m.cfg.Size)
+	case WarmupFrequent:
+		return m.Repo.GetMostAccessedOrders(ctx, m.cfg.Size)
+	case WarmupCustomers:
+		if len(m.cfg.WarmupCustomers) == 0 {
+			return nil, fmt.Errorf("warm-up strategy %q requires a list of customers", WarmupCustomers)
+		}
+		return m.Repo.GetOrdersByCustomers(ctx, m.cfg.WarmupCustomers, m.cfg.Size)
+	case WarmupNone:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown warm-up strategy %q", m.cfg.WarmupStrategy)
+	}
+}
+
+func (m *OrderMap) strategy() string {
+	if m.cfg.WarmupStrategy == "" {
+		return WarmupNewest
+	}
+	return strings.ToLower(m.cfg.WarmupStrategy)
+}
+
+// AccessTracker accumulates order lookups in memory and periodically flushes them to DB
+// for the "frequent" warm-up strategy, so that API requests do not write to DB one by one
+type AccessTracker struct {
+	repo     repository.OrderRepository
+	interval time.Duration
+
+	sync.Mutex
+	counts map[string]int64
+}
+
+// NewAccessTracker - flushes counters every interval
+func NewAccessTracker(repo repository.OrderRepository, interval time.Duration) *AccessTracker {
+	return &AccessTracker{repo: repo, interval: interval, counts: make(map[string]int64)}
+}
+
+// Record counts one lookup of the order
+func (t *AccessTracker) Record(uid string) {
+	t.Lock()
+	t.counts[uid]++
+	t.Unlock()
+}
+
+// Run flushes counters until ctx is done, then flushes the rest once more
+func (t *AccessTracker) Run(ctx context.Context) {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.flush(ctx)
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+			t.flush(flushCtx)
+			cancel()
+			return
+		}
+	}
+}
+
+func (t *AccessTracker) flush(ctx context.Context) {
+	t.Lock()
+	counts := t.counts
+	t.counts = make(map[string]int64)
+	t.Unlock()
+
+	if err := t.repo.IncrementOrderAccesses(ctx, counts); err != nil {
+		slog.ErrorContext(ctx, "Failed to save order access counters", "orders", len(counts), "error", err)
+		// возвращаем несохраненные счетчики, чтобы не потерять их до следующей попытки
+		t.Lock()
+		for uid, n := range counts {
+			t.counts[uid] += n
+		}
+		t.Unlock()
+	}
+}
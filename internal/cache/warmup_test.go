@@ -0,0 +1,231 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"orderservice/internal/model"
+)
+
+// warmupRepo - фейковый репозиторий, запоминающий, какой метод прогрева был вызван
+type warmupRepo struct {
+	snapshotRepo
+	mu        sync.Mutex
+	called    string
+	customers []string
+	release   chan struct{} // если задан - прогрев ждет его закрытия
+	flushed   map[string]int64
+	flushErr  error
+}
+
+func (r *warmupRepo) wait() {
+	if r.release != nil {
+		<-r.release
+	}
+}
+
+func (r *warmupRepo) getCalled() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.called
+}
+
+func (r *warmupRepo) GetAllOrders(context.Context, int) ([]model.Order, error) {
+	r.wait()
+	r.mu.Lock()
+	r.called = WarmupNewest
+	r.mu.Unlock()
+	return []model.Order{testOrder("newest", 1)}, nil
+}
+
+func (r *warmupRepo) GetMostAccessedOrders(context.Context, int) ([]model.Order, error) {
+	r.called = WarmupFrequent
+	return []model.Order{testOrder("frequent", 1)}, nil
+}
+
+func (r *warmupRepo) GetOrdersByCustomers(_ context.Context, customers []string, _ int) ([]model.Order, error) {
+	r.called = WarmupCustomers
+	r.customers = customers
+	return []model.Order{testOrder("customer", 1)}, nil
+}
+
+func (r *warmupRepo) IncrementOrderAccesses(_ context.Context, counts map[string]int64) error {
+	if r.flushErr != nil {
+		return r.flushErr
+	}
+	r.flushed = counts
+	return nil
+}
+
+func TestWarmup_Strategies(t *testing.T) {
+	tests := []struct {
+		strategy string
+		wantUID  string
+	}{
+		{"", "newest"},
+		{WarmupNewest, "newest"},
+		{WarmupFrequent, "frequent"},
+		{WarmupCustomers, "customer"},
+		{WarmupNone, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			repo := &warmupRepo{}
+			m, err := CreateAndWarmUpOrderCache(context.Background(), repo, Config{
+				Size: 10, WarmupStrategy: tt.strategy, WarmupCustomers: []string{"c1", "c2"},
+			}, &sync.WaitGroup{})
+			if err != nil {
+				t.Fatalf("CreateAndWarmUpOrderCache: %v", err)
+			}
+			if tt.wantUID == "" {
+				if m.Len() != 0 || repo.called != "" {
+					t.Fatalf("strategy none must not touch DB, called %q", repo.called)
+				}
+				return
+			}
+			if _, ok := m.Get(tt.wantUID); !ok {
+				t.Fatalf("order %q must be cached, repo called %q", tt.wantUID, repo.called)
+			}
+			if tt.strategy == WarmupCustomers && !reflect.DeepEqual(repo.customers, []string{"c1", "c2"}) {
+				t.Errorf("customers = %v", repo.customers)
+			}
+		})
+	}
+}
+
+func TestWarmup_InvalidConfig(t *testing.T) {
+	for _, cfg := range []Config{
+		{Size: 10, WarmupStrategy: "random"},
+		{Size: 10, WarmupStrategy: WarmupCustomers},
+	} {
+		if _, err := CreateAndWarmUpOrderCache(context.Background(), &warmupRepo{}, cfg, &sync.WaitGroup{}); err == nil {
+			t.Errorf("expected error for %+v", cfg)
+		}
+	}
+}
+
+func TestWarmup_Async(t *testing.T) {
+	repo := &warmupRepo{release: make(chan struct{})}
+	var wg sync.WaitGroup
+	done := make(chan *OrderMap)
+	go func() {
+		m, err := CreateAndWarmUpOrderCache(context.Background(), repo, Config{Size: 10, WarmupAsync: true}, &wg)
+		if err != nil {
+			t.Errorf("CreateAndWarmUpOrderCache: %v", err)
+		}
+		done <- m
+	}()
+
+	var m *OrderMap
+	select {
+	case m = <-done:
+	case <-time.After(time.Second):
+		t.Fatal("async warm-up must not block start")
+	}
+
+	// пока идет прогрев, консюмер успел положить свежую версию заказа - прогрев ее не затирает
+	fresh := testOrder("newest", 5)
+	m.Add("newest", fresh)
+	close(repo.release)
+
+	// фоновый прогрев учтен в wg: приложение дождется его до закрытия БД
+	wg.Wait()
+	if repo.getCalled() != WarmupNewest {
+		t.Fatal("warm-up must finish before wg is released")
+	}
+	if got, ok := m.Get("newest"); !ok || len(got.Items) != 5 {
+		t.Fatalf("warm-up overwrote fresher entry: %+v", got)
+	}
+}
+
+func TestWarmup_RefreshesExpiredEntries(t *testing.T) {
+	m, err := NewOrderMap(&warmupRepo{}, Config{Size: 10, TTL: 30 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewOrderMap: %v", err)
+	}
+	m.Add("newest", testOrder("newest", 5))
+	time.Sleep(40 * time.Millisecond)
+
+	// истекшая запись не мешает прогреву положить свежую копию из БД
+	if err := m.Warmup(context.Background()); err != nil {
+		t.Fatalf("Warmup: %v", err)
+	}
+	if got, ok := m.Get("newest"); !ok || len(got.Items) != 1 {
+		t.Fatalf("warm-up must replace expired entry, got %+v, %v", got, ok)
+	}
+}
+
+// erasingRepo - во время чтения заказов для прогрева клиент стирает свои данные
+type erasingRepo struct {
+	snapshotRepo
+	loads  int
+	during func(load int)
+}
+
+func (r *erasingRepo) GetAllOrders(context.Context, int) ([]model.Order, error) {
+	r.loads++
+	o := testOrder("a", 1)
+	o.Delivery.Name = "Alice"
+	if r.loads > 1 {
+		o.Delivery.Name = model.ErasedValue
+	}
+	r.during(r.loads)
+	return []model.Order{o}, nil
+}
+
+func TestWarmup_ErasedDuringLoad(t *testing.T) {
+	repo := &erasingRepo{}
+	m, err := NewOrderMap(repo, Config{Size: 10})
+	if err != nil {
+		t.Fatalf("NewOrderMap: %v", err)
+	}
+	repo.during = func(load int) {
+		if load == 1 {
+			if err := m.Erase([]string{"a"}); err != nil {
+				t.Errorf("Erase: %v", err)
+			}
+		}
+	}
+	if err := m.Warmup(context.Background()); err != nil {
+		t.Fatalf("Warmup: %v", err)
+	}
+	if repo.loads != 2 {
+		t.Errorf("orders read before erasure must be read again, loads = %d", repo.loads)
+	}
+	if got, ok := m.Get("a"); !ok || got.Delivery.Name != model.ErasedValue {
+		t.Fatalf("warm-up cached personal data read before erasure: %+v", got.Delivery)
+	}
+
+	// стирания на каждой попытке - прогрев сдается, ничего не положив
+	repo.loads = 0
+	repo.during = func(int) { _ = m.Erase([]string{"a"}) }
+	if err := m.Warmup(context.Background()); err == nil {
+		t.Fatal("warm-up must fail when every attempt races with erasure")
+	}
+	if m.Contains("a") || repo.loads != warmupAttempts {
+		t.Errorf("cached = %v, loads = %d", m.Contains("a"), repo.loads)
+	}
+}
+
+func TestAccessTracker_Flush(t *testing.T) {
+	repo := &warmupRepo{flushErr: errors.New("db down")}
+	tr := NewAccessTracker(repo, time.Hour)
+	tr.Record("a")
+	tr.Record("a")
+	tr.Record("b")
+
+	// при ошибке счетчики не теряются
+	tr.flush(context.Background())
+	repo.flushErr = nil
+	tr.Record("a")
+	tr.flush(context.Background())
+
+	want := map[string]int64{"a": 3, "b": 1}
+	if !reflect.DeepEqual(repo.flushed, want) {
+		t.Fatalf("flushed %v, want %v", repo.flushed, want)
+	}
+}
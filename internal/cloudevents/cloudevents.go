@@ -0,0 +1,294 @@
+// Package cloudevents - CloudEvents 1.0 envelope of Kafka messages in structured and binary content modes
+// as defined by the Kafka protocol binding of the specification
+package cloudevents
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"mime"
+	"slices"
+	"strings"
+	"time"
+
+	"orderservice/internal/messaging"
+
+	"github.com/google/uuid"
+)
+
+// SpecVersion - supported version of the specification
+const SpecVersion = "1.0"
+
+// Content modes: binary keeps payload as is and puts attributes into ce_ headers,
+// structured wraps payload and attributes into a JSON document
+const (
+	ModeBinary     = "binary"
+	ModeStructured = "structured"
+)
+
+// ContentType of structured mode messages
+const ContentType = "application/cloudevents+json"
+
+const (
+	headerPrefix      = "ce_"
+	contentTypeHeader = "content-type"
+)
+
+var ErrInvalidEvent = errors.New("invalid CloudEvent")
+
+// Event - context attributes and data of a CloudEvent; Extensions hold extension attributes as strings
+type Event struct {
+	ID              string
+	Source          string
+	Type            string
+	Subject         string
+	Time            time.Time
+	DataContentType string
+	DataSchema      string
+	Extensions      map[string]string
+	Data            []byte
+}
+
+// атрибуты, которые хранятся в полях Event, а не в Extensions
+var coreAttributes = map[string]bool{
+	"specversion": true, "id": true, "source": true, "type": true, "subject": true, "time": true,
+	"datacontenttype": true, "dataschema": true, "data": true, "data_base64": true,
+}
+
+// Parse returns nil event for messages that are not CloudEvents: structured mode is recognized
+// by content-type header, binary mode by ce_specversion header
+func Parse(msg *messaging.Message) (*Event, error) {
+	if ct, ok := msg.Header(contentTypeHeader); ok && isStructured(string(ct)) {
+		return parseStructured(msg.Value)
+	}
+	if _, ok := msg.Header(headerPrefix + "specversion"); ok {
+		return parseBinary(msg)
+	}
+	return nil, nil
+}
+
+func isStructured(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && strings.EqualFold(mediaType, ContentType)
+}
+
+func parseBinary(msg *messaging.Message) (*Event, error) {
+	attrs := make(map[string]string)
+	for _, h := range msg.Headers {
+		if name, ok := strings.CutPrefix(h.Key, headerPrefix); ok {
+			attrs[name] = string(h.Value)
+		}
+	}
+	if ct, ok := msg.Header(contentTypeHeader); ok {
+		attrs["datacontenttype"] = string(ct)
+	}
+	e, err := fromAttributes(attrs)
+	if err != nil {
+		return nil, err
+	}
+	e.Data = msg.Value
+	return e, nil
+}
+
+func parseStructured(value []byte) (*Event, error) {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(value, &doc); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEvent, err)
+	}
+	attrs := make(map[string]string, len(doc))
+	for name, raw := range doc {
+		if name == "data" || name == "data_base64" {
+			continue
+		}
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			// расширения могут быть числами и булевыми значениями - храним их JSON-представление
+			s = string(raw)
+		}
+		attrs[name] = s
+	}
+	e, err := fromAttributes(attrs)
+	if err != nil {
+		return nil, err
+	}
+
+	if raw, ok := doc["data_base64"]; ok {
+		var encoded string
+		if err := json.Unmarshal(raw, &encoded); err != nil {
+			return nil, fmt.Errorf("%w: data_base64 must be a string", ErrInvalidEvent)
+		}
+		if e.Data, err = base64.StdEncoding.DecodeString(encoded); err != nil {
+			return nil, fmt.Errorf("%w: data_base64: %v", ErrInvalidEvent, err)
+		}
+		return e, nil
+	}
+	raw, ok := doc["data"]
+	if !ok || string(raw) == "null" {
+		return e, nil
+	}
+	// данные в JSON кладутся в документ как есть, прочие типы - строкой
+	if isJSON(e.DataContentType) {
+		e.Data = raw
+		return e, nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, fmt.Errorf("%w: data of type %q must be a string", ErrInvalidEvent, e.DataContentType)
+	}
+	e.Data = []byte(s)
+	return e, nil
+}
+
+func fromAttributes(attrs map[string]string) (*Event, error) {
+	if v := attrs["specversion"]; v != SpecVersion {
+		return nil, fmt.Errorf("%w: unsupported specversion %q", ErrInvalidEvent, v)
+	}
+	e := &Event{
+		ID:              attrs["id"],
+		Source:          attrs["source"],
+		Type:            attrs["type"],
+		Subject:         attrs["subject"],
+		DataContentType: attrs["datacontenttype"],
+		DataSchema:      attrs["dataschema"],
+	}
+	if e.ID == "" || e.Source == "" || e.Type == "" {
+		return nil, fmt.Errorf("%w: id, source and type are required", ErrInvalidEvent)
+	}
+	if t := attrs["time"]; t != "" {
+		var err error
+		if e.Time, err = time.Parse(time.RFC3339Nano, t); err != nil {
+			return nil, fmt.Errorf("%w: time: %v", ErrInvalidEvent, err)
+		}
+	}
+	for name, value := range attrs {
+		if !coreAttributes[name] {
+			if e.Extensions == nil {
+				e.Extensions = make(map[string]string)
+			}
+			e.Extensions[name] = value
+		}
+	}
+	return e, nil
+}
+
+// isJSON - пустой тип данных по спецификации означает JSON
+func isJSON(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
+
+// Payload returns the message as a plain one carrying event data: envelope headers are replaced
+// with content-type of the data, the rest of the headers, key and coordinates are kept
+func (e *Event) Payload(msg *messaging.Message) *messaging.Message {
+	payload := *msg
+	payload.Value = e.Data
+	payload.Headers = withoutEnvelope(msg.Headers)
+	if e.DataContentType != "" {
+		payload.Headers = append(payload.Headers, messaging.Header{Key: contentTypeHeader, Value: []byte(e.DataContentType)})
+	}
+	return &payload
+}
+
+// withoutEnvelope - заголовки без атрибутов события и content-type, которые заменяются при перекодировании
+func withoutEnvelope(headers []messaging.Header) []messaging.Header {
+	out := make([]messaging.Header, 0, len(headers))
+	for _, h := range headers {
+		if h.Key != contentTypeHeader && !strings.HasPrefix(h.Key, headerPrefix) {
+			out = append(out, h)
+		}
+	}
+	return out
+}
+
+// Encode writes the event into msg in the given mode, key and headers of msg other than envelope ones are kept
+func (e *Event) Encode(mode string, msg messaging.Message) (messaging.Message, error) {
+	msg.Headers = withoutEnvelope(msg.Headers)
+	switch mode {
+	case ModeBinary, "":
+		attrs := e.attributes()
+		for _, name := range slices.Sorted(maps.Keys(attrs)) {
+			value := attrs[name]
+			if name == "datacontenttype" {
+				name = contentTypeHeader
+			} else {
+				name = headerPrefix + name
+			}
+			msg.Headers = append(msg.Headers, messaging.Header{Key: name, Value: []byte(value)})
+		}
+		msg.Value = e.Data
+		return msg, nil
+	case ModeStructured:
+		doc := make(map[string]any)
+		for name, value := range e.attributes() {
+			doc[name] = value
+		}
+		switch {
+		case e.Data == nil:
+		case isJSON(e.DataContentType) && json.Valid(e.Data):
+			doc["data"] = json.RawMessage(bytes.TrimSpace(e.Data))
+		default:
+			doc["data_base64"] = base64.StdEncoding.EncodeToString(e.Data)
+		}
+		value, err := json.Marshal(doc)
+		if err != nil {
+			return msg, err
+		}
+		msg.Value = value
+		msg.Headers = append(msg.Headers, messaging.Header{Key: contentTypeHeader, Value: []byte(ContentType)})
+		return msg, nil
+	default:
+		return msg, fmt.Errorf("unknown CloudEvents mode %q", mode)
+	}
+}
+
+func (e *Event) attributes() map[string]string {
+	attrs := make(map[string]string, len(e.Extensions)+8)
+	for name, value := range e.Extensions {
+		attrs[name] = value
+	}
+	attrs["specversion"] = SpecVersion
+	attrs["id"] = e.ID
+	attrs["source"] = e.Source
+	attrs["type"] = e.Type
+	set := func(name, value string) {
+		if value != "" {
+			attrs[name] = value
+		}
+	}
+	set("subject", e.Subject)
+	set("datacontenttype", e.DataContentType)
+	set("dataschema", e.DataSchema)
+	if !e.Time.IsZero() {
+		attrs["time"] = e.Time.UTC().Format(time.RFC3339Nano)
+	}
+	return attrs
+}
+
+// Emitter creates events of this service, Source identifies the service instance in the source attribute
+type Emitter struct {
+	Source string
+	Mode   string
+}
+
+// NewEvent returns an event with a random ID and the current time
+func (em Emitter) NewEvent(eventType string, data []byte, contentType string) *Event {
+	return &Event{
+		ID:              uuid.NewString(),
+		Source:          em.Source,
+		Type:            eventType,
+		Time:            time.Now(),
+		DataContentType: contentType,
+		Data:            data,
+	}
+}
+
+// Encode writes the event into msg in the mode of the emitter
+func (em Emitter) Encode(e *Event, msg messaging.Message) (messaging.Message, error) {
+	return e.Encode(em.Mode, msg)
+}
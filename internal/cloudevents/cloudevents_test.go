@@ -0,0 +1,152 @@
+package cloudevents
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"orderservice/internal/messaging"
+)
+
+func TestParse_Structured(t *testing.T) {
+	msg := &messaging.Message{
+		Value: []byte(`{"specversion":"1.0","id":"e1","source":"/checkout","type":"order.created","subject":"u1",
+			"time":"2021-11-26T06:22:19Z","datacontenttype":"application/json","traceid":"abc","priority":5,
+			"data":{"order_uid":"u1"}}`),
+		Headers: []messaging.Header{{Key: "content-type", Value: []byte("application/cloudevents+json; charset=utf-8")}},
+	}
+	e, err := Parse(msg)
+	if err != nil || e == nil {
+		t.Fatalf("Parse: %v, %v", e, err)
+	}
+	if e.ID != "e1" || e.Source != "/checkout" || e.Type != "order.created" || e.Subject != "u1" {
+		t.Errorf("attributes: %+v", e)
+	}
+	if !e.Time.Equal(time.Date(2021, 11, 26, 6, 22, 19, 0, time.UTC)) {
+		t.Errorf("time: %v", e.Time)
+	}
+	if e.Extensions["traceid"] != "abc" || e.Extensions["priority"] != "5" {
+		t.Errorf("extensions: %v", e.Extensions)
+	}
+	if string(e.Data) != `{"order_uid":"u1"}` {
+		t.Errorf("data: %s", e.Data)
+	}
+
+	payload := e.Payload(msg)
+	if ct, _ := payload.Header("content-type"); string(ct) != "application/json" || !bytes.Equal(payload.Value, e.Data) {
+		t.Errorf("payload %q with content-type %q", payload.Value, ct)
+	}
+}
+
+func TestParse_StructuredData(t *testing.T) {
+	structured := func(value string) *messaging.Message {
+		return &messaging.Message{Value: []byte(value), Headers: []messaging.Header{{Key: "content-type", Value: []byte(ContentType)}}}
+	}
+	e, err := Parse(structured(`{"specversion":"1.0","id":"e1","source":"s","type":"t","data_base64":"AAEC"}`))
+	if err != nil || !bytes.Equal(e.Data, []byte{0, 1, 2}) {
+		t.Errorf("data_base64: %v, %v", e, err)
+	}
+	e, err = Parse(structured(`{"specversion":"1.0","id":"e1","source":"s","type":"t","datacontenttype":"text/plain","data":"hi"}`))
+	if err != nil || string(e.Data) != "hi" {
+		t.Errorf("text data: %v, %v", e, err)
+	}
+
+	for name, value := range map[string]string{
+		"not json":        `{"specversion":`,
+		"no id":           `{"specversion":"1.0","source":"s","type":"t"}`,
+		"old specversion": `{"specversion":"0.3","id":"e1","source":"s","type":"t"}`,
+		"bad time":        `{"specversion":"1.0","id":"e1","source":"s","type":"t","time":"yesterday"}`,
+	} {
+		if _, err := Parse(structured(value)); !errors.Is(err, ErrInvalidEvent) {
+			t.Errorf("%s: err = %v", name, err)
+		}
+	}
+}
+
+func TestParse_Binary(t *testing.T) {
+	msg := &messaging.Message{
+		Key:   []byte("u1"),
+		Value: []byte{1, 2, 3},
+		Headers: []messaging.Header{
+			{Key: "ce_specversion", Value: []byte("1.0")}, {Key: "ce_id", Value: []byte("e2")},
+			{Key: "ce_source", Value: []byte("/checkout")}, {Key: "ce_type", Value: []byte("order.created")},
+			{Key: "ce_traceid", Value: []byte("abc")}, {Key: "content-type", Value: []byte("application/x-protobuf")},
+			{Key: "traceparent", Value: []byte("00-abc")},
+		},
+	}
+	e, err := Parse(msg)
+	if err != nil || e == nil {
+		t.Fatalf("Parse: %v, %v", e, err)
+	}
+	if e.ID != "e2" || e.DataContentType != "application/x-protobuf" || e.Extensions["traceid"] != "abc" || !bytes.Equal(e.Data, msg.Value) {
+		t.Errorf("event: %+v", e)
+	}
+
+	// заголовки конверта убираются, остальные и ключ остаются
+	payload := e.Payload(msg)
+	if _, ok := payload.Header("ce_id"); ok || len(payload.Headers) != 2 || string(payload.Key) != "u1" {
+		t.Errorf("payload headers: %v", payload.Headers)
+	}
+
+	plain := &messaging.Message{Value: []byte(`{}`), Headers: []messaging.Header{{Key: "content-type", Value: []byte("application/json")}}}
+	if e, err := Parse(plain); e != nil || err != nil {
+		t.Errorf("plain message: %v, %v", e, err)
+	}
+}
+
+func TestEncode_RoundTrip(t *testing.T) {
+	em := Emitter{Source: "orderservice"}
+	cases := []struct {
+		mode        string
+		data        []byte
+		contentType string
+	}{
+		{ModeBinary, []byte(`{"order_uid":"u1"}`), "application/json"},
+		{ModeStructured, []byte(`{"order_uid":"u1"}`), "application/json"},
+		{ModeStructured, []byte("not json"), ""},
+		{ModeStructured, []byte{0xff, 0}, "application/avro"},
+	}
+	for _, c := range cases {
+		e := em.NewEvent("order.rejected", c.data, c.contentType)
+		e.Extensions = map[string]string{"dlqreason": "decode"}
+		em.Mode = c.mode
+		msg, err := em.Encode(e, messaging.Message{
+			Key:     []byte("k"),
+			Headers: []messaging.Header{{Key: "ce_id", Value: []byte("stale")}, {Key: "dlq-reason", Value: []byte("decode")}},
+		})
+		if err != nil {
+			t.Fatalf("%s: Encode: %v", c.mode, err)
+		}
+		if n := countHeaders(msg, "ce_id"); c.mode == ModeBinary && n != 1 || c.mode == ModeStructured && n != 0 {
+			t.Errorf("%s: stale envelope headers must be replaced, ce_id headers = %d", c.mode, n)
+		}
+		got, err := Parse(&msg)
+		if err != nil || got == nil {
+			t.Fatalf("%s: Parse: %v, %v", c.mode, got, err)
+		}
+		if got.ID != e.ID || got.Source != "orderservice" || got.Extensions["dlqreason"] != "decode" || !bytes.Equal(got.Data, c.data) {
+			t.Errorf("%s %q: round trip %+v", c.mode, c.data, got)
+		}
+		if !got.Time.Equal(e.Time) {
+			t.Errorf("%s: time %v, want %v", c.mode, got.Time, e.Time)
+		}
+		if _, ok := msg.Header("dlq-reason"); !ok || string(msg.Key) != "k" {
+			t.Errorf("%s: key and other headers must be kept", c.mode)
+		}
+	}
+
+	if _, err := (Emitter{Mode: "xml"}).Encode(&Event{}, messaging.Message{}); err == nil {
+		t.Error("unknown mode must fail")
+	}
+}
+
+func countHeaders(msg messaging.Message, key string) int {
+	n := 0
+	for _, h := range msg.Headers {
+		if h.Key == key {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,46 @@
+package codec
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/hamba/avro/v2"
+)
+
+// OrderAvroSchema - schema of Avro messages sent with content-type header instead of schema registry
+//
+//go:embed schemas/order.avsc
+var OrderAvroSchema string
+
+type avroCodec struct {
+	defaultSchema avro.Schema
+	parsed        sync.Map // ID схемы из реестра -> avro.Schema, разбор схемы дорогой
+}
+
+func newAvroCodec() *avroCodec {
+	return &avroCodec{defaultSchema: avro.MustParse(OrderAvroSchema)}
+}
+
+func (c *avroCodec) schema(s *Schema) (avro.Schema, error) {
+	if parsed, ok := c.parsed.Load(s.ID); ok {
+		return parsed.(avro.Schema), nil
+	}
+	parsed, err := avro.Parse(s.Definition)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Avro schema %d: %w", s.ID, err)
+	}
+	c.parsed.Store(s.ID, parsed)
+	return parsed, nil
+}
+
+// decode читает запись по схеме продюсера в универсальное представление и переводит в JSON-документ заказа:
+// поля сопоставляются по именам json-тегов модели, лишние поля схемы игнорируются
+func (c *avroCodec) decode(schema avro.Schema, payload []byte) ([]byte, error) {
+	var record any
+	if err := avro.Unmarshal(schema, payload, &record); err != nil {
+		return nil, fmt.Errorf("failed to decode Avro payload: %w", err)
+	}
+	return json.Marshal(record)
+}
@@ -0,0 +1,184 @@
+// Package codec - decoding of order messages in JSON, Protobuf and Avro: the format is chosen by content-type header
+// or by magic byte of Confluent wire format with schema from a schema registry, JSON is the default
+package codec
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+
+	"orderservice/internal/messaging"
+	"orderservice/internal/model"
+
+	"github.com/hamba/avro/v2"
+)
+
+// ContentTypeHeader - message header with MIME type of the payload
+const ContentTypeHeader = "content-type"
+
+// Formats of order messages
+const (
+	FormatJSON     = "json"
+	FormatProtobuf = "protobuf"
+	FormatAvro     = "avro"
+)
+
+// Confluent wire format: нулевой байт, 4 байта ID схемы(big-endian), затем данные
+const (
+	magicByte    = 0
+	headerLength = 5
+)
+
+var ErrUnsupportedFormat = errors.New("unsupported message format")
+
+// RegistryContentType - content-type of messages in Confluent wire format; such messages may also come without the header
+const RegistryContentType = "application/vnd.schemaregistry.v1+binary"
+
+// contentTypes - MIME-типы форматов, включая распространенные синонимы
+var contentTypes = map[string]string{
+	"application/json":                   FormatJSON,
+	"application/x-protobuf":             FormatProtobuf,
+	"application/protobuf":               FormatProtobuf,
+	"application/vnd.google.protobuf":    FormatProtobuf,
+	"application/avro":                   FormatAvro,
+	"avro/binary":                        FormatAvro,
+	"application/vnd.apache.avro+binary": FormatAvro,
+}
+
+// Decoder turns message payloads into orders
+type Decoder struct {
+	registry Registry // nil - сообщения в формате Confluent отклоняются
+	avro     *avroCodec
+	proto    *protoCodec
+	versions *Versions
+}
+
+// NewDecoder - registry may be nil if producers do not use schema registry
+func NewDecoder(registry Registry) *Decoder {
+	return &Decoder{registry: registry, avro: newAvroCodec(), proto: newProtoCodec(), versions: DefaultVersions}
+}
+
+// WithVersions returns a copy of the decoder upgrading orders by the given chain instead of DefaultVersions
+func (d *Decoder) WithVersions(versions *Versions) *Decoder {
+	c := *d
+	c.versions = versions
+	return &c
+}
+
+// Decode returns the order and the format it was encoded in. The content-type header decides the format:
+// Protobuf by order.proto, Avro by order.avsc, JSON, or RegistryContentType for Confluent wire format decoded with
+// the schema from registry. Without the header messages starting with the wire format magic byte go to registry,
+// others are JSON. JSON and Avro orders of older schema versions are upgraded to the current one, newer versions
+// fail with ErrFutureVersion
+func (d *Decoder) Decode(ctx context.Context, msg *messaging.Message) (*model.Order, string, error) {
+	version, hasVersion, err := headerVersion(msg)
+	if err != nil {
+		return nil, "", err
+	}
+
+	format := ""
+	if ct, ok := msg.Header(ContentTypeHeader); ok && len(ct) > 0 {
+		mediaType, _, err := mime.ParseMediaType(string(ct))
+		if err != nil {
+			return nil, "", fmt.Errorf("%w: content-type %q", ErrUnsupportedFormat, ct)
+		}
+		mediaType = strings.ToLower(mediaType)
+		if mediaType == RegistryContentType {
+			return d.decodeRegistered(ctx, msg.Value, version, hasVersion)
+		}
+		if format, ok = contentTypes[mediaType]; !ok {
+			return nil, "", fmt.Errorf("%w: content-type %q", ErrUnsupportedFormat, mediaType)
+		}
+	}
+	// нулевой байт проверяется только без заголовка: сырой Avro с пустым первым полем(order_uid) тоже начинается с 0x00
+	if format == "" {
+		if len(msg.Value) > 0 && msg.Value[0] == magicByte {
+			return d.decodeRegistered(ctx, msg.Value, version, hasVersion)
+		}
+		format = FormatJSON
+	}
+
+	var order *model.Order
+	switch format {
+	case FormatProtobuf:
+		order, err = d.decodeProtobuf(msg.Value, version, hasVersion)
+	case FormatAvro:
+		order, err = d.decodeAvro(d.avro.defaultSchema, msg.Value, version, hasVersion)
+	default:
+		order, err = d.versions.decodeDocument(msg.Value, version, hasVersion)
+	}
+	return order, format, err
+}
+
+func (d *Decoder) decodeRegistered(ctx context.Context, value []byte, version int, hasVersion bool) (*model.Order, string, error) {
+	if d.registry == nil {
+		return nil, "", fmt.Errorf("%w: message has schema registry framing, but no registry is configured", ErrUnsupportedFormat)
+	}
+	if len(value) < headerLength || value[0] != magicByte {
+		return nil, "", fmt.Errorf("%w: message is not in schema registry wire format", ErrUnsupportedFormat)
+	}
+	id := int(binary.BigEndian.Uint32(value[1:headerLength]))
+	schema, err := d.registry.Schema(ctx, id)
+	if err != nil {
+		// временный сбой реестра(ErrRegistryUnavailable) вызывающий повторяет, остальные ошибки относятся к сообщению
+		// или к настройке доступа к реестру
+		return nil, "", fmt.Errorf("schema %d: %w", id, err)
+	}
+	payload := value[headerLength:]
+
+	var order *model.Order
+	switch schema.Type {
+	case SchemaAvro, "":
+		parsed, err := d.avro.schema(schema)
+		if err != nil {
+			return nil, FormatAvro, err
+		}
+		order, err = d.decodeAvro(parsed, payload, version, hasVersion)
+		return order, FormatAvro, err
+	case SchemaProtobuf:
+		if err := d.proto.check(schema); err != nil {
+			return nil, FormatProtobuf, err
+		}
+		if payload, err = skipMessageIndexes(payload); err != nil {
+			return nil, FormatProtobuf, err
+		}
+		order, err = d.decodeProtobuf(payload, version, hasVersion)
+		return order, FormatProtobuf, err
+	case SchemaJSON:
+		order, err = d.versions.decodeDocument(payload, version, hasVersion)
+		return order, FormatJSON, err
+	default:
+		return nil, "", fmt.Errorf("%w: schema type %q", ErrUnsupportedFormat, schema.Type)
+	}
+}
+
+func (d *Decoder) decodeAvro(schema avro.Schema, payload []byte, version int, hasVersion bool) (*model.Order, error) {
+	data, err := d.avro.decode(schema, payload)
+	if err != nil {
+		return nil, err
+	}
+	return d.versions.decodeDocument(data, version, hasVersion)
+}
+
+// decodeProtobuf - поля Protobuf меняются только добавлением новых номеров, поэтому переходы между версиями
+// к нему не применяются, проверяется лишь, что версия из заголовка поддерживается
+func (d *Decoder) decodeProtobuf(payload []byte, version int, hasVersion bool) (*model.Order, error) {
+	if hasVersion {
+		if err := d.versions.check(version); err != nil {
+			return nil, err
+		}
+	}
+	return decodeProtobuf(payload)
+}
+
+func decodeJSON(data []byte) (*model.Order, error) {
+	var order model.Order
+	if err := json.Unmarshal(data, &order); err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
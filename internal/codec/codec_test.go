@@ -0,0 +1,408 @@
+package codec
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"orderservice/internal/messaging"
+
+	"github.com/hamba/avro/v2"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const testOrderJSON = `{"order_uid":"b563feb7b2b84b6test","track_number":"WBILMTESTTRACK","entry":"WBIL",
+"delivery":{"name":"Test Testov","email":"test@gmail.com"},"payment":{"amount":1817,"payment_dt":1637907727},
+"items":[{"chrt_id":9934930,"price":453,"status":202}],"locale":"en","sm_id":99}`
+
+// protoOrder кодирует заказ по schemas/order.proto так, как это сделал бы сгенерированный код
+func protoOrder() []byte {
+	var delivery, payment, item, b []byte
+	delivery = protowire.AppendTag(delivery, 1, protowire.BytesType)
+	delivery = protowire.AppendString(delivery, "Test Testov")
+	delivery = protowire.AppendTag(delivery, 7, protowire.BytesType)
+	delivery = protowire.AppendString(delivery, "test@gmail.com")
+
+	payment = protowire.AppendTag(payment, 5, protowire.VarintType)
+	payment = protowire.AppendVarint(payment, 1817)
+	payment = protowire.AppendTag(payment, 6, protowire.VarintType)
+	payment = protowire.AppendVarint(payment, 1637907727)
+
+	item = protowire.AppendTag(item, 1, protowire.VarintType)
+	item = protowire.AppendVarint(item, 9934930)
+	item = protowire.AppendTag(item, 3, protowire.VarintType)
+	item = protowire.AppendVarint(item, 453)
+	item = protowire.AppendTag(item, 11, protowire.VarintType)
+	item = protowire.AppendVarint(item, 202)
+
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, "b563feb7b2b84b6test")
+	b = protowire.AppendTag(b, 3, protowire.BytesType)
+	b = protowire.AppendString(b, "WBIL")
+	b = protowire.AppendTag(b, 4, protowire.BytesType)
+	b = protowire.AppendBytes(b, delivery)
+	b = protowire.AppendTag(b, 5, protowire.BytesType)
+	b = protowire.AppendBytes(b, payment)
+	b = protowire.AppendTag(b, 6, protowire.BytesType)
+	b = protowire.AppendBytes(b, item)
+	// поле из будущей версии схемы должно пропускаться
+	b = protowire.AppendTag(b, 99, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, 42)
+	b = protowire.AppendTag(b, 12, protowire.VarintType)
+	b = protowire.AppendVarint(b, 99)
+	return b
+}
+
+func avroRecord() map[string]any {
+	return map[string]any{
+		"order_uid": "b563feb7b2b84b6test", "track_number": "WBILMTESTTRACK", "entry": "WBIL",
+		"delivery": map[string]any{
+			"name": "Test Testov", "phone": "", "zip": "", "city": "", "address": "", "region": "", "email": "test@gmail.com",
+		},
+		"payment": map[string]any{
+			"transaction": "", "request_id": "", "currency": "", "provider": "", "amount": int64(1817),
+			"payment_dt": int64(1637907727), "bank": "", "delivery_cost": int64(0), "goods_total": int64(0), "custom_fee": int64(0),
+		},
+		"items": []any{map[string]any{
+			"chrt_id": int64(9934930), "track_number": "", "price": int64(453), "rid": "", "name": "", "sale": int64(0),
+			"size": "", "total_price": int64(0), "nm_id": int64(0), "brand": "", "status": 202,
+		}},
+		"locale": "en", "internal_signature": "", "customer_id": "", "delivery_service": "", "shardkey": "",
+		"sm_id": int64(99), "date_created": "", "oof_shard": "",
+	}
+}
+
+func avroOrder(t *testing.T, schema string) []byte {
+	t.Helper()
+	data, err := avro.Marshal(avro.MustParse(schema), avroRecord())
+	if err != nil {
+		t.Fatalf("avro.Marshal: %v", err)
+	}
+	return data
+}
+
+// framed добавляет заголовок Confluent wire format
+func framed(id uint32, payload ...[]byte) []byte {
+	b := []byte{magicByte, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(b[1:], id)
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func withContentType(value []byte, ct string) *messaging.Message {
+	msg := &messaging.Message{Value: value}
+	if ct != "" {
+		msg.Headers = []messaging.Header{{Key: ContentTypeHeader, Value: []byte(ct)}}
+	}
+	return msg
+}
+
+func TestDecode_ContentType(t *testing.T) {
+	d := NewDecoder(nil)
+	cases := []struct {
+		name   string
+		msg    *messaging.Message
+		format string
+	}{
+		{"no header", withContentType([]byte(testOrderJSON), ""), FormatJSON},
+		{"json", withContentType([]byte(testOrderJSON), "application/json; charset=utf-8"), FormatJSON},
+		{"protobuf", withContentType(protoOrder(), "application/x-protobuf"), FormatProtobuf},
+		{"avro", withContentType(avroOrder(t, OrderAvroSchema), "Avro/Binary"), FormatAvro},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			order, format, err := d.Decode(context.Background(), c.msg)
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if format != c.format {
+				t.Errorf("format = %q, want %q", format, c.format)
+			}
+			if order.OrderUID != "b563feb7b2b84b6test" || order.Entry != "WBIL" || order.SMID != 99 {
+				t.Errorf("order fields: %+v", order)
+			}
+			if order.Delivery.Email != "test@gmail.com" || order.Payment.PaymentDT != 1637907727 {
+				t.Errorf("nested fields: %+v %+v", order.Delivery, order.Payment)
+			}
+			if len(order.Items) != 1 || order.Items[0].ChrtID != 9934930 || order.Items[0].Status != 202 {
+				t.Errorf("items: %+v", order.Items)
+			}
+		})
+	}
+}
+
+func TestDecode_Unsupported(t *testing.T) {
+	d := NewDecoder(nil)
+	for name, msg := range map[string]*messaging.Message{
+		"unknown content-type": withContentType([]byte(testOrderJSON), "text/xml"),
+		"broken content-type":  withContentType([]byte(testOrderJSON), "application/"),
+		"framing w/o registry": {Value: framed(1, avroOrder(t, OrderAvroSchema))},
+	} {
+		if _, _, err := d.Decode(context.Background(), msg); !errors.Is(err, ErrUnsupportedFormat) {
+			t.Errorf("%s: err = %v, want ErrUnsupportedFormat", name, err)
+		}
+	}
+
+	if _, _, err := d.Decode(context.Background(), withContentType([]byte{0x0a, 0xff}, "application/protobuf")); err == nil {
+		t.Error("truncated Protobuf payload must fail")
+	}
+	if _, _, err := NewDecoder(registryFunc(func(ctx context.Context, id int) (*Schema, error) {
+		return nil, ErrSchemaNotFound
+	})).Decode(context.Background(), withContentType([]byte(testOrderJSON), RegistryContentType)); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("registry content-type without framing: %v", err)
+	}
+}
+
+func TestDecode_ContentTypeBeforeMagicByte(t *testing.T) {
+	// сырой Avro с пустым order_uid начинается с 0x00(длина строки), как и Confluent wire format
+	record := avroRecord()
+	record["order_uid"] = ""
+	payload, err := avro.Marshal(avro.MustParse(OrderAvroSchema), record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload[0] != magicByte {
+		t.Fatalf("payload must start with the magic byte, got %#x", payload[0])
+	}
+
+	d := NewDecoder(registryFunc(func(ctx context.Context, id int) (*Schema, error) {
+		t.Errorf("registry must not be asked for schema %d", id)
+		return nil, ErrSchemaNotFound
+	}))
+	order, format, err := d.Decode(context.Background(), withContentType(payload, "application/avro"))
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if format != FormatAvro || order.OrderUID != "" || order.Entry != "WBIL" || order.SMID != 99 {
+		t.Errorf("format %q, order %+v", format, order)
+	}
+}
+
+func TestDecode_Registry(t *testing.T) {
+	dir := t.TempDir()
+	// продюсер перешел на версию схемы с новым полем: лишние поля при приеме игнорируются
+	evolved := strings.Replace(OrderAvroSchema, `{"name": "locale", "type": "string"},`,
+		`{"name": "locale", "type": "string"}, {"name": "gift_wrap", "type": "boolean", "default": false},`, 1)
+	if evolved == OrderAvroSchema {
+		t.Fatal("failed to evolve schema")
+	}
+	if err := os.WriteFile(filepath.Join(dir, "order.avsc"), []byte(evolved), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	evolvedProto := strings.Replace(OrderProtoSchema, "string oof_shard = 14;", "string oof_shard = 14;\n  bool gift_wrap = 15;", 1)
+	if err := os.WriteFile(filepath.Join(dir, "order.proto"), []byte(evolvedProto), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	registryFile := filepath.Join(dir, "registry.json")
+	if err := os.WriteFile(registryFile, []byte(`{"schemas": [
+		{"id": 7, "schemaType": "AVRO", "schemaFile": "order.avsc"},
+		{"id": 8, "schemaType": "PROTOBUF", "schemaFile": "order.proto"},
+		{"id": 9, "schemaType": "JSON", "schema": "{}"}
+	]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	registry, err := NewRegistry(RegistryConfig{File: registryFile})
+	if err != nil {
+		t.Fatalf("NewRegistry: %v", err)
+	}
+	d := NewDecoder(registry)
+
+	record := avroRecord()
+	record["gift_wrap"] = true
+	avroPayload, err := avro.Marshal(avro.MustParse(evolved), record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		value  []byte
+		format string
+	}{
+		{"avro", framed(7, avroPayload), FormatAvro},
+		{"protobuf", framed(8, []byte{0}, protoOrder()), FormatProtobuf},
+		{"protobuf explicit index", framed(8, []byte{2, 0}, protoOrder()), FormatProtobuf},
+		{"json", framed(9, []byte(testOrderJSON)), FormatJSON},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// фрейминг реестра узнается по нулевому байту без заголовка или по явному content-type
+			for _, ct := range []string{"", RegistryContentType} {
+				order, format, err := d.Decode(context.Background(), withContentType(c.value, ct))
+				if err != nil {
+					t.Fatalf("Decode(%q): %v", ct, err)
+				}
+				if format != c.format || order.OrderUID != "b563feb7b2b84b6test" || order.Payment.Amount != 1817 {
+					t.Errorf("content-type %q: format %q, order %+v", ct, format, order)
+				}
+			}
+		})
+	}
+
+	if _, _, err := d.Decode(context.Background(), &messaging.Message{Value: framed(100, avroPayload)}); !errors.Is(err, ErrSchemaNotFound) {
+		t.Errorf("unknown schema id: %v", err)
+	}
+	// заказ не первое сообщение схемы
+	if _, _, err := d.Decode(context.Background(), &messaging.Message{Value: framed(8, []byte{2, 2}, protoOrder())}); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("nested message index: %v", err)
+	}
+
+	if _, err := NewRegistry(RegistryConfig{URL: "http://registry", File: registryFile}); err == nil {
+		t.Error("URL and file together must be rejected")
+	}
+	if r, err := NewRegistry(RegistryConfig{}); r != nil || err != nil {
+		t.Errorf("empty config: %v, %v", r, err)
+	}
+}
+
+func TestDecode_ProtobufSchemaContract(t *testing.T) {
+	const delivery = "message Delivery { string name = 1; string phone = 2; }\n"
+	schemas := []struct {
+		name       string
+		definition string
+		ok         bool
+		mismatch   bool // отклонена сверкой, а не разбором
+	}{
+		{"contract", OrderProtoSchema, true, false},
+		{"qualified and nested types", `syntax = "proto3"; package shop.v2;
+			/* заказ - первое сообщение */
+			message Order {
+				string order_uid = 1;
+				.shop.v2.Order.Dlv delivery = 4 [deprecated = true];
+				repeated Line items = 6;
+				message Dlv { string name = 1; }
+				message Line { uint64 chrt_id = 1; map<string, string> labels = 20; }
+				oneof extra { string note = 30; int64 sm_id = 12; }
+				reserved 40 to 50;
+			}`, true, false},
+		{"first message is not the order", "message Item { uint64 chrt_id = 1; }\nmessage Order { string order_uid = 1; }", false, true},
+		{"renamed field", "message Order { string order_id = 1; }", false, true},
+		{"changed scalar type", "message Order { string order_uid = 1; string sm_id = 12; }", false, true},
+		{"changed repetition", "message Order { Delivery delivery = 4; Item items = 6; }\n" + delivery + "message Item { uint64 chrt_id = 1; }", false, true},
+		{"mismatched nested message", "message Order { Delivery delivery = 4; }\nmessage Delivery { string name = 1; uint64 phone = 2; }", false, true},
+		{"undeclared message type", "message Order { Delivery delivery = 4; }", false, true},
+		{"no messages", `syntax = "proto3";`, false, false},
+		{"unclosed message", "message Order { string order_uid = 1;", false, false},
+	}
+	for i, s := range schemas {
+		t.Run(s.name, func(t *testing.T) {
+			d := NewDecoder(registryFunc(func(ctx context.Context, id int) (*Schema, error) {
+				return &Schema{ID: id, Type: SchemaProtobuf, Definition: s.definition}, nil
+			}))
+			msg := &messaging.Message{Value: framed(uint32(i), []byte{0}, protoOrder())}
+			order, _, err := d.Decode(context.Background(), msg)
+			if s.ok {
+				if err != nil || order.OrderUID != "b563feb7b2b84b6test" {
+					t.Fatalf("compatible schema rejected: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("incompatible schema accepted, order %+v", order)
+			}
+			if errors.Is(err, ErrSchemaMismatch) != s.mismatch {
+				t.Errorf("errors.Is(err, ErrSchemaMismatch) = %v for %v", !s.mismatch, err)
+			}
+			// результат сверки кэшируется по ID схемы
+			if _, _, again := d.Decode(context.Background(), msg); again == nil || again.Error() != err.Error() {
+				t.Errorf("cached check: %v, want %v", again, err)
+			}
+		})
+	}
+}
+
+type registryFunc func(ctx context.Context, id int) (*Schema, error)
+
+func (f registryFunc) Schema(ctx context.Context, id int) (*Schema, error) {
+	return f(ctx, id)
+}
+
+func TestHTTPRegistry(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if user, pass, ok := r.BasicAuth(); !ok || user != "svc" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/schemas/ids/3":
+		case "/schemas/ids/5":
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		case "/schemas/ids/6":
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(`{"schemaType":"PROTOBUF","schema":"syntax = \"proto3\";"}`))
+	}))
+	defer srv.Close()
+
+	r, err := NewHTTPRegistry(RegistryConfig{URL: srv.URL + "/", Username: "svc", Password: "secret"})
+	if err != nil {
+		t.Fatalf("NewHTTPRegistry: %v", err)
+	}
+	for range 2 {
+		s, err := r.Schema(context.Background(), 3)
+		if err != nil {
+			t.Fatalf("Schema: %v", err)
+		}
+		if s.ID != 3 || s.Type != SchemaProtobuf {
+			t.Errorf("schema: %+v", s)
+		}
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("schema must be cached, got %d requests", n)
+	}
+	if _, err := r.Schema(context.Background(), 4); !errors.Is(err, ErrSchemaNotFound) {
+		t.Errorf("missing schema: %v", err)
+	}
+
+	unauthorized, _ := NewHTTPRegistry(RegistryConfig{URL: srv.URL})
+	if _, err := unauthorized.Schema(context.Background(), 3); err == nil || errors.Is(err, ErrSchemaNotFound) {
+		t.Errorf("unauthorized: %v", err)
+	}
+
+	// временные сбои реестра повторяются, отказ в доступе и неизвестная схема - нет
+	payload := func(id uint32) *messaging.Message {
+		return &messaging.Message{Value: framed(id, []byte{0}, protoOrder())}
+	}
+	cases := []struct {
+		name     string
+		registry Registry
+		id       uint32
+		want     error
+	}{
+		{"unauthorized", unauthorized, 3, ErrRegistryRejected},
+		{"server error", r, 5, ErrRegistryUnavailable},
+		{"rate limited", r, 6, ErrRegistryUnavailable},
+		{"missing schema", r, 4, ErrSchemaNotFound},
+	}
+	for _, c := range cases {
+		_, _, err := NewDecoder(c.registry).Decode(context.Background(), payload(c.id))
+		if !errors.Is(err, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, err, c.want)
+		}
+		for _, other := range []error{ErrRegistryRejected, ErrRegistryUnavailable, ErrSchemaNotFound} {
+			if other != c.want && errors.Is(err, other) {
+				t.Errorf("%s: %v must not be %v", c.name, err, other)
+			}
+		}
+	}
+	srv.Close()
+	if _, _, err := NewDecoder(unauthorized).Decode(context.Background(), payload(3)); !errors.Is(err, ErrRegistryUnavailable) {
+		t.Errorf("unreachable registry must be ErrRegistryUnavailable: %v", err)
+	}
+}
@@ -0,0 +1,136 @@
+package codec
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"orderservice/internal/model"
+)
+
+// jsonSchemaDraft - версия спецификации JSON Schema генерируемой схемы
+const jsonSchemaDraft = "https://json-schema.org/draft/2020-12/schema"
+
+// jsonSchema - подмножество JSON Schema, достаточное для описания модели; properties - map,
+// поэтому ключи при сериализации отсортированы и схема воспроизводится байт в байт
+type jsonSchema struct {
+	Schema      string                 `json:"$schema,omitempty"`
+	Title       string                 `json:"title,omitempty"`
+	Description string                 `json:"description,omitempty"`
+	Type        string                 `json:"type"`
+	Format      string                 `json:"format,omitempty"`
+	Const       any                    `json:"const,omitempty"`
+	Minimum     *int64                 `json:"minimum,omitempty"`
+	MinLength   int                    `json:"minLength,omitempty"`
+	MinItems    int                    `json:"minItems,omitempty"`
+	Items       *jsonSchema            `json:"items,omitempty"`
+	Properties  map[string]*jsonSchema `json:"properties,omitempty"`
+	Required    []string               `json:"required,omitempty"`
+}
+
+// OrderJSONSchema generates JSON Schema of the current order message from json and validate tags of model.Order,
+// so producers can check their payloads against the same rules the service applies
+func OrderJSONSchema() ([]byte, error) {
+	s, err := structSchema(reflect.TypeOf(model.Order{}))
+	if err != nil {
+		return nil, err
+	}
+	s.Schema = jsonSchemaDraft
+	s.Title = "Order"
+	s.Description = fmt.Sprintf("Order message, schema version %d", CurrentSchemaVersion)
+	s.Properties[SchemaVersionField] = &jsonSchema{
+		Type:        "integer",
+		Const:       CurrentSchemaVersion,
+		Description: "may be omitted or sent in " + SchemaVersionHeader + " header instead",
+	}
+	return json.MarshalIndent(s, "", "  ")
+}
+
+// structSchema - поля без json-тега(внешние ключи) и с тегом "-" в контракт не входят
+func structSchema(t reflect.Type) (*jsonSchema, error) {
+	s := &jsonSchema{Type: "object", Properties: make(map[string]*jsonSchema)}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag, ok := f.Tag.Lookup("json")
+		name, _, _ := strings.Cut(tag, ",")
+		if !ok || name == "-" || name == "" {
+			continue
+		}
+		prop, required, err := fieldSchema(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %w", t.Name(), f.Name, err)
+		}
+		s.Properties[name] = prop
+		if required {
+			s.Required = append(s.Required, name)
+		}
+	}
+	return s, nil
+}
+
+// fieldSchema переносит в схему правила validate-тега; правила после dive относятся к элементам и вложенным структурам
+func fieldSchema(f reflect.StructField) (*jsonSchema, bool, error) {
+	s, err := typeSchema(f.Type)
+	if err != nil {
+		return nil, false, err
+	}
+	required := false
+	for _, rule := range strings.Split(f.Tag.Get("validate"), ",") {
+		name, param, _ := strings.Cut(rule, "=")
+		switch name {
+		case "dive":
+			return s, required, nil
+		case "required":
+			required = true
+			if s.Type == "string" {
+				s.MinLength = 1
+			}
+		case "gte":
+			n, err := strconv.ParseInt(param, 10, 64)
+			if err != nil {
+				return nil, false, fmt.Errorf("rule %q: %w", rule, err)
+			}
+			s.Minimum = &n
+			required = required || n > 0
+		case "min":
+			n, err := strconv.Atoi(param)
+			if err != nil {
+				return nil, false, fmt.Errorf("rule %q: %w", rule, err)
+			}
+			if s.Type == "array" {
+				s.MinItems = n
+			} else {
+				s.MinLength = n
+			}
+		case "email":
+			s.Format = "email"
+		}
+	}
+	return s, required, nil
+}
+
+func typeSchema(t reflect.Type) (*jsonSchema, error) {
+	switch t.Kind() {
+	case reflect.String:
+		return &jsonSchema{Type: "string"}, nil
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return &jsonSchema{Type: "integer"}, nil
+	case reflect.Uint, reflect.Uint32, reflect.Uint64:
+		var zero int64
+		return &jsonSchema{Type: "integer", Minimum: &zero}, nil
+	case reflect.Bool:
+		return &jsonSchema{Type: "boolean"}, nil
+	case reflect.Slice:
+		items, err := typeSchema(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return &jsonSchema{Type: "array", Items: items}, nil
+	case reflect.Struct:
+		return structSchema(t)
+	default:
+		return nil, fmt.Errorf("unsupported kind %s", t.Kind())
+	}
+}
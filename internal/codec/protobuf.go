@@ -0,0 +1,240 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+
+	"orderservice/internal/model"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Protobuf-сообщения разбираются по номерам полей из schemas/order.proto без сгенерированного кода,
+// неизвестные поля пропускаются - так продюсер может добавлять поля, не ломая прием
+
+var errProtoMalformed = errors.New("malformed Protobuf payload")
+
+// field - одно поле сообщения: для varint заполнено num, для length-delimited - raw
+type field struct {
+	number protowire.Number
+	typ    protowire.Type
+	num    uint64
+	raw    []byte
+}
+
+func (f field) str() (string, error) {
+	if f.typ != protowire.BytesType {
+		return "", fmt.Errorf("%w: field %d must be length-delimited", errProtoMalformed, f.number)
+	}
+	return string(f.raw), nil
+}
+
+func (f field) uint() (uint, error) {
+	if f.typ != protowire.VarintType {
+		return 0, fmt.Errorf("%w: field %d must be varint", errProtoMalformed, f.number)
+	}
+	return uint(f.num), nil
+}
+
+func (f field) int() (int, error) {
+	v, err := f.uint()
+	return int(int64(v)), err
+}
+
+func (f field) message() ([]byte, error) {
+	if f.typ != protowire.BytesType {
+		return nil, fmt.Errorf("%w: field %d must be a message", errProtoMalformed, f.number)
+	}
+	return f.raw, nil
+}
+
+// walk вызывает fn для каждого поля varint и length-delimited, остальные типы пропускает
+func walk(b []byte, fn func(f field) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("%w: %v", errProtoMalformed, protowire.ParseError(n))
+		}
+		b = b[n:]
+		f := field{number: num, typ: typ}
+		switch typ {
+		case protowire.VarintType:
+			f.num, n = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			f.raw, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return fmt.Errorf("%w: field %d: %v", errProtoMalformed, num, protowire.ParseError(n))
+		}
+		b = b[n:]
+		if typ != protowire.VarintType && typ != protowire.BytesType {
+			continue
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeProtobuf(b []byte) (*model.Order, error) {
+	var o model.Order
+	err := walk(b, func(f field) error {
+		var err error
+		switch f.number {
+		case 1:
+			o.OrderUID, err = f.str()
+		case 2:
+			o.TrackNumber, err = f.str()
+		case 3:
+			o.Entry, err = f.str()
+		case 4:
+			var raw []byte
+			if raw, err = f.message(); err == nil {
+				err = decodeProtoDelivery(raw, &o.Delivery)
+			}
+		case 5:
+			var raw []byte
+			if raw, err = f.message(); err == nil {
+				err = decodeProtoPayment(raw, &o.Payment)
+			}
+		case 6:
+			var raw []byte
+			if raw, err = f.message(); err == nil {
+				var item model.Item
+				if err = decodeProtoItem(raw, &item); err == nil {
+					o.Items = append(o.Items, item)
+				}
+			}
+		case 7:
+			o.Locale, err = f.str()
+		case 8:
+			o.InternalSignature, err = f.str()
+		case 9:
+			o.CustomerID, err = f.str()
+		case 10:
+			o.DeliveryService, err = f.str()
+		case 11:
+			o.ShardKey, err = f.str()
+		case 12:
+			o.SMID, err = f.int()
+		case 13:
+			o.DateCreated, err = f.str()
+		case 14:
+			o.OofShard, err = f.str()
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+func decodeProtoDelivery(b []byte, d *model.Delivery) error {
+	return walk(b, func(f field) error {
+		var err error
+		switch f.number {
+		case 1:
+			d.Name, err = f.str()
+		case 2:
+			d.Phone, err = f.str()
+		case 3:
+			d.Zip, err = f.str()
+		case 4:
+			d.City, err = f.str()
+		case 5:
+			d.Address, err = f.str()
+		case 6:
+			d.Region, err = f.str()
+		case 7:
+			d.Email, err = f.str()
+		}
+		return err
+	})
+}
+
+func decodeProtoPayment(b []byte, p *model.Payment) error {
+	return walk(b, func(f field) error {
+		var err error
+		switch f.number {
+		case 1:
+			p.Transaction, err = f.str()
+		case 2:
+			p.RequestID, err = f.str()
+		case 3:
+			p.Currency, err = f.str()
+		case 4:
+			p.Provider, err = f.str()
+		case 5:
+			p.Amount, err = f.uint()
+		case 6:
+			p.PaymentDT, err = f.uint()
+		case 7:
+			p.Bank, err = f.str()
+		case 8:
+			p.DeliveryCost, err = f.uint()
+		case 9:
+			p.GoodsTotal, err = f.uint()
+		case 10:
+			p.CustomFee, err = f.uint()
+		}
+		return err
+	})
+}
+
+func decodeProtoItem(b []byte, it *model.Item) error {
+	return walk(b, func(f field) error {
+		var err error
+		switch f.number {
+		case 1:
+			it.ChrtID, err = f.uint()
+		case 2:
+			it.TrackNumber, err = f.str()
+		case 3:
+			it.Price, err = f.uint()
+		case 4:
+			it.RID, err = f.str()
+		case 5:
+			it.Name, err = f.str()
+		case 6:
+			it.Sale, err = f.uint()
+		case 7:
+			it.Size, err = f.str()
+		case 8:
+			it.TotalPrice, err = f.uint()
+		case 9:
+			it.NMID, err = f.uint()
+		case 10:
+			it.Brand, err = f.str()
+		case 11:
+			it.Status, err = f.int()
+		}
+		return err
+	})
+}
+
+// skipMessageIndexes - после ID схемы Confluent пишет путь к типу сообщения внутри схемы: число индексов
+// и сами индексы в zigzag varint, одиночный 0 означает первое сообщение; заказ должен быть первым сообщением схемы
+func skipMessageIndexes(b []byte) ([]byte, error) {
+	raw, n := protowire.ConsumeVarint(b)
+	if n < 0 {
+		return nil, fmt.Errorf("%w: message indexes", errProtoMalformed)
+	}
+	b = b[n:]
+	switch protowire.DecodeZigZag(raw) {
+	case 0:
+		return b, nil
+	case 1:
+		idx, n := protowire.ConsumeVarint(b)
+		if n < 0 {
+			return nil, fmt.Errorf("%w: message indexes", errProtoMalformed)
+		}
+		if protowire.DecodeZigZag(idx) == 0 {
+			return b[n:], nil
+		}
+	}
+	return nil, fmt.Errorf("%w: order must be the first top-level message of the schema", ErrUnsupportedFormat)
+}
@@ -0,0 +1,350 @@
+package codec
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// OrderProtoSchema - Protobuf contract of order messages, PROTOBUF schemas from registry are checked against it
+//
+//go:embed schemas/order.proto
+var OrderProtoSchema string
+
+var ErrSchemaMismatch = errors.New("registered schema does not match the order contract")
+
+// protoField - объявление поля: тип как записан в схеме, ссылки на сообщения разрешаются при сверке
+type protoField struct {
+	name     string
+	typ      string
+	repeated bool
+}
+
+func (f protoField) String() string {
+	if f.repeated {
+		return "repeated " + f.typ + " " + f.name
+	}
+	return f.typ + " " + f.name
+}
+
+// protoFile - сообщения схемы по именам без пакета, вложенные - через точку("Order.Line"),
+// first - первое сообщение верхнего уровня, по соглашению реестра это заказ
+type protoFile struct {
+	pkg      string
+	messages map[string]map[int]protoField
+	first    string
+}
+
+type protoCodec struct {
+	expected *protoFile
+	checked  sync.Map // ID схемы из реестра -> результат сверки с контрактом, сверка разбирает схему
+}
+
+func newProtoCodec() *protoCodec {
+	expected, err := parseProto(OrderProtoSchema)
+	if err != nil {
+		panic(fmt.Sprintf("invalid embedded order.proto: %v", err))
+	}
+	return &protoCodec{expected: expected}
+}
+
+// check - сообщения разбираются по номерам полей order.proto, поэтому схема продюсера должна им соответствовать:
+// иначе любой ID схемы PROTOBUF давал бы молча искаженный заказ
+func (c *protoCodec) check(s *Schema) error {
+	if res, ok := c.checked.Load(s.ID); ok {
+		err, _ := res.(error)
+		return err
+	}
+	registered, err := parseProto(s.Definition)
+	if err != nil {
+		err = fmt.Errorf("invalid Protobuf schema %d: %w", s.ID, err)
+	} else if err = checkProto(c.expected, registered); err != nil {
+		err = fmt.Errorf("schema %d: %w", s.ID, err)
+	}
+	c.checked.Store(s.ID, err)
+	return err
+}
+
+// checkProto сверяет первое сообщение схемы с Order из order.proto: поля с номерами из контракта должны совпадать
+// по имени, типу и повторяемости, поля-сообщения сверяются рекурсивно. Новые номера и отсутствие части полей
+// допускаются - так схема развивается добавлением полей
+func checkProto(expected, registered *protoFile) error {
+	if registered.first != "Order" {
+		return fmt.Errorf("%w: first message is %q, want Order", ErrSchemaMismatch, registered.first)
+	}
+	return compareProto(expected, registered, "Order", "Order", make(map[string]bool))
+}
+
+func compareProto(expected, registered *protoFile, want, got string, seen map[string]bool) error {
+	if seen[got] {
+		return nil
+	}
+	seen[got] = true
+	for _, num := range slices.Sorted(maps.Keys(expected.messages[want])) {
+		ef := expected.messages[want][num]
+		rf, ok := registered.messages[got][num]
+		if !ok {
+			continue
+		}
+		mismatch := fmt.Errorf("%w: field %d of %s is %q, want %q", ErrSchemaMismatch, num, got, rf, ef)
+		if rf.name != ef.name || rf.repeated != ef.repeated {
+			return mismatch
+		}
+		wantMsg, isMsg := expected.resolve(want, ef.typ)
+		if !isMsg {
+			if rf.typ != ef.typ {
+				return mismatch
+			}
+			continue
+		}
+		gotMsg, ok := registered.resolve(got, rf.typ)
+		if !ok {
+			return fmt.Errorf("%w: field %d of %s refers to undeclared message %s", ErrSchemaMismatch, num, got, rf.typ)
+		}
+		if err := compareProto(expected, registered, wantMsg, gotMsg, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolve ищет сообщение typ, на которое ссылается поле сообщения scope: как в protoc, сначала среди вложенных
+// в scope, затем во внешних областях; false - typ скалярный или не объявлен в схеме
+func (f *protoFile) resolve(scope, typ string) (string, bool) {
+	absolute := strings.HasPrefix(typ, ".")
+	typ = strings.TrimPrefix(typ, ".")
+	if f.pkg != "" {
+		typ = strings.TrimPrefix(typ, f.pkg+".")
+	}
+	if absolute {
+		scope = ""
+	}
+	for {
+		name := typ
+		if scope != "" {
+			name = scope + "." + typ
+		}
+		if _, ok := f.messages[name]; ok {
+			return name, true
+		}
+		if scope == "" {
+			return "", false
+		}
+		scope = scope[:max(strings.LastIndex(scope, "."), 0)]
+	}
+}
+
+// parseProto разбирает из .proto только то, что нужно для сверки: пакет, сообщения и их поля, включая поля oneof;
+// перечисления, сервисы, опции и reserved пропускаются
+func parseProto(def string) (*protoFile, error) {
+	p := &protoParser{tokens: protoTokens(def), file: &protoFile{messages: make(map[string]map[int]protoField)}}
+	for p.peek() != "" {
+		switch p.peek() {
+		case "package":
+			p.next()
+			p.file.pkg = p.next()
+			if err := p.expect(";"); err != nil {
+				return nil, err
+			}
+		case "message":
+			p.next()
+			name := p.next()
+			if p.file.first == "" {
+				p.file.first = name
+			}
+			if err := p.message(name); err != nil {
+				return nil, err
+			}
+		case ";":
+			p.next()
+		default:
+			if err := p.skip(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if p.file.first == "" {
+		return nil, errors.New("schema declares no messages")
+	}
+	return p.file, nil
+}
+
+type protoParser struct {
+	tokens []string
+	pos    int
+	file   *protoFile
+}
+
+func (p *protoParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *protoParser) next() string {
+	t := p.peek()
+	if t != "" {
+		p.pos++
+	}
+	return t
+}
+
+func (p *protoParser) expect(tok string) error {
+	if got := p.next(); got != tok {
+		return fmt.Errorf("expected %q, got %q", tok, got)
+	}
+	return nil
+}
+
+// skip пропускает объявление до ";" или до конца его блока "{...}"
+func (p *protoParser) skip() error {
+	depth := 0
+	for {
+		switch p.next() {
+		case "":
+			return errors.New("unexpected end of schema")
+		case ";":
+			if depth == 0 {
+				return nil
+			}
+		case "{":
+			depth++
+		case "}":
+			if depth--; depth <= 0 {
+				return nil
+			}
+		}
+	}
+}
+
+func (p *protoParser) message(name string) error {
+	if err := p.expect("{"); err != nil {
+		return fmt.Errorf("message %s: %w", name, err)
+	}
+	fields := make(map[int]protoField)
+	p.file.messages[name] = fields
+	oneof := 0 // глубина блоков oneof: их поля принадлежат сообщению
+	for {
+		var err error
+		switch p.peek() {
+		case "":
+			return fmt.Errorf("message %s is not closed", name)
+		case "}":
+			p.next()
+			if oneof == 0 {
+				return nil
+			}
+			oneof--
+		case ";":
+			p.next()
+		case "message":
+			p.next()
+			err = p.message(name + "." + p.next())
+		case "oneof":
+			p.next()
+			p.next()
+			err = p.expect("{")
+			oneof++
+		case "enum", "option", "reserved", "extensions", "extend":
+			err = p.skip()
+		default:
+			err = p.field(fields)
+		}
+		if err != nil {
+			return fmt.Errorf("message %s: %w", name, err)
+		}
+	}
+}
+
+// field - [repeated|optional|required] тип имя = номер [опции];
+func (p *protoParser) field(fields map[int]protoField) error {
+	var f protoField
+	switch p.peek() {
+	case "repeated":
+		f.repeated = true
+		p.next()
+	case "optional", "required":
+		p.next()
+	}
+	f.typ = p.next()
+	if f.typ == "map" {
+		var b strings.Builder
+		b.WriteString("map")
+		for tok := ""; tok != ">"; {
+			if tok = p.next(); tok == "" {
+				return errors.New("unexpected end of schema")
+			}
+			b.WriteString(tok)
+		}
+		f.typ = b.String()
+	}
+	f.name = p.next()
+	if err := p.expect("="); err != nil {
+		return fmt.Errorf("field %s: %w", f.name, err)
+	}
+	num, err := strconv.Atoi(p.next())
+	if err != nil || num <= 0 {
+		return fmt.Errorf("field %s: invalid number", f.name)
+	}
+	if _, ok := fields[num]; ok {
+		return fmt.Errorf("duplicate field number %d", num)
+	}
+	fields[num] = f
+	return p.skip()
+}
+
+// protoTokens делит схему на идентификаторы(вместе с точками и числами), строки и отдельные символы, комментарии отбрасываются
+func protoTokens(def string) []string {
+	var tokens []string
+	for i := 0; i < len(def); {
+		c := def[i]
+		switch {
+		case strings.HasPrefix(def[i:], "//"):
+			if end := strings.IndexByte(def[i:], '\n'); end >= 0 {
+				i += end
+			} else {
+				i = len(def)
+			}
+		case strings.HasPrefix(def[i:], "/*"):
+			if end := strings.Index(def[i+2:], "*/"); end >= 0 {
+				i += end + 4
+			} else {
+				i = len(def)
+			}
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(def) && def[j] != c {
+				if def[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			j = min(j+1, len(def))
+			tokens = append(tokens, def[i:j])
+			i = j
+		case isProtoIdent(c):
+			j := i
+			for j < len(def) && isProtoIdent(def[j]) {
+				j++
+			}
+			tokens = append(tokens, def[i:j])
+			i = j
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		default:
+			tokens = append(tokens, string(c))
+			i++
+		}
+	}
+	return tokens
+}
+
+func isProtoIdent(c byte) bool {
+	return c == '_' || c == '.' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
@@ -0,0 +1,199 @@
+package codec
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Schema types as in Confluent Schema Registry; empty type means Avro
+const (
+	SchemaAvro     = "AVRO"
+	SchemaProtobuf = "PROTOBUF"
+	SchemaJSON     = "JSON"
+)
+
+var (
+	ErrSchemaNotFound = errors.New("schema not found in registry")
+	// ErrRegistryUnavailable - registry is unreachable, overloaded or failing (transport error, 5xx, 429):
+	// the message itself may be valid, decoding should be retried
+	ErrRegistryUnavailable = errors.New("schema registry is unavailable")
+	// ErrRegistryRejected - registry refused the request (401, 403 and other 4xx): retrying will not help
+	// until access to registry is fixed
+	ErrRegistryRejected = errors.New("schema registry rejected the request")
+)
+
+// Schema - registered schema of message payloads
+type Schema struct {
+	ID         int    `json:"id"`
+	Type       string `json:"schemaType"`
+	Definition string `json:"schema"`
+}
+
+// Registry resolves schema IDs from Confluent wire format; transient failures must wrap ErrRegistryUnavailable
+type Registry interface {
+	Schema(ctx context.Context, id int) (*Schema, error)
+}
+
+// RegistryConfig - URL of Confluent-compatible registry or File with schemas; both empty - no registry
+type RegistryConfig struct {
+	URL      string
+	File     string
+	Username string
+	Password string
+	Timeout  time.Duration
+}
+
+// NewRegistry returns nil registry when nothing is configured
+func NewRegistry(cfg RegistryConfig) (Registry, error) {
+	switch {
+	case cfg.URL != "" && cfg.File != "":
+		return nil, errors.New("schema registry URL and file are mutually exclusive")
+	case cfg.URL != "":
+		return NewHTTPRegistry(cfg)
+	case cfg.File != "":
+		return LoadFileRegistry(cfg.File)
+	default:
+		return nil, nil
+	}
+}
+
+// FileRegistry - schemas from a local file, stand-in for schema registry in tests and local runs
+type FileRegistry struct {
+	schemas map[int]*Schema
+}
+
+// file format:
+//
+//	{"schemas": [{"id": 1, "schemaType": "AVRO", "schema": "{...}"}, {"id": 2, "schemaType": "PROTOBUF", "schemaFile": "order.proto"}]}
+//
+// relative schemaFile is resolved against the directory of the registry file
+type registryFile struct {
+	Schemas []struct {
+		Schema
+		SchemaFile string `json:"schemaFile"`
+	} `json:"schemas"`
+}
+
+// LoadFileRegistry reads schemas from path
+func LoadFileRegistry(path string) (*FileRegistry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema registry file: %w", err)
+	}
+	var rf registryFile
+	if err := json.Unmarshal(data, &rf); err != nil {
+		return nil, fmt.Errorf("failed to decode schema registry file: %w", err)
+	}
+
+	r := &FileRegistry{schemas: make(map[int]*Schema, len(rf.Schemas))}
+	for _, s := range rf.Schemas {
+		if _, ok := r.schemas[s.ID]; ok {
+			return nil, fmt.Errorf("duplicate schema id %d", s.ID)
+		}
+		schema := s.Schema
+		if s.SchemaFile != "" {
+			file := s.SchemaFile
+			if !filepath.IsAbs(file) {
+				file = filepath.Join(filepath.Dir(path), file)
+			}
+			def, err := os.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("schema %d: %w", s.ID, err)
+			}
+			schema.Definition = string(def)
+		}
+		r.schemas[s.ID] = &schema
+	}
+	return r, nil
+}
+
+// Schema implements Registry
+func (r *FileRegistry) Schema(_ context.Context, id int) (*Schema, error) {
+	s, ok := r.schemas[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: id %d", ErrSchemaNotFound, id)
+	}
+	return s, nil
+}
+
+// HTTPRegistry - client of Confluent-compatible schema registry; schemas are immutable by ID, so they are cached forever
+type HTTPRegistry struct {
+	baseURL  string
+	username string
+	password string
+	client   *http.Client
+
+	mu    sync.Mutex
+	cache map[int]*Schema
+}
+
+// NewHTTPRegistry - cfg.Username and cfg.Password enable basic auth
+func NewHTTPRegistry(cfg RegistryConfig) (*HTTPRegistry, error) {
+	if _, err := url.ParseRequestURI(cfg.URL); err != nil {
+		return nil, fmt.Errorf("invalid schema registry URL: %w", err)
+	}
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	return &HTTPRegistry{
+		baseURL:  strings.TrimRight(cfg.URL, "/"),
+		username: cfg.Username,
+		password: cfg.Password,
+		client:   &http.Client{Timeout: timeout},
+		cache:    make(map[int]*Schema),
+	}, nil
+}
+
+// Schema implements Registry: GET /schemas/ids/{id}
+func (r *HTTPRegistry) Schema(ctx context.Context, id int) (*Schema, error) {
+	r.mu.Lock()
+	s, ok := r.cache[id]
+	r.mu.Unlock()
+	if ok {
+		return s, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.baseURL+"/schemas/ids/"+strconv.Itoa(id), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.schemaregistry.v1+json")
+	if r.username != "" {
+		req.SetBasicAuth(r.username, r.password)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: request failed: %w", ErrRegistryUnavailable, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, fmt.Errorf("%w: id %d", ErrSchemaNotFound, id)
+	case resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests:
+		return nil, fmt.Errorf("%w: answered %s", ErrRegistryUnavailable, resp.Status)
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("%w: answered %s", ErrRegistryRejected, resp.Status)
+	}
+	var schema Schema
+	if err := json.NewDecoder(resp.Body).Decode(&schema); err != nil {
+		return nil, fmt.Errorf("failed to decode schema registry response: %w", err)
+	}
+	schema.ID = id
+
+	r.mu.Lock()
+	r.cache[id] = &schema
+	r.mu.Unlock()
+	return &schema, nil
+}
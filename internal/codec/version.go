@@ -0,0 +1,155 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"orderservice/internal/messaging"
+	"orderservice/internal/model"
+)
+
+// SchemaVersionHeader - message header with version of the order schema; JSON and Avro payloads may carry
+// the version in SchemaVersionField instead
+const (
+	SchemaVersionHeader = "schema-version"
+	SchemaVersionField  = "schema_version"
+)
+
+// CurrentSchemaVersion - version of the contract described by model.Order; messages without version are version 1
+const CurrentSchemaVersion = 1
+
+var (
+	ErrFutureVersion  = errors.New("order schema version is newer than supported")
+	ErrInvalidVersion = errors.New("invalid order schema version")
+)
+
+// Upgrade converts JSON document of an order from its version to the next one
+type Upgrade func(doc map[string]any) error
+
+// upgrades - переходы между версиями схемы заказа: upgrades[v] переводит документ версии v в v+1.
+// При несовместимом изменении модели CurrentSchemaVersion увеличивается, а переход с предыдущей версии добавляется сюда
+var upgrades = map[int]Upgrade{}
+
+// DefaultVersions - upgrades of this build
+var DefaultVersions = mustVersions(CurrentSchemaVersion, upgrades)
+
+// Versions - chain of upgrades from the oldest supported version to the current one
+type Versions struct {
+	current  int
+	oldest   int
+	upgrades map[int]Upgrade
+}
+
+// NewVersions checks that upgrades form a chain ending at current: upgrades[v] converts version v into v+1;
+// versions older than the chain start are no longer accepted
+func NewVersions(current int, upgrades map[int]Upgrade) (*Versions, error) {
+	if current < 1 {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidVersion, current)
+	}
+	oldest := current
+	for oldest > 1 && upgrades[oldest-1] != nil {
+		oldest--
+	}
+	for v := range upgrades {
+		if v < oldest || v >= current {
+			return nil, fmt.Errorf("upgrade from version %d is not connected to current version %d", v, current)
+		}
+	}
+	return &Versions{current: current, oldest: oldest, upgrades: upgrades}, nil
+}
+
+func mustVersions(current int, upgrades map[int]Upgrade) *Versions {
+	v, err := NewVersions(current, upgrades)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// Current returns the version decoded orders are upgraded to
+func (v *Versions) Current() int {
+	return v.current
+}
+
+func (v *Versions) check(version int) error {
+	switch {
+	case version > v.current:
+		return fmt.Errorf("%w: version %d, supported %d-%d", ErrFutureVersion, version, v.oldest, v.current)
+	case version < v.oldest:
+		return fmt.Errorf("%w: version %d, supported %d-%d", ErrInvalidVersion, version, v.oldest, v.current)
+	}
+	return nil
+}
+
+// upgrade применяет переходы по очереди от версии документа до текущей
+func (v *Versions) upgrade(doc map[string]any, from int) error {
+	for version := from; version < v.current; version++ {
+		if err := v.upgrades[version](doc); err != nil {
+			return fmt.Errorf("upgrade from version %d: %w", version, err)
+		}
+	}
+	delete(doc, SchemaVersionField)
+	return nil
+}
+
+// headerVersion - версия из заголовка сообщения, ok=false если заголовка нет
+func headerVersion(msg *messaging.Message) (version int, ok bool, err error) {
+	raw, ok := msg.Header(SchemaVersionHeader)
+	if !ok || len(raw) == 0 {
+		return 0, false, nil
+	}
+	version, err = strconv.Atoi(strings.TrimSpace(string(raw)))
+	if err != nil {
+		return 0, false, fmt.Errorf("%w: header %q", ErrInvalidVersion, raw)
+	}
+	return version, true, nil
+}
+
+// decodeDocument - JSON-документ заказа(из JSON или Avro): версия берется из поля документа или заголовка,
+// при расхождении между ними сообщение отклоняется; старые версии поднимаются до текущей перед разбором в модель
+func (v *Versions) decodeDocument(data []byte, version int, hasVersion bool) (*model.Order, error) {
+	var probe struct {
+		SchemaVersion json.RawMessage `json:"schema_version"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return nil, err
+	}
+	if raw := string(probe.SchemaVersion); raw != "" && raw != "null" {
+		field, err := strconv.Atoi(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s %s", ErrInvalidVersion, SchemaVersionField, raw)
+		}
+		if hasVersion && field != version {
+			return nil, fmt.Errorf("%w: header says %d, payload says %d", ErrInvalidVersion, version, field)
+		}
+		version, hasVersion = field, true
+	}
+	if !hasVersion {
+		version = 1
+	}
+	if err := v.check(version); err != nil {
+		return nil, err
+	}
+	if version == v.current {
+		return decodeJSON(data)
+	}
+
+	var doc map[string]any
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if err := v.upgrade(doc, version); err != nil {
+		return nil, err
+	}
+	upgraded, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSON(upgraded)
+}
@@ -0,0 +1,164 @@
+package codec
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"os"
+	"strings"
+	"testing"
+
+	"orderservice/internal/messaging"
+)
+
+var update = flag.Bool("update", false, "regenerate schemas/order.schema.json")
+
+// testVersions - в версии 1 город доставки приходил полем town, в версии 2 поле sm_id называлось smid
+func testVersions(t *testing.T) *Versions {
+	t.Helper()
+	v, err := NewVersions(3, map[int]Upgrade{
+		1: func(doc map[string]any) error {
+			delivery, ok := doc["delivery"].(map[string]any)
+			if !ok {
+				return errors.New("delivery must be an object")
+			}
+			delivery["city"] = delivery["town"]
+			delete(delivery, "town")
+			return nil
+		},
+		2: func(doc map[string]any) error {
+			doc["sm_id"] = doc["smid"]
+			delete(doc, "smid")
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewVersions: %v", err)
+	}
+	return v
+}
+
+func versioned(value string, header string) *messaging.Message {
+	msg := &messaging.Message{Value: []byte(value)}
+	if header != "" {
+		msg.Headers = []messaging.Header{{Key: SchemaVersionHeader, Value: []byte(header)}}
+	}
+	return msg
+}
+
+func TestDecode_Versions(t *testing.T) {
+	d := NewDecoder(nil).WithVersions(testVersions(t))
+	v1 := `{"order_uid":"u1","delivery":{"town":"Moscow"},"smid":99}`
+	cases := []struct {
+		name string
+		msg  *messaging.Message
+	}{
+		{"no version is version 1", versioned(v1, "")},
+		{"version in header", versioned(v1, "1")},
+		{"version in payload", versioned(`{"schema_version":2,"order_uid":"u1","delivery":{"city":"Moscow"},"smid":99}`, "")},
+		{"current version", versioned(`{"schema_version":3,"order_uid":"u1","delivery":{"city":"Moscow"},"sm_id":99}`, "3")},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			order, _, err := d.Decode(context.Background(), c.msg)
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if order.OrderUID != "u1" || order.Delivery.City != "Moscow" || order.SMID != 99 {
+				t.Errorf("order was not upgraded: %+v", order)
+			}
+		})
+	}
+
+	// Avro проходит те же переходы, что и JSON
+	avroPayload := avroOrder(t, OrderAvroSchema)
+	msg := withContentType(avroPayload, "application/avro")
+	msg.Headers = append(msg.Headers, messaging.Header{Key: SchemaVersionHeader, Value: []byte("4")})
+	if _, _, err := d.Decode(context.Background(), msg); !errors.Is(err, ErrFutureVersion) {
+		t.Errorf("future Avro version: %v", err)
+	}
+}
+
+func TestDecode_RejectedVersions(t *testing.T) {
+	d := NewDecoder(nil)
+	cases := []struct {
+		name string
+		msg  *messaging.Message
+		want error
+	}{
+		{"future in payload", versioned(`{"schema_version":2,"order_uid":"u1"}`, ""), ErrFutureVersion},
+		{"future in header", versioned(`{"order_uid":"u1"}`, "2"), ErrFutureVersion},
+		{"future Protobuf", &messaging.Message{Value: protoOrder(), Headers: []messaging.Header{
+			{Key: ContentTypeHeader, Value: []byte("application/x-protobuf")}, {Key: SchemaVersionHeader, Value: []byte("9")},
+		}}, ErrFutureVersion},
+		{"zero", versioned(`{"schema_version":0}`, ""), ErrInvalidVersion},
+		{"not a number", versioned(`{"schema_version":"1"}`, ""), ErrInvalidVersion},
+		{"bad header", versioned(`{}`, "v1"), ErrInvalidVersion},
+		{"header and payload differ", versioned(`{"schema_version":1}`, "2"), ErrInvalidVersion},
+	}
+	for _, c := range cases {
+		if _, _, err := d.Decode(context.Background(), c.msg); !errors.Is(err, c.want) {
+			t.Errorf("%s: err = %v, want %v", c.name, err, c.want)
+		}
+	}
+}
+
+func TestNewVersions(t *testing.T) {
+	noop := func(map[string]any) error { return nil }
+
+	// версии старше начала цепочки больше не принимаются
+	v, err := NewVersions(3, map[int]Upgrade{2: noop})
+	if err != nil {
+		t.Fatalf("NewVersions: %v", err)
+	}
+	if err := v.check(1); !errors.Is(err, ErrInvalidVersion) {
+		t.Errorf("dropped version: %v", err)
+	}
+	if err := v.check(2); err != nil {
+		t.Errorf("supported version: %v", err)
+	}
+
+	if _, err := NewVersions(3, map[int]Upgrade{1: noop}); err == nil {
+		t.Error("gap in the chain must be rejected")
+	}
+	if _, err := NewVersions(1, map[int]Upgrade{1: noop}); err == nil {
+		t.Error("upgrade from current version must be rejected")
+	}
+}
+
+func TestOrderJSONSchema(t *testing.T) {
+	schema, err := OrderJSONSchema()
+	if err != nil {
+		t.Fatalf("OrderJSONSchema: %v", err)
+	}
+	for _, want := range []string{
+		`"required": [
+    "order_uid",`,
+		`"minItems": 1`,
+		`"format": "email"`,
+		`"const": 1`,
+	} {
+		if !strings.Contains(string(schema), want) {
+			t.Errorf("schema has no %s", want)
+		}
+	}
+	if strings.Contains(string(schema), "OrderUID") || strings.Contains(string(schema), `"index"`) {
+		t.Error("fields without json tag must not be in the schema")
+	}
+
+	// сгенерированная схема лежит в репозитории для продюсеров и должна совпадать с моделью
+	const path = "schemas/order.schema.json"
+	if *update {
+		if err := os.WriteFile(path, append(schema, '\n'), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	committed, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bytes.TrimSpace(committed), schema) {
+		t.Errorf("%s is out of date, run go test ./internal/codec -run TestOrderJSONSchema -update", path)
+	}
+}
@@ -2,7 +2,8 @@
 package db
 
 import (
-	"log"
+	"log/slog"
+	"os"
 
 	"orderservice/internal/model"
 
@@ -15,17 +16,22 @@ var models = []any{ // the order of tables is important
 	&model.Delivery{},
 	&model.Payment{},
 	&model.Item{},
+	&model.OrderAccess{},
+	&model.AuditEvent{},
+	&model.IdempotencyKey{},
 }
 
 // ConnectPostgres creates connection to Postres and runs automigration using structs from order.go
 func ConnectPostgres(dsn string) *gorm.DB {
 	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
 	if err != nil {
-		log.Fatalf("Cannot open db: %v", err)
+		slog.Error("Cannot open db", "error", err)
+		os.Exit(1)
 	}
 	if err := db.AutoMigrate(models...); err != nil {
-		log.Fatalf("Failed to migrate: %v", err)
+		slog.Error("Failed to migrate", "error", err)
+		os.Exit(1)
 	}
-	log.Println("Connected to Postgres")
+	slog.Info("Connected to Postgres")
 	return db
 }
@@ -2,51 +2,123 @@ package kafka
 
 import (
 	"context"
-	"log"
-	"sync"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
 	"time"
 
+	"orderservice/internal/kafkaconn"
+	"orderservice/internal/logger"
+	"orderservice/internal/messaging"
+	"orderservice/internal/metrics"
 	"orderservice/internal/service"
+	"orderservice/internal/tracing"
 
 	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// StartConsumer initializes listening to Kafka messages, which will be forwarded to Service-layer
-func StartConsumer(ctx context.Context, srv service.OrderService, broker, topic string, wg *sync.WaitGroup) {
-	defer wg.Done()
-	reader := NewKafkaReader(broker, topic)
+// StartConsumer reads messages from source and forwards them to Service-layer, a message is committed after processing;
+// source is closed on return. Fetching stops when ctx is done, the message in progress is processed and committed under drain:
+// cancelling drain aborts it, and the message is left uncommitted to be redelivered after restart.
+// It reports whether a message was abandoned this way
+func StartConsumer(ctx, drain context.Context, srv service.OrderService, source messaging.MessageSource) (abandoned bool) {
 	defer func() {
-		if err := reader.Close(); err != nil {
-			log.Println("Failed to close Kafa-reader:", err)
+		if err := source.Close(); err != nil {
+			slog.Error("Failed to close Kafka-reader", "error", err)
 		}
 	}()
 	for {
 		select {
 		case <-ctx.Done():
-			return
+			return false
 		default:
-			msg, err := reader.ReadMessage(ctx)
+			msg, err := source.Fetch(ctx)
 			if err != nil {
-				log.Printf("Kafka read error: %v", err)
+				if ctx.Err() != nil || errors.Is(err, messaging.ErrClosed) {
+					return false
+				}
+				slog.Error("Kafka read error", "error", err)
 				continue
 			}
-			srv.AddNewOrder(&msg)
-			if err := reader.CommitMessages(ctx, msg); err != nil {
-				log.Println("Failed to commit kafka-message:", err)
+			if !processMessage(drain, srv, msg, source.Commit) {
+				return true
 			}
 		}
 	}
 }
 
-// NewKafkaReader -
-func NewKafkaReader(broker, topic string) *kafka.Reader {
+// processMessage обрабатывает и коммитит сообщение(commit nil - без коммита), false - обработка прервана
+// по истечении времени на остановку
+func processMessage(drain context.Context, srv service.OrderService, msg messaging.Message,
+	commit func(ctx context.Context, msgs ...messaging.Message) error) bool {
+	metrics.MessagesConsumed.Inc()
+	metrics.ConsumerLag.WithLabelValues(msg.Topic, strconv.Itoa(msg.Partition)).Set(float64(msg.HighWaterMark - msg.Offset - 1))
+
+	// все логи жизненного цикла сообщения помечаются его координатами в топике
+	msgCtx := logger.WithCorrelationID(drain, fmt.Sprintf("kafka:%s/%d/%d", msg.Topic, msg.Partition, msg.Offset))
+	// продолжаем трейс продюсера, если он передал контекст в заголовках
+	msgCtx, span := tracing.Tracer().Start(tracing.ExtractKafka(msgCtx, &msg), "kafka.consume "+msg.Topic,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "kafka"),
+			attribute.String("messaging.destination.name", msg.Topic),
+			attribute.Int("messaging.kafka.partition", msg.Partition),
+			attribute.Int64("messaging.kafka.offset", msg.Offset),
+		))
+	defer span.End()
+	slog.DebugContext(msgCtx, "Kafka message received")
+	srv.AddNewOrder(msgCtx, &msg)
+	if err := drain.Err(); err != nil {
+		slog.WarnContext(msgCtx, "In-flight message abandoned on shutdown, it will be redelivered after restart")
+		tracing.RecordError(span, err)
+		metrics.ShutdownAbandoned.WithLabelValues("message").Inc()
+		return false
+	}
+	if commit == nil {
+		return true
+	}
+	if err := commit(drain, msg); err != nil {
+		slog.ErrorContext(msgCtx, "Failed to commit kafka-message", "error", err)
+		tracing.RecordError(span, err)
+	}
+	return true
+}
+
+// ConsumerConfig - consumer group of the service and fetch settings of its reader
+type ConsumerConfig struct {
+	GroupID        string
+	StartOffset    string // OffsetEarliest или OffsetLatest - откуда читать партиции, по которым группа еще ничего не закоммитила
+	MinBytes       int
+	MaxBytes       int
+	MaxWait        time.Duration
+	ClientID       string        // client id читателя в группе, по нему статус отличает реплики
+	StatusInterval time.Duration // период опроса брокера ConsumerMonitor
+}
+
+// NewKafkaReader - reader of the consumer group of the service, wrap it with messaging.NewKafkaSource
+func NewKafkaReader(conn *kafkaconn.Connector, topic string, cfg ConsumerConfig) *kafka.Reader {
+	startOffset := kafka.FirstOffset
+	if cfg.StartOffset == OffsetLatest {
+		startOffset = kafka.LastOffset
+	}
+	dialer := conn.Dialer()
+	if cfg.ClientID != "" {
+		// копия, чтобы не менять client id остальных клиентов соединения
+		d := *dialer
+		d.ClientID = cfg.ClientID
+		dialer = &d
+	}
 	return kafka.NewReader(kafka.ReaderConfig{
-		Brokers:     []string{broker},
+		Brokers:     conn.Brokers(),
+		Dialer:      dialer,
 		Topic:       topic,
-		GroupID:     "order-service",
-		MinBytes:    10e3,
-		MaxBytes:    10e6,
-		StartOffset: kafka.FirstOffset,
-		MaxWait:     1 * time.Second,
+		GroupID:     cfg.GroupID,
+		MinBytes:    cfg.MinBytes,
+		MaxBytes:    cfg.MaxBytes,
+		StartOffset: startOffset,
+		MaxWait:     cfg.MaxWait,
 	})
 }
@@ -0,0 +1,468 @@
+package kafka
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"orderservice/internal/cache"
+	"orderservice/internal/cloudevents"
+	"orderservice/internal/codec"
+	"orderservice/internal/messaging"
+	"orderservice/internal/mocks"
+	"orderservice/internal/model"
+	"orderservice/internal/repository"
+	"orderservice/internal/service"
+	"orderservice/internal/signature"
+
+	"gorm.io/gorm"
+)
+
+// memRepo - заказы в памяти; консюмеру нужны только запись с ключами идемпотентности и поиск по UID
+type memRepo struct {
+	repository.OrderRepository
+
+	mu     sync.Mutex
+	orders map[string]model.Order
+	keys   map[string]model.IdempotencyKey
+}
+
+func (r *memRepo) AddNewOrder(ctx context.Context, o *model.Order, keys ...model.IdempotencyKey) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, key := range keys {
+		if existing, ok := r.keys[key.Key]; ok {
+			return &repository.DuplicateError{Existing: existing}
+		}
+	}
+	if _, ok := r.orders[o.OrderUID]; ok {
+		return &repository.DuplicateError{Existing: model.IdempotencyKey{Key: model.OrderKey(o.OrderUID), OrderUID: o.OrderUID}}
+	}
+	for _, key := range keys {
+		r.keys[key.Key] = key
+	}
+	r.orders[o.OrderUID] = *o
+	return nil
+}
+
+func (r *memRepo) GetOrderByUID(ctx context.Context, uid string) (*model.Order, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	o, ok := r.orders[uid]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &o, nil
+}
+
+func (r *memRepo) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.orders)
+}
+
+type pipeline struct {
+	broker *messaging.Broker
+	repo   *memRepo
+	orders messaging.MessageSink
+}
+
+// startPipeline запускает консюмер с настоящим сервисом поверх брокера в памяти, DLQ и топик конфликтов в cfg подставляются
+func startPipeline(t *testing.T, cfg service.Config) *pipeline {
+	t.Helper()
+	b := messaging.NewBroker()
+	for _, topic := range []string{"orders", "orders-dlq", "orders-conflicts"} {
+		if err := b.CreateTopic(topic, 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+	repo := &memRepo{orders: make(map[string]model.Order), keys: make(map[string]model.IdempotencyKey)}
+	orderMap, err := cache.NewOrderMap(repo, cache.Config{Size: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.DLQ = b.Sink("orders-dlq")
+	cfg.Conflicts = b.Sink("orders-conflicts")
+	svc := service.NewOrderService(repo, orderMap, cfg)
+
+	source, err := b.Source("orders", "order-service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		StartConsumer(ctx, context.Background(), svc, source)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+	return &pipeline{broker: b, repo: repo, orders: b.Sink("orders")}
+}
+
+func (p *pipeline) publish(t *testing.T, msgs ...messaging.Message) {
+	t.Helper()
+	if err := p.orders.Publish(context.Background(), msgs...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitCommitted ждет, пока группа закоммитит все сообщения топика заказов
+func (p *pipeline) waitCommitted(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		done := true
+		for _, m := range p.broker.Messages("orders") {
+			if p.broker.Committed("orders", "order-service", m.Partition) <= m.Offset {
+				done = false
+			}
+		}
+		if done {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("messages were not committed in time")
+}
+
+func orderMessage(t *testing.T, o *model.Order) messaging.Message {
+	t.Helper()
+	raw, err := json.Marshal(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return messaging.Message{Key: []byte(o.OrderUID), Value: raw}
+}
+
+func TestConsumer_EndToEnd(t *testing.T) {
+	p := startPipeline(t, service.Config{})
+
+	valid := mocks.GenerateMockOrder()
+	invalid := mocks.GenerateMockOrder()
+	invalid.Delivery.Email = "not-an-email"
+	broken := messaging.Message{
+		Key:     []byte("broken"),
+		Value:   []byte(`{"order_uid":`),
+		Headers: []messaging.Header{{Key: "producer", Value: []byte("legacy")}},
+	}
+	keyless := messaging.Message{Value: []byte("not json")}
+	future := orderMessage(t, mocks.GenerateMockOrder())
+	future.Headers = []messaging.Header{{Key: codec.SchemaVersionHeader, Value: []byte(strconv.Itoa(codec.CurrentSchemaVersion + 1))}}
+	p.publish(t, orderMessage(t, valid), orderMessage(t, valid), orderMessage(t, invalid), broken, keyless, future)
+	p.waitCommitted(t)
+
+	// валидный заказ сохранен один раз, дубликат отброшен
+	if p.repo.count() != 1 {
+		t.Fatalf("saved orders = %d, want 1", p.repo.count())
+	}
+	if _, err := p.repo.GetOrderByUID(context.Background(), valid.OrderUID); err != nil {
+		t.Fatalf("valid order not saved: %v", err)
+	}
+
+	reasons := map[string]messaging.Message{}
+	var keylessInDLQ *messaging.Message
+	for _, m := range p.broker.Messages("orders-dlq") {
+		if string(m.Value) == "not json" {
+			keylessInDLQ = &m
+			continue
+		}
+		reason, _ := m.Header(service.DLQReasonHeader)
+		reasons[string(reason)] = m
+	}
+	if len(reasons) != 3 {
+		t.Fatalf("DLQ reasons = %v", reasons)
+	}
+	// сжимаемый DLQ требует ключ - сообщение без ключа получает координаты исходного
+	if keylessInDLQ == nil || !strings.HasPrefix(string(keylessInDLQ.Key), "orders/") {
+		t.Errorf("keyless message must get its coordinates as DLQ key, got %+v", keylessInDLQ)
+	}
+	if m := reasons["validation"]; string(m.Key) != invalid.OrderUID {
+		t.Errorf("invalid order must keep its key in DLQ, got %q", m.Key)
+	}
+	// заказ новой версии схемы не разбирается по старой модели, а откладывается до обновления сервиса
+	if m := reasons["schema_version"]; !bytes.Equal(m.Value, future.Value) {
+		t.Errorf("future schema version must go to DLQ as is, got %q", m.Value)
+	}
+	m := reasons["decode"]
+	if !bytes.Equal(m.Value, broken.Value) || string(m.Key) != "broken" {
+		t.Errorf("broken message must be forwarded as is, got %q/%q", m.Key, m.Value)
+	}
+	if v, ok := m.Header("producer"); !ok || string(v) != "legacy" {
+		t.Errorf("original headers must be kept in DLQ, got %v", m.Headers)
+	}
+	// DLQ - CloudEvents в binary-режиме: атрибуты в заголовках ce_
+	event, err := cloudevents.Parse(&m)
+	if err != nil || event == nil {
+		t.Fatalf("DLQ message must be a CloudEvent: %v", err)
+	}
+	if event.Type != service.EventTypeOrderRejected || event.Source != service.DefaultEventSource ||
+		event.Extensions["dlqreason"] != "decode" || event.Subject != "broken" {
+		t.Errorf("DLQ event %+v", event)
+	}
+}
+
+func TestConsumer_SignatureRejectedToDLQ(t *testing.T) {
+	keys := signature.Keys{"WBIL": {bytes.Repeat([]byte{3}, 32)}}
+	p := startPipeline(t, service.Config{Signatures: signature.NewVerifier(keys)})
+
+	signed := mocks.GenerateMockOrder()
+	if err := mocks.SignOrder(signed, keys); err != nil {
+		t.Fatal(err)
+	}
+	forged := mocks.GenerateMockOrder()
+	if err := mocks.SignOrder(forged, keys); err != nil {
+		t.Fatal(err)
+	}
+	forged.Payment.Amount *= 10 // подмена суммы после подписи
+
+	p.publish(t, orderMessage(t, signed), orderMessage(t, forged))
+	p.waitCommitted(t)
+
+	if p.repo.count() != 1 {
+		t.Fatalf("saved orders = %d, want only the correctly signed one", p.repo.count())
+	}
+	dlq := p.broker.Messages("orders-dlq")
+	if len(dlq) != 1 {
+		t.Fatalf("DLQ messages = %d", len(dlq))
+	}
+	if reason, _ := dlq[0].Header(service.DLQReasonHeader); string(reason) != "signature" || string(dlq[0].Key) != forged.OrderUID {
+		t.Errorf("DLQ message %q with reason %q", dlq[0].Key, reason)
+	}
+}
+
+func TestConsumer_CloudEvents(t *testing.T) {
+	p := startPipeline(t, service.Config{Events: cloudevents.Emitter{Source: "/orderservice/test", Mode: cloudevents.ModeStructured}})
+
+	structured := mocks.GenerateMockOrder()
+	binary := mocks.GenerateMockOrder()
+	// тот же id и source, что у первого события, но другой заказ - повтор события отбрасывается;
+	// ключ у обоих событий общий, чтобы они попали в одну партицию и читались по порядку
+	replayed := mocks.GenerateMockOrder()
+
+	structuredMsg := func(o *model.Order) messaging.Message {
+		data, err := json.Marshal(o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := &cloudevents.Event{ID: "evt-1", Source: "/checkout", Type: "com.example.order.created", DataContentType: "application/json", Data: data}
+		msg, err := e.Encode(cloudevents.ModeStructured, messaging.Message{Key: []byte("evt-1")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	binaryMsg := orderMessage(t, binary)
+	binaryMsg.Headers = []messaging.Header{
+		{Key: "ce_specversion", Value: []byte("1.0")}, {Key: "ce_id", Value: []byte("evt-2")},
+		{Key: "ce_source", Value: []byte("/checkout")}, {Key: "ce_type", Value: []byte("com.example.order.created")},
+		{Key: "content-type", Value: []byte("application/json")},
+	}
+	broken := messaging.Message{
+		Key:     []byte("no-id"),
+		Value:   []byte(`{"specversion":"1.0","source":"/checkout","type":"com.example.order.created","data":{}}`),
+		Headers: []messaging.Header{{Key: "content-type", Value: []byte(cloudevents.ContentType)}},
+	}
+	p.publish(t, structuredMsg(structured), binaryMsg, structuredMsg(replayed), broken)
+	p.waitCommitted(t)
+
+	if p.repo.count() != 2 {
+		t.Fatalf("saved orders = %d, want 2", p.repo.count())
+	}
+	saved, err := p.repo.GetOrderByUID(context.Background(), structured.OrderUID)
+	if err != nil {
+		t.Fatalf("structured event order not saved: %v", err)
+	}
+	if saved.EventSource != "/checkout" || saved.EventID != "evt-1" {
+		t.Errorf("event source and id must be stored with the order, got %q/%q", saved.EventSource, saved.EventID)
+	}
+	if _, err := p.repo.GetOrderByUID(context.Background(), binary.OrderUID); err != nil {
+		t.Errorf("binary event order not saved: %v", err)
+	}
+
+	dlq := p.broker.Messages("orders-dlq")
+	if len(dlq) != 1 {
+		t.Fatalf("DLQ messages = %d", len(dlq))
+	}
+	if ct, _ := dlq[0].Header("content-type"); string(ct) != cloudevents.ContentType {
+		t.Errorf("DLQ event must be structured, content-type %q", ct)
+	}
+	event, err := cloudevents.Parse(&dlq[0])
+	if err != nil {
+		t.Fatalf("DLQ event: %v", err)
+	}
+	if event.Source != "/orderservice/test" || event.Extensions["dlqreason"] != "cloudevent" || !bytes.Equal(event.Data, broken.Value) {
+		t.Errorf("DLQ event %+v", event)
+	}
+}
+
+// keyed - все сообщения с одним ключом попадают в одну партицию и обрабатываются по порядку
+func keyed(t *testing.T, key string, orders ...*model.Order) []messaging.Message {
+	t.Helper()
+	msgs := make([]messaging.Message, len(orders))
+	for i, o := range orders {
+		msgs[i] = orderMessage(t, o)
+		msgs[i].Key = []byte(key)
+	}
+	return msgs
+}
+
+func conflictEvents(t *testing.T, p *pipeline) []*cloudevents.Event {
+	t.Helper()
+	var events []*cloudevents.Event
+	for _, m := range p.broker.Messages("orders-conflicts") {
+		e, err := cloudevents.Parse(&m)
+		if err != nil || e == nil {
+			t.Fatalf("conflict message must be a CloudEvent: %v", err)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+func TestConsumer_DuplicatesAndConflicts(t *testing.T) {
+	p := startPipeline(t, service.Config{})
+
+	first := mocks.GenerateMockOrder()
+	sameTransaction := mocks.GenerateMockOrder()
+	sameTransaction.Payment.Transaction = first.Payment.Transaction
+	sameUID := mocks.GenerateMockOrder()
+	sameUID.OrderUID, sameUID.Payment.Transaction = first.OrderUID, "other-transaction"
+
+	p.publish(t, keyed(t, "checkout", first, first, sameTransaction, sameUID)...)
+	p.waitCommitted(t)
+
+	if p.repo.count() != 1 {
+		t.Fatalf("saved orders = %d, want 1", p.repo.count())
+	}
+	// повтор с тем же содержимым отбрасывается, остальные уходят в топик конфликтов
+	events := conflictEvents(t, p)
+	if len(events) != 2 {
+		t.Fatalf("conflict events = %d, want 2", len(events))
+	}
+	want := []string{model.PaymentKey(first.Payment.Transaction), model.OrderKey(first.OrderUID)}
+	for i, e := range events {
+		if e.Type != service.EventTypeOrderConflict || e.Extensions["conflictkey"] != want[i] ||
+			e.Extensions["existingorder"] != first.OrderUID || e.Extensions["duplicate"] != "conflicting" {
+			t.Errorf("conflict event %d: %+v", i, e)
+		}
+	}
+	if len(p.broker.Messages("orders-dlq")) != 0 {
+		t.Error("duplicates must not go to DLQ")
+	}
+}
+
+func TestConsumer_DuplicatePolicies(t *testing.T) {
+	p := startPipeline(t, service.Config{Idempotency: service.IdempotencyConfig{
+		MessageKey:  true,
+		Identical:   service.DuplicateConflict,
+		Conflicting: service.DuplicateSkip,
+	}})
+
+	first := mocks.GenerateMockOrder()
+	// другой заказ с тем же ключом сообщения - конфликт по идентичности сообщения, по политике отбрасывается
+	other := mocks.GenerateMockOrder()
+	p.publish(t, keyed(t, "message-1", first, first, other)...)
+	p.waitCommitted(t)
+
+	if p.repo.count() != 1 {
+		t.Fatalf("saved orders = %d, want 1", p.repo.count())
+	}
+	events := conflictEvents(t, p)
+	if len(events) != 1 || events[0].Extensions["duplicate"] != "identical" || events[0].Extensions["conflictkey"] != model.OrderKey(first.OrderUID) {
+		t.Fatalf("only the identical duplicate must be published, got %+v", events)
+	}
+}
+
+func TestConsumer_SharedMessageKeyIsNotIdentity(t *testing.T) {
+	// настройки по умолчанию: ключ сообщения не считается ключом идемпотентности
+	p := startPipeline(t, service.Config{})
+
+	// продюсер партиционирует по клиенту - разные заказы одного клиента идут с одним ключом
+	first, second := mocks.GenerateMockOrder(), mocks.GenerateMockOrder()
+	p.publish(t, keyed(t, "customer-42", first, second)...)
+	p.waitCommitted(t)
+
+	if p.repo.count() != 2 {
+		t.Fatalf("saved orders = %d, want 2", p.repo.count())
+	}
+	if events := conflictEvents(t, p); len(events) != 0 {
+		t.Fatalf("distinct orders sharing a message key must not conflict, got %+v", events)
+	}
+}
+
+// blockingService - сервис, который держит сообщение до release или до отмены контекста сообщения
+type blockingService struct {
+	service.OrderService
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingService) AddNewOrder(ctx context.Context, msg *messaging.Message) {
+	close(s.started)
+	select {
+	case <-s.release:
+	case <-ctx.Done():
+	}
+}
+
+// startBlockingConsumer - в канал приходит результат StartConsumer, брошено ли сообщение
+func startBlockingConsumer(t *testing.T, drain context.Context) (*messaging.Broker, *blockingService, context.CancelFunc, <-chan bool) {
+	t.Helper()
+	b := messaging.NewBroker()
+	if err := b.CreateTopic("orders", 1); err != nil {
+		t.Fatal(err)
+	}
+	source, err := b.Source("orders", "order-service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Sink("orders").Publish(context.Background(), messaging.Message{Value: []byte(`{}`)}); err != nil {
+		t.Fatal(err)
+	}
+	svc := &blockingService{started: make(chan struct{}), release: make(chan struct{})}
+	ctx, stop := context.WithCancel(context.Background())
+	abandoned := make(chan bool, 1)
+	go func() { abandoned <- StartConsumer(ctx, drain, svc, source) }()
+	<-svc.started
+	return b, svc, stop, abandoned
+}
+
+func TestConsumer_ShutdownFinishesInFlightMessage(t *testing.T) {
+	b, svc, stop, abandoned := startBlockingConsumer(t, context.Background())
+
+	// остановка чтения не прерывает обработку уже прочитанного сообщения
+	stop()
+	time.Sleep(20 * time.Millisecond)
+	close(svc.release)
+	if <-abandoned {
+		t.Error("finished message must not be reported as abandoned")
+	}
+
+	if got := b.Committed("orders", "order-service", 0); got != 1 {
+		t.Fatalf("in-flight message must be committed on shutdown, committed offset = %d", got)
+	}
+}
+
+func TestConsumer_ShutdownDrainTimeout(t *testing.T) {
+	drain, abort := context.WithCancel(context.Background())
+	b, _, stop, abandoned := startBlockingConsumer(t, drain)
+
+	stop()
+	abort()
+	if !<-abandoned {
+		t.Error("aborted message must be reported as abandoned")
+	}
+
+	if got := b.Committed("orders", "order-service", 0); got != 0 {
+		t.Fatalf("abandoned message must stay uncommitted, committed offset = %d", got)
+	}
+}
@@ -2,45 +2,264 @@
 package kafka
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"orderservice/internal/kafkaconn"
+
 	"github.com/segmentio/kafka-go"
 )
 
-// InitKafkaTopics - cerates topics for orders: the main one and DLQ
-func InitKafkaTopics(broker, topic, topicDLQ string) {
-	topics := []kafka.TopicConfig{{
-		Topic:             topic,
-		NumPartitions:     3,
-		ReplicationFactor: 1,
-	}, {
-		Topic:             topicDLQ,
-		NumPartitions:     3,
-		ReplicationFactor: 1,
-	}}
-
-	topicsCreated := false
-
-	for !topicsCreated {
-		conn, err := kafka.Dial("tcp", broker)
+// Cleanup policies of topics
+const (
+	CleanupDelete        = "delete"
+	CleanupCompact       = "compact"
+	CleanupCompactDelete = "compact,delete"
+)
+
+// настройки топика, которые сверяются со спецификацией
+const (
+	configCleanupPolicy = "cleanup.policy"
+	configRetentionMs   = "retention.ms"
+)
+
+// TopicSpec - desired state of a topic
+type TopicSpec struct {
+	Name              string
+	Partitions        int
+	ReplicationFactor int
+	Retention         time.Duration // 0 - значение брокера по умолчанию
+	CleanupPolicy     string        // пусто - значение брокера по умолчанию
+}
+
+// Drift - setting of an existing topic differing from its spec; Fixed is set when the service brought it in line
+type Drift struct {
+	Topic   string
+	Setting string
+	Want    string
+	Got     string
+	Fixed   bool
+}
+
+// topicState - фактическое состояние существующего топика
+type topicState struct {
+	Partitions        int
+	ReplicationFactor int
+	Configs           map[string]string
+}
+
+// topicAdmin - административные операции с кластером, в тестах подменяется
+type topicAdmin interface {
+	describe(ctx context.Context, names []string) (map[string]topicState, error)
+	create(ctx context.Context, specs []TopicSpec) error
+	grow(ctx context.Context, topic string, partitions int) error
+}
+
+// InitKafkaTopics - creates missing topics and reports drift of existing ones, retrying until the cluster answers
+func InitKafkaTopics(kc *kafkaconn.Connector, specs []TopicSpec, growPartitions bool) {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		drifts, err := EnsureTopics(ctx, kc, specs, growPartitions)
+		cancel()
 		if err != nil {
-			log.Println("Failed to dial broker:", err)
+			slog.Warn("Failed to reconcile topics, retrying in 5s...", "error", err)
 			time.Sleep(5 * time.Second)
 			continue
 		}
-		defer func() {
-			if err := conn.Close(); err != nil {
-				log.Println("Failed to close reader connection to Kafka:", err)
+		for _, d := range drifts {
+			if d.Fixed {
+				slog.Info("Topic brought in line with config", "topic", d.Topic, "setting", d.Setting, "was", d.Got, "now", d.Want)
+			} else {
+				slog.Warn("Topic differs from config", "topic", d.Topic, "setting", d.Setting, "want", d.Want, "got", d.Got)
 			}
-		}()
+		}
+		slog.Info("Topics are ready", "topics", len(specs), "drifts", len(drifts))
+		return
+	}
+}
 
-		if err := conn.CreateTopics(topics...); err != nil {
-			log.Println("Failed to create topics:", err)
-			time.Sleep(5 * time.Second)
+// EnsureTopics creates missing topics, compares existing ones with specs and, if growPartitions is set,
+// adds missing partitions; partitions cannot be removed and replication is not changed - such drift is only reported
+func EnsureTopics(ctx context.Context, kc *kafkaconn.Connector, specs []TopicSpec, growPartitions bool) ([]Drift, error) {
+	return reconcileTopics(ctx, clientAdmin{client: kc.Client()}, specs, growPartitions)
+}
+
+func reconcileTopics(ctx context.Context, admin topicAdmin, specs []TopicSpec, growPartitions bool) ([]Drift, error) {
+	names := make([]string, len(specs))
+	for i, s := range specs {
+		names[i] = s.Name
+	}
+	existing, err := admin.describe(ctx, names)
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []TopicSpec
+	var drifts []Drift
+	for _, spec := range specs {
+		state, ok := existing[spec.Name]
+		if !ok {
+			missing = append(missing, spec)
+			continue
+		}
+		topicDrifts, err := compareTopic(ctx, admin, spec, state, growPartitions)
+		drifts = append(drifts, topicDrifts...)
+		if err != nil {
+			return drifts, err
+		}
+	}
+
+	if len(missing) > 0 {
+		if err := admin.create(ctx, missing); err != nil {
+			return drifts, err
+		}
+		for _, spec := range missing {
+			slog.Info("Topic created", "topic", spec.Name, "partitions", spec.Partitions, "replication_factor", spec.ReplicationFactor)
+		}
+	}
+	return drifts, nil
+}
+
+func compareTopic(ctx context.Context, admin topicAdmin, spec TopicSpec, state topicState, growPartitions bool) ([]Drift, error) {
+	var drifts []Drift
+	if state.Partitions != spec.Partitions {
+		d := Drift{Topic: spec.Name, Setting: "partitions", Want: strconv.Itoa(spec.Partitions), Got: strconv.Itoa(state.Partitions)}
+		// уменьшить число партиций Kafka не позволяет
+		if growPartitions && state.Partitions < spec.Partitions {
+			if err := admin.grow(ctx, spec.Name, spec.Partitions); err != nil {
+				return append(drifts, d), fmt.Errorf("failed to add partitions to %s: %w", spec.Name, err)
+			}
+			d.Fixed = true
+		}
+		drifts = append(drifts, d)
+	}
+	if state.ReplicationFactor != spec.ReplicationFactor {
+		drifts = append(drifts, Drift{Topic: spec.Name, Setting: "replication_factor", Want: strconv.Itoa(spec.ReplicationFactor), Got: strconv.Itoa(state.ReplicationFactor)})
+	}
+	if spec.CleanupPolicy != "" && normalizePolicy(state.Configs[configCleanupPolicy]) != normalizePolicy(spec.CleanupPolicy) {
+		drifts = append(drifts, Drift{Topic: spec.Name, Setting: configCleanupPolicy, Want: spec.CleanupPolicy, Got: state.Configs[configCleanupPolicy]})
+	}
+	if want := retentionMs(spec.Retention); want != "" && state.Configs[configRetentionMs] != want {
+		drifts = append(drifts, Drift{Topic: spec.Name, Setting: configRetentionMs, Want: want, Got: state.Configs[configRetentionMs]})
+	}
+	return drifts, nil
+}
+
+// configEntries - настройки, с которыми создается топик
+func (s TopicSpec) configEntries() []kafka.ConfigEntry {
+	var entries []kafka.ConfigEntry
+	if s.CleanupPolicy != "" {
+		entries = append(entries, kafka.ConfigEntry{ConfigName: configCleanupPolicy, ConfigValue: s.CleanupPolicy})
+	}
+	if ms := retentionMs(s.Retention); ms != "" {
+		entries = append(entries, kafka.ConfigEntry{ConfigName: configRetentionMs, ConfigValue: ms})
+	}
+	return entries
+}
+
+func retentionMs(d time.Duration) string {
+	if d <= 0 {
+		return ""
+	}
+	return strconv.FormatInt(d.Milliseconds(), 10)
+}
+
+// normalizePolicy - "delete,compact" и "compact, delete" одна и та же политика
+func normalizePolicy(p string) string {
+	parts := strings.Split(p, ",")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+// clientAdmin - реализация через kafka.Client: запросы на создание топиков и партиций транспорт kafka-go
+// отправляет контроллеру кластера
+type clientAdmin struct {
+	client *kafka.Client
+}
+
+func (a clientAdmin) describe(ctx context.Context, names []string) (map[string]topicState, error) {
+	meta, err := a.client.Metadata(ctx, &kafka.MetadataRequest{Topics: names})
+	if err != nil {
+		return nil, err
+	}
+	states := make(map[string]topicState, len(names))
+	var resources []kafka.DescribeConfigRequestResource
+	for _, t := range meta.Topics {
+		if errors.Is(t.Error, kafka.UnknownTopicOrPartition) {
 			continue
 		}
-		log.Println("Topics successfully created!")
-		topicsCreated = true
+		if t.Error != nil {
+			return nil, fmt.Errorf("metadata of topic %s: %w", t.Name, t.Error)
+		}
+		state := topicState{Partitions: len(t.Partitions), Configs: map[string]string{}}
+		if len(t.Partitions) > 0 {
+			state.ReplicationFactor = len(t.Partitions[0].Replicas)
+		}
+		states[t.Name] = state
+		resources = append(resources, kafka.DescribeConfigRequestResource{
+			ResourceType: kafka.ResourceTypeTopic,
+			ResourceName: t.Name,
+			ConfigNames:  []string{configCleanupPolicy, configRetentionMs},
+		})
+	}
+	if len(resources) == 0 {
+		return states, nil
+	}
+
+	configs, err := a.client.DescribeConfigs(ctx, &kafka.DescribeConfigsRequest{Resources: resources})
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range configs.Resources {
+		if r.Error != nil {
+			return nil, fmt.Errorf("configs of topic %s: %w", r.ResourceName, r.Error)
+		}
+		for _, e := range r.ConfigEntries {
+			states[r.ResourceName].Configs[e.ConfigName] = e.ConfigValue
+		}
+	}
+	return states, nil
+}
+
+func (a clientAdmin) create(ctx context.Context, specs []TopicSpec) error {
+	topics := make([]kafka.TopicConfig, len(specs))
+	for i, s := range specs {
+		topics[i] = kafka.TopicConfig{
+			Topic:             s.Name,
+			NumPartitions:     s.Partitions,
+			ReplicationFactor: s.ReplicationFactor,
+			ConfigEntries:     s.configEntries(),
+		}
+	}
+	res, err := a.client.CreateTopics(ctx, &kafka.CreateTopicsRequest{Topics: topics})
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for name, err := range res.Errors {
+		// топик мог создать соседний экземпляр сервиса между проверкой и созданием
+		if err != nil && !errors.Is(err, kafka.TopicAlreadyExists) {
+			errs = append(errs, fmt.Errorf("failed to create topic %s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (a clientAdmin) grow(ctx context.Context, topic string, partitions int) error {
+	res, err := a.client.CreatePartitions(ctx, &kafka.CreatePartitionsRequest{
+		Topics: []kafka.TopicPartitionsConfig{{Name: topic, Count: int32(partitions)}},
+	})
+	if err != nil {
+		return err
 	}
+	return res.Errors[topic]
 }
@@ -0,0 +1,124 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeAdmin - кластер в памяти
+type fakeAdmin struct {
+	topics  map[string]topicState
+	created []TopicSpec
+	grown   map[string]int
+	growErr error
+}
+
+func (f *fakeAdmin) describe(ctx context.Context, names []string) (map[string]topicState, error) {
+	res := map[string]topicState{}
+	for _, n := range names {
+		if s, ok := f.topics[n]; ok {
+			res[n] = s
+		}
+	}
+	return res, nil
+}
+
+func (f *fakeAdmin) create(ctx context.Context, specs []TopicSpec) error {
+	f.created = append(f.created, specs...)
+	return nil
+}
+
+func (f *fakeAdmin) grow(ctx context.Context, topic string, partitions int) error {
+	if f.growErr != nil {
+		return f.growErr
+	}
+	f.grown[topic] = partitions
+	return nil
+}
+
+func testSpecs() []TopicSpec {
+	return []TopicSpec{
+		{Name: "orders", Partitions: 6, ReplicationFactor: 3, CleanupPolicy: CleanupDelete},
+		{Name: "orders-dlq", Partitions: 3, ReplicationFactor: 3, Retention: 7 * 24 * time.Hour, CleanupPolicy: CleanupCompactDelete},
+	}
+}
+
+func TestReconcileTopics_CreatesMissing(t *testing.T) {
+	admin := &fakeAdmin{topics: map[string]topicState{
+		"orders": {Partitions: 6, ReplicationFactor: 3, Configs: map[string]string{configCleanupPolicy: "delete"}},
+	}, grown: map[string]int{}}
+
+	drifts, err := reconcileTopics(context.Background(), admin, testSpecs(), false)
+	if err != nil {
+		t.Fatalf("reconcileTopics: %v", err)
+	}
+	if len(drifts) != 0 {
+		t.Errorf("topic matching spec must have no drift, got %+v", drifts)
+	}
+	if len(admin.created) != 1 || admin.created[0].Name != "orders-dlq" {
+		t.Fatalf("created = %+v", admin.created)
+	}
+
+	entries := map[string]string{}
+	for _, e := range admin.created[0].configEntries() {
+		entries[e.ConfigName] = e.ConfigValue
+	}
+	if entries[configCleanupPolicy] != "compact,delete" || entries[configRetentionMs] != "604800000" {
+		t.Errorf("DLQ config entries = %v", entries)
+	}
+}
+
+func TestReconcileTopics_Drift(t *testing.T) {
+	existing := func() map[string]topicState {
+		return map[string]topicState{
+			"orders": {Partitions: 3, ReplicationFactor: 1, Configs: map[string]string{configCleanupPolicy: "delete"}},
+			// порядок политик в настройке брокера не важен
+			"orders-dlq": {Partitions: 5, ReplicationFactor: 3, Configs: map[string]string{configCleanupPolicy: "delete,compact", configRetentionMs: "86400000"}},
+		}
+	}
+
+	// без разрешения на рост только отчет
+	admin := &fakeAdmin{topics: existing(), grown: map[string]int{}}
+	drifts, err := reconcileTopics(context.Background(), admin, testSpecs(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]Drift{}
+	for _, d := range drifts {
+		got[d.Topic+" "+d.Setting] = d
+	}
+	want := []string{"orders partitions", "orders replication_factor", "orders-dlq partitions", "orders-dlq retention.ms"}
+	if len(got) != len(want) {
+		t.Fatalf("drifts = %+v", drifts)
+	}
+	for _, k := range want {
+		if d, ok := got[k]; !ok || d.Fixed {
+			t.Errorf("expected unfixed drift %q, got %+v", k, d)
+		}
+	}
+	if len(admin.created) != 0 || len(admin.grown) != 0 {
+		t.Errorf("existing topics must not be recreated or grown: %+v %+v", admin.created, admin.grown)
+	}
+
+	// с разрешением партиции добавляются, но не удаляются
+	admin = &fakeAdmin{topics: existing(), grown: map[string]int{}}
+	drifts, err = reconcileTopics(context.Background(), admin, testSpecs(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if admin.grown["orders"] != 6 || len(admin.grown) != 1 {
+		t.Errorf("grown = %v", admin.grown)
+	}
+	for _, d := range drifts {
+		if d.Setting == "partitions" && d.Fixed != (d.Topic == "orders") {
+			t.Errorf("drift %+v", d)
+		}
+	}
+
+	admin = &fakeAdmin{topics: existing(), grown: map[string]int{}, growErr: errors.New("not controller")}
+	if _, err := reconcileTopics(context.Background(), admin, testSpecs(), true); err == nil {
+		t.Error("failed partition growth must be reported")
+	}
+}
@@ -0,0 +1,378 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"orderservice/internal/kafkaconn"
+	"orderservice/internal/messaging"
+	"orderservice/internal/service"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Positions of the consumer group: earliest and latest are also start offsets of partitions without committed offset
+const (
+	OffsetEarliest  = "earliest"
+	OffsetLatest    = "latest"
+	OffsetTimestamp = "timestamp"
+	OffsetExplicit  = "explicit"
+)
+
+// ErrGroupActive - offsets of a group with members can not be reset, the service must be stopped first
+var ErrGroupActive = errors.New("consumer group has active members")
+
+// OffsetReset - target position of the consumer group: Timestamp is used by OffsetTimestamp,
+// Offsets by partition by OffsetExplicit, partitions missing from Offsets are left as they are
+type OffsetReset struct {
+	Mode      string
+	Timestamp time.Time
+	Offsets   map[int]int64
+}
+
+// PartitionPosition - position of the group on a partition: Earliest is the first available offset, Latest - the high
+// watermark, Committed is -1 when the group has committed nothing; Target is set by ResetOffsets
+type PartitionPosition struct {
+	Partition int
+	Earliest  int64
+	Latest    int64
+	Committed int64
+	Target    int64
+}
+
+// Lag - messages of the partition not yet processed by the group
+func (p PartitionPosition) Lag() int64 {
+	if p.Committed < 0 {
+		return p.Latest - p.Earliest
+	}
+	return p.Latest - p.Committed
+}
+
+// offsetAdmin - запросы смещений и коммиты группы, в тестах подменяется
+type offsetAdmin interface {
+	partitions(ctx context.Context, topic string) ([]int, error)
+	// listOffsets - смещения по kafka.FirstOffset, kafka.LastOffset или времени в миллисекундах;
+	// -1, если после этого времени сообщений нет
+	listOffsets(ctx context.Context, topic string, partitions []int, at int64) (map[int]int64, error)
+	committed(ctx context.Context, group, topic string, partitions []int) (map[int]int64, error)
+	members(ctx context.Context, group string) (int, error)
+	commit(ctx context.Context, group, topic string, offsets map[int]int64) error
+	// assignments - client id участника группы по каждой назначенной партиции topic
+	assignments(ctx context.Context, group, topic string) (map[int]string, error)
+}
+
+// DescribeGroup returns watermarks and committed offsets of the group on every partition of topic
+func DescribeGroup(ctx context.Context, kc *kafkaconn.Connector, group, topic string) ([]PartitionPosition, error) {
+	return describeGroup(ctx, clientAdmin{client: kc.Client()}, group, topic)
+}
+
+// ResetOffsets computes target offsets of the group and commits them unless dryRun; the group must have no members,
+// otherwise ErrGroupActive is returned. Offsets at a timestamp are the first ones written at or after it
+func ResetOffsets(ctx context.Context, kc *kafkaconn.Connector, group, topic string, reset OffsetReset, dryRun bool) ([]PartitionPosition, error) {
+	return resetOffsets(ctx, clientAdmin{client: kc.Client()}, group, topic, reset, dryRun)
+}
+
+func describeGroup(ctx context.Context, admin offsetAdmin, group, topic string) ([]PartitionPosition, error) {
+	partitions, err := admin.partitions(ctx, topic)
+	if err != nil {
+		return nil, err
+	}
+	earliest, err := admin.listOffsets(ctx, topic, partitions, kafka.FirstOffset)
+	if err != nil {
+		return nil, err
+	}
+	latest, err := admin.listOffsets(ctx, topic, partitions, kafka.LastOffset)
+	if err != nil {
+		return nil, err
+	}
+	committed, err := admin.committed(ctx, group, topic, partitions)
+	if err != nil {
+		return nil, err
+	}
+	positions := make([]PartitionPosition, len(partitions))
+	for i, p := range partitions {
+		positions[i] = PartitionPosition{Partition: p, Earliest: earliest[p], Latest: latest[p], Committed: committed[p], Target: committed[p]}
+	}
+	return positions, nil
+}
+
+func resetOffsets(ctx context.Context, admin offsetAdmin, group, topic string, reset OffsetReset, dryRun bool) ([]PartitionPosition, error) {
+	positions, err := describeGroup(ctx, admin, group, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	switch reset.Mode {
+	case OffsetEarliest:
+		for i := range positions {
+			positions[i].Target = positions[i].Earliest
+		}
+	case OffsetLatest:
+		for i := range positions {
+			positions[i].Target = positions[i].Latest
+		}
+	case OffsetTimestamp:
+		partitions := make([]int, len(positions))
+		for i, p := range positions {
+			partitions[i] = p.Partition
+		}
+		at, err := admin.listOffsets(ctx, topic, partitions, reset.Timestamp.UnixMilli())
+		if err != nil {
+			return nil, err
+		}
+		for i, p := range positions {
+			// после указанного времени в партицию ничего не писали - читать с конца
+			positions[i].Target = p.Latest
+			if offset, ok := at[p.Partition]; ok && offset >= 0 {
+				positions[i].Target = offset
+			}
+		}
+	case OffsetExplicit:
+		if len(reset.Offsets) == 0 {
+			return nil, errors.New("no partition offsets given")
+		}
+		for partition, offset := range reset.Offsets {
+			i := slices.IndexFunc(positions, func(p PartitionPosition) bool { return p.Partition == partition })
+			if i < 0 {
+				return nil, fmt.Errorf("topic %s has no partition %d", topic, partition)
+			}
+			if p := positions[i]; offset < p.Earliest || offset > p.Latest {
+				return nil, fmt.Errorf("offset %d of partition %d is out of range [%d, %d]", offset, partition, p.Earliest, p.Latest)
+			}
+			positions[i].Target = offset
+		}
+	default:
+		return nil, fmt.Errorf("unknown offset reset mode %q", reset.Mode)
+	}
+
+	if dryRun {
+		return positions, nil
+	}
+	// смещения активной группы перезапишет первый же коммит ее участников
+	members, err := admin.members(ctx, group)
+	if err != nil {
+		return nil, err
+	}
+	if members > 0 {
+		return nil, fmt.Errorf("%w: %s has %d members", ErrGroupActive, group, members)
+	}
+	offsets := make(map[int]int64)
+	for _, p := range positions {
+		if p.Target >= 0 && p.Target != p.Committed {
+			offsets[p.Partition] = p.Target
+		}
+	}
+	if len(offsets) == 0 {
+		return positions, nil
+	}
+	if err := admin.commit(ctx, group, topic, offsets); err != nil {
+		return nil, err
+	}
+	return positions, nil
+}
+
+// Replay re-ingests messages of topic written since from and before until(zero - up to the moment of the call) through srv.
+// Partitions are read directly without a consumer group, so offsets of the service are untouched; orders already saved
+// are recognized by their idempotency keys and handled as duplicates. Returns the number of processed messages
+func Replay(ctx context.Context, kc *kafkaconn.Connector, topic string, cfg ConsumerConfig, from, until time.Time, srv service.OrderService) (int, error) {
+	ranges, err := replayRanges(ctx, clientAdmin{client: kc.Client()}, topic, from, until)
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, r := range ranges {
+		reader := kafka.NewReader(kafka.ReaderConfig{
+			Brokers:   kc.Brokers(),
+			Dialer:    kc.Dialer(),
+			Topic:     topic,
+			Partition: r.Partition,
+			MinBytes:  cfg.MinBytes,
+			MaxBytes:  cfg.MaxBytes,
+			MaxWait:   cfg.MaxWait,
+		})
+		if err := reader.SetOffset(r.Earliest); err != nil {
+			reader.Close()
+			return total, err
+		}
+		source := messaging.NewKafkaSource(reader)
+		n, err := replayPartition(ctx, srv, source, r.Latest)
+		total += n
+		if closeErr := source.Close(); closeErr != nil {
+			slog.Error("Failed to close Kafka-reader", "error", closeErr)
+		}
+		if err != nil {
+			return total, err
+		}
+		slog.Info("Partition replayed", "topic", topic, "partition", r.Partition, "from_offset", r.Earliest, "to_offset", r.Latest, "messages", n)
+	}
+	return total, nil
+}
+
+// replayRanges - смещения сообщений, записанных в [from, until), по партициям; Earliest - начало, Latest - конец диапазона
+func replayRanges(ctx context.Context, admin offsetAdmin, topic string, from, until time.Time) ([]PartitionPosition, error) {
+	partitions, err := admin.partitions(ctx, topic)
+	if err != nil {
+		return nil, err
+	}
+	latest, err := admin.listOffsets(ctx, topic, partitions, kafka.LastOffset)
+	if err != nil {
+		return nil, err
+	}
+	start, err := admin.listOffsets(ctx, topic, partitions, from.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	end := latest
+	if !until.IsZero() {
+		if end, err = admin.listOffsets(ctx, topic, partitions, until.UnixMilli()); err != nil {
+			return nil, err
+		}
+	}
+
+	var ranges []PartitionPosition
+	for _, p := range partitions {
+		first, last := start[p], end[p]
+		if last < 0 {
+			last = latest[p]
+		}
+		if first < 0 || first >= last {
+			continue
+		}
+		ranges = append(ranges, PartitionPosition{Partition: p, Earliest: first, Latest: last, Committed: -1, Target: -1})
+	}
+	return ranges, nil
+}
+
+// replayPartition обрабатывает сообщения партиции до смещения end(не включая) без коммитов
+func replayPartition(ctx context.Context, srv service.OrderService, source messaging.MessageSource, end int64) (int, error) {
+	n := 0
+	for {
+		msg, err := source.Fetch(ctx)
+		if err != nil {
+			return n, err
+		}
+		if msg.Offset >= end {
+			return n, nil
+		}
+		if !processMessage(ctx, srv, msg, nil) {
+			return n, ctx.Err()
+		}
+		n++
+		if msg.Offset == end-1 {
+			return n, nil
+		}
+	}
+}
+
+func (a clientAdmin) partitions(ctx context.Context, topic string) ([]int, error) {
+	meta, err := a.client.Metadata(ctx, &kafka.MetadataRequest{Topics: []string{topic}})
+	if err != nil {
+		return nil, err
+	}
+	if len(meta.Topics) != 1 {
+		return nil, fmt.Errorf("no metadata of topic %s", topic)
+	}
+	if err := meta.Topics[0].Error; err != nil {
+		return nil, fmt.Errorf("topic %s: %w", topic, err)
+	}
+	partitions := make([]int, 0, len(meta.Topics[0].Partitions))
+	for _, p := range meta.Topics[0].Partitions {
+		partitions = append(partitions, p.ID)
+	}
+	slices.Sort(partitions)
+	return partitions, nil
+}
+
+func (a clientAdmin) listOffsets(ctx context.Context, topic string, partitions []int, at int64) (map[int]int64, error) {
+	requests := make([]kafka.OffsetRequest, len(partitions))
+	for i, p := range partitions {
+		requests[i] = kafka.OffsetRequest{Partition: p, Timestamp: at}
+	}
+	res, err := a.client.ListOffsets(ctx, &kafka.ListOffsetsRequest{Topics: map[string][]kafka.OffsetRequest{topic: requests}})
+	if err != nil {
+		return nil, err
+	}
+	offsets := make(map[int]int64, len(partitions))
+	for _, p := range res.Topics[topic] {
+		if p.Error != nil {
+			return nil, fmt.Errorf("offsets of %s/%d: %w", topic, p.Partition, p.Error)
+		}
+		switch at {
+		case kafka.FirstOffset:
+			offsets[p.Partition] = p.FirstOffset
+		case kafka.LastOffset:
+			offsets[p.Partition] = p.LastOffset
+		default:
+			// kafka-go раскладывает ответ по меткам времени: найденное смещение - в Offsets,
+			// а "сообщений после этого времени нет"(метка -1) - в LastOffset
+			offsets[p.Partition] = -1
+			for offset := range p.Offsets {
+				offsets[p.Partition] = offset
+			}
+		}
+	}
+	return offsets, nil
+}
+
+func (a clientAdmin) committed(ctx context.Context, group, topic string, partitions []int) (map[int]int64, error) {
+	res, err := a.client.OffsetFetch(ctx, &kafka.OffsetFetchRequest{GroupID: group, Topics: map[string][]int{topic: partitions}})
+	if err != nil {
+		return nil, err
+	}
+	if res.Error != nil {
+		return nil, fmt.Errorf("committed offsets of group %s: %w", group, res.Error)
+	}
+	committed := make(map[int]int64, len(partitions))
+	for _, p := range partitions {
+		committed[p] = -1
+	}
+	for _, p := range res.Topics[topic] {
+		if p.Error != nil {
+			return nil, fmt.Errorf("committed offset of %s/%d: %w", topic, p.Partition, p.Error)
+		}
+		committed[p.Partition] = p.CommittedOffset
+	}
+	return committed, nil
+}
+
+func (a clientAdmin) members(ctx context.Context, group string) (int, error) {
+	res, err := a.client.DescribeGroups(ctx, &kafka.DescribeGroupsRequest{GroupIDs: []string{group}})
+	if err != nil {
+		return 0, err
+	}
+	for _, g := range res.Groups {
+		if g.GroupID == group {
+			if g.Error != nil {
+				return 0, fmt.Errorf("group %s: %w", group, g.Error)
+			}
+			return len(g.Members), nil
+		}
+	}
+	return 0, nil
+}
+
+func (a clientAdmin) commit(ctx context.Context, group, topic string, offsets map[int]int64) error {
+	commits := make([]kafka.OffsetCommit, 0, len(offsets))
+	for p, offset := range offsets {
+		commits = append(commits, kafka.OffsetCommit{Partition: p, Offset: offset})
+	}
+	// группа без участников принимает коммит вне поколения
+	res, err := a.client.OffsetCommit(ctx, &kafka.OffsetCommitRequest{
+		GroupID:      group,
+		GenerationID: -1,
+		Topics:       map[string][]kafka.OffsetCommit{topic: commits},
+	})
+	if err != nil {
+		return err
+	}
+	for _, p := range res.Topics[topic] {
+		if p.Error != nil {
+			return fmt.Errorf("commit of %s/%d: %w", topic, p.Partition, p.Error)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"orderservice/internal/cache"
+	"orderservice/internal/messaging"
+	"orderservice/internal/mocks"
+	"orderservice/internal/model"
+	"orderservice/internal/service"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// fakeOffsetAdmin - две партиции: в 0 доступны смещения 10..20, в 1 - 0..5; по времени - смещения из byTime
+type fakeOffsetAdmin struct {
+	committedOffsets map[int]int64
+	byTime           map[int64]map[int]int64
+	activeMembers    int
+	commits          []map[int]int64
+	owners           map[int]string
+	err              error // ошибка assignments - брокер недоступен
+}
+
+func (f *fakeOffsetAdmin) partitions(ctx context.Context, topic string) ([]int, error) {
+	return []int{0, 1}, nil
+}
+
+func (f *fakeOffsetAdmin) listOffsets(ctx context.Context, topic string, partitions []int, at int64) (map[int]int64, error) {
+	switch at {
+	case kafka.FirstOffset:
+		return map[int]int64{0: 10, 1: 0}, nil
+	case kafka.LastOffset:
+		return map[int]int64{0: 20, 1: 5}, nil
+	}
+	offsets := map[int]int64{0: -1, 1: -1}
+	for p, o := range f.byTime[at] {
+		offsets[p] = o
+	}
+	return offsets, nil
+}
+
+func (f *fakeOffsetAdmin) committed(ctx context.Context, group, topic string, partitions []int) (map[int]int64, error) {
+	committed := map[int]int64{0: -1, 1: -1}
+	for p, o := range f.committedOffsets {
+		committed[p] = o
+	}
+	return committed, nil
+}
+
+func (f *fakeOffsetAdmin) members(ctx context.Context, group string) (int, error) {
+	return f.activeMembers, nil
+}
+
+func (f *fakeOffsetAdmin) commit(ctx context.Context, group, topic string, offsets map[int]int64) error {
+	f.commits = append(f.commits, offsets)
+	return nil
+}
+
+func (f *fakeOffsetAdmin) assignments(ctx context.Context, group, topic string) (map[int]string, error) {
+	return f.owners, f.err
+}
+
+func targets(positions []PartitionPosition) map[int]int64 {
+	res := make(map[int]int64, len(positions))
+	for _, p := range positions {
+		res[p.Partition] = p.Target
+	}
+	return res
+}
+
+func TestResetOffsets(t *testing.T) {
+	at := time.Date(2025, 10, 1, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name  string
+		reset OffsetReset
+		want  map[int]int64
+	}{
+		{"earliest", OffsetReset{Mode: OffsetEarliest}, map[int]int64{0: 10, 1: 0}},
+		{"latest", OffsetReset{Mode: OffsetLatest}, map[int]int64{0: 20, 1: 5}},
+		// в партицию 1 после этого времени не писали - читать с конца
+		{"timestamp", OffsetReset{Mode: OffsetTimestamp, Timestamp: at}, map[int]int64{0: 15, 1: 5}},
+		{"explicit", OffsetReset{Mode: OffsetExplicit, Offsets: map[int]int64{1: 3}}, map[int]int64{0: 12, 1: 3}},
+	}
+	for _, c := range cases {
+		admin := &fakeOffsetAdmin{
+			committedOffsets: map[int]int64{0: 12},
+			byTime:           map[int64]map[int]int64{at.UnixMilli(): {0: 15}},
+		}
+		positions, err := resetOffsets(context.Background(), admin, "order-service", "orders", c.reset, true)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		got := targets(positions)
+		if got[0] != c.want[0] || got[1] != c.want[1] {
+			t.Errorf("%s: targets %v, want %v", c.name, got, c.want)
+		}
+		if positions[0].Lag() != 8 || positions[1].Lag() != 5 {
+			t.Errorf("%s: lag of current position %d, %d", c.name, positions[0].Lag(), positions[1].Lag())
+		}
+		if len(admin.commits) != 0 {
+			t.Errorf("%s: dry run must not commit", c.name)
+		}
+	}
+}
+
+func TestResetOffsets_Execute(t *testing.T) {
+	admin := &fakeOffsetAdmin{committedOffsets: map[int]int64{0: 10}}
+	if _, err := resetOffsets(context.Background(), admin, "order-service", "orders", OffsetReset{Mode: OffsetEarliest}, false); err != nil {
+		t.Fatal(err)
+	}
+	// партиция 0 уже на нужном смещении
+	if len(admin.commits) != 1 || len(admin.commits[0]) != 1 || admin.commits[0][1] != 0 {
+		t.Fatalf("commits = %v", admin.commits)
+	}
+
+	admin = &fakeOffsetAdmin{activeMembers: 2}
+	if _, err := resetOffsets(context.Background(), admin, "order-service", "orders", OffsetReset{Mode: OffsetLatest}, false); !errors.Is(err, ErrGroupActive) {
+		t.Fatalf("err = %v, want ErrGroupActive", err)
+	}
+	if len(admin.commits) != 0 {
+		t.Fatal("offsets of an active group must not be committed")
+	}
+
+	for name, offsets := range map[string]map[int]int64{
+		"unknown partition": {2: 0},
+		"below earliest":    {0: 5},
+		"above latest":      {1: 6},
+	} {
+		reset := OffsetReset{Mode: OffsetExplicit, Offsets: offsets}
+		if _, err := resetOffsets(context.Background(), &fakeOffsetAdmin{}, "order-service", "orders", reset, false); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestReplayRanges(t *testing.T) {
+	from := time.Date(2025, 10, 1, 0, 0, 0, 0, time.UTC)
+	until := from.Add(time.Hour)
+	admin := &fakeOffsetAdmin{byTime: map[int64]map[int]int64{
+		from.UnixMilli():  {0: 12, 1: 2},
+		until.UnixMilli(): {0: 18},
+	}}
+
+	ranges, err := replayRanges(context.Background(), admin, "orders", from, until)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// в партиции 1 после until сообщений нет - читаем до конца
+	if len(ranges) != 2 || ranges[0].Earliest != 12 || ranges[0].Latest != 18 || ranges[1].Earliest != 2 || ranges[1].Latest != 5 {
+		t.Fatalf("ranges = %+v", ranges)
+	}
+
+	ranges, err = replayRanges(context.Background(), admin, "orders", until.Add(time.Hour), time.Time{})
+	if err != nil || len(ranges) != 0 {
+		t.Fatalf("nothing was written after from, got %+v, %v", ranges, err)
+	}
+}
+
+func TestReplayPartition_Idempotent(t *testing.T) {
+	b := messaging.NewBroker()
+	for _, topic := range []string{"orders", "orders-dlq", "orders-conflicts"} {
+		if err := b.CreateTopic(topic, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	repo := &memRepo{orders: make(map[string]model.Order), keys: make(map[string]model.IdempotencyKey)}
+	orderMap, err := cache.NewOrderMap(repo, cache.Config{Size: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := service.NewOrderService(repo, orderMap, service.Config{DLQ: b.Sink("orders-dlq"), Conflicts: b.Sink("orders-conflicts")})
+
+	var msgs []messaging.Message
+	for range 3 {
+		msgs = append(msgs, orderMessage(t, mocks.GenerateMockOrder()))
+	}
+	if err := b.Sink("orders").Publish(context.Background(), msgs...); err != nil {
+		t.Fatal(err)
+	}
+
+	// повторный прогон тех же сообщений не создает заказов и не публикует конфликтов
+	for i, group := range []string{"replay-1", "replay-2"} {
+		source, err := b.Source("orders", group)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := replayPartition(context.Background(), svc, source, 2)
+		if err != nil || n != 2 {
+			t.Fatalf("replay %d: %d messages, %v", i, n, err)
+		}
+		if b.Committed("orders", group, 0) != 0 {
+			t.Fatalf("replay %d must not commit offsets", i)
+		}
+		source.Close()
+	}
+	if repo.count() != 2 {
+		t.Fatalf("saved orders = %d, want 2 - messages up to the end offset", repo.count())
+	}
+	if len(b.Messages("orders-conflicts")) != 0 || len(b.Messages("orders-dlq")) != 0 {
+		t.Fatal("identical replayed orders must be skipped")
+	}
+}
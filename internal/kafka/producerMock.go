@@ -4,32 +4,34 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
-	"fmt"
-	"log"
+	"log/slog"
 	"os"
+	"strconv"
 	"time"
 
+	"orderservice/internal/codec"
+	"orderservice/internal/kafkaconn"
+	"orderservice/internal/messaging"
 	"orderservice/internal/mocks"
+	"orderservice/internal/model"
+	"orderservice/internal/signature"
+	"orderservice/internal/tracing"
 
-	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // EmulateMsgSending used to emulate real messages flow to test the app in real-time with real DB;
-// mock json-data is read from file and generated using faker-package
-func EmulateMsgSending(broker, topic string) {
-	mockWriter := kafka.Writer{
-		Addr:  kafka.TCP(broker),
-		Topic: topic,
-	}
-
+// mock json-data is read from file and generated using faker-package; with non-empty keys orders are signed
+func EmulateMsgSending(sink messaging.MessageSink, keys signature.Keys) {
 	// чтение заказов из json-файла - 5 валидных, 2 дубликата и 3 невалидных
 	file, err := os.Open("./internal/kafka/mocks.jsonl")
 	if err != nil {
-		log.Fatalf("Failed to open json-mocks file: %v\nExiting application.", err)
+		slog.Error("Failed to open json-mocks file, exiting application", "error", err)
+		os.Exit(1)
 	}
 	defer func() {
 		if err := file.Close(); err != nil {
-			log.Println("Failed to close mock-file:", err)
+			slog.Error("Failed to close mock-file", "error", err)
 		}
 	}()
 
@@ -39,58 +41,91 @@ func EmulateMsgSending(broker, topic string) {
 		time.Sleep(1 * time.Second)
 		counter++
 		line := scanner.Bytes()
-		err = mockWriter.WriteMessages(context.Background(), kafka.Message{
-			Value: line,
-		})
+		if len(keys) > 0 {
+			line = signMockLine(line, keys)
+		}
+		msg := newTracedMessage(line)
+		err = sink.Publish(context.Background(), msg)
 		for err != nil {
-			log.Printf("Failed to publish test order #%d: %v", counter, err)
-			log.Printf("Retrying to send order #%d...", counter)
+			slog.Warn("Failed to publish test order, retrying", "order", counter, "error", err)
 			time.Sleep(5 * time.Second)
-			err = mockWriter.WriteMessages(context.Background(), kafka.Message{
-				Value: line,
-			})
+			err = sink.Publish(context.Background(), msg)
 		}
 
-		log.Printf("Order #%d published to Kafka", counter)
+		slog.Info("Test order published to Kafka", "order", counter)
 	}
 
 	// начинаем генерацию 10 заказов через Faker
-	fmt.Println("\nInitiating fake orders generation...")
+	slog.Info("Initiating fake orders generation...")
 	for i := range 10 {
-		order, err := json.Marshal(mocks.GenerateMockOrder())
+		fake := mocks.GenerateMockOrder()
+		if len(keys) > 0 {
+			if err := mocks.SignOrder(fake, keys); err != nil {
+				slog.Error("Fake order signing failed", "order", i, "error", err)
+			}
+		}
+		order, err := json.Marshal(fake)
 		if err != nil {
-			log.Printf("Fake order marshalling #%d failed: %v", i, err)
+			slog.Error("Fake order marshalling failed", "order", i, "error", err)
 			continue
 		}
 
-		err = mockWriter.WriteMessages(context.Background(), kafka.Message{
-			Value: order,
-		})
+		msg := newTracedMessage(order)
+		err = sink.Publish(context.Background(), msg)
 		for err != nil {
-			log.Printf("Failed to publish fake order #%d: %v", i, err)
-			log.Printf("Retrying to send fake order #%d...", i)
+			slog.Warn("Failed to publish fake order, retrying", "order", i, "error", err)
 			time.Sleep(5 * time.Second)
-			err = mockWriter.WriteMessages(context.Background(), kafka.Message{
-				Value: order,
-			})
+			err = sink.Publish(context.Background(), msg)
 		}
 
-		log.Printf("Fake order #%d published to Kafka\n", i)
+		slog.Info("Fake order published to Kafka", "order", i)
 		time.Sleep(2 * time.Second)
 	}
 }
 
+// signMockLine signs an order from mock-file; lines that are not orders are sent as is to check DLQ
+func signMockLine(line []byte, keys signature.Keys) []byte {
+	var order model.Order
+	if err := json.Unmarshal(line, &order); err != nil {
+		return line
+	}
+	if err := mocks.SignOrder(&order, keys); err != nil {
+		slog.Error("Mock order signing failed", "order_uid", order.OrderUID, "error", err)
+		return line
+	}
+	signed, err := json.Marshal(&order)
+	if err != nil {
+		return line
+	}
+	return signed
+}
+
+// newTracedMessage starts a producer span for the mock message, so a trace begins before the order reaches the consumer
+func newTracedMessage(value []byte) messaging.Message {
+	ctx, span := tracing.Tracer().Start(context.Background(), "kafka.produce mock-order", trace.WithSpanKind(trace.SpanKindProducer))
+	defer span.End()
+	msg := messaging.Message{
+		Value: value,
+		Headers: []messaging.Header{
+			{Key: codec.ContentTypeHeader, Value: []byte("application/json")},
+			{Key: codec.SchemaVersionHeader, Value: []byte(strconv.Itoa(codec.CurrentSchemaVersion))},
+		},
+	}
+	tracing.InjectKafka(ctx, &msg)
+	return msg
+}
+
 // WaitKafkaReady - timeout given to kafka-service for getting fully functional
-func WaitKafkaReady(broker string) {
+func WaitKafkaReady(kc *kafkaconn.Connector) {
 	for {
-		conn, err := kafka.Dial("tcp", broker)
+		conn, err := kc.Dial(context.Background())
 		if err == nil {
 			if errConn := conn.Close(); errConn != nil {
-				log.Println("Failed to close connection after testing Kafka readyness:", errConn)
+				slog.Error("Failed to close connection after testing Kafka readiness", "error", errConn)
 			}
 			break
 		}
-		log.Println("Kafka not ready, retrying in 5s...")
+		slog.Warn("Kafka not ready, retrying in 5s...")
 		time.Sleep(5 * time.Second)
 	}
 	time.Sleep(25 * time.Second)
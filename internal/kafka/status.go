@@ -0,0 +1,263 @@
+package kafka
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"orderservice/internal/kafkaconn"
+	"orderservice/internal/messaging"
+	"orderservice/internal/metrics"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// PartitionStatus - state of a partition of the orders topic: assignment, committed offset, high watermark and lag
+// come from the broker, LastProcessed and Rate - from processing of this replica
+type PartitionStatus struct {
+	Partition       int        `json:"partition"`
+	AssignedReplica string     `json:"assigned_replica"` // client id участника группы, пусто - партиция не назначена
+	AssignedHere    bool       `json:"assigned_here"`
+	CommittedOffset int64      `json:"committed_offset"` // -1 - группа ничего не коммитила
+	HighWatermark   int64      `json:"high_watermark"`
+	Lag             int64      `json:"lag"`
+	LastProcessed   *time.Time `json:"last_processed,omitempty"`
+	Rate            float64    `json:"rate"` // сообщений в секунду между двумя последними обновлениями
+}
+
+// ReaderStatus - kafka-go reader statistics, counters are totals since the start of the replica
+type ReaderStatus struct {
+	Messages    int64 `json:"messages"`
+	Bytes       int64 `json:"bytes"`
+	Rebalances  int64 `json:"rebalances"`
+	Errors      int64 `json:"errors"`
+	Timeouts    int64 `json:"timeouts"`
+	QueueLength int64 `json:"queue_length"`
+	Lag         int64 `json:"lag"` // оценка читателя по последнему полученному сообщению
+}
+
+// ConsumerStatus - snapshot of the consumer group on the orders topic as seen by this replica
+type ConsumerStatus struct {
+	Group      string            `json:"group"`
+	Topic      string            `json:"topic"`
+	Replica    string            `json:"replica"`
+	UpdatedAt  time.Time         `json:"updated_at"`
+	Error      string            `json:"error,omitempty"` // последняя ошибка опроса брокера, данные - с прошлого успешного
+	Partitions []PartitionStatus `json:"partitions"`
+	Reader     *ReaderStatus     `json:"reader,omitempty"`
+}
+
+// ConsumerMonitor periodically polls the broker for group assignment, committed offsets and watermarks, collects
+// reader statistics and processing activity of this replica recorded by the source returned from Observe
+type ConsumerMonitor struct {
+	admin   offsetAdmin
+	group   string
+	topic   string
+	replica string
+	stats   func() kafka.ReaderStats // nil - без статистики читателя
+
+	mu       sync.Mutex
+	activity map[int]*partitionActivity
+	reader   ReaderStatus
+	status   ConsumerStatus
+	polledAt time.Time
+}
+
+// partitionActivity - обработка сообщений партиции этой репликой
+type partitionActivity struct {
+	processed     int64
+	lastProcessed time.Time
+	polled        int64 // processed на момент прошлого обновления, для расчета скорости
+}
+
+// NewConsumerMonitor - monitor of the group cfg.GroupID on topic, replicas are told apart by cfg.ClientID;
+// reader is the reader of the consumer, nil - without reader statistics
+func NewConsumerMonitor(kc *kafkaconn.Connector, topic string, cfg ConsumerConfig, reader *kafka.Reader) *ConsumerMonitor {
+	var stats func() kafka.ReaderStats
+	if reader != nil {
+		stats = reader.Stats
+	}
+	return newConsumerMonitor(clientAdmin{client: kc.Client()}, cfg.GroupID, topic, cfg.ClientID, stats)
+}
+
+func newConsumerMonitor(admin offsetAdmin, group, topic, replica string, stats func() kafka.ReaderStats) *ConsumerMonitor {
+	return &ConsumerMonitor{
+		admin:    admin,
+		group:    group,
+		topic:    topic,
+		replica:  replica,
+		stats:    stats,
+		activity: make(map[int]*partitionActivity),
+		status:   ConsumerStatus{Group: group, Topic: topic, Replica: replica, Partitions: []PartitionStatus{}},
+	}
+}
+
+// Observe returns source recording every committed message as processed by this replica
+func (m *ConsumerMonitor) Observe(source messaging.MessageSource) messaging.MessageSource {
+	return observedSource{MessageSource: source, monitor: m}
+}
+
+type observedSource struct {
+	messaging.MessageSource
+	monitor *ConsumerMonitor
+}
+
+// Commit - сообщение обработано, даже если коммит не удался
+func (s observedSource) Commit(ctx context.Context, msgs ...messaging.Message) error {
+	s.monitor.processed(msgs...)
+	return s.MessageSource.Commit(ctx, msgs...)
+}
+
+func (m *ConsumerMonitor) processed(msgs ...messaging.Message) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, msg := range msgs {
+		a, ok := m.activity[msg.Partition]
+		if !ok {
+			a = &partitionActivity{}
+			m.activity[msg.Partition] = a
+		}
+		a.processed++
+		a.lastProcessed = now
+		partition := strconv.Itoa(msg.Partition)
+		metrics.KafkaPartitionProcessed.WithLabelValues(m.topic, partition).Inc()
+		metrics.KafkaPartitionLastProcessed.WithLabelValues(m.topic, partition).Set(float64(now.UnixMilli()) / 1000)
+	}
+}
+
+// Run refreshes the status every interval until ctx is done
+func (m *ConsumerMonitor) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		m.refresh(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Status returns the last refreshed status
+func (m *ConsumerMonitor) Status() ConsumerStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status := m.status
+	status.Partitions = append([]PartitionStatus(nil), m.status.Partitions...)
+	if status.Reader != nil {
+		reader := *status.Reader
+		status.Reader = &reader
+	}
+	return status
+}
+
+// refresh опрашивает брокер; при ошибке остаются данные прошлого успешного опроса
+func (m *ConsumerMonitor) refresh(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	positions, err := describeGroup(ctx, m.admin, m.group, m.topic)
+	var owners map[int]string
+	if err == nil {
+		owners, err = m.admin.assignments(ctx, m.group, m.topic)
+	}
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.refreshReader()
+	m.status.UpdatedAt = now
+	if err != nil {
+		if ctx.Err() == nil || m.status.Error == "" {
+			slog.Warn("Failed to refresh consumer group status", "group", m.group, "topic", m.topic, "error", err)
+		}
+		m.status.Error = err.Error()
+		return
+	}
+	m.status.Error = ""
+
+	elapsed := now.Sub(m.polledAt).Seconds()
+	partitions := make([]PartitionStatus, len(positions))
+	for i, p := range positions {
+		ps := PartitionStatus{
+			Partition:       p.Partition,
+			AssignedReplica: owners[p.Partition],
+			AssignedHere:    owners[p.Partition] == m.replica,
+			CommittedOffset: p.Committed,
+			HighWatermark:   p.Latest,
+			Lag:             p.Lag(),
+		}
+		if a, ok := m.activity[p.Partition]; ok {
+			last := a.lastProcessed
+			ps.LastProcessed = &last
+			if !m.polledAt.IsZero() && elapsed > 0 {
+				ps.Rate = float64(a.processed-a.polled) / elapsed
+			}
+			a.polled = a.processed
+		}
+		partitions[i] = ps
+
+		partition := strconv.Itoa(p.Partition)
+		assigned := 0.0
+		if ps.AssignedHere {
+			assigned = 1
+		}
+		metrics.KafkaPartitionAssigned.WithLabelValues(m.topic, partition).Set(assigned)
+		metrics.KafkaPartitionCommittedOffset.WithLabelValues(m.topic, partition).Set(float64(ps.CommittedOffset))
+		metrics.KafkaPartitionHighWatermark.WithLabelValues(m.topic, partition).Set(float64(ps.HighWatermark))
+		metrics.KafkaPartitionGroupLag.WithLabelValues(m.topic, partition).Set(float64(ps.Lag))
+		metrics.KafkaPartitionRate.WithLabelValues(m.topic, partition).Set(ps.Rate)
+	}
+	m.status.Partitions = partitions
+	m.polledAt = now
+}
+
+// refreshReader - Stats читателя kafka-go сбрасывает счетчики при каждом вызове, поэтому они накапливаются здесь;
+// вызывается под mu
+func (m *ConsumerMonitor) refreshReader() {
+	if m.stats == nil {
+		return
+	}
+	s := m.stats()
+	m.reader.Messages += s.Messages
+	m.reader.Bytes += s.Bytes
+	m.reader.Rebalances += s.Rebalances
+	m.reader.Errors += s.Errors
+	m.reader.Timeouts += s.Timeouts
+	m.reader.QueueLength = s.QueueLength
+	m.reader.Lag = s.Lag
+	metrics.KafkaReaderRebalances.Add(float64(s.Rebalances))
+	metrics.KafkaReaderErrors.Add(float64(s.Errors))
+	reader := m.reader
+	m.status.Reader = &reader
+}
+
+func (a clientAdmin) assignments(ctx context.Context, group, topic string) (map[int]string, error) {
+	res, err := a.client.DescribeGroups(ctx, &kafka.DescribeGroupsRequest{GroupIDs: []string{group}})
+	if err != nil {
+		return nil, err
+	}
+	owners := make(map[int]string)
+	for _, g := range res.Groups {
+		if g.GroupID != group {
+			continue
+		}
+		if g.Error != nil {
+			return nil, g.Error
+		}
+		for _, member := range g.Members {
+			for _, t := range member.MemberAssignments.Topics {
+				if t.Topic != topic {
+					continue
+				}
+				for _, p := range t.Partitions {
+					owners[p] = member.ClientID
+				}
+			}
+		}
+	}
+	return owners, nil
+}
@@ -0,0 +1,76 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"orderservice/internal/messaging"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestConsumerMonitor(t *testing.T) {
+	b := messaging.NewBroker()
+	if err := b.CreateTopic("orders", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Sink("orders").Publish(context.Background(), messaging.Message{Value: []byte("a")}, messaging.Message{Value: []byte("b")}); err != nil {
+		t.Fatal(err)
+	}
+
+	admin := &fakeOffsetAdmin{committedOffsets: map[int]int64{0: 12}, owners: map[int]string{0: "replica-1", 1: "replica-2"}}
+	// Stats читателя сбрасывает счетчики - монитор должен их суммировать
+	stats := func() kafka.ReaderStats { return kafka.ReaderStats{Messages: 2, Rebalances: 1, QueueLength: 3} }
+	m := newConsumerMonitor(admin, "order-service", "orders", "replica-1", stats)
+	m.refresh(context.Background())
+
+	source, err := b.Source("orders", "order-service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	observed := m.Observe(source)
+	for range 2 {
+		msg, err := observed.Fetch(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := observed.Commit(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if b.Committed("orders", "order-service", 0) != 2 {
+		t.Fatal("observed source must commit to the wrapped one")
+	}
+	m.refresh(context.Background())
+
+	status := m.Status()
+	if status.Group != "order-service" || status.Replica != "replica-1" || status.Error != "" || len(status.Partitions) != 2 {
+		t.Fatalf("status = %+v", status)
+	}
+	p0, p1 := status.Partitions[0], status.Partitions[1]
+	if !p0.AssignedHere || p0.AssignedReplica != "replica-1" || p0.CommittedOffset != 12 || p0.HighWatermark != 20 || p0.Lag != 8 {
+		t.Errorf("partition 0 = %+v", p0)
+	}
+	if p0.LastProcessed == nil || p0.Rate <= 0 {
+		t.Errorf("partition 0 processed by this replica, got last %v, rate %v", p0.LastProcessed, p0.Rate)
+	}
+	if p1.AssignedHere || p1.AssignedReplica != "replica-2" || p1.CommittedOffset != -1 || p1.Lag != 5 || p1.LastProcessed != nil || p1.Rate != 0 {
+		t.Errorf("partition 1 = %+v", p1)
+	}
+	if status.Reader == nil || status.Reader.Messages != 4 || status.Reader.Rebalances != 2 || status.Reader.QueueLength != 3 {
+		t.Errorf("reader = %+v", status.Reader)
+	}
+
+	// без новых сообщений скорость падает до нуля, ошибка опроса оставляет прошлые данные
+	m.refresh(context.Background())
+	if rate := m.Status().Partitions[0].Rate; rate != 0 {
+		t.Errorf("rate without processed messages = %v", rate)
+	}
+	admin.err = errors.New("broker unavailable")
+	m.refresh(context.Background())
+	status = m.Status()
+	if status.Error == "" || len(status.Partitions) != 2 || status.Partitions[0].CommittedOffset != 12 {
+		t.Errorf("status after failed refresh = %+v", status)
+	}
+}
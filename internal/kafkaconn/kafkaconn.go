@@ -0,0 +1,186 @@
+// Package kafkaconn - shared connection settings for every Kafka reader, writer and admin connection of the app:
+// broker list, TLS with client certificates and SASL(PLAIN/SCRAM) authentication
+package kafkaconn
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+// SASL mechanisms
+const (
+	MechanismNone        = ""
+	MechanismPlain       = "PLAIN"
+	MechanismScramSHA256 = "SCRAM-SHA-256"
+	MechanismScramSHA512 = "SCRAM-SHA-512"
+)
+
+// таймаут установки соединения с брокером, как у kafka.DefaultDialer
+const dialTimeout = 10 * time.Second
+
+// Config - how to reach the cluster
+type Config struct {
+	Brokers []string
+	TLS     TLSConfig
+	SASL    SASLConfig
+}
+
+// TLSConfig - CAFile empty means system roots, CertFile and KeyFile are set together for client certificate auth
+type TLSConfig struct {
+	Enabled            bool
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+// SASLConfig - Mechanism empty disables SASL
+type SASLConfig struct {
+	Mechanism string
+	Username  string
+	Password  string
+}
+
+// Connector builds readers, writers and admin connections with the same brokers, TLS and SASL settings
+type Connector struct {
+	brokers   []string
+	dialer    *kafka.Dialer
+	transport *kafka.Transport
+}
+
+// New validates cfg and loads certificates, so misconfiguration is reported at startup
+func New(cfg Config) (*Connector, error) {
+	if len(cfg.Brokers) == 0 {
+		return nil, errors.New("no Kafka brokers configured")
+	}
+	tlsCfg, err := newTLSConfig(cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+	mechanism, err := newMechanism(cfg.SASL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Connector{
+		brokers: cfg.Brokers,
+		dialer: &kafka.Dialer{
+			Timeout:       dialTimeout,
+			DualStack:     true,
+			TLS:           tlsCfg,
+			SASLMechanism: mechanism,
+		},
+		transport: &kafka.Transport{
+			Dial:        (&net.Dialer{Timeout: dialTimeout}).DialContext,
+			DialTimeout: dialTimeout,
+			TLS:         tlsCfg,
+			SASL:        mechanism,
+		},
+	}, nil
+}
+
+// Brokers returns bootstrap brokers
+func (c *Connector) Brokers() []string {
+	return c.brokers
+}
+
+// Dialer - for kafka.ReaderConfig and admin connections
+func (c *Connector) Dialer() *kafka.Dialer {
+	return c.dialer
+}
+
+// Writer returns a writer to topic; writes go to partition leaders discovered through any of the brokers
+func (c *Connector) Writer(topic string) *kafka.Writer {
+	return &kafka.Writer{
+		Addr:      kafka.TCP(c.brokers...),
+		Topic:     topic,
+		Transport: c.transport,
+	}
+}
+
+// Dial connects to the first available broker
+func (c *Connector) Dial(ctx context.Context) (*kafka.Conn, error) {
+	var errs []error
+	for _, broker := range c.brokers {
+		conn, err := c.dialer.DialContext(ctx, "tcp", broker)
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", broker, err))
+	}
+	return nil, errors.Join(errs...)
+}
+
+// Client - for admin requests: topic metadata, configs and creation
+func (c *Connector) Client() *kafka.Client {
+	return &kafka.Client{
+		Addr:      kafka.TCP(c.brokers...),
+		Timeout:   dialTimeout,
+		Transport: c.transport,
+	}
+}
+
+func newTLSConfig(cfg TLSConfig) (*tls.Config, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	tlsCfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify, // только для тестовых стендов, включается явно
+	}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Kafka CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in Kafka CA file %s", cfg.CAFile)
+		}
+		tlsCfg.RootCAs = pool
+	}
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return nil, errors.New("Kafka client certificate and key must be set together")
+	}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load Kafka client certificate: %w", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	return tlsCfg, nil
+}
+
+func newMechanism(cfg SASLConfig) (sasl.Mechanism, error) {
+	mechanism := strings.ToUpper(cfg.Mechanism)
+	if mechanism != MechanismNone && cfg.Username == "" {
+		return nil, fmt.Errorf("SASL %s requires username", mechanism)
+	}
+	switch mechanism {
+	case MechanismNone:
+		return nil, nil
+	case MechanismPlain:
+		return plain.Mechanism{Username: cfg.Username, Password: cfg.Password}, nil
+	case MechanismScramSHA256:
+		return scram.Mechanism(scram.SHA256, cfg.Username, cfg.Password)
+	case MechanismScramSHA512:
+		return scram.Mechanism(scram.SHA512, cfg.Username, cfg.Password)
+	default:
+		return nil, fmt.Errorf("unknown SASL mechanism %q, expected %s, %s or %s", cfg.Mechanism, MechanismPlain, MechanismScramSHA256, MechanismScramSHA512)
+	}
+}
@@ -0,0 +1,126 @@
+package kafkaconn
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go/sasl/plain"
+)
+
+// writeCert создает самоподписанный сертификат и ключ в PEM
+func writeCert(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "order-service"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestNew_TLSAndSASL(t *testing.T) {
+	certFile, keyFile := writeCert(t)
+	c, err := New(Config{
+		Brokers: []string{"kafka-1:9093", "kafka-2:9093"},
+		TLS:     TLSConfig{Enabled: true, CAFile: certFile, CertFile: certFile, KeyFile: keyFile, ServerName: "kafka"},
+		SASL:    SASLConfig{Mechanism: "plain", Username: "svc", Password: "secret"},
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	d := c.Dialer()
+	if d.TLS == nil || len(d.TLS.Certificates) != 1 || d.TLS.RootCAs == nil || d.TLS.ServerName != "kafka" {
+		t.Errorf("dialer TLS is not configured: %+v", d.TLS)
+	}
+	if m, ok := d.SASLMechanism.(plain.Mechanism); !ok || m.Username != "svc" {
+		t.Errorf("dialer SASL = %#v", d.SASLMechanism)
+	}
+
+	// писатели используют тот же транспорт и все брокеры для начального подключения
+	w := c.Writer("orders")
+	if w.Transport != c.transport || w.Addr.String() != "kafka-1:9093,kafka-2:9093" || w.Topic != "orders" {
+		t.Errorf("writer = addr %s, topic %s", w.Addr, w.Topic)
+	}
+
+	for _, mechanism := range []string{MechanismScramSHA256, MechanismScramSHA512} {
+		c, err := New(Config{Brokers: []string{"kafka:9092"}, SASL: SASLConfig{Mechanism: mechanism, Username: "svc", Password: "secret"}})
+		if err != nil || c.Dialer().SASLMechanism.Name() != mechanism {
+			t.Errorf("%s: %v", mechanism, err)
+		}
+	}
+}
+
+func TestNew_InvalidConfig(t *testing.T) {
+	certFile, _ := writeCert(t)
+	notPEM := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	brokers := []string{"kafka:9092"}
+	cases := map[string]Config{
+		"no brokers":        {},
+		"unknown mechanism": {Brokers: brokers, SASL: SASLConfig{Mechanism: "GSSAPI", Username: "svc"}},
+		"no username":       {Brokers: brokers, SASL: SASLConfig{Mechanism: MechanismPlain}},
+		"cert without key":  {Brokers: brokers, TLS: TLSConfig{Enabled: true, CertFile: certFile}},
+		"CA without certs":  {Brokers: brokers, TLS: TLSConfig{Enabled: true, CAFile: notPEM}},
+		"missing CA file":   {Brokers: brokers, TLS: TLSConfig{Enabled: true, CAFile: notPEM + ".missing"}},
+	}
+	for name, cfg := range cases {
+		if _, err := New(cfg); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+
+	// без TLS файлы сертификатов не читаются
+	if c, err := New(Config{Brokers: brokers, TLS: TLSConfig{CAFile: notPEM}}); err != nil || c.Dialer().TLS != nil {
+		t.Errorf("disabled TLS: %v", err)
+	}
+}
+
+func TestDial_TriesAllBrokers(t *testing.T) {
+	c, err := New(Config{Brokers: []string{"127.0.0.1:1", "127.0.0.1:2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	_, err = c.Dial(ctx)
+	if err == nil || !strings.Contains(err.Error(), "127.0.0.1:1") || !strings.Contains(err.Error(), "127.0.0.1:2") {
+		t.Fatalf("error must mention every broker, got %v", err)
+	}
+}
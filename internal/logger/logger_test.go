@@ -0,0 +1,50 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSetup_CorrelationAndRedaction(t *testing.T) {
+	var buf bytes.Buffer
+	l := Setup(&buf, "debug", "json")
+
+	ctx := WithCorrelationID(context.Background(), "kafka:orders/1/42")
+	l.InfoContext(ctx, "order received", "order_uid", "u1", "phone", "+79990000000", "email", "a@b.com")
+
+	var rec map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatalf("log line is not JSON: %v", err)
+	}
+	if rec[CorrelationKey] != "kafka:orders/1/42" {
+		t.Errorf("correlation_id = %v, want kafka:orders/1/42", rec[CorrelationKey])
+	}
+	if rec["phone"] != redacted || rec["email"] != redacted {
+		t.Errorf("PII not redacted: %v", rec)
+	}
+	if rec["order_uid"] != "u1" {
+		t.Errorf("order_uid = %v, want u1", rec["order_uid"])
+	}
+}
+
+func TestSetup_Level(t *testing.T) {
+	var buf bytes.Buffer
+	l := Setup(&buf, "warn", "text")
+	l.Info("hidden")
+	l.Warn("shown")
+	if strings.Contains(buf.String(), "hidden") || !strings.Contains(buf.String(), "shown") {
+		t.Errorf("unexpected output for warn level: %q", buf.String())
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil)))
+}
+
+func TestRedactDSN(t *testing.T) {
+	got := RedactDSN("postgresql://user:supersecret@db:5432/orders?sslmode=disable")
+	if strings.Contains(got, "supersecret") || !strings.Contains(got, "user") {
+		t.Errorf("RedactDSN() = %q", got)
+	}
+}
@@ -0,0 +1,77 @@
+package messaging
+
+import (
+	"context"
+
+	"github.com/segmentio/kafka-go"
+)
+
+type kafkaSource struct {
+	reader *kafka.Reader
+}
+
+// NewKafkaSource wraps reader of a consumer group; offsets are committed only by Commit
+func NewKafkaSource(reader *kafka.Reader) MessageSource {
+	return &kafkaSource{reader: reader}
+}
+
+func (s *kafkaSource) Fetch(ctx context.Context) (Message, error) {
+	m, err := s.reader.FetchMessage(ctx)
+	if err != nil {
+		return Message{}, err
+	}
+	msg := Message{
+		Topic:         m.Topic,
+		Partition:     m.Partition,
+		Offset:        m.Offset,
+		HighWaterMark: m.HighWaterMark,
+		Key:           m.Key,
+		Value:         m.Value,
+		Time:          m.Time,
+	}
+	for _, h := range m.Headers {
+		msg.Headers = append(msg.Headers, Header{Key: h.Key, Value: h.Value})
+	}
+	return msg, nil
+}
+
+func (s *kafkaSource) Commit(ctx context.Context, msgs ...Message) error {
+	// для коммита kafka-go нужны только координаты сообщения
+	km := make([]kafka.Message, len(msgs))
+	for i, m := range msgs {
+		km[i] = kafka.Message{Topic: m.Topic, Partition: m.Partition, Offset: m.Offset}
+	}
+	return s.reader.CommitMessages(ctx, km...)
+}
+
+func (s *kafkaSource) Close() error {
+	return s.reader.Close()
+}
+
+type kafkaSink struct {
+	writer *kafka.Writer
+}
+
+// NewKafkaSink wraps writer with Topic set
+func NewKafkaSink(writer *kafka.Writer) MessageSink {
+	return &kafkaSink{writer: writer}
+}
+
+func (s *kafkaSink) Topic() string {
+	return s.writer.Topic
+}
+
+func (s *kafkaSink) Publish(ctx context.Context, msgs ...Message) error {
+	km := make([]kafka.Message, len(msgs))
+	for i, m := range msgs {
+		km[i] = kafka.Message{Key: m.Key, Value: m.Value, Time: m.Time}
+		for _, h := range m.Headers {
+			km[i].Headers = append(km[i].Headers, kafka.Header{Key: h.Key, Value: h.Value})
+		}
+	}
+	return s.writer.WriteMessages(ctx, km...)
+}
+
+func (s *kafkaSink) Close() error {
+	return s.writer.Close()
+}
@@ -0,0 +1,278 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnknownTopic = errors.New("unknown topic")
+	ErrTopicExists  = errors.New("topic already exists")
+	ErrClosed       = errors.New("message source is closed")
+)
+
+// Broker - in-memory broker with Kafka semantics for tests: partitioned topics, offsets, headers and
+// consumer groups whose members split partitions and continue from the committed offsets after rebalance
+type Broker struct {
+	mu      sync.Mutex
+	topics  map[string]*memTopic
+	groups  map[string]*memGroup // ключ - группа и топик
+	changed chan struct{}        // закрывается при любом изменении, ожидающие Fetch просыпаются
+}
+
+type memTopic struct {
+	partitions [][]Message
+	next       int // round-robin для сообщений без ключа
+}
+
+type memGroup struct {
+	committed []int64 // следующее необработанное смещение по партициям
+	members   []*memSource
+}
+
+// NewBroker returns broker without topics
+func NewBroker() *Broker {
+	return &Broker{
+		topics:  make(map[string]*memTopic),
+		groups:  make(map[string]*memGroup),
+		changed: make(chan struct{}),
+	}
+}
+
+// CreateTopic creates topic with the given number of partitions
+func (b *Broker) CreateTopic(name string, partitions int) error {
+	if partitions < 1 {
+		return fmt.Errorf("topic %s: partitions must be positive, got %d", name, partitions)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.topics[name]; ok {
+		return fmt.Errorf("%w: %s", ErrTopicExists, name)
+	}
+	b.topics[name] = &memTopic{partitions: make([][]Message, partitions)}
+	return nil
+}
+
+// Messages returns copies of all messages of topic, partition by partition
+func (b *Broker) Messages(topic string) []Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t, ok := b.topics[topic]
+	if !ok {
+		return nil
+	}
+	var res []Message
+	for _, p := range t.partitions {
+		for _, m := range p {
+			res = append(res, cloneMessage(m))
+		}
+	}
+	return res
+}
+
+// Committed returns the committed offset of group on the partition, 0 if nothing was committed
+func (b *Broker) Committed(topic, groupID string, partition int) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	g, ok := b.groups[groupID+"/"+topic]
+	if !ok || partition < 0 || partition >= len(g.committed) {
+		return 0
+	}
+	return g.committed[partition]
+}
+
+// Sink returns producer to topic; messages with a key go to the partition by key hash, without - round-robin
+func (b *Broker) Sink(topic string) MessageSink {
+	return &memSink{b: b, topic: topic}
+}
+
+// Source joins the consumer group on topic, partitions are redistributed between all members of the group
+func (b *Broker) Source(topic, groupID string) (MessageSource, error) {
+	if groupID == "" {
+		return nil, errors.New("consumer group is required")
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t, ok := b.topics[topic]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownTopic, topic)
+	}
+	key := groupID + "/" + topic
+	g, ok := b.groups[key]
+	if !ok {
+		g = &memGroup{committed: make([]int64, len(t.partitions))}
+		b.groups[key] = g
+	}
+	s := &memSource{b: b, topic: topic, group: g}
+	g.members = append(g.members, s)
+	b.rebalance(g)
+	return s, nil
+}
+
+// rebalance распределяет партиции между участниками группы по кругу, чтение продолжается
+// с закоммиченных смещений - незакоммиченные сообщения будут прочитаны повторно, как в Kafka
+func (b *Broker) rebalance(g *memGroup) {
+	for _, m := range g.members {
+		m.assigned = m.assigned[:0]
+		m.position = make(map[int]int64)
+	}
+	if len(g.members) > 0 {
+		for p := range g.committed {
+			m := g.members[p%len(g.members)]
+			m.assigned = append(m.assigned, p)
+			m.position[p] = g.committed[p]
+		}
+	}
+	b.notify()
+}
+
+// notify будит всех ожидающих; вызывается под mu
+func (b *Broker) notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+type memSink struct {
+	b     *Broker
+	topic string
+}
+
+func (s *memSink) Topic() string {
+	return s.topic
+}
+
+func (s *memSink) Publish(ctx context.Context, msgs ...Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b := s.b
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t, ok := b.topics[s.topic]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownTopic, s.topic)
+	}
+	for _, m := range msgs {
+		m = cloneMessage(m)
+		m.Topic = s.topic
+		if len(m.Key) > 0 {
+			h := fnv.New32a()
+			h.Write(m.Key)
+			m.Partition = int(h.Sum32() % uint32(len(t.partitions)))
+		} else {
+			m.Partition = t.next % len(t.partitions)
+			t.next++
+		}
+		m.Offset = int64(len(t.partitions[m.Partition]))
+		if m.Time.IsZero() {
+			m.Time = time.Now()
+		}
+		t.partitions[m.Partition] = append(t.partitions[m.Partition], m)
+	}
+	b.notify()
+	return nil
+}
+
+func (s *memSink) Close() error {
+	return nil
+}
+
+type memSource struct {
+	b        *Broker
+	topic    string
+	group    *memGroup
+	assigned []int
+	position map[int]int64
+	next     int // с какой из назначенных партиций начинать поиск, чтобы ни одна не простаивала
+	closed   bool
+}
+
+func (s *memSource) Fetch(ctx context.Context) (Message, error) {
+	b := s.b
+	for {
+		b.mu.Lock()
+		if s.closed {
+			b.mu.Unlock()
+			return Message{}, ErrClosed
+		}
+		partitions := b.topics[s.topic].partitions
+		for i := range s.assigned {
+			p := s.assigned[(s.next+i)%len(s.assigned)]
+			pos := s.position[p]
+			if pos < int64(len(partitions[p])) {
+				m := cloneMessage(partitions[p][pos])
+				m.HighWaterMark = int64(len(partitions[p]))
+				s.position[p] = pos + 1
+				s.next = (s.next + i + 1) % len(s.assigned)
+				b.mu.Unlock()
+				return m, nil
+			}
+		}
+		wait := b.changed
+		b.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return Message{}, ctx.Err()
+		case <-wait:
+		}
+	}
+}
+
+func (s *memSource) Commit(ctx context.Context, msgs ...Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b := s.b
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	for _, m := range msgs {
+		if m.Topic != s.topic || m.Partition < 0 || m.Partition >= len(s.group.committed) {
+			return fmt.Errorf("cannot commit message of %s/%d in source of %s", m.Topic, m.Partition, s.topic)
+		}
+		if next := m.Offset + 1; next > s.group.committed[m.Partition] {
+			s.group.committed[m.Partition] = next
+		}
+	}
+	return nil
+}
+
+func (s *memSource) Close() error {
+	b := s.b
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	g := s.group
+	for i, m := range g.members {
+		if m == s {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			break
+		}
+	}
+	b.rebalance(g)
+	return nil
+}
+
+// cloneMessage - брокер и потребители не должны делить слайсы, чтобы изменения заголовков не протекали
+func cloneMessage(m Message) Message {
+	m.Key = append([]byte(nil), m.Key...)
+	m.Value = append([]byte(nil), m.Value...)
+	if m.Headers != nil {
+		headers := make([]Header, len(m.Headers))
+		for i, h := range m.Headers {
+			headers[i] = Header{Key: h.Key, Value: append([]byte(nil), h.Value...)}
+		}
+		m.Headers = headers
+	}
+	return m
+}
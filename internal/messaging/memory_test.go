@@ -0,0 +1,163 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func fetch(t *testing.T, s MessageSource) Message {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	m, err := s.Fetch(ctx)
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	return m
+}
+
+func TestBroker_PartitionsAndOffsets(t *testing.T) {
+	b := NewBroker()
+	if err := b.CreateTopic("orders", 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.CreateTopic("orders", 3); !errors.Is(err, ErrTopicExists) {
+		t.Errorf("second CreateTopic = %v", err)
+	}
+
+	sink := b.Sink("orders")
+	for range 3 {
+		if err := sink.Publish(context.Background(), Message{Key: []byte("u1"), Value: []byte("v")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msgs := b.Messages("orders")
+	if len(msgs) != 3 {
+		t.Fatalf("messages = %d", len(msgs))
+	}
+	// сообщения с одним ключом попадают в одну партицию и получают последовательные смещения
+	for i, m := range msgs {
+		if m.Partition != msgs[0].Partition || m.Offset != int64(i) || m.Topic != "orders" || m.Time.IsZero() {
+			t.Errorf("message %d: %+v", i, m)
+		}
+	}
+
+	// без ключа - по кругу
+	if err := sink.Publish(context.Background(), Message{Value: []byte("a")}, Message{Value: []byte("b")}, Message{Value: []byte("c")}); err != nil {
+		t.Fatal(err)
+	}
+	used := map[int]bool{}
+	for _, m := range b.Messages("orders") {
+		if m.Key == nil {
+			used[m.Partition] = true
+		}
+	}
+	if len(used) != 3 {
+		t.Errorf("keyless messages must be spread over partitions, got %v", used)
+	}
+
+	if err := b.Sink("missing").Publish(context.Background(), Message{}); !errors.Is(err, ErrUnknownTopic) {
+		t.Errorf("publish to missing topic = %v", err)
+	}
+}
+
+func TestBroker_HeadersAreCopied(t *testing.T) {
+	b := NewBroker()
+	_ = b.CreateTopic("orders", 1)
+	headers := []Header{{Key: "traceparent", Value: []byte("00-a")}}
+	_ = b.Sink("orders").Publish(context.Background(), Message{Value: []byte("v"), Headers: headers})
+	headers[0].Value[0] = 'X'
+
+	s, err := b.Source("orders", "g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := fetch(t, s)
+	if v, ok := m.Header("traceparent"); !ok || string(v) != "00-a" {
+		t.Fatalf("header = %q, %v", v, ok)
+	}
+	m.Headers[0].Value[0] = 'Y'
+	if v, _ := b.Messages("orders")[0].Header("traceparent"); string(v) != "00-a" {
+		t.Errorf("consumer changes must not leak into broker, got %q", v)
+	}
+	if m.HighWaterMark != 1 {
+		t.Errorf("HighWaterMark = %d", m.HighWaterMark)
+	}
+}
+
+func TestBroker_ConsumerGroups(t *testing.T) {
+	b := NewBroker()
+	_ = b.CreateTopic("orders", 2)
+	sink := b.Sink("orders")
+	for range 4 {
+		_ = sink.Publish(context.Background(), Message{Value: []byte("v")})
+	}
+
+	// два участника одной группы делят партиции
+	first, _ := b.Source("orders", "service")
+	second, _ := b.Source("orders", "service")
+	m1, m2 := fetch(t, first), fetch(t, second)
+	if m1.Partition == m2.Partition {
+		t.Fatalf("members of a group must read different partitions, both got %d", m1.Partition)
+	}
+	if err := first.Commit(context.Background(), m1); err != nil {
+		t.Fatal(err)
+	}
+
+	// другая группа читает топик независимо с начала
+	other, _ := b.Source("orders", "audit")
+	seen := 0
+	for range 4 {
+		fetch(t, other)
+		seen++
+	}
+	if seen != 4 {
+		t.Errorf("other group read %d messages", seen)
+	}
+
+	// после выхода участника его партиции переходят оставшемуся, незакоммиченное читается повторно
+	if err := second.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := second.Fetch(context.Background()); !errors.Is(err, ErrClosed) {
+		t.Errorf("Fetch after Close = %v", err)
+	}
+	redelivered := false
+	for range 3 {
+		m := fetch(t, first)
+		if m.Partition == m2.Partition && m.Offset == m2.Offset {
+			redelivered = true
+		}
+		if m.Partition == m1.Partition && m.Offset == m1.Offset {
+			t.Errorf("committed message %d/%d delivered again", m.Partition, m.Offset)
+		}
+	}
+	if !redelivered {
+		t.Error("uncommitted message of the left member must be redelivered")
+	}
+	if got := b.Committed("orders", "service", m1.Partition); got != m1.Offset+1 {
+		t.Errorf("Committed = %d, want %d", got, m1.Offset+1)
+	}
+}
+
+func TestBroker_FetchWaitsForMessages(t *testing.T) {
+	b := NewBroker()
+	_ = b.CreateTopic("orders", 1)
+	s, _ := b.Source("orders", "g")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := s.Fetch(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Fetch on empty topic = %v", err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_ = b.Sink("orders").Publish(context.Background(), Message{Value: []byte("late")})
+	}()
+	if m := fetch(t, s); string(m.Value) != "late" {
+		t.Errorf("got %q", m.Value)
+	}
+}
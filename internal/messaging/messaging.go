@@ -0,0 +1,53 @@
+// Package messaging - broker-independent consuming and publishing of messages: kafka-go implementation
+// for the app and in-memory broker for tests without Docker
+package messaging
+
+import (
+	"context"
+	"time"
+)
+
+// Header - message header, as in Kafka keys may repeat
+type Header struct {
+	Key   string
+	Value []byte
+}
+
+// Message - consumed or published message; Topic, Partition, Offset and HighWaterMark are set by the broker
+type Message struct {
+	Topic         string
+	Partition     int
+	Offset        int64
+	HighWaterMark int64 // смещение следующего сообщения партиции на момент чтения, для расчета лага
+	Key           []byte
+	Value         []byte
+	Headers       []Header
+	Time          time.Time
+}
+
+// Header returns value of the first header with the given key
+func (m *Message) Header(key string) ([]byte, bool) {
+	for _, h := range m.Headers {
+		if h.Key == key {
+			return h.Value, true
+		}
+	}
+	return nil, false
+}
+
+// MessageSource - consumer group member reading a topic
+type MessageSource interface {
+	// Fetch blocks until the next message is available or ctx is done
+	Fetch(ctx context.Context) (Message, error)
+	// Commit marks messages and all previous ones of their partitions as processed by the group
+	Commit(ctx context.Context, msgs ...Message) error
+	Close() error
+}
+
+// MessageSink - producer writing to a single topic
+type MessageSink interface {
+	Topic() string
+	// Publish writes messages, Topic, Partition and Offset of msgs are ignored
+	Publish(ctx context.Context, msgs ...Message) error
+	Close() error
+}
@@ -0,0 +1,261 @@
+// Package metrics - provides Prometheus collectors for ingestion, cache, DB and HTTP layers of the app
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "orderservice"
+
+// Kafka ingestion
+var (
+	// MessagesConsumed - all messages read from the orders topic
+	MessagesConsumed = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "kafka_messages_consumed_total",
+		Help:      "Number of messages consumed from the orders topic.",
+	})
+	// OrdersCreated - orders successfully saved to DB
+	OrdersCreated = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "orders_created_total",
+		Help:      "Number of orders saved to DB.",
+	})
+	// OrdersDuplicate - orders skipped because they already exist
+	OrdersDuplicate = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "orders_duplicate_total",
+		Help:      "Number of consumed orders which already existed.",
+	})
+	// OrdersConflicting - orders whose UID, payment transaction or message identity is taken by a different order, labeled by key kind
+	OrdersConflicting = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "orders_conflicting_total",
+		Help:      "Number of consumed orders conflicting with an existing order.",
+	}, []string{"key"})
+	// ConflictWriteErrors - failed attempts to write to the conflict topic
+	ConflictWriteErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "conflict_write_errors_total",
+		Help:      "Number of failed attempts to write to the conflict topic.",
+	})
+	// MessagesInvalid - messages rejected by decoding, validation or signature check, labeled by reason
+	MessagesInvalid = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "kafka_messages_invalid_total",
+		Help:      "Number of consumed messages rejected as invalid.",
+	}, []string{"reason"})
+	// DLQMessages - messages successfully written to DLQ-topic
+	DLQMessages = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dlq_messages_total",
+		Help:      "Number of messages written to the DLQ topic.",
+	})
+	// DLQWriteErrors - failed attempts to write to DLQ-topic
+	DLQWriteErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dlq_write_errors_total",
+		Help:      "Number of failed attempts to write to the DLQ topic.",
+	})
+	// SchemaRegistryErrors - failed attempts to fetch a schema from schema registry, the message is decoded again
+	SchemaRegistryErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "schema_registry_errors_total",
+		Help:      "Number of failed attempts to fetch a message schema from the schema registry.",
+	})
+	// ShutdownAbandoned - work dropped when the shutdown drain timeout ran out, labeled by kind: message, dlq, conflict
+	ShutdownAbandoned = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "shutdown_abandoned_total",
+		Help:      "Number of in-flight messages and DLQ or conflict topic writes abandoned on shutdown.",
+	}, []string{"kind"})
+	// ConsumerLag - difference between high watermark and the last consumed offset per partition
+	ConsumerLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "kafka_consumer_lag",
+		Help:      "Messages left to consume per partition.",
+	}, []string{"topic", "partition"})
+	// KafkaPartitionAssigned - 1 for partitions of the orders topic assigned to this replica, 0 for the rest
+	KafkaPartitionAssigned = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "kafka_partition_assigned",
+		Help:      "Whether the partition is assigned to this replica in the consumer group.",
+	}, []string{"topic", "partition"})
+	// KafkaPartitionCommittedOffset - committed offset of the consumer group from broker metadata
+	KafkaPartitionCommittedOffset = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "kafka_partition_committed_offset",
+		Help:      "Committed offset of the consumer group, -1 if nothing was committed.",
+	}, []string{"topic", "partition"})
+	// KafkaPartitionHighWatermark - offset of the next message to be written to the partition
+	KafkaPartitionHighWatermark = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "kafka_partition_high_watermark",
+		Help:      "High watermark of the partition.",
+	}, []string{"topic", "partition"})
+	// KafkaPartitionGroupLag - high watermark minus committed offset of the group, whichever replica owns the partition
+	KafkaPartitionGroupLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "kafka_partition_group_lag",
+		Help:      "Messages of the partition not yet committed by the consumer group.",
+	}, []string{"topic", "partition"})
+	// KafkaPartitionProcessed - messages of the partition processed by this replica
+	KafkaPartitionProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "kafka_partition_messages_processed_total",
+		Help:      "Number of messages of the partition processed by this replica.",
+	}, []string{"topic", "partition"})
+	// KafkaPartitionLastProcessed - time of the last message of the partition processed by this replica
+	KafkaPartitionLastProcessed = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "kafka_partition_last_processed_timestamp_seconds",
+		Help:      "Unix time when this replica last processed a message of the partition.",
+	}, []string{"topic", "partition"})
+	// KafkaPartitionRate - messages per second processed by this replica between the last two status refreshes
+	KafkaPartitionRate = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "kafka_partition_processing_rate",
+		Help:      "Messages of the partition processed by this replica per second.",
+	}, []string{"topic", "partition"})
+	// KafkaReaderRebalances - consumer group rebalances seen by the reader
+	KafkaReaderRebalances = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "kafka_reader_rebalances_total",
+		Help:      "Number of consumer group rebalances seen by the reader.",
+	})
+	// KafkaReaderErrors - fetch errors of the reader
+	KafkaReaderErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "kafka_reader_errors_total",
+		Help:      "Number of errors of the Kafka reader.",
+	})
+)
+
+// Cache
+var (
+	// CacheHits - lookups served from LRU-cache
+	CacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_hits_total",
+		Help:      "Number of order lookups served from cache.",
+	})
+	// CacheMisses - lookups not found in LRU-cache
+	CacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_misses_total",
+		Help:      "Number of order lookups missing in cache.",
+	})
+	// CacheNegativeHits - lookups of unknown UIDs answered by negative cache without going to DB
+	CacheNegativeHits = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_negative_hits_total",
+		Help:      "Number of lookups of missing orders answered from negative cache.",
+	})
+	// CacheCoalescedLookups - DB lookups shared with a concurrent request for the same UID
+	CacheCoalescedLookups = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_coalesced_lookups_total",
+		Help:      "Number of cache misses which reused a concurrent DB lookup of the same order.",
+	})
+	// CacheEvictions - entries removed from LRU-cache
+	CacheEvictions = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_evictions_total",
+		Help:      "Number of entries evicted from cache.",
+	})
+	// CacheSharedHits - local misses served from the shared Redis tier
+	CacheSharedHits = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_shared_hits_total",
+		Help:      "Number of local cache misses served from shared cache.",
+	})
+	// CacheSharedMisses - local misses not found in the shared Redis tier either
+	CacheSharedMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_shared_misses_total",
+		Help:      "Number of local cache misses missing in shared cache.",
+	})
+	// CacheSharedErrors - failed operations with the shared Redis tier
+	CacheSharedErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_shared_errors_total",
+		Help:      "Number of failed shared cache operations.",
+	})
+	// CacheInvalidations - invalidation messages received from other replicas
+	CacheInvalidations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_invalidations_total",
+		Help:      "Number of cache invalidations received from other replicas by operation.",
+	}, []string{"op"})
+)
+
+// DB
+var (
+	// DBQueryDuration - latency of repository methods
+	DBQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_query_duration_seconds",
+		Help:      "Latency of repository calls by method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+	// DBReconnectAttempts - attempts to restore connection to DB
+	DBReconnectAttempts = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "db_reconnect_attempts_total",
+		Help:      "Number of attempts to reconnect to DB.",
+	})
+	// AuditEventsDropped - audit events discarded because DB was unavailable for too long
+	AuditEventsDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "audit_events_dropped_total",
+		Help:      "Number of audit events dropped due to overflow of the pending queue.",
+	})
+)
+
+// HTTP
+var (
+	// HTTPRequestDuration - latency of HTTP requests by route and status
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of HTTP requests by route and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+)
+
+// ObserveDBQuery records duration of repository method since start; intended to be used with defer
+func ObserveDBQuery(method string, start time.Time) {
+	DBQueryDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
+
+// Handler - exposes registered metrics in Prometheus format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// HTTPMiddleware measures request duration labeled with chi route pattern, so that /order/{uid} is not split per uid
+func HTTPMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		status := ww.Status()
+		if status == 0 { // хэндлер ничего не записал
+			status = http.StatusOK
+		}
+		HTTPRequestDuration.WithLabelValues(r.Method, route, strconv.Itoa(status)).Observe(time.Since(start).Seconds())
+	})
+}
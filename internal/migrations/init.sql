@@ -10,9 +10,13 @@ CREATE TABLE orders (
     shardkey TEXT NOT NULL,
     sm_id INT NOT NULL,
     date_created TEXT NOT NULL,
-    oof_shard TEXT NOT NULL
+    oof_shard TEXT NOT NULL,
+    event_source TEXT NOT NULL DEFAULT '', -- CloudEvent, в котором пришел заказ
+    event_id TEXT NOT NULL DEFAULT ''
 );
 
+CREATE UNIQUE INDEX idx_orders_event ON orders (event_source, event_id) WHERE event_id <> '';
+
 -- Таблица доставок
 CREATE TABLE deliveries (
     did SERIAL PRIMARY KEY,
@@ -24,9 +28,14 @@ CREATE TABLE deliveries (
     address TEXT NOT NULL,
     region TEXT NOT NULL,
     email TEXT NOT NULL,
+    email_index TEXT,
+    phone_index TEXT,
     CONSTRAINT fk_deliveries_order FOREIGN KEY (order_uid) REFERENCES orders (order_uid) ON UPDATE CASCADE ON DELETE CASCADE
 );
 
+CREATE INDEX idx_deliveries_email_index ON deliveries (email_index);
+CREATE INDEX idx_deliveries_phone_index ON deliveries (phone_index);
+
 -- Таблица оплат
 CREATE TABLE payments (
     pid SERIAL PRIMARY KEY,
@@ -44,6 +53,9 @@ CREATE TABLE payments (
     CONSTRAINT fk_payments_order FOREIGN KEY (order_uid) REFERENCES orders (order_uid) ON UPDATE CASCADE ON DELETE CASCADE
 );
 
+-- одна транзакция оплаты - один заказ
+CREATE UNIQUE INDEX idx_payments_transaction ON payments (transaction);
+
 -- Таблица товаров
 CREATE TABLE items (
     iid SERIAL PRIMARY KEY,
@@ -63,4 +75,37 @@ CREATE TABLE items (
     brand TEXT NOT NULL,
     status INT NOT NULL CHECK (status >= 0),
     CONSTRAINT fk_items_order FOREIGN KEY (order_uid) REFERENCES orders (order_uid) ON UPDATE CASCADE ON DELETE CASCADE
-);
\ No newline at end of file
+);
+-- Счетчики обращений к заказам через API(для прогрева кэша самыми запрашиваемыми)
+CREATE TABLE order_accesses (
+    order_uid TEXT PRIMARY KEY,
+    count BIGINT NOT NULL DEFAULT 0,
+    last_access_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX idx_order_accesses_count ON order_accesses (count);
+
+-- Журнал доступа к персональным данным заказов(кто и в какой роли смотрел заказ)
+CREATE TABLE audit_events (
+    id BIGSERIAL PRIMARY KEY,
+    at TIMESTAMPTZ NOT NULL,
+    action TEXT NOT NULL,
+    order_uid TEXT NOT NULL,
+    customer_id TEXT,
+    subject TEXT NOT NULL,
+    role TEXT NOT NULL
+);
+
+CREATE INDEX idx_audit_events_at ON audit_events (at);
+CREATE INDEX idx_audit_events_order_uid ON audit_events (order_uid);
+CREATE INDEX idx_audit_events_customer_id ON audit_events (customer_id);
+
+-- Ключи идемпотентности принятых заказов: UID, транзакция оплаты, CloudEvent или ключ сообщения Kafka
+CREATE TABLE idempotency_keys (
+    key TEXT PRIMARY KEY,
+    order_uid TEXT NOT NULL,
+    payload_hash TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX idx_idempotency_keys_order_uid ON idempotency_keys (order_uid);
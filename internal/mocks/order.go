@@ -4,7 +4,8 @@
 package mocks
 
 import (
-	"log"
+	"log/slog"
+	"os"
 	"reflect"
 
 	"orderservice/internal/model"
@@ -19,7 +20,8 @@ func init() {
 		return uint(number[0]), nil
 	})
 	if err != nil {
-		log.Fatal("Failed to initialize custom tag 'number' for faker:", err)
+		slog.Error("Failed to initialize custom tag 'number' for faker", "error", err)
+		os.Exit(1)
 	}
 }
 
@@ -27,7 +29,7 @@ func init() {
 func GenerateMockOrder() *model.Order {
 	var order model.Order
 	if err := faker.FakeData(&order); err != nil {
-		log.Printf("Failed faker order generation: %v", err)
+		slog.Error("Failed faker order generation", "error", err)
 	}
 
 	order.OrderUID = "fake-" + faker.UUIDHyphenated()
@@ -43,6 +45,7 @@ func GenerateMockOrder() *model.Order {
 func conformOrderUID(order *model.Order) {
 	order.Delivery.OrderUID = order.OrderUID
 	order.Payment.OrderUID = order.OrderUID
+	order.Payment.Transaction = order.OrderUID // транзакция уникальна, как и в настоящих заказах
 
 	for i := range order.Items {
 		order.Items[i].OrderUID = order.OrderUID
@@ -0,0 +1,26 @@
+package mocks
+
+import (
+	"errors"
+
+	"orderservice/internal/model"
+	"orderservice/internal/signature"
+)
+
+// SignOrder fills InternalSignature of the order with the first key of its Entry; an order whose Entry has no key
+// is moved to the first configured entry, so generated orders pass verification
+func SignOrder(order *model.Order, keys signature.Keys) error {
+	if len(keys[order.Entry]) == 0 {
+		entries := keys.Entries()
+		if len(entries) == 0 {
+			return errors.New("no signing keys configured")
+		}
+		order.Entry = entries[0]
+	}
+	sig, err := signature.Sign(order, keys[order.Entry][0])
+	if err != nil {
+		return err
+	}
+	order.InternalSignature = sig
+	return nil
+}
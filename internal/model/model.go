@@ -6,6 +6,10 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"orderservice/internal/pii"
+
+	"gorm.io/gorm"
 )
 
 // CustomTime used for converting time fields from Kafka-JSON into time.Time
@@ -32,26 +36,55 @@ type Order struct {
 	SMID              int    `gorm:"not null" json:"sm_id" faker:"number" validate:"gte=1"`
 	DateCreated       string `gorm:"not null" json:"date_created" faker:"date" validate:"required"` // ожидается формат "2021-11-26T06:22:19Z"
 	OofShard          string `gorm:"not null" json:"oof_shard" faker:"word" validate:"required"`
+
+	// source и id CloudEvent, в котором пришел заказ: пара уникальна, по ней отсекаются повторы события;
+	// пусто - заказ пришел без конверта. В контракт сообщения не входят
+	EventSource string `gorm:"not null;default:'';uniqueIndex:idx_orders_event,where:event_id <> ''" json:"-" faker:"-"`
+	EventID     string `gorm:"not null;default:'';uniqueIndex:idx_orders_event,where:event_id <> ''" json:"-" faker:"-"`
 }
 
-// Delivery contains delivery information for a certain order
+// Delivery contains delivery information for a certain order;
+// name, phone, address and email are stored encrypted when PII keyring is configured
 type Delivery struct {
 	DID      *uint  `gorm:"primaryKey;autoIncrement;->" json:"-" faker:"-"`
 	OrderUID string `gorm:"index;not null" faker:"-"` // FK на Order.OrderUID
-	Name     string `gorm:"not null" json:"name" faker:"name" validate:"required"`
-	Phone    string `gorm:"not null" json:"phone" faker:"-" validate:"required"`
+	Name     string `gorm:"not null;serializer:pii" json:"name" faker:"name" validate:"required"`
+	Phone    string `gorm:"not null;serializer:pii" json:"phone" faker:"-" validate:"required"`
 	Zip      string `gorm:"not null" json:"zip" faker:"word" validate:"required"`
 	City     string `gorm:"not null" json:"city" faker:"word" validate:"required"`
-	Address  string `gorm:"not null" json:"address" faker:"word" validate:"required"`
+	Address  string `gorm:"not null;serializer:pii" json:"address" faker:"word" validate:"required"`
 	Region   string `gorm:"not null" json:"region"  faker:"word" validate:"required"`
-	Email    string `gorm:"not null" json:"email" faker:"email" validate:"required,email"`
+	Email    string `gorm:"not null;serializer:pii" json:"email" faker:"email" validate:"required,email"`
+
+	// слепые индексы для поиска по зашифрованным email и телефону, см. pii.Keyring.BlindIndex
+	EmailIndex string `gorm:"index" json:"-" faker:"-"`
+	PhoneIndex string `gorm:"index" json:"-" faker:"-"`
+}
+
+// ErasedValue replaces personal data of a customer after erasure request
+const ErasedValue = "[erased]"
+
+// Blind index kinds
+const (
+	IndexEmail = "email"
+	IndexPhone = "phone"
+)
+
+// BeforeSave - gorm hook keeping blind indexes in sync with email and phone
+func (d *Delivery) BeforeSave(*gorm.DB) error {
+	d.EmailIndex, d.PhoneIndex = "", ""
+	if kr := pii.Current(); kr != nil {
+		d.EmailIndex = kr.BlindIndex(IndexEmail, pii.NormalizeEmail(d.Email))
+		d.PhoneIndex = kr.BlindIndex(IndexPhone, pii.NormalizePhone(d.Phone))
+	}
+	return nil
 }
 
 // Payment contains payment information for a certain order
 type Payment struct {
 	PID          *uint  `gorm:"primaryKey;autoIncrement;->" json:"-" faker:"-"`
 	OrderUID     string `gorm:"index;not null;index" faker:"-"` // FK на Order.OrderUID
-	Transaction  string `gorm:"not null" json:"transaction" faker:"word" validate:"required"`
+	Transaction  string `gorm:"not null;uniqueIndex" json:"transaction" faker:"word" validate:"required"`
 	RequestID    string `gorm:"not null" json:"request_id" faker:"word" validate:"required"`
 	Currency     string `gorm:"not null" json:"currency" faker:"word" validate:"required"`
 	Provider     string `gorm:"not null" json:"provider" faker:"word" validate:"required"`
@@ -80,6 +113,82 @@ type Item struct {
 	Status      int    `gorm:"not null" json:"status" faker:"number" validate:"gte=0"`
 }
 
+// Clone returns a deep copy of the order: Items slice and ID pointers are not shared with the original
+func (o Order) Clone() Order {
+	o.Delivery.DID = cloneID(o.Delivery.DID)
+	o.Payment.PID = cloneID(o.Payment.PID)
+	if o.Items != nil {
+		items := make([]Item, len(o.Items))
+		copy(items, o.Items)
+		for i := range items {
+			items[i].IID = cloneID(items[i].IID)
+		}
+		o.Items = items
+	}
+	return o
+}
+
+func cloneID(id *uint) *uint {
+	if id == nil {
+		return nil
+	}
+	v := *id
+	return &v
+}
+
+// OrderAccess counts lookups of an order through API, used for warming up cache with the most requested orders
+type OrderAccess struct {
+	OrderUID     string    `gorm:"primaryKey"`
+	Count        int64     `gorm:"not null;default:0;index"`
+	LastAccessAt time.Time `gorm:"not null"`
+}
+
+// IdempotencyKey - identity of a consumed order: its UID, payment transaction, CloudEvent or Kafka message key;
+// the primary key lets exactly one of concurrent consumers save the order, PayloadHash tells identical duplicates from conflicting ones
+type IdempotencyKey struct {
+	Key         string    `gorm:"primaryKey"`
+	OrderUID    string    `gorm:"not null;index"`
+	PayloadHash string    `gorm:"not null"`
+	CreatedAt   time.Time `gorm:"not null"`
+}
+
+// Kinds of idempotency keys, prefix of IdempotencyKey.Key
+const (
+	KeyOrder   = "order"
+	KeyPayment = "payment"
+	KeyEvent   = "event"
+	KeyMessage = "message"
+)
+
+// OrderKey - idempotency key of an order UID
+func OrderKey(uid string) string { return KeyOrder + ":" + uid }
+
+// PaymentKey - idempotency key of a payment transaction
+func PaymentKey(transaction string) string { return KeyPayment + ":" + transaction }
+
+// EventKey - idempotency key of a CloudEvent, id is unique within its source
+func EventKey(source, id string) string { return KeyEvent + ":" + source + " " + id }
+
+// MessageKey - idempotency key of a Kafka message key within its topic
+func MessageKey(topic string, key []byte) string { return KeyMessage + ":" + topic + "/" + string(key) }
+
+// KeyKind returns kind of an idempotency key
+func KeyKind(key string) string {
+	kind, _, _ := strings.Cut(key, ":")
+	return kind
+}
+
+// AuditEvent - access to personal data of an order: who, in which role and what did
+type AuditEvent struct {
+	ID         uint      `gorm:"primaryKey;autoIncrement"`
+	At         time.Time `gorm:"not null;index"`
+	Action     string    `gorm:"not null"`
+	OrderUID   string    `gorm:"not null;index"`
+	CustomerID string    `gorm:"index"` // для операций над всеми данными клиента
+	Subject    string    `gorm:"not null"`
+	Role       string    `gorm:"not null"`
+}
+
 // UnmarshalJSON - method for CustomTime used to process "RFC3339" and "Unix timestamp" input date types
 func (ct *CustomTime) UnmarshalJSON(b []byte) error {
 	s := strings.Trim(string(b), `"`)
@@ -28,3 +28,17 @@ func TestCustomTime_Unix(t *testing.T) {
 		t.Fatalf("got %v", ct.UTC())
 	}
 }
+
+func TestOrder_Clone(t *testing.T) {
+	id := uint(7)
+	o := Order{OrderUID: "u1", Delivery: Delivery{DID: &id}, Items: []Item{{Name: "a", IID: &id}}}
+	c := o.Clone()
+
+	c.Items[0].Name = "b"
+	*c.Items[0].IID = 8
+	*c.Delivery.DID = 9
+
+	if o.Items[0].Name != "a" || *o.Items[0].IID != 7 || *o.Delivery.DID != 7 {
+		t.Fatalf("clone shares data with original: %+v", o)
+	}
+}
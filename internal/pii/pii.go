@@ -0,0 +1,236 @@
+// Package pii - application-level encryption of personal data stored in DB: envelope AES-GCM with rotating
+// key-encryption keys from a local keyfile and blind indexes for lookups by encrypted values
+package pii
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"unicode"
+)
+
+// prefix - признак зашифрованного значения, значения без него считаются открытым текстом(данные до включения шифрования)
+const prefix = "enc:v1:"
+
+var (
+	ErrNoKeyring  = errors.New("PII keyring is not configured")
+	ErrUnknownKey = errors.New("unknown PII key id")
+	ErrMalformed  = errors.New("malformed encrypted value")
+)
+
+// Keyring - key-encryption keys by ID, the active one encrypts new values, all of them decrypt
+type Keyring struct {
+	active   string
+	keys     map[string]cipher.AEAD
+	indexKey []byte
+}
+
+// keyfile format:
+//
+//	{"active_key_id": "2025-10", "keys": {"2025-01": "<base64 32 bytes>", "2025-10": "..."}, "blind_index_key": "<base64>"}
+type keyfile struct {
+	ActiveKeyID   string            `json:"active_key_id"`
+	Keys          map[string]string `json:"keys"`
+	BlindIndexKey string            `json:"blind_index_key"`
+}
+
+// LoadKeyring reads keys from a JSON keyfile
+func LoadKeyring(path string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PII keyfile: %w", err)
+	}
+	var kf keyfile
+	if err := json.Unmarshal(data, &kf); err != nil {
+		return nil, fmt.Errorf("failed to decode PII keyfile: %w", err)
+	}
+
+	keys := make(map[string][]byte, len(kf.Keys))
+	for id, k := range kf.Keys {
+		raw, err := base64.StdEncoding.DecodeString(k)
+		if err != nil {
+			return nil, fmt.Errorf("PII key %q: %w", id, err)
+		}
+		keys[id] = raw
+	}
+	indexKey, err := base64.StdEncoding.DecodeString(kf.BlindIndexKey)
+	if err != nil {
+		return nil, fmt.Errorf("blind index key: %w", err)
+	}
+	return NewKeyring(kf.ActiveKeyID, keys, indexKey)
+}
+
+// NewKeyring validates keys: AES-256 only, active key must be present, blind index key at least 32 bytes
+func NewKeyring(active string, keys map[string][]byte, indexKey []byte) (*Keyring, error) {
+	if _, ok := keys[active]; !ok {
+		return nil, fmt.Errorf("active PII key %q is not in keyring", active)
+	}
+	if len(indexKey) < 32 {
+		return nil, fmt.Errorf("blind index key must be at least 32 bytes, got %d", len(indexKey))
+	}
+	kr := &Keyring{active: active, keys: make(map[string]cipher.AEAD, len(keys)), indexKey: indexKey}
+	for id, k := range keys {
+		if id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("invalid PII key id %q", id)
+		}
+		if len(k) != 32 {
+			return nil, fmt.Errorf("PII key %q must be 32 bytes, got %d", id, len(k))
+		}
+		aead, err := newAEAD(k)
+		if err != nil {
+			return nil, err
+		}
+		kr.keys[id] = aead
+	}
+	return kr, nil
+}
+
+// ActiveKeyID returns ID of the key used for new values
+func (kr *Keyring) ActiveKeyID() string {
+	return kr.active
+}
+
+// Encrypt seals plaintext with a fresh data key, the data key is sealed with the active key:
+// enc:v1:<key id>:<base64 wrapped data key>:<base64 nonce+ciphertext>
+func (kr *Keyring) Encrypt(plaintext string) (string, error) {
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return "", err
+	}
+	wrapped, err := seal(kr.keys[kr.active], dek, []byte(kr.active))
+	if err != nil {
+		return "", err
+	}
+	dataAEAD, err := newAEAD(dek)
+	if err != nil {
+		return "", err
+	}
+	// ID ключа - дополнительные данные, подмена ID в строке ломает проверку
+	sealed, err := seal(dataAEAD, []byte(plaintext), []byte(kr.active))
+	if err != nil {
+		return "", err
+	}
+	return prefix + kr.active + ":" + base64.RawStdEncoding.EncodeToString(wrapped) + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens value produced by Encrypt with any known key; values without prefix are returned as is
+func (kr *Keyring) Decrypt(value string) (string, error) {
+	rest, ok := strings.CutPrefix(value, prefix)
+	if !ok {
+		return value, nil
+	}
+	parts := strings.Split(rest, ":")
+	if len(parts) != 3 {
+		return "", ErrMalformed
+	}
+	kek, ok := kr.keys[parts[0]]
+	if !ok {
+		return "", fmt.Errorf("%w %q", ErrUnknownKey, parts[0])
+	}
+	wrapped, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", ErrMalformed
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", ErrMalformed
+	}
+
+	dek, err := open(kek, wrapped, []byte(parts[0]))
+	if err != nil {
+		return "", fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	dataAEAD, err := newAEAD(dek)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := open(dataAEAD, sealed, []byte(parts[0]))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt value: %w", err)
+	}
+	return string(plaintext), nil
+}
+
+// NeedsRotation reports whether value is plaintext or encrypted with a non-active key
+func (kr *Keyring) NeedsRotation(value string) bool {
+	return value != "" && !strings.HasPrefix(value, prefix+kr.active+":")
+}
+
+// BlindIndex returns keyed hash of the normalized value, equal values give equal hashes,
+// so the column can be searched without decryption; kind separates hashes of different fields
+func (kr *Keyring) BlindIndex(kind, normalized string) string {
+	if normalized == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, kr.indexKey)
+	mac.Write([]byte(kind + ":" + normalized))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// IsEncrypted reports whether value was produced by Encrypt
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, prefix)
+}
+
+// NormalizeEmail - регистр и пробелы по краям не влияют на поиск
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// NormalizePhone - только цифры, "+7 (972) 000-78-85" и "79720007885" совпадают
+func NormalizePhone(phone string) string {
+	var b strings.Builder
+	for _, r := range phone {
+		if unicode.IsDigit(r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// текущий ключ для сериализатора gorm и хуков модели, nil - шифрование выключено
+var current atomic.Pointer[Keyring]
+
+// SetKeyring makes kr used for all encrypted columns, nil disables encryption
+func SetKeyring(kr *Keyring) {
+	current.Store(kr)
+}
+
+// Current returns keyring set by SetKeyring or nil
+func Current() *Keyring {
+	return current.Load()
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func seal(aead cipher.AEAD, plaintext, ad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, ad), nil
+}
+
+func open(aead cipher.AEAD, sealed, ad []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrMalformed
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, ad)
+}
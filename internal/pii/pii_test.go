@@ -0,0 +1,163 @@
+package pii
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"gorm.io/gorm/schema"
+)
+
+func testKey(b byte) []byte { return bytes.Repeat([]byte{b}, 32) }
+
+func testKeyring(t *testing.T, active string, ids ...string) *Keyring {
+	t.Helper()
+	keys := make(map[string][]byte, len(ids))
+	for i, id := range ids {
+		keys[id] = testKey(byte(i + 1))
+	}
+	kr, err := NewKeyring(active, keys, testKey(0xAA))
+	if err != nil {
+		t.Fatalf("NewKeyring: %v", err)
+	}
+	return kr
+}
+
+func TestKeyring_RoundTripAndRotation(t *testing.T) {
+	old := testKeyring(t, "k1", "k1")
+	enc, err := old.Encrypt("Иван Петров")
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	if !strings.HasPrefix(enc, "enc:v1:k1:") || strings.Contains(enc, "Иван") {
+		t.Fatalf("unexpected ciphertext %q", enc)
+	}
+	if again, _ := old.Encrypt("Иван Петров"); again == enc {
+		t.Error("encryption must be randomized")
+	}
+
+	// после ротации новый ключ активен, старые значения по-прежнему читаются
+	rotated := testKeyring(t, "k2", "k1", "k2")
+	if got, err := rotated.Decrypt(enc); err != nil || got != "Иван Петров" {
+		t.Fatalf("Decrypt after rotation = %q, %v", got, err)
+	}
+	if !rotated.NeedsRotation(enc) || rotated.NeedsRotation("") {
+		t.Error("value under old key must need rotation")
+	}
+	fresh, _ := rotated.Encrypt("x")
+	if rotated.NeedsRotation(fresh) {
+		t.Error("value under active key must not need rotation")
+	}
+
+	// без старого ключа значение не читается
+	withoutOld := testKeyring(t, "k2", "k2")
+	if _, err := withoutOld.Decrypt(enc); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Decrypt without key = %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestKeyring_Tampering(t *testing.T) {
+	kr := testKeyring(t, "k1", "k1", "k2")
+	enc, _ := kr.Encrypt("secret")
+
+	// подмена ID ключа ломает проверку подлинности
+	swapped := strings.Replace(enc, "enc:v1:k1:", "enc:v1:k2:", 1)
+	if _, err := kr.Decrypt(swapped); err == nil {
+		t.Error("swapped key id must fail")
+	}
+	tampered := enc[:len(enc)-2] + "AA"
+	if _, err := kr.Decrypt(tampered); err == nil {
+		t.Error("tampered ciphertext must fail")
+	}
+	if _, err := kr.Decrypt("enc:v1:k1:broken"); !errors.Is(err, ErrMalformed) {
+		t.Errorf("malformed value error = %v", err)
+	}
+	if got, err := kr.Decrypt("plain text"); err != nil || got != "plain text" {
+		t.Errorf("legacy plaintext must be returned as is, got %q, %v", got, err)
+	}
+}
+
+func TestBlindIndex(t *testing.T) {
+	kr := testKeyring(t, "k1", "k1")
+	if kr.BlindIndex("email", NormalizeEmail(" Ivan@Mail.RU ")) != kr.BlindIndex("email", NormalizeEmail("ivan@mail.ru")) {
+		t.Error("emails differing in case must have equal index")
+	}
+	if kr.BlindIndex("phone", NormalizePhone("+7 (972) 000-78-85")) != kr.BlindIndex("phone", NormalizePhone("79720007885")) {
+		t.Error("phones differing in format must have equal index")
+	}
+	if kr.BlindIndex("email", "a") == kr.BlindIndex("phone", "a") {
+		t.Error("index kinds must not collide")
+	}
+	other, _ := NewKeyring("k1", map[string][]byte{"k1": testKey(1)}, testKey(0xBB))
+	if kr.BlindIndex("email", "a") == other.BlindIndex("email", "a") {
+		t.Error("index must depend on the key")
+	}
+	if kr.BlindIndex("email", "") != "" {
+		t.Error("empty value must have empty index")
+	}
+}
+
+func TestLoadKeyring(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	content := `{"active_key_id":"2025-10","keys":{"2025-10":"` + strings.Repeat("A", 43) + `="},"blind_index_key":"` + strings.Repeat("B", 43) + `="}`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	kr, err := LoadKeyring(path)
+	if err != nil {
+		t.Fatalf("LoadKeyring: %v", err)
+	}
+	if kr.ActiveKeyID() != "2025-10" {
+		t.Errorf("ActiveKeyID = %q", kr.ActiveKeyID())
+	}
+
+	if _, err := NewKeyring("missing", map[string][]byte{"k1": testKey(1)}, testKey(2)); err == nil {
+		t.Error("missing active key must fail")
+	}
+	if _, err := NewKeyring("k1", map[string][]byte{"k1": testKey(1)[:16]}, testKey(2)); err == nil {
+		t.Error("AES-128 key must be rejected")
+	}
+	if _, err := NewKeyring("k1", map[string][]byte{"k1": testKey(1)}, testKey(2)[:8]); err == nil {
+		t.Error("short blind index key must be rejected")
+	}
+}
+
+type person struct {
+	Name string `gorm:"serializer:pii"`
+}
+
+func TestSerializer(t *testing.T) {
+	s, err := schema.Parse(&person{}, &sync.Map{}, schema.NamingStrategy{})
+	if err != nil {
+		t.Fatalf("schema.Parse: %v", err)
+	}
+	field := s.LookUpField("Name")
+	ctx := context.Background()
+
+	SetKeyring(testKeyring(t, "k1", "k1"))
+	defer SetKeyring(nil)
+
+	var p person
+	v := reflect.ValueOf(&p).Elem()
+	stored, err := Serializer{}.Value(ctx, field, v, "Иван")
+	if err != nil || !IsEncrypted(stored.(string)) {
+		t.Fatalf("Value = %v, %v", stored, err)
+	}
+	if err := (Serializer{}).Scan(ctx, field, v, []byte(stored.(string))); err != nil || p.Name != "Иван" {
+		t.Fatalf("Scan = %q, %v", p.Name, err)
+	}
+
+	SetKeyring(nil)
+	if err := (Serializer{}).Scan(ctx, field, v, stored); !errors.Is(err, ErrNoKeyring) {
+		t.Errorf("Scan of encrypted value without keyring = %v", err)
+	}
+	if plain, _ := (Serializer{}).Value(ctx, field, v, "Иван"); plain != "Иван" {
+		t.Errorf("without keyring value must be stored as is, got %v", plain)
+	}
+}
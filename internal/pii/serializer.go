@@ -0,0 +1,61 @@
+package pii
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"gorm.io/gorm/schema"
+)
+
+// SerializerName - use as `gorm:"serializer:pii"` on string fields to be stored encrypted
+const SerializerName = "pii"
+
+func init() {
+	schema.RegisterSerializer(SerializerName, Serializer{})
+}
+
+// Serializer encrypts string fields on write and decrypts them on read using the current keyring;
+// without keyring values are written as is, plaintext values from DB are read as is
+type Serializer struct{}
+
+// Scan implements schema.SerializerInterface
+func (Serializer) Scan(ctx context.Context, field *schema.Field, dst reflect.Value, dbValue interface{}) error {
+	var stored string
+	switch v := dbValue.(type) {
+	case nil:
+		return nil
+	case string:
+		stored = v
+	case []byte:
+		stored = string(v)
+	default:
+		return fmt.Errorf("pii: unsupported DB value type %T for %s", dbValue, field.Name)
+	}
+
+	plaintext := stored
+	if IsEncrypted(stored) {
+		kr := Current()
+		if kr == nil {
+			return fmt.Errorf("pii: %s is encrypted: %w", field.Name, ErrNoKeyring)
+		}
+		var err error
+		if plaintext, err = kr.Decrypt(stored); err != nil {
+			return fmt.Errorf("pii: %s: %w", field.Name, err)
+		}
+	}
+	return field.Set(ctx, dst, plaintext)
+}
+
+// Value implements schema.SerializerInterface
+func (Serializer) Value(_ context.Context, field *schema.Field, _ reflect.Value, fieldValue interface{}) (interface{}, error) {
+	s, ok := fieldValue.(string)
+	if !ok {
+		return nil, fmt.Errorf("pii: field %s must be string, got %T", field.Name, fieldValue)
+	}
+	kr := Current()
+	if kr == nil {
+		return s, nil
+	}
+	return kr.Encrypt(s)
+}
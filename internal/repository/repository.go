@@ -3,26 +3,44 @@ package repository
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"orderservice/internal/metrics"
 	"orderservice/internal/model"
+	"orderservice/internal/pii"
+	"orderservice/internal/tracing"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // OrderRepository -
 type OrderRepository interface {
-	AddNewOrder(ctx context.Context, neworder *model.Order) error
+	AddNewOrder(ctx context.Context, neworder *model.Order, keys ...model.IdempotencyKey) error
 	GetOrderByUID(ctx context.Context, uid string) (*model.Order, error)
+	GetOrdersByUIDs(ctx context.Context, uids []string) ([]model.Order, error)
 	GetAllOrders(ctx context.Context, count int) ([]model.Order, error)
+	GetMostAccessedOrders(ctx context.Context, count int) ([]model.Order, error)
+	GetOrdersByCustomers(ctx context.Context, customerIDs []string, count int) ([]model.Order, error)
+	IncrementOrderAccesses(ctx context.Context, counts map[string]int64) error
+	AddAuditEvents(ctx context.Context, events []model.AuditEvent) error
+	GetOrdersByContact(ctx context.Context, email, phone string) ([]model.Order, error)
+	ReencryptDeliveries(ctx context.Context, batch int) (int, error)
+	AnonymizeCustomer(ctx context.Context, customerID string) ([]string, error)
 }
 
+// ErrEncryptionDisabled - lookups by blind index and re-encryption need a PII keyring
+var ErrEncryptionDisabled = errors.New("PII encryption is not configured")
+
 type orderRepository struct {
 	DB           *gorm.DB
 	dsn          string      // для переподключения если отвалилась база
@@ -37,129 +55,396 @@ func NewOrderRepository(db *gorm.DB, dsnDB string) OrderRepository {
 
 // GetOrderByUID finds order by its UUID and provides it with error message(if any)
 func (OR *orderRepository) GetOrderByUID(ctx context.Context, uid string) (*model.Order, error) {
-	var order model.Order
-	for range 3 { // ограничимся тройным циклом вместо рекурсивного вызова всей AddNewOrder
-		err := OR.DB.WithContext(ctx).Preload("Delivery").Preload("Payment").Preload("Items").Where("order_uid = ?", uid).First(&order).Error
-		if err == nil { // если успешно - сразу выходим из цикла и функции
-			return &order, nil
-		}
+	defer metrics.ObserveDBQuery("GetOrderByUID", time.Now())
+	ctx, span := startSpan(ctx, "GetOrderByUID")
+	defer span.End()
 
-		if isConnectionError(err) {
-			switch OR.reconnecting.Load() {
-			case true: // если ошибка соединения и уже запущено переподключение - ждем и пробуем снова
-				time.Sleep(15 * time.Second)
-				continue
-			case false:
-				if conErr := OR.connectWithRetry(); conErr != nil { // если не получилось восстановить соединение с одной попытки - выход из функции
-					return nil, conErr
-				}
-				continue
-			}
-		}
+	var order model.Order
+	err := OR.withReconnect(ctx, span, func(db *gorm.DB) error {
+		return withOrderRelations(db).Where("order_uid = ?", uid).First(&order).Error
+	})
+	if err != nil {
 		return nil, err
 	}
 	return &order, nil
 }
 
-// AddNewOrder creates a new record in DB using ctx and transaction
-func (OR *orderRepository) AddNewOrder(ctx context.Context, neworder *model.Order) error {
-	var tx *gorm.DB
+// GetOrdersByUIDs returns existing orders among the given UIDs, missing ones are silently skipped
+func (OR *orderRepository) GetOrdersByUIDs(ctx context.Context, uids []string) ([]model.Order, error) {
+	defer metrics.ObserveDBQuery("GetOrdersByUIDs", time.Now())
+	ctx, span := startSpan(ctx, "GetOrdersByUIDs", attribute.Int("db.uids", len(uids)))
+	defer span.End()
+
+	var orders []model.Order
+	err := OR.withReconnect(ctx, span, func(db *gorm.DB) error {
+		return withOrderRelations(db).Where("order_uid IN ?", uids).Find(&orders).Error
+	})
+	return orders, err
+}
+
+// DuplicateError - order was not saved because one of its idempotency keys, its UID or payment transaction is taken
+type DuplicateError struct {
+	Existing model.IdempotencyKey // PayloadHash пуст, если занятый заказ сохранен без ключей идемпотентности
+}
+
+func (e *DuplicateError) Error() string {
+	return fmt.Sprintf("%s is taken by order %s", e.Existing.Key, e.Existing.OrderUID)
+}
+
+// AddNewOrder creates a new record in DB using ctx and transaction; idempotency keys are inserted in the same transaction,
+// so exactly one of concurrent consumers saves the order and others get *DuplicateError
+func (OR *orderRepository) AddNewOrder(ctx context.Context, neworder *model.Order, keys ...model.IdempotencyKey) error {
+	defer metrics.ObserveDBQuery("AddNewOrder", time.Now())
+	ctx, span := startSpan(ctx, "AddNewOrder", attribute.String("order.uid", neworder.OrderUID))
+	defer span.End()
+
 	neworder.Delivery.DID = nil
 	neworder.Payment.PID = nil
 	for i := range neworder.Items {
 		neworder.Items[i].IID = nil
 	}
 
-	auxFunc := func() error {
-		tx = OR.DB.WithContext(ctx).Begin()
-
-		// Создаём заказ, если его ещё нет
-		if err := tx.FirstOrCreate(&neworder, model.Order{OrderUID: neworder.OrderUID}).Error; err != nil {
+	return OR.withReconnect(ctx, span, func(db *gorm.DB) error {
+		tx := db.Begin()
+		if err := insertOrder(tx, neworder, keys); err != nil {
 			tx.Rollback()
 			return err
 		}
-
-		// Delivery
-		neworder.Delivery.OrderUID = neworder.OrderUID
-		if err := tx.FirstOrCreate(&neworder.Delivery, model.Delivery{OrderUID: neworder.OrderUID}).Error; err != nil {
+		if err := tx.Commit().Error; err != nil {
 			tx.Rollback()
 			return err
 		}
+		return nil
+	})
+}
 
-		// Payment
-		neworder.Payment.OrderUID = neworder.OrderUID
-		if err := tx.FirstOrCreate(&neworder.Payment, model.Payment{OrderUID: neworder.OrderUID}).Error; err != nil {
-			tx.Rollback()
-			return err
-		}
+// insertOrder - вставки с ON CONFLICT DO NOTHING не прерывают транзакцию при конфликте, а ничего не вставляют:
+// так занятый ключ отличается от ошибки запроса, а гонку между репликами решают уникальные индексы
+func insertOrder(tx *gorm.DB, neworder *model.Order, keys []model.IdempotencyKey) error {
+	onConflict := clause.OnConflict{DoNothing: true}
 
-		// Items — вставляем все новые элементы
-		for i := range neworder.Items {
-			neworder.Items[i].OrderUID = neworder.OrderUID
+	// Ключи идемпотентности - первыми, по ним находится заказ, с которым конфликтует сообщение
+	for _, key := range keys {
+		res := tx.Clauses(onConflict).Create(&key)
+		if res.Error != nil {
+			return res.Error
 		}
-		if err := tx.Create(&neworder.Items).Error; err != nil {
-			tx.Rollback()
-			return err
+		if res.RowsAffected == 0 {
+			var existing model.IdempotencyKey
+			if err := tx.Where("key = ?", key.Key).First(&existing).Error; err != nil {
+				return err
+			}
+			return &DuplicateError{Existing: existing}
 		}
+	}
 
-		if err := tx.Commit().Error; err != nil {
-			tx.Rollback()
+	// Заказ и оплата без ключей - сохраненные раньше заказы защищены только уникальными индексами
+	res := tx.Omit(clause.Associations).Clauses(onConflict).Create(neworder)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return &DuplicateError{Existing: model.IdempotencyKey{Key: model.OrderKey(neworder.OrderUID), OrderUID: neworder.OrderUID}}
+	}
+
+	// Delivery
+	neworder.Delivery.OrderUID = neworder.OrderUID
+	if err := tx.Create(&neworder.Delivery).Error; err != nil {
+		return err
+	}
+
+	// Payment
+	neworder.Payment.OrderUID = neworder.OrderUID
+	res = tx.Clauses(onConflict).Create(&neworder.Payment)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		existing := model.IdempotencyKey{Key: model.PaymentKey(neworder.Payment.Transaction)}
+		if err := tx.Model(&model.Payment{}).Where("transaction = ?", neworder.Payment.Transaction).
+			Select("order_uid").Scan(&existing.OrderUID).Error; err != nil {
 			return err
 		}
+		return &DuplicateError{Existing: existing}
+	}
+
+	// Items — вставляем все новые элементы
+	for i := range neworder.Items {
+		neworder.Items[i].OrderUID = neworder.OrderUID
+	}
+	return tx.Create(&neworder.Items).Error
+}
+
+// GetAllOrders retreives existing orders from DB with limit=count, used for warming up cache at app launch
+func (OR *orderRepository) GetAllOrders(ctx context.Context, count int) ([]model.Order, error) {
+	defer metrics.ObserveDBQuery("GetAllOrders", time.Now())
+	ctx, span := startSpan(ctx, "GetAllOrders", attribute.Int("db.limit", count))
+	defer span.End()
+
+	var orders []model.Order
+	err := OR.withReconnect(ctx, span, func(db *gorm.DB) error {
+		return withOrderRelations(db).Order("date_created DESC").Limit(count).Find(&orders).Error
+	})
+	return orders, err
+}
+
+// GetMostAccessedOrders returns up to count orders with the highest number of API lookups
+func (OR *orderRepository) GetMostAccessedOrders(ctx context.Context, count int) ([]model.Order, error) {
+	defer metrics.ObserveDBQuery("GetMostAccessedOrders", time.Now())
+	ctx, span := startSpan(ctx, "GetMostAccessedOrders", attribute.Int("db.limit", count))
+	defer span.End()
+
+	var orders []model.Order
+	err := OR.withReconnect(ctx, span, func(db *gorm.DB) error {
+		return withOrderRelations(db).
+			Joins("JOIN order_accesses ON order_accesses.order_uid = orders.order_uid").
+			Order("order_accesses.count DESC, order_accesses.last_access_at DESC").
+			Limit(count).Find(&orders).Error
+	})
+	return orders, err
+}
+
+// GetOrdersByCustomers returns up to count latest orders of the given customers, count <= 0 - all of them
+func (OR *orderRepository) GetOrdersByCustomers(ctx context.Context, customerIDs []string, count int) ([]model.Order, error) {
+	defer metrics.ObserveDBQuery("GetOrdersByCustomers", time.Now())
+	ctx, span := startSpan(ctx, "GetOrdersByCustomers", attribute.Int("db.customers", len(customerIDs)), attribute.Int("db.limit", count))
+	defer span.End()
+
+	var orders []model.Order
+	err := OR.withReconnect(ctx, span, func(db *gorm.DB) error {
+		q := withOrderRelations(db).Where("customer_id IN ?", customerIDs).Order("date_created DESC")
+		if count > 0 {
+			q = q.Limit(count)
+		}
+		return q.Find(&orders).Error
+	})
+	return orders, err
+}
+
+// IncrementOrderAccesses adds lookup counters accumulated in memory to order_accesses with one upsert
+func (OR *orderRepository) IncrementOrderAccesses(ctx context.Context, counts map[string]int64) error {
+	if len(counts) == 0 {
 		return nil
 	}
+	defer metrics.ObserveDBQuery("IncrementOrderAccesses", time.Now())
+	ctx, span := startSpan(ctx, "IncrementOrderAccesses", attribute.Int("db.rows", len(counts)))
+	defer span.End()
 
-	for range 3 {
-		err := auxFunc()
-		if err == nil {
-			return nil
+	now := time.Now().UTC()
+	rows := make([]model.OrderAccess, 0, len(counts))
+	for uid, n := range counts {
+		rows = append(rows, model.OrderAccess{OrderUID: uid, Count: n, LastAccessAt: now})
+	}
+	return OR.withReconnect(ctx, span, func(db *gorm.DB) error {
+		return db.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "order_uid"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{
+				"count":          gorm.Expr("order_accesses.count + excluded.count"),
+				"last_access_at": gorm.Expr("excluded.last_access_at"),
+			}),
+		}).Create(&rows).Error
+	})
+}
+
+// AddAuditEvents appends a batch of audit records with one insert
+func (OR *orderRepository) AddAuditEvents(ctx context.Context, events []model.AuditEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	defer metrics.ObserveDBQuery("AddAuditEvents", time.Now())
+	ctx, span := startSpan(ctx, "AddAuditEvents", attribute.Int("db.rows", len(events)))
+	defer span.End()
+
+	return OR.withReconnect(ctx, span, func(db *gorm.DB) error {
+		return db.Create(&events).Error
+	})
+}
+
+// GetOrdersByContact finds orders by delivery email and/or phone through blind indexes, empty arguments are ignored
+func (OR *orderRepository) GetOrdersByContact(ctx context.Context, email, phone string) ([]model.Order, error) {
+	kr := pii.Current()
+	if kr == nil {
+		return nil, ErrEncryptionDisabled
+	}
+	defer metrics.ObserveDBQuery("GetOrdersByContact", time.Now())
+	ctx, span := startSpan(ctx, "GetOrdersByContact")
+	defer span.End()
+
+	var (
+		cond []string
+		args []interface{}
+	)
+	if email != "" {
+		cond = append(cond, "email_index = ?")
+		args = append(args, kr.BlindIndex(model.IndexEmail, pii.NormalizeEmail(email)))
+	}
+	if phone != "" {
+		cond = append(cond, "phone_index = ?")
+		args = append(args, kr.BlindIndex(model.IndexPhone, pii.NormalizePhone(phone)))
+	}
+	if len(cond) == 0 {
+		return nil, nil
+	}
+
+	var orders []model.Order
+	err := OR.withReconnect(ctx, span, func(db *gorm.DB) error {
+		sub := db.Session(&gorm.Session{NewDB: true}).Model(&model.Delivery{}).Select("order_uid").Where(strings.Join(cond, " AND "), args...)
+		return withOrderRelations(db).Where("order_uid IN (?)", sub).Find(&orders).Error
+	})
+	return orders, err
+}
+
+// AnonymizeCustomer replaces personal data in deliveries of all orders of the customer with model.ErasedValue
+// and clears their blind indexes; orders, payments and items are kept. Returns UIDs of affected orders
+func (OR *orderRepository) AnonymizeCustomer(ctx context.Context, customerID string) ([]string, error) {
+	defer metrics.ObserveDBQuery("AnonymizeCustomer", time.Now())
+	ctx, span := startSpan(ctx, "AnonymizeCustomer")
+	defer span.End()
+
+	var uids []string
+	err := OR.withReconnect(ctx, span, func(db *gorm.DB) error {
+		return db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(&model.Order{}).Where("customer_id = ?", customerID).Pluck("order_uid", &uids).Error; err != nil {
+				return err
+			}
+			if len(uids) == 0 {
+				return nil
+			}
+			// map не проходит через сериализатор pii: метка удаления пишется открытым текстом и так же читается
+			return tx.Model(&model.Delivery{}).Where("order_uid IN ?", uids).Updates(map[string]interface{}{
+				"name":        model.ErasedValue,
+				"phone":       model.ErasedValue,
+				"zip":         model.ErasedValue,
+				"address":     model.ErasedValue,
+				"email":       model.ErasedValue,
+				"email_index": "",
+				"phone_index": "",
+			}).Error
+		})
+	})
+	return uids, err
+}
+
+// rawDelivery - зашифрованные колонки как есть, без сериализатора
+type rawDelivery struct {
+	DID     uint
+	Name    string
+	Phone   string
+	Address string
+	Email   string
+}
+
+// ReencryptDeliveries re-encrypts up to batch deliveries stored in plaintext or under a non-active key
+// and refreshes their blind indexes; erased deliveries are left as they are. A row changed after it was read
+// (for example, erased by AnonymizeCustomer) is skipped, not overwritten. Returns number of rows handled in the batch,
+// 0 when nothing is left
+func (OR *orderRepository) ReencryptDeliveries(ctx context.Context, batch int) (int, error) {
+	kr := pii.Current()
+	if kr == nil {
+		return 0, ErrEncryptionDisabled
+	}
+	defer metrics.ObserveDBQuery("ReencryptDeliveries", time.Now())
+	ctx, span := startSpan(ctx, "ReencryptDeliveries", attribute.Int("db.limit", batch))
+	defer span.End()
+
+	current := "enc:v1:" + kr.ActiveKeyID() + ":%"
+	var handled, skipped int
+	err := OR.withReconnect(ctx, span, func(db *gorm.DB) error {
+		var rows []rawDelivery
+		err := db.Table("deliveries").Select("d_id, name, phone, address, email").
+			Where("(name NOT LIKE ? OR phone NOT LIKE ? OR address NOT LIKE ? OR email NOT LIKE ?) AND name <> ?",
+				current, current, current, current, model.ErasedValue).
+			Order("d_id").Limit(batch).Scan(&rows).Error
+		if err != nil {
+			return err
 		}
 
-		if isConnectionError(err) {
-			switch OR.reconnecting.Load() {
-			case true:
-				time.Sleep(15 * time.Second)
-				continue
-			case false:
-				if conErr := OR.connectWithRetry(); conErr != nil {
-					return conErr
+		skipped = 0
+		return db.Transaction(func(tx *gorm.DB) error {
+			for _, row := range rows {
+				// у стертых данных пустые слепые индексы - пересчет записал бы одинаковые индексы всем стертым клиентам
+				if row.Name == model.ErasedValue || row.Email == model.ErasedValue {
+					skipped++
+					continue
+				}
+				values := map[string]interface{}{}
+				plain := map[string]string{}
+				for col, v := range map[string]string{"name": row.Name, "phone": row.Phone, "address": row.Address, "email": row.Email} {
+					p, err := kr.Decrypt(v)
+					if err != nil {
+						return fmt.Errorf("delivery %d, %s: %w", row.DID, col, err)
+					}
+					plain[col] = p
+					if values[col], err = kr.Encrypt(p); err != nil {
+						return err
+					}
+				}
+				values["email_index"] = kr.BlindIndex(model.IndexEmail, pii.NormalizeEmail(plain["email"]))
+				values["phone_index"] = kr.BlindIndex(model.IndexPhone, pii.NormalizePhone(plain["phone"]))
+				// строка читалась вне транзакции: пишем, только если с тех пор ее не изменили, иначе стертые
+				// за это время данные вернулись бы из прочитанной копии
+				res := tx.Table("deliveries").
+					Where("d_id = ? AND name = ? AND phone = ? AND address = ? AND email = ?", row.DID, row.Name, row.Phone, row.Address, row.Email).
+					Updates(values)
+				if res.Error != nil {
+					return res.Error
+				}
+				if res.RowsAffected == 0 {
+					skipped++
 				}
-				continue
 			}
-		}
-		return err
+			handled = len(rows)
+			return nil
+		})
+	})
+	if skipped > 0 {
+		slog.InfoContext(ctx, "Deliveries changed during re-encryption were skipped", "rows", skipped)
 	}
-	return nil
+	return handled, err
 }
 
-// GetAllOrders retreives existing orders from DB with limit=count, used for warming up cache at app launch
-func (OR *orderRepository) GetAllOrders(ctx context.Context, count int) ([]model.Order, error) {
-	var orders []model.Order
-
-	for range 3 { // ограничимся тройным циклом вместо рекурсивного вызова всей GetAllOrders
-		err := OR.DB.WithContext(ctx).Preload("Delivery").Preload("Payment").Preload("Items").Order("date_created DESC").Limit(count).Find(&orders).Error
+// withReconnect runs query up to 3 times restoring lost connection to DB between attempts
+// (ограничимся тройным циклом вместо рекурсивного вызова всего метода репозитория);
+// query receives the current connection, because reconnect replaces OR.DB
+func (OR *orderRepository) withReconnect(ctx context.Context, span trace.Span, query func(db *gorm.DB) error) error {
+	var err error
+	for range 3 {
+		err = query(OR.DB.WithContext(ctx))
 		if err == nil { // если успешно - сразу выходим из цикла и функции
-			return orders, nil
+			return nil
 		}
 
 		if isConnectionError(err) {
 			switch OR.reconnecting.Load() {
 			case true: // если ошибка соединения и уже запущено переподключение - ждем и пробуем снова
-				time.Sleep(15 * time.Second)
+				if err := sleepCtx(ctx, 15*time.Second); err != nil {
+					return err
+				}
 				continue
 			case false:
-				if conErr := OR.connectWithRetry(); conErr != nil { // если не получилось восстановить соединение с одной попытки - выход из функции
-					return nil, conErr
+				if conErr := OR.connectWithRetry(ctx); conErr != nil { // если не получилось восстановить соединение с одной попытки - выход из функции
+					tracing.RecordError(span, conErr)
+					return conErr
 				}
 				continue
 			}
 		}
-		return nil, err
+		var duplicate *DuplicateError
+		if !errors.Is(err, gorm.ErrRecordNotFound) && !errors.As(err, &duplicate) { // отсутствие записи и дубликат - не ошибки запроса
+			tracing.RecordError(span, err)
+		}
+		return err
 	}
-	return orders, nil
+	tracing.RecordError(span, err)
+	return err
+}
+
+// withOrderRelations - заказ всегда читается вместе с доставкой, оплатой и товарами
+func withOrderRelations(db *gorm.DB) *gorm.DB {
+	return db.Preload("Delivery").Preload("Payment").Preload("Items")
 }
 
-func (OR *orderRepository) connectWithRetry() error {
+func (OR *orderRepository) connectWithRetry(ctx context.Context) error {
 	OR.reconnecting.Store(true)
 	defer OR.reconnecting.Store(false)
 
@@ -177,24 +462,43 @@ func (OR *orderRepository) connectWithRetry() error {
 	}
 
 	for i := 0; i < maxRetries; i++ {
-		log.Printf("#%d attempt reconnecting to DB...", i+1)
+		slog.WarnContext(ctx, "Reconnecting to DB...", "attempt", i+1)
+		metrics.DBReconnectAttempts.Inc()
 		db, err = gorm.Open(postgres.Open(OR.dsn), &gorm.Config{})
 		if err == nil {
 			sqlDB, _ := db.DB()
 			pingErr := sqlDB.Ping()
 			if pingErr == nil {
 				OR.DB = db
-				log.Println("Successfully reconnected!")
+				slog.InfoContext(ctx, "Successfully reconnected to DB")
 				return nil
 			}
 			err = pingErr
 		}
-		time.Sleep(delay)
+		if ctxErr := sleepCtx(ctx, delay); ctxErr != nil {
+			return ctxErr
+		}
 	}
 
 	return fmt.Errorf("could not reconnect after %d retries: %w", maxRetries, err)
 }
 
+// sleepCtx - пауза между попытками, которую прерывает остановка сервиса
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// startSpan - общий спан для методов репозитория
+func startSpan(ctx context.Context, method string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append(attrs, attribute.String("db.system", "postgresql"), attribute.String("db.operation", method))
+	return tracing.Tracer().Start(ctx, "repository."+method, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
 func isConnectionError(err error) bool {
 	return strings.Contains(err.Error(), "bad connection") ||
 		strings.Contains(err.Error(), "connection refused") ||
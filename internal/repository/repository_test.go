@@ -0,0 +1,223 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"orderservice/internal/model"
+	"orderservice/internal/pii"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// deliveriesDB - драйвер database/sql с таблицей deliveries в памяти; понимает только запросы ReencryptDeliveries:
+// выборку строк на перешифрование и UPDATE с условиями равенства
+type deliveriesDB struct {
+	mu           sync.Mutex
+	rows         map[int64]map[string]string // d_id -> колонка -> значение
+	beforeUpdate func(db *deliveriesDB)      // вызывается один раз перед первым UPDATE, под mu
+}
+
+func (d *deliveriesDB) Open(string) (driver.Conn, error) { return deliveriesConn{d}, nil }
+
+type deliveriesConn struct{ db *deliveriesDB }
+
+func (c deliveriesConn) Prepare(query string) (driver.Stmt, error) {
+	return deliveriesStmt{db: c.db, query: query}, nil
+}
+func (c deliveriesConn) Close() error              { return nil }
+func (c deliveriesConn) Begin() (driver.Tx, error) { return deliveriesTx{}, nil }
+
+type deliveriesTx struct{}
+
+func (deliveriesTx) Commit() error   { return nil }
+func (deliveriesTx) Rollback() error { return nil }
+
+type deliveriesStmt struct {
+	db    *deliveriesDB
+	query string
+}
+
+func (s deliveriesStmt) Close() error  { return nil }
+func (s deliveriesStmt) NumInput() int { return -1 }
+
+var (
+	setColumn   = regexp.MustCompile(`"(\w+)"=\$(\d+)`)
+	whereColumn = regexp.MustCompile(`(\w+) = \$(\d+)`)
+)
+
+// Exec - UPDATE "deliveries" SET "col"=$1,... WHERE d_id = $n AND name = $m ...
+func (s deliveriesStmt) Exec(args []driver.Value) (driver.Result, error) {
+	set, where, ok := strings.Cut(s.query, " WHERE ")
+	if !strings.HasPrefix(s.query, "UPDATE") || !ok {
+		return nil, errors.New("unexpected exec: " + s.query)
+	}
+	arg := func(n string) string {
+		i, _ := strconv.Atoi(n)
+		switch v := args[i-1].(type) {
+		case int64:
+			return strconv.FormatInt(v, 10)
+		default:
+			return v.(string)
+		}
+	}
+
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	if s.db.beforeUpdate != nil {
+		s.db.beforeUpdate(s.db)
+		s.db.beforeUpdate = nil
+	}
+	var affected int64
+	for id, row := range s.db.rows {
+		row["d_id"] = strconv.FormatInt(id, 10)
+		matches := true
+		for _, m := range whereColumn.FindAllStringSubmatch(where, -1) {
+			matches = matches && row[m[1]] == arg(m[2])
+		}
+		if !matches {
+			continue
+		}
+		for _, m := range setColumn.FindAllStringSubmatch(set, -1) {
+			row[m[1]] = arg(m[2])
+		}
+		affected++
+	}
+	return driver.RowsAffected(affected), nil
+}
+
+// Query - строки, которые не стерты и не все колонки которых зашифрованы активным ключом(шаблон LIKE - первый аргумент)
+func (s deliveriesStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if !strings.HasPrefix(s.query, "SELECT d_id, name, phone, address, email FROM") {
+		return nil, errors.New("unexpected query: " + s.query)
+	}
+	current := strings.TrimSuffix(args[0].(string), "%")
+	erased, _ := args[4].(string) // условие на стертые строки, затем LIMIT
+
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	rows := &deliveriesRows{}
+	for _, id := range slices.Sorted(maps.Keys(s.db.rows)) {
+		row := s.db.rows[id]
+		if erased != "" && row["name"] == erased {
+			continue
+		}
+		for _, col := range []string{"name", "phone", "address", "email"} {
+			if !strings.HasPrefix(row[col], current) {
+				rows.values = append(rows.values, []driver.Value{id, row["name"], row["phone"], row["address"], row["email"]})
+				break
+			}
+		}
+	}
+	return rows, nil
+}
+
+type deliveriesRows struct {
+	values [][]driver.Value
+}
+
+func (r *deliveriesRows) Columns() []string {
+	return []string{"d_id", "name", "phone", "address", "email"}
+}
+func (r *deliveriesRows) Close() error { return nil }
+
+func (r *deliveriesRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+var registerDeliveries sync.Once
+
+func newDeliveriesRepo(t *testing.T, db *deliveriesDB) *orderRepository {
+	t.Helper()
+	registerDeliveries.Do(func() { sql.Register("deliveries-test", &deliveriesDriver{}) })
+	deliveriesDrivers.Store(t.Name(), db)
+	sqlDB, err := sql.Open("deliveries-test", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = sqlDB.Close() })
+	gdb, err := gorm.Open(postgres.New(postgres.Config{Conn: sqlDB}), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatalf("gorm.Open: %v", err)
+	}
+	return &orderRepository{DB: gdb}
+}
+
+// deliveriesDriver - sql.Register принимает один драйвер на имя, таблица теста выбирается по DSN
+type deliveriesDriver struct{}
+
+var deliveriesDrivers sync.Map // DSN(имя теста) -> *deliveriesDB
+
+func (deliveriesDriver) Open(dsn string) (driver.Conn, error) {
+	db, ok := deliveriesDrivers.Load(dsn)
+	if !ok {
+		return nil, errors.New("unknown test database " + dsn)
+	}
+	return db.(*deliveriesDB).Open(dsn)
+}
+
+func TestReencryptDeliveries_SkipsRowsErasedConcurrently(t *testing.T) {
+	kr, err := pii.NewKeyring("k2", map[string][]byte{"k2": bytes.Repeat([]byte{2}, 32)}, bytes.Repeat([]byte{9}, 32))
+	if err != nil {
+		t.Fatalf("NewKeyring: %v", err)
+	}
+	pii.SetKeyring(kr)
+	t.Cleanup(func() { pii.SetKeyring(nil) })
+
+	plain := func(name string) map[string]string {
+		return map[string]string{"name": name, "phone": "+79990000000", "address": "Lenina 1", "email": name + "@example.com"}
+	}
+	erased := func() map[string]string {
+		return map[string]string{"name": model.ErasedValue, "phone": model.ErasedValue, "address": model.ErasedValue,
+			"email": model.ErasedValue, "email_index": "", "phone_index": ""}
+	}
+	db := &deliveriesDB{rows: map[int64]map[string]string{
+		1: plain("alice"),
+		2: erased(),
+		3: plain("bob"),
+	}}
+	// клиент 3 стерт после чтения пакета, но до записи перешифрованных значений
+	db.beforeUpdate = func(db *deliveriesDB) { db.rows[3] = erased() }
+
+	repo := newDeliveriesRepo(t, db)
+	n, err := repo.ReencryptDeliveries(context.Background(), 10)
+	if err != nil {
+		t.Fatalf("ReencryptDeliveries: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("handled rows = %d, want 2", n)
+	}
+
+	if name := db.rows[1]["name"]; !strings.HasPrefix(name, "enc:v1:k2:") || db.rows[1]["email_index"] == "" {
+		t.Errorf("row 1 must be re-encrypted with the active key, got %v", db.rows[1])
+	}
+	for _, id := range []int64{2, 3} {
+		row := db.rows[id]
+		for _, col := range []string{"name", "phone", "address", "email"} {
+			if row[col] != model.ErasedValue {
+				t.Errorf("row %d: erased %s overwritten with %q", id, col, row[col])
+			}
+		}
+		if row["email_index"] != "" || row["phone_index"] != "" {
+			t.Errorf("row %d: blind indexes of erased delivery must stay empty, got %q/%q", id, row["email_index"], row["phone_index"])
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"time"
+
+	"orderservice/internal/cloudevents"
+	"orderservice/internal/messaging"
+	"orderservice/internal/metrics"
+	"orderservice/internal/model"
+	"orderservice/internal/signature"
+	"orderservice/internal/tracing"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// DuplicatePolicy - what to do with a consumed order whose idempotency key is already taken
+type DuplicatePolicy string
+
+const (
+	DuplicateSkip     DuplicatePolicy = "skip"     // отбросить с записью в лог
+	DuplicateConflict DuplicatePolicy = "conflict" // опубликовать в топик конфликтов
+)
+
+// IdempotencyConfig - identity of consumed messages and policies for identical and conflicting duplicates
+type IdempotencyConfig struct {
+	MessageKey  bool            // ключ сообщения Kafka - ключ идемпотентности сообщений без CloudEvent, только если он уникален для заказа
+	Identical   DuplicatePolicy // повтор с тем же содержимым, "" - skip
+	Conflicting DuplicatePolicy // другое содержимое под занятым ключом, "" - conflict
+}
+
+// EventTypeOrderConflict - type of CloudEvents published to the conflict topic
+const EventTypeOrderConflict = "orderservice.order.conflict"
+
+// payloadHash - hex SHA-256 канонической формы заказа(как для подписи): одинаковые заказы в разных форматах
+// и с разным порядком полей дают один хеш
+func payloadHash(o *model.Order) (string, error) {
+	canonical, err := signature.Canonical(o)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// idempotencyKeys - UID заказа, транзакция оплаты и идентичность сообщения: id события, а без конверта - ключ Kafka
+func (OS *orderService) idempotencyKeys(msg *messaging.Message, event *cloudevents.Event, o *model.Order, hash string) []model.IdempotencyKey {
+	keys := []string{model.OrderKey(o.OrderUID), model.PaymentKey(o.Payment.Transaction)}
+	switch {
+	case event != nil:
+		keys = append(keys, model.EventKey(event.Source, event.ID))
+	case OS.idempotency.MessageKey && len(msg.Key) > 0:
+		keys = append(keys, model.MessageKey(msg.Topic, msg.Key))
+	}
+
+	now := time.Now()
+	out := make([]model.IdempotencyKey, len(keys))
+	for i, key := range keys {
+		out[i] = model.IdempotencyKey{Key: key, OrderUID: o.OrderUID, PayloadHash: hash, CreatedAt: now}
+	}
+	return out
+}
+
+// handleDuplicate - повтор с тем же содержимым и другой заказ под занятым ключом обрабатываются по своим политикам
+func (OS *orderService) handleDuplicate(ctx context.Context, msg *messaging.Message, o *model.Order, hash string, existing model.IdempotencyKey) {
+	identical := existing.PayloadHash == hash
+	if existing.PayloadHash == "" {
+		// заказ сохранен без ключей идемпотентности - сравниваем с ним самим
+		identical = false
+		if stored, err := OS.lookupOrder(ctx, existing.OrderUID); err == nil {
+			storedHash, err := payloadHash(stored)
+			identical = err == nil && storedHash == hash
+		}
+	}
+	kind := model.KeyKind(existing.Key)
+
+	if identical {
+		slog.InfoContext(ctx, "Order already exists", "order_uid", o.OrderUID, "key", kind)
+		metrics.OrdersDuplicate.Inc()
+		if OS.idempotency.Identical != DuplicateConflict {
+			return
+		}
+	} else {
+		slog.WarnContext(ctx, "Order conflicts with an existing one", "order_uid", o.OrderUID, "key", kind, "existing_order_uid", existing.OrderUID)
+		metrics.OrdersConflicting.WithLabelValues(kind).Inc()
+		if OS.idempotency.Conflicting == DuplicateSkip {
+			return
+		}
+	}
+	OS.pushToConflicts(ctx, msg, existing, identical)
+}
+
+// pushToConflicts publishes the duplicate to the conflict topic with the taken key and the order holding it
+func (OS *orderService) pushToConflicts(ctx context.Context, msg *messaging.Message, existing model.IdempotencyKey, identical bool) {
+	if OS.conflicts == nil {
+		return
+	}
+	ctx, span := tracing.Tracer().Start(ctx, "kafka.produce "+OS.conflicts.Topic(), trace.WithSpanKind(trace.SpanKindProducer))
+	defer span.End()
+
+	duplicate := "conflicting"
+	if identical {
+		duplicate = "identical"
+	}
+	out, err := OS.forwardedMessage(ctx, msg, EventTypeOrderConflict, map[string]string{
+		"conflictkey":   existing.Key,
+		"existingorder": existing.OrderUID,
+		"duplicate":     duplicate,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to encode conflict CloudEvent", "error", err)
+		tracing.RecordError(span, err)
+		return
+	}
+
+	if err := publishWithRetry(ctx, span, OS.conflicts, out, metrics.ConflictWriteErrors); err != nil {
+		slog.WarnContext(ctx, "Conflict topic write abandoned on shutdown", "key", existing.Key)
+		metrics.ShutdownAbandoned.WithLabelValues("conflict").Inc()
+		return
+	}
+	slog.InfoContext(ctx, "Duplicate order sent to conflict topic", "key", existing.Key)
+}
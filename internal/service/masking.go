@@ -0,0 +1,140 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"unicode"
+
+	"orderservice/internal/auth"
+	"orderservice/internal/model"
+)
+
+// Role - who is viewing an order, defines which personal data is masked
+type Role string
+
+// Roles in order of decreasing access
+const (
+	RoleAdmin   Role = "admin"   // видит все
+	RoleSupport Role = "support" // связь с клиентом: контакты и адрес, без платежных идентификаторов
+	RoleAnalyst Role = "analyst" // обезличенные данные: город и регион, без имени, контактов и транзакций
+	RoleViewer  Role = "viewer"  // роль не назначена - маскируется все персональное
+)
+
+// rolePriority - при нескольких ролях действует самая широкая
+var rolePriority = []Role{RoleAdmin, RoleSupport, RoleAnalyst}
+
+// MaskPolicy lists fields of Delivery and Payment hidden from a role
+type MaskPolicy struct {
+	Name, Phone, Email, Address, Zip bool
+	Transaction, RequestID           bool
+}
+
+var maskPolicies = map[Role]MaskPolicy{
+	RoleAdmin:   {},
+	RoleSupport: {Transaction: true, RequestID: true},
+	RoleAnalyst: {Name: true, Phone: true, Email: true, Address: true, Zip: true, Transaction: true, RequestID: true},
+	RoleViewer:  {Name: true, Phone: true, Email: true, Address: true, Zip: true, Transaction: true, RequestID: true},
+}
+
+// RoleFromContext picks the widest known role of the authenticated caller;
+// without principal the most restrictive role is used
+func RoleFromContext(ctx context.Context) Role {
+	p := auth.FromContext(ctx)
+	if p == nil {
+		return RoleViewer
+	}
+	if p.HasScope(auth.ScopeAll) { // режим без аутентификации
+		return RoleAdmin
+	}
+	for _, r := range rolePriority {
+		for _, have := range p.Roles {
+			if Role(strings.ToLower(have)) == r {
+				return r
+			}
+		}
+	}
+	return RoleViewer
+}
+
+// maskOrder hides fields of order in place according to the policy of role
+func maskOrder(o *model.Order, role Role) {
+	p, ok := maskPolicies[role]
+	if !ok {
+		p = maskPolicies[RoleViewer]
+	}
+	d := &o.Delivery
+	if p.Name {
+		d.Name = maskName(d.Name)
+	}
+	if p.Phone {
+		d.Phone = maskPhone(d.Phone)
+	}
+	if p.Email {
+		d.Email = maskEmail(d.Email)
+	}
+	if p.Address {
+		d.Address = maskAll(d.Address)
+	}
+	if p.Zip {
+		d.Zip = maskAll(d.Zip)
+	}
+	if p.Transaction {
+		o.Payment.Transaction = maskKeepPrefix(o.Payment.Transaction, 4)
+	}
+	if p.RequestID {
+		o.Payment.RequestID = maskAll(o.Payment.RequestID)
+	}
+}
+
+// maskPhone - код страны и последние 4 цифры: +79720000785 -> +7 *** *** 78 85
+func maskPhone(phone string) string {
+	var digits []rune
+	for _, r := range phone {
+		if unicode.IsDigit(r) {
+			digits = append(digits, r)
+		}
+	}
+	if len(digits) < 7 {
+		return maskAll(phone)
+	}
+	prefix := ""
+	if strings.HasPrefix(strings.TrimSpace(phone), "+") {
+		prefix = "+"
+	}
+	last := digits[len(digits)-4:]
+	return prefix + string(digits[0]) + " *** *** " + string(last[:2]) + " " + string(last[2:])
+}
+
+// maskEmail - первая буква имени и домен: ivan@mail.ru -> i***@mail.ru
+func maskEmail(email string) string {
+	at := strings.LastIndexByte(email, '@')
+	if at <= 0 {
+		return maskAll(email)
+	}
+	first := []rune(email[:at])[0]
+	return string(first) + "***" + email[at:]
+}
+
+// maskName - первые буквы слов: Иван Петров -> И*** П***
+func maskName(name string) string {
+	words := strings.Fields(name)
+	for i, w := range words {
+		words[i] = string([]rune(w)[0]) + "***"
+	}
+	return strings.Join(words, " ")
+}
+
+func maskKeepPrefix(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return maskAll(s)
+	}
+	return string(r[:n]) + "***"
+}
+
+func maskAll(s string) string {
+	if s == "" {
+		return ""
+	}
+	return "***"
+}
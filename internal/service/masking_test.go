@@ -0,0 +1,115 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"orderservice/internal/auth"
+	"orderservice/internal/model"
+)
+
+type recordedAudit struct {
+	sync.Mutex
+	events []model.AuditEvent
+}
+
+func (r *recordedAudit) Record(ev model.AuditEvent) {
+	r.Lock()
+	defer r.Unlock()
+	r.events = append(r.events, ev)
+}
+
+func piiOrder(uid string) *model.Order {
+	return &model.Order{
+		OrderUID: uid,
+		Delivery: model.Delivery{Name: "Иван Петров", Phone: "+79720007885", Email: "ivan@mail.ru", Address: "ул. Ленина 1", Zip: "123456", City: "Казань"},
+		Payment:  model.Payment{Transaction: "b563feb7b2b84b6test", RequestID: "req-1", Bank: "alpha"},
+	}
+}
+
+func TestMaskHelpers(t *testing.T) {
+	cases := []struct{ got, want string }{
+		{maskPhone("+79720007885"), "+7 *** *** 78 85"},
+		{maskPhone("8 (972) 000-78-85"), "8 *** *** 78 85"},
+		{maskPhone("123"), "***"},
+		{maskEmail("ivan@mail.ru"), "i***@mail.ru"},
+		{maskEmail("broken"), "***"},
+		{maskName("Иван Петров"), "И*** П***"},
+		{maskKeepPrefix("b563feb7b2b84b6test", 4), "b563***"},
+		{maskAll(""), ""},
+	}
+	for _, c := range cases {
+		if c.got != c.want {
+			t.Errorf("got %q, want %q", c.got, c.want)
+		}
+	}
+}
+
+func TestGetOrderInfo_MasksByRole(t *testing.T) {
+	repo := &fakeRepo{GetOrderInfoFunc: func(ctx context.Context, uid string) (*model.Order, error) {
+		return piiOrder(uid), nil
+	}}
+	svc := newTestService(t, repo, 0)
+	rec := &recordedAudit{}
+	svc.audit = rec
+
+	tests := []struct {
+		name      string
+		principal *auth.Principal
+		wantRole  Role
+		check     func(t *testing.T, o *model.Order)
+	}{
+		{"admin", &auth.Principal{Subject: "root", Roles: []string{"admin"}}, RoleAdmin, func(t *testing.T, o *model.Order) {
+			if o.Delivery.Name != "Иван Петров" || o.Payment.Transaction != "b563feb7b2b84b6test" {
+				t.Errorf("admin must see everything: %+v", o.Delivery)
+			}
+		}},
+		{"support", &auth.Principal{Subject: "agent", Scopes: []string{"orders:read", "role:support"}, Roles: []string{"support"}}, RoleSupport, func(t *testing.T, o *model.Order) {
+			if o.Delivery.Phone != "+79720007885" || o.Delivery.Name != "Иван Петров" {
+				t.Errorf("support must see contacts: %+v", o.Delivery)
+			}
+			if o.Payment.Transaction != "b563***" {
+				t.Errorf("support must not see transaction: %q", o.Payment.Transaction)
+			}
+		}},
+		{"analyst", &auth.Principal{Subject: "bi", Roles: []string{"Analyst"}}, RoleAnalyst, func(t *testing.T, o *model.Order) {
+			d := o.Delivery
+			if d.Name != "И*** П***" || d.Email != "i***@mail.ru" || d.Phone != "+7 *** *** 78 85" || d.Address != "***" {
+				t.Errorf("analyst must not see personal data: %+v", d)
+			}
+			if d.City != "Казань" || o.Payment.Bank != "alpha" {
+				t.Errorf("analyst must see non-personal fields: %+v", o)
+			}
+		}},
+		{"no role", &auth.Principal{Subject: "key"}, RoleViewer, func(t *testing.T, o *model.Order) {
+			if o.Delivery.Phone == "+79720007885" {
+				t.Error("caller without role must see masked phone")
+			}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := auth.WithPrincipal(context.Background(), tt.principal)
+			o, err := svc.GetOrderInfo(ctx, "u1")
+			if err != nil {
+				t.Fatalf("GetOrderInfo: %v", err)
+			}
+			tt.check(t, o)
+
+			rec.Lock()
+			last := rec.events[len(rec.events)-1]
+			rec.Unlock()
+			if last.OrderUID != "u1" || last.Role != string(tt.wantRole) || last.Subject != tt.principal.Subject {
+				t.Errorf("audit event = %+v, want role %s", last, tt.wantRole)
+			}
+		})
+	}
+
+	// маскирование не должно портить закэшированный заказ
+	cached, ok := svc.Map.Get("u1")
+	if !ok || cached.Delivery.Phone != "+79720007885" {
+		t.Errorf("cached order must stay unmasked: %+v", cached.Delivery)
+	}
+}
@@ -0,0 +1,109 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"orderservice/internal/auth"
+	"orderservice/internal/model"
+	"orderservice/internal/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Actions of customer data requests recorded in audit log
+const (
+	ActionCustomerExport = "customer.export"
+	ActionCustomerErase  = "customer.erase"
+)
+
+var ErrCustomerNotFound = errors.New("заказы клиента не найдены")
+
+// CustomerExport - archive with all stored data of a customer
+type CustomerExport struct {
+	CustomerID string        `json:"customer_id"`
+	ExportedAt time.Time     `json:"exported_at"`
+	Orders     []model.Order `json:"orders"`
+}
+
+// ExportCustomerData returns all orders of the customer without masking; the export is recorded in audit log
+// before data is returned, so unaudited exports are impossible
+func (OS *orderService) ExportCustomerData(ctx context.Context, customerID string) (*CustomerExport, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "service.ExportCustomerData", trace.WithAttributes(attribute.String("customer.id", customerID)))
+	defer span.End()
+
+	orders, err := OS.Repo.GetOrdersByCustomers(ctx, []string{customerID}, 0)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+	if len(orders) == 0 {
+		return nil, ErrCustomerNotFound
+	}
+
+	uids := make([]string, len(orders))
+	for i := range orders {
+		uids[i] = orders[i].OrderUID
+	}
+	if err := OS.auditCustomer(ctx, ActionCustomerExport, customerID, uids); err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.Int("orders", len(orders)))
+	slog.InfoContext(ctx, "Customer data exported", "customer_id", customerID, "orders", len(orders))
+	return &CustomerExport{CustomerID: customerID, ExportedAt: time.Now().UTC(), Orders: orders}, nil
+}
+
+// EraseCustomerData anonymizes delivery data of all orders of the customer, keeping payments and items,
+// erases these orders from caches and cache snapshots of all replicas and records the erasure in audit log;
+// returns affected order UIDs. Repeated call is safe: already erased data is simply overwritten again
+func (OS *orderService) EraseCustomerData(ctx context.Context, customerID string) ([]string, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "service.EraseCustomerData", trace.WithAttributes(attribute.String("customer.id", customerID)))
+	defer span.End()
+
+	uids, err := OS.Repo.AnonymizeCustomer(ctx, customerID)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, err
+	}
+	if len(uids) == 0 {
+		return nil, ErrCustomerNotFound
+	}
+
+	// в кэшах и снапшотах остались исходные данные - стираем, следующий запрос прочитает обезличенную версию из БД;
+	// стирание в БД уже состоялось, поэтому журналируется в любом случае
+	cacheErr := OS.Map.Erase(uids)
+	if err := OS.auditCustomer(ctx, ActionCustomerErase, customerID, uids); err != nil {
+		tracing.RecordError(span, err)
+		return uids, fmt.Errorf("data erased, but audit record failed: %w", errors.Join(err, cacheErr))
+	}
+	if cacheErr != nil {
+		tracing.RecordError(span, cacheErr)
+		return uids, fmt.Errorf("data erased in DB, but cached copies may remain: %w", cacheErr)
+	}
+
+	span.SetAttributes(attribute.Int("orders", len(uids)))
+	slog.InfoContext(ctx, "Customer data erased", "customer_id", customerID, "orders", len(uids))
+	return uids, nil
+}
+
+// auditCustomer - операции над данными клиента журналируются сразу в БД, а не через буфер просмотров
+func (OS *orderService) auditCustomer(ctx context.Context, action, customerID string, uids []string) error {
+	subject := ""
+	if p := auth.FromContext(ctx); p != nil {
+		subject = p.Subject
+	}
+	role := string(RoleFromContext(ctx))
+	now := time.Now().UTC()
+
+	events := make([]model.AuditEvent, len(uids))
+	for i, uid := range uids {
+		events[i] = model.AuditEvent{At: now, Action: action, OrderUID: uid, CustomerID: customerID, Subject: subject, Role: role}
+	}
+	return OS.Repo.AddAuditEvents(ctx, events)
+}
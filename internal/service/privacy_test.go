@@ -0,0 +1,107 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"orderservice/internal/auth"
+	"orderservice/internal/cache"
+	"orderservice/internal/model"
+)
+
+func TestExportCustomerData(t *testing.T) {
+	var audited []model.AuditEvent
+	repo := &fakeRepo{
+		GetOrdersByCustomersFunc: func(ctx context.Context, customerIDs []string, count int) ([]model.Order, error) {
+			if count > 0 {
+				t.Errorf("export must not limit orders, count = %d", count)
+			}
+			if customerIDs[0] != "c1" {
+				return nil, nil
+			}
+			return []model.Order{*piiOrder("u1"), *piiOrder("u2")}, nil
+		},
+		AddAuditEventsFunc: func(ctx context.Context, events []model.AuditEvent) error {
+			audited = append(audited, events...)
+			return nil
+		},
+	}
+	svc := newTestService(t, repo, 0)
+	ctx := auth.WithPrincipal(context.Background(), &auth.Principal{Subject: "dpo", Roles: []string{"admin"}})
+
+	export, err := svc.ExportCustomerData(ctx, "c1")
+	if err != nil {
+		t.Fatalf("ExportCustomerData: %v", err)
+	}
+	if len(export.Orders) != 2 || export.Orders[0].Delivery.Phone != "+79720007885" {
+		t.Errorf("export must contain all unmasked orders: %+v", export.Orders)
+	}
+	if len(audited) != 2 || audited[0].Action != ActionCustomerExport || audited[0].CustomerID != "c1" || audited[0].Subject != "dpo" {
+		t.Errorf("unexpected audit events %+v", audited)
+	}
+
+	if _, err := svc.ExportCustomerData(ctx, "unknown"); !errors.Is(err, ErrCustomerNotFound) {
+		t.Errorf("unknown customer error = %v", err)
+	}
+
+	// без записи в журнал данные не отдаются
+	repo.AddAuditEventsFunc = func(context.Context, []model.AuditEvent) error { return errors.New("db down") }
+	if _, err := svc.ExportCustomerData(ctx, "c1"); err == nil {
+		t.Error("export must fail when audit cannot be recorded")
+	}
+}
+
+func TestEraseCustomerData(t *testing.T) {
+	var audited []model.AuditEvent
+	repo := &fakeRepo{
+		AnonymizeCustomerFunc: func(ctx context.Context, customerID string) ([]string, error) {
+			if customerID != "c1" {
+				return nil, nil
+			}
+			return []string{"u1", "u2"}, nil
+		},
+		AddAuditEventsFunc: func(ctx context.Context, events []model.AuditEvent) error {
+			audited = append(audited, events...)
+			return nil
+		},
+	}
+	// снапшот уже записан с исходными данными - стирание должно переписать и его
+	snapshot := filepath.Join(t.TempDir(), "cache.json")
+	mapa, err := cache.NewOrderMap(repo, cache.Config{Size: 10, SnapshotPath: snapshot})
+	if err != nil {
+		t.Fatalf("NewOrderMap: %v", err)
+	}
+	svc := NewOrderService(repo, mapa, Config{}).(*orderService)
+	svc.Map.Add("u1", *piiOrder("u1"))
+	svc.Map.Add("u3", *piiOrder("u3"))
+	if err := mapa.SaveSnapshot(snapshot); err != nil {
+		t.Fatalf("SaveSnapshot: %v", err)
+	}
+
+	uids, err := svc.EraseCustomerData(context.Background(), "c1")
+	if err != nil || len(uids) != 2 {
+		t.Fatalf("EraseCustomerData = %v, %v", uids, err)
+	}
+	if _, ok := svc.Map.Get("u1"); ok {
+		t.Error("erased order must be purged from cache")
+	}
+	if _, ok := svc.Map.Get("u3"); !ok {
+		t.Error("orders of other customers must stay cached")
+	}
+	saved, err := cache.LoadSnapshot(snapshot, 0)
+	if err != nil {
+		t.Fatalf("LoadSnapshot: %v", err)
+	}
+	if len(saved) != 1 || saved[0].OrderUID != "u3" {
+		t.Errorf("erased order must be removed from cache snapshot, snapshot has %d orders", len(saved))
+	}
+	if len(audited) != 2 || audited[1].Action != ActionCustomerErase || audited[1].OrderUID != "u2" {
+		t.Errorf("unexpected audit events %+v", audited)
+	}
+
+	if _, err := svc.EraseCustomerData(context.Background(), "unknown"); !errors.Is(err, ErrCustomerNotFound) {
+		t.Errorf("unknown customer error = %v", err)
+	}
+}
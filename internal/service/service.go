@@ -3,32 +3,89 @@ package service
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
-	"log"
+	"fmt"
+	"log/slog"
 	"time"
 
+	"orderservice/internal/audit"
+	"orderservice/internal/auth"
 	"orderservice/internal/cache"
+	"orderservice/internal/cloudevents"
+	"orderservice/internal/codec"
+	"orderservice/internal/messaging"
+	"orderservice/internal/metrics"
 	"orderservice/internal/model"
 	"orderservice/internal/repository"
+	"orderservice/internal/signature"
+	"orderservice/internal/tracing"
 
 	"github.com/go-playground/validator"
-	"github.com/segmentio/kafka-go"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
 	"gorm.io/gorm"
 )
 
 type OrderService interface {
-	AddNewOrder(msg *kafka.Message)
+	AddNewOrder(ctx context.Context, msg *messaging.Message)
 	GetOrderInfo(ctx context.Context, uid string) (*model.Order, error)
+	ExportCustomerData(ctx context.Context, customerID string) (*CustomerExport, error)
+	EraseCustomerData(ctx context.Context, customerID string) ([]string, error)
 }
 
 // OrderService provides access to repo - DB operations, and contains a Map - cached orders
 type orderService struct {
-	Repo      repository.OrderRepository
-	Map       *cache.OrderMap
-	DLQwriter *kafka.Writer
+	Repo repository.OrderRepository
+	Map  cache.OrderCache
+	DLQ  messaging.MessageSink
+
+	lookups     singleflight.Group // объединение одновременных запросов в БД за одним и тем же UID
+	notFound    *lru.Cache         // UID отсутствующих в БД заказов -> время истечения записи
+	notFoundTTL time.Duration
+	accesses    AccessRecorder
+	audit       AuditRecorder
+	signatures  *signature.Verifier
+	decoder     *codec.Decoder
+	events      cloudevents.Emitter
+	conflicts   messaging.MessageSink
+	idempotency IdempotencyConfig
+}
+
+// Config - settings of service layer
+type Config struct {
+	DLQ         messaging.MessageSink // куда отправляются отклоненные сообщения
+	NotFoundTTL time.Duration         // сколько помнить отсутствующие в БД UID, 0 - не помнить
+	Accesses    AccessRecorder        // nil - обращения к заказам не учитываются
+	Audit       AuditRecorder         // nil - просмотры заказов не журналируются
+	Signatures  *signature.Verifier   // nil - internal_signature не проверяется
+	Decoder     *codec.Decoder        // nil - JSON, Protobuf и Avro по content-type, без реестра схем
+	Events      cloudevents.Emitter   // source и режим CloudEvents, в которых публикуются отклоненные сообщения
+	Conflicts   messaging.MessageSink // куда публикуются конфликтующие дубликаты, nil - только в лог
+	Idempotency IdempotencyConfig
+}
+
+// EventTypeOrderRejected - type of CloudEvents published to DLQ
+const EventTypeOrderRejected = "orderservice.order.rejected"
+
+// DefaultEventSource - source attribute of emitted CloudEvents when Config.Events.Source is empty
+const DefaultEventSource = "orderservice"
+
+// AccessRecorder counts successful order lookups through API
+type AccessRecorder interface {
+	Record(uid string)
 }
 
+// AuditRecorder journals access to personal data of orders
+type AuditRecorder interface {
+	Record(ev model.AuditEvent)
+}
+
+// ограничение на число запоминаемых несуществующих UID, чтобы сканер не раздул память
+const notFoundCacheSize = 10000
+
 var (
 	ErrRecordNotFound = errors.New("запрошенный номер заказа не найден в базе")
 	ErrJSONDecode     = errors.New("ошибка декодирования JSON-сообщения: ")
@@ -36,95 +93,365 @@ var (
 )
 
 // NewOrderService - returns *orderService
-func NewOrderService(repo repository.OrderRepository, mapa *cache.OrderMap, broker, topic string) OrderService {
-	dlqWriter := kafka.Writer{
-		Addr:  kafka.TCP(broker),
-		Topic: topic,
+func NewOrderService(repo repository.OrderRepository, mapa cache.OrderCache, cfg Config) OrderService {
+	notFound, _ := lru.New(notFoundCacheSize) // ошибка возможна только при неположительном размере
+	decoder := cfg.Decoder
+	if decoder == nil {
+		decoder = codec.NewDecoder(nil)
+	}
+	events := cfg.Events
+	if events.Source == "" {
+		events.Source = DefaultEventSource
+	}
+	return &orderService{
+		Repo:        repo,
+		Map:         mapa,
+		DLQ:         cfg.DLQ,
+		notFound:    notFound,
+		notFoundTTL: cfg.NotFoundTTL,
+		accesses:    cfg.Accesses,
+		audit:       cfg.Audit,
+		signatures:  cfg.Signatures,
+		decoder:     decoder,
+		events:      events,
+		conflicts:   cfg.Conflicts,
+		idempotency: cfg.Idempotency,
 	}
-	return &orderService{Repo: repo, Map: mapa, DLQwriter: &dlqWriter}
 }
 
-// AddNewOrder receives rawJson from Kafka consumer and creates new order in DB if rawJSON is valid, otherwise adds broken JSON into table InvalidRequests
-func (OS *orderService) AddNewOrder(msg *kafka.Message) {
-	var order model.Order
+// AddNewOrder receives rawJson from Kafka consumer and creates new order in DB if rawJSON is valid, otherwise sends broken JSON to DLQ;
+// ctx is used for logging with correlation id of the message
+func (OS *orderService) AddNewOrder(ctx context.Context, msg *messaging.Message) {
+	ctx, span := tracing.Tracer().Start(ctx, "service.AddNewOrder")
+	defer span.End()
+
+	// Заказ в конверте CloudEvents(structured или binary) - данные события, id и source события отсекают его повторы
+	event, err := cloudevents.Parse(msg)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to parse CloudEvent", "error", err)
+		tracing.RecordError(span, err)
+		metrics.MessagesInvalid.WithLabelValues("cloudevent").Inc()
+		OS.pushToDLQ(ctx, msg, "cloudevent")
+		return
+	}
+	payload := msg
+	if event != nil {
+		payload = event.Payload(msg)
+		span.SetAttributes(attribute.String("cloudevents.event_id", event.ID), attribute.String("cloudevents.event_source", event.Source),
+			attribute.String("cloudevents.event_type", event.Type))
+		slog.InfoContext(ctx, "Order event received", "event_id", event.ID, "event_source", event.Source, "event_type", event.Type)
+	}
+
 	// Обработка ошибки декодирования
-	if err := json.Unmarshal(msg.Value, &order); err != nil {
-		log.Printf(ErrJSONDecode.Error(), err)
-		OS.pushToDLQ(msg.Value)
+	decoded, format, err := OS.decodeWithRetry(ctx, span, payload)
+	if err != nil {
+		if errors.Is(err, codec.ErrRegistryUnavailable) {
+			// остановка сервиса во время сбоя реестра: сообщение не закоммичено и после перезапуска будет разобрано снова
+			slog.WarnContext(ctx, "Order decoding abandoned on shutdown, schema registry is unavailable", "error", err)
+			tracing.RecordError(span, err)
+			return
+		}
+		// версия схемы новее поддерживаемой и отказ реестра(неверные учетные данные, нет прав) - отдельные причины:
+		// такие сообщения можно переиграть после обновления сервиса или исправления доступа к реестру
+		reason := "decode"
+		switch {
+		case errors.Is(err, codec.ErrFutureVersion):
+			reason = "schema_version"
+		case errors.Is(err, codec.ErrRegistryRejected):
+			reason = "schema_registry"
+			slog.ErrorContext(ctx, "Schema registry rejected the request, check SCHEMA_REGISTRY_* settings", "error", err)
+		}
+		slog.WarnContext(ctx, "Failed to decode order", "format", format, "reason", reason, "error", err)
+		tracing.RecordError(span, err)
+		metrics.MessagesInvalid.WithLabelValues(reason).Inc()
+		OS.pushToDLQ(ctx, msg, reason)
 		return
 	}
+	order := *decoded
+	if event != nil {
+		order.EventSource, order.EventID = event.Source, event.ID
+	}
+	span.SetAttributes(attribute.String("order.uid", order.OrderUID), attribute.String("message.format", format))
 
 	// Обработка ошибок валидации данных
 	validateOrder := validator.New()
 
-	err := validateOrder.Struct(order)
-	if err != nil {
+	if err := validateOrder.Struct(order); err != nil {
 		for _, e := range err.(validator.ValidationErrors) {
-			log.Printf("Order UID '%v': Поле '%s' не прошло проверку: %s\n", order.OrderUID, e.Field(), e.Tag())
+			slog.WarnContext(ctx, "Order field failed validation", "order_uid", order.OrderUID, "field", e.Namespace(), "rule", e.Tag())
 		}
-		OS.pushToDLQ(msg.Value)
+		tracing.RecordError(span, err)
+		metrics.MessagesInvalid.WithLabelValues("validation").Inc()
+		OS.pushToDLQ(ctx, msg, "validation")
 		return
 	}
 
-	// Проверка на существование в кеше
-	_, exists := OS.Map.CacheMap.Get(order.OrderUID)
-
-	if exists {
-		log.Printf("Заказ с номером '%s' уже существует!", order.OrderUID)
-		return
+	// Проверка подписи продюсера
+	if OS.signatures != nil {
+		if err := OS.signatures.Verify(&order); err != nil {
+			slog.WarnContext(ctx, "Order signature check failed", "order_uid", order.OrderUID, "entry", order.Entry, "error", err)
+			tracing.RecordError(span, err)
+			metrics.MessagesInvalid.WithLabelValues("signature").Inc()
+			OS.pushToDLQ(ctx, msg, "signature")
+			return
+		}
 	}
-	// Проверка на существование в БД
-	if _, err := OS.GetOrderInfo(context.Background(), order.OrderUID); err == nil {
-		log.Printf("Заказ с номером '%s' уже существует!", order.OrderUID)
+
+	// Записываем заказ в базу вместе с ключами идемпотентности: повторы и конфликты отсекают уникальные индексы БД,
+	// поэтому параллельные консюмеры и реплики не сохранят заказ дважды
+	hash, err := payloadHash(&order)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to hash order payload", "order_uid", order.OrderUID, "error", err)
+		tracing.RecordError(span, err)
 		return
 	}
-
-	// Записываем заказ в базу
-	if err := OS.Repo.AddNewOrder(context.Background(), &order); err != nil {
-		log.Printf("Failed to save order %s to DB: %v", order.OrderUID, err)
+	if err := OS.Repo.AddNewOrder(ctx, &order, OS.idempotencyKeys(msg, event, &order, hash)...); err != nil {
+		var duplicate *repository.DuplicateError
+		if errors.As(err, &duplicate) {
+			OS.handleDuplicate(ctx, msg, &order, hash, duplicate.Existing)
+			return
+		}
+		slog.ErrorContext(ctx, "Failed to save order to DB", "order_uid", order.OrderUID, "error", err)
+		tracing.RecordError(span, err)
 		return
 	}
 	// Обновление кеша
-	OS.Map.CacheMap.Add(order.OrderUID, order)
+	OS.Map.Add(order.OrderUID, order)
+	OS.notFound.Remove(order.OrderUID)
+	metrics.OrdersCreated.Inc()
 
-	log.Printf("Order '%s' created and cached", order.OrderUID)
+	slog.InfoContext(ctx, "Order created and cached", "order_uid", order.OrderUID, "event_source", order.EventSource)
 }
 
-// GetOrderInfo used only for API-calls, returns model.Order by its uuid from DB if there is any, or nil and error
+// GetOrderInfo used only for API-calls, returns model.Order by its uuid from DB if there is any, or nil and error;
+// personal data is masked according to the role of the caller from ctx and the view is journaled
 func (OS *orderService) GetOrderInfo(ctx context.Context, uid string) (*model.Order, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "service.GetOrderInfo", trace.WithAttributes(attribute.String("order.uid", uid)))
+	defer span.End()
+
+	order, err := OS.lookupOrder(ctx, uid)
+	if err != nil {
+		if !errors.Is(err, ErrRecordNotFound) {
+			tracing.RecordError(span, err)
+		}
+		return nil, err
+	}
+	if OS.accesses != nil {
+		OS.accesses.Record(uid)
+	}
+
+	// order - собственная копия вызывающего, маскируем прямо в ней
+	role := RoleFromContext(ctx)
+	maskOrder(order, role)
+	span.SetAttributes(attribute.String("enduser.role", string(role)))
+	if OS.audit != nil {
+		subject := ""
+		if p := auth.FromContext(ctx); p != nil {
+			subject = p.Subject
+		}
+		OS.audit.Record(model.AuditEvent{Action: audit.ActionView, OrderUID: uid, Subject: subject, Role: string(role)})
+	}
+	return order, nil
+}
+
+// lookupOrder - поиск заказа в кэше, затем в БД; используется и API, и сравнением дубликатов с сохраненным заказом
+func (OS *orderService) lookupOrder(ctx context.Context, uid string) (*model.Order, error) {
+	span := trace.SpanFromContext(ctx)
+
 	// Проверяем сначала кэш
-	if cached, ok := OS.Map.CacheMap.Get(uid); ok {
-		order := cached.(model.Order)
+	if order, ok := OS.getCached(ctx, uid); ok {
 		return &order, nil
 	}
 
-	// В кеше нет, идем в бд:
-	orderFromDB, err := OS.Repo.GetOrderByUID(ctx, uid)
-	if err == nil {
-		// Обновление кеша
-		OS.Map.CacheMap.Add(uid, orderFromDB)
-		return orderFromDB, nil
+	// Недавно уже искали и не нашли - в БД не идем
+	if OS.isKnownMissing(uid) {
+		metrics.CacheNegativeHits.Inc()
+		span.SetAttributes(attribute.Bool("cache.negative_hit", true))
+		return nil, ErrRecordNotFound
+	}
+
+	// В кеше нет, идем в бд - одним запросом на все одновременные промахи по этому UID;
+	// запрос не отменяется вместе с ctx первого вызвавшего, чтобы не уронить остальных ожидающих
+	dbCtx := context.WithoutCancel(ctx)
+	resCh := OS.lookups.DoChan(uid, func() (interface{}, error) {
+		return OS.Repo.GetOrderByUID(dbCtx, uid)
+	})
+
+	var res singleflight.Result
+	select {
+	case res = <-resCh:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if res.Shared {
+		metrics.CacheCoalescedLookups.Inc()
+	}
+
+	if res.Err == nil {
+		// результат общий для всех ожидавших - каждому своя копия
+		orderFromDB := res.Val.(*model.Order).Clone()
+		// Обновление кеша: заказ не менялся, копии других реплик не инвалидируем
+		OS.Map.Fill(uid, orderFromDB)
+		return &orderFromDB, nil
 	}
 
 	// Получили ошибку из бд
-	if errors.Is(err, gorm.ErrRecordNotFound) {
+	if errors.Is(res.Err, gorm.ErrRecordNotFound) {
+		OS.rememberMissing(uid)
 		return nil, ErrRecordNotFound
 	}
-	return nil, err
+	return nil, res.Err
 }
 
-func (OS *orderService) pushToDLQ(brokenJSON []byte) {
-	err := OS.DLQwriter.WriteMessages(context.Background(), kafka.Message{
-		Value: brokenJSON,
-	})
-	for err != nil {
-		log.Printf("Failed to write to DLQtopic: %v\nRetrying...", err)
-		time.Sleep(5 * time.Second)
-		err = OS.DLQwriter.WriteMessages(context.Background(), kafka.Message{
-			Value: brokenJSON,
-		})
-	}
-	log.Printf("Invalid JSON successfully sent to DLQ.")
+// isKnownMissing - есть ли UID в негативном кэше с неистекшим сроком
+func (OS *orderService) isKnownMissing(uid string) bool {
+	if OS.notFoundTTL <= 0 {
+		return false
+	}
+	v, ok := OS.notFound.Get(uid)
+	if !ok {
+		return false
+	}
+	if time.Now().After(v.(time.Time)) {
+		OS.notFound.Remove(uid)
+		return false
+	}
+	return true
+}
+
+func (OS *orderService) rememberMissing(uid string) {
+	if OS.notFoundTTL > 0 {
+		OS.notFound.Add(uid, time.Now().Add(OS.notFoundTTL))
+	}
+}
+
+// getCached - поиск в LRU с учетом метрик и отдельным спаном
+func (OS *orderService) getCached(ctx context.Context, uid string) (model.Order, bool) {
+	_, span := tracing.Tracer().Start(ctx, "cache.Get")
+	defer span.End()
+
+	cached, ok := OS.Map.Get(uid)
+	span.SetAttributes(attribute.Bool("cache.hit", ok))
+	if ok {
+		metrics.CacheHits.Inc()
+	} else {
+		metrics.CacheMisses.Inc()
+	}
+	return cached, ok
+}
+
+// DLQReasonHeader - header of DLQ messages with the rejection reason: cloudevent, decode, schema_version, schema_registry,
+// validation or signature
+const DLQReasonHeader = "dlq-reason"
+
+// pushToDLQ forwards the original message to DLQ keeping its key and headers, trace context of the current span
+// and the rejection reason are added
+func (OS *orderService) pushToDLQ(ctx context.Context, msg *messaging.Message, reason string) {
+	ctx, span := tracing.Tracer().Start(ctx, "kafka.produce "+OS.DLQ.Topic(), trace.WithSpanKind(trace.SpanKindProducer))
+	defer span.End()
+
+	dlqMsg, err := OS.forwardedMessage(ctx, msg, EventTypeOrderRejected, map[string]string{"dlqreason": reason},
+		messaging.Header{Key: DLQReasonHeader, Value: []byte(reason)})
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to encode DLQ CloudEvent", "error", err)
+		tracing.RecordError(span, err)
+		return
+	}
+
+	if err := publishWithRetry(ctx, span, OS.DLQ, dlqMsg, metrics.DLQWriteErrors); err != nil {
+		// остановка сервиса: сообщение не закоммичено и после перезапуска снова попадет в DLQ
+		slog.WarnContext(ctx, "DLQ write abandoned on shutdown", "reason", reason, "key", string(dlqMsg.Key))
+		metrics.ShutdownAbandoned.WithLabelValues("dlq").Inc()
+		return
+	}
+	metrics.DLQMessages.Inc()
+	slog.InfoContext(ctx, "Invalid message sent to DLQ")
+}
+
+// registryRetryInterval - первая пауза между попытками получить схему из реестра, далее она удваивается
+// до maxRegistryRetryInterval
+var (
+	registryRetryInterval    = time.Second
+	maxRegistryRetryInterval = time.Minute
+)
+
+// decodeWithRetry decodes msg retrying while schema registry is unavailable: such messages are valid and must not
+// go to DLQ. Gives up with codec.ErrRegistryUnavailable only when ctx is done
+func (OS *orderService) decodeWithRetry(ctx context.Context, span trace.Span, msg *messaging.Message) (*model.Order, string, error) {
+	interval := registryRetryInterval
+	for {
+		order, format, err := OS.decoder.Decode(ctx, msg)
+		if err == nil || !errors.Is(err, codec.ErrRegistryUnavailable) || ctx.Err() != nil {
+			return order, format, err
+		}
+		metrics.SchemaRegistryErrors.Inc()
+		span.AddEvent("retry", trace.WithAttributes(attribute.String("error", err.Error())))
+		slog.ErrorContext(ctx, "Failed to fetch message schema, retrying...", "retry_in", interval, "error", err)
+		select {
+		case <-ctx.Done():
+			return nil, format, err
+		case <-time.After(interval):
+		}
+		interval = min(2*interval, maxRegistryRetryInterval)
+	}
+}
+
+// publishRetryInterval - пауза между попытками записи в DLQ и топик конфликтов
+var publishRetryInterval = 5 * time.Second
+
+// publishWithRetry retries writing msg until it succeeds or ctx is done, ctx error is returned in the latter case;
+// on shutdown ctx of the message is cancelled when the drain timeout runs out
+func publishWithRetry(ctx context.Context, span trace.Span, sink messaging.MessageSink, msg messaging.Message, failures prometheus.Counter) error {
+	for {
+		err := sink.Publish(ctx, msg)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		failures.Inc()
+		span.AddEvent("retry", trace.WithAttributes(attribute.String("error", err.Error())))
+		slog.ErrorContext(ctx, "Failed to write to topic, retrying...", "topic", sink.Topic(), "error", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(publishRetryInterval):
+		}
+	}
+}
+
+// forwardedMessage - исходное сообщение как CloudEvent для DLQ и топика конфликтов: данные события - исходное сообщение
+// как есть; если оно само было событием, пересылаются его данные, а id, source и type сохраняются в расширениях
+func (OS *orderService) forwardedMessage(ctx context.Context, msg *messaging.Message, eventType string, extensions map[string]string,
+	headers ...messaging.Header) (messaging.Message, error) {
+	event := OS.events.NewEvent(eventType, msg.Value, "")
+	event.Extensions = extensions
+	origin, err := cloudevents.Parse(msg)
+	switch {
+	case origin != nil:
+		event.Data, event.DataContentType = origin.Data, origin.DataContentType
+		event.Extensions["originid"], event.Extensions["originsource"], event.Extensions["origintype"] = origin.ID, origin.Source, origin.Type
+	case err == nil:
+		if ct, ok := msg.Header(codec.ContentTypeHeader); ok {
+			event.DataContentType = string(ct)
+		}
+	}
+
+	out := messaging.Message{
+		Key:     msg.Key,
+		Headers: append(append([]messaging.Header(nil), msg.Headers...), headers...),
+	}
+	// сжимаемый DLQ не принимает сообщения без ключа - ключом становятся координаты исходного сообщения
+	if len(out.Key) == 0 {
+		out.Key = []byte(fmt.Sprintf("%s/%d/%d", msg.Topic, msg.Partition, msg.Offset))
+	}
+	event.Subject = string(out.Key)
+	if out, err = OS.events.Encode(event, out); err != nil {
+		return out, err
+	}
+	tracing.InjectKafka(ctx, &out)
+	return out, nil
 }
 
 /*
@@ -2,17 +2,24 @@
 package service
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"orderservice/internal/cache"
+	"orderservice/internal/codec"
+	"orderservice/internal/messaging"
+	"orderservice/internal/mocks"
 	"orderservice/internal/model"
+	"orderservice/internal/signature"
 
-	lru "github.com/hashicorp/golang-lru"
-	"github.com/segmentio/kafka-go"
 	"gorm.io/gorm"
 )
 
@@ -21,9 +28,13 @@ type fakeRepo struct {
 	AddNewOrderFunc  func(ctx context.Context, o *model.Order) error
 	GetOrderInfoFunc func(ctx context.Context, uid string) (*model.Order, error)
 	GetAllOrdersFunc func(ctx context.Context) ([]model.Order, error)
+
+	GetOrdersByCustomersFunc func(ctx context.Context, customerIDs []string, count int) ([]model.Order, error)
+	AnonymizeCustomerFunc    func(ctx context.Context, customerID string) ([]string, error)
+	AddAuditEventsFunc       func(ctx context.Context, events []model.AuditEvent) error
 }
 
-func (f *fakeRepo) AddNewOrder(ctx context.Context, o *model.Order) error {
+func (f *fakeRepo) AddNewOrder(ctx context.Context, o *model.Order, _ ...model.IdempotencyKey) error {
 	if f.AddNewOrderFunc != nil {
 		return f.AddNewOrderFunc(ctx, o)
 	}
@@ -37,6 +48,47 @@ func (f *fakeRepo) GetOrderByUID(ctx context.Context, uid string) (*model.Order,
 	return nil, gorm.ErrRecordNotFound
 }
 
+func (f *fakeRepo) GetOrdersByUIDs(ctx context.Context, uids []string) ([]model.Order, error) {
+	return nil, nil
+}
+
+func (f *fakeRepo) GetMostAccessedOrders(ctx context.Context, count int) ([]model.Order, error) {
+	return nil, nil
+}
+
+func (f *fakeRepo) GetOrdersByCustomers(ctx context.Context, customerIDs []string, count int) ([]model.Order, error) {
+	if f.GetOrdersByCustomersFunc != nil {
+		return f.GetOrdersByCustomersFunc(ctx, customerIDs, count)
+	}
+	return nil, nil
+}
+
+func (f *fakeRepo) IncrementOrderAccesses(ctx context.Context, counts map[string]int64) error {
+	return nil
+}
+
+func (f *fakeRepo) AddAuditEvents(ctx context.Context, events []model.AuditEvent) error {
+	if f.AddAuditEventsFunc != nil {
+		return f.AddAuditEventsFunc(ctx, events)
+	}
+	return nil
+}
+
+func (f *fakeRepo) GetOrdersByContact(ctx context.Context, email, phone string) ([]model.Order, error) {
+	return nil, nil
+}
+
+func (f *fakeRepo) ReencryptDeliveries(ctx context.Context, batch int) (int, error) {
+	return 0, nil
+}
+
+func (f *fakeRepo) AnonymizeCustomer(ctx context.Context, customerID string) ([]string, error) {
+	if f.AnonymizeCustomerFunc != nil {
+		return f.AnonymizeCustomerFunc(ctx, customerID)
+	}
+	return nil, nil
+}
+
 func (f *fakeRepo) GetAllOrders(ctx context.Context, count int) ([]model.Order, error) {
 	if f.GetAllOrdersFunc != nil {
 		return f.GetAllOrdersFunc(ctx)
@@ -55,18 +107,14 @@ func TestProcessKafkaMessage_OK(t *testing.T) {
 			return nil, nil
 		},
 	}
-	cacheTest, err := lru.New(1000)
+	mapa, err := cache.NewOrderMap(repo, cache.Config{Size: 1000})
 	if err != nil {
 		log.Printf("Failed to create lru-test-cache: %v", err)
 	}
-	mapa := cache.OrderMap{
-		CacheMap: cacheTest,
-		Repo:     repo,
-	}
 
-	svc := NewOrderService(repo, &mapa, "", "")
-	msg := kafka.Message{
-		Value: []byte(`{"order_uid":"u1","track_number":"T","entry":"WBIL","delivery":{"name":"A","phone":"1","zip":"1","city":"C","address":"A","region":"R","email":"e@e"},"payment":{"transaction":"u1","request_id":"","currency":"USD","provider":"p","amount":1,"payment_dt":1637907727,"bank":"b","delivery_cost":1,"goods_total":1,"custom_fee":500},"items":[{"chrt_id":1,"track_number":"T","price":1,"rid":"r","name":"n","sale":0,"size":"s","total_price":1,"nm_id":1,"brand":"b","status":1}],"locale":"en","internal_signature":"","customer_id":"c","delivery_service":"d","shardkey":"1","sm_id":1,"date_created":"2021-11-26T06:22:19Z","oof_shard":"1"}`),
+	svc := NewOrderService(repo, mapa, Config{})
+	msg := messaging.Message{
+		Value: []byte(`{"order_uid":"u1","track_number":"T","entry":"WBIL","delivery":{"name":"A","phone":"1","zip":"1","city":"C","address":"A","region":"R","email":"e@e.com"},"payment":{"transaction":"u1","request_id":"r1","currency":"USD","provider":"p","amount":1,"payment_dt":1637907727,"bank":"b","delivery_cost":1,"goods_total":1,"custom_fee":500},"items":[{"chrt_id":1,"track_number":"T","price":1,"rid":"r","name":"n","sale":0,"size":"s","total_price":1,"nm_id":1,"brand":"b","status":1}],"locale":"en","internal_signature":"","customer_id":"c","delivery_service":"d","shardkey":"1","sm_id":1,"date_created":"2021-11-26T06:22:19Z","oof_shard":"1"}`),
 	}
 	var testOrder model.Order
 	if err := json.Unmarshal(msg.Value, &testOrder); err != nil {
@@ -74,12 +122,11 @@ func TestProcessKafkaMessage_OK(t *testing.T) {
 	}
 	rawTestOrder, _ := json.Marshal(testOrder)
 
-	svc.AddNewOrder(&msg)
-	cached, ok := mapa.CacheMap.Get("u1")
+	svc.AddNewOrder(context.Background(), &msg)
+	svcOrder, ok := mapa.Get("u1")
 	if !ok {
 		t.Fatalf("expected order created and in cache")
 	}
-	svcOrder := cached.(model.Order)
 	rawSvcOrder, _ := json.Marshal(svcOrder)
 	if string(rawTestOrder) != string(rawSvcOrder) {
 		fmt.Println("Original json:", string(rawTestOrder))
@@ -87,3 +134,412 @@ func TestProcessKafkaMessage_OK(t *testing.T) {
 		t.Fatalf("expected input and output order data to be equal")
 	}
 }
+
+func newTestService(t *testing.T, repo *fakeRepo, notFoundTTL time.Duration) *orderService {
+	t.Helper()
+	mapa, err := cache.NewOrderMap(repo, cache.Config{Size: 10})
+	if err != nil {
+		t.Fatalf("Failed to create lru-test-cache: %v", err)
+	}
+	return NewOrderService(repo, mapa, Config{NotFoundTTL: notFoundTTL}).(*orderService)
+}
+
+func TestGetOrderInfo_CoalescesConcurrentMisses(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	repo := &fakeRepo{
+		GetOrderInfoFunc: func(ctx context.Context, uid string) (*model.Order, error) {
+			calls.Add(1)
+			<-release
+			return &model.Order{OrderUID: uid}, nil
+		},
+	}
+	svc := newTestService(t, repo, 0)
+
+	const concurrent = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, concurrent)
+	for range concurrent {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			order, err := svc.GetOrderInfo(context.Background(), "u1")
+			if err == nil && order.OrderUID != "u1" {
+				err = fmt.Errorf("got order %q", order.OrderUID)
+			}
+			errs <- err
+		}()
+	}
+	// даем горутинам дойти до ожидания общего запроса
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if got := calls.Load(); got != 1 {
+		t.Fatalf("repository called %d times, want 1", got)
+	}
+}
+
+func TestGetOrderInfo_CoalescedResultsAreIndependent(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	repo := &fakeRepo{
+		GetOrderInfoFunc: func(ctx context.Context, uid string) (*model.Order, error) {
+			calls.Add(1)
+			<-release
+			return &model.Order{OrderUID: uid, Delivery: model.Delivery{Name: "Ivan"}, Items: []model.Item{{Name: "item"}}}, nil
+		},
+	}
+	svc := newTestService(t, repo, 0)
+
+	// каждый ожидавший меняет свой заказ - под -race общий указатель из singleflight дал бы гонку
+	const concurrent = 10
+	var wg sync.WaitGroup
+	orders := make([]*model.Order, concurrent)
+	for i := range concurrent {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			order, err := svc.lookupOrder(context.Background(), "u1")
+			if err != nil {
+				t.Errorf("lookupOrder: %v", err)
+				return
+			}
+			order.Delivery.Name = fmt.Sprintf("caller %d", i)
+			order.Items[0].Name = fmt.Sprintf("caller %d", i)
+			orders[i] = order
+		}()
+	}
+	for calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	for i, order := range orders {
+		if order == nil {
+			continue
+		}
+		if want := fmt.Sprintf("caller %d", i); order.Delivery.Name != want || order.Items[0].Name != want {
+			t.Errorf("order of caller %d was changed by another caller: %q, %q", i, order.Delivery.Name, order.Items[0].Name)
+		}
+	}
+	cached, ok := svc.Map.Get("u1")
+	if !ok || cached.Delivery.Name != "Ivan" || cached.Items[0].Name != "item" {
+		t.Errorf("cached order was changed by callers: %+v", cached)
+	}
+}
+
+func TestGetOrderInfo_NegativeCache(t *testing.T) {
+	var calls atomic.Int32
+	repo := &fakeRepo{
+		GetOrderInfoFunc: func(ctx context.Context, uid string) (*model.Order, error) {
+			calls.Add(1)
+			return nil, gorm.ErrRecordNotFound
+		},
+	}
+	svc := newTestService(t, repo, 50*time.Millisecond)
+
+	for range 3 {
+		if _, err := svc.GetOrderInfo(context.Background(), "typo"); !errors.Is(err, ErrRecordNotFound) {
+			t.Fatalf("err = %v, want ErrRecordNotFound", err)
+		}
+	}
+	if got := calls.Load(); got != 1 {
+		t.Fatalf("repository called %d times within TTL, want 1", got)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if _, err := svc.GetOrderInfo(context.Background(), "typo"); !errors.Is(err, ErrRecordNotFound) {
+		t.Fatalf("err = %v, want ErrRecordNotFound", err)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Fatalf("repository called %d times after TTL, want 2", got)
+	}
+}
+
+func TestGetOrderInfo_DBMissThenCacheHit(t *testing.T) {
+	var calls atomic.Int32
+	repo := &fakeRepo{
+		GetOrderInfoFunc: func(ctx context.Context, uid string) (*model.Order, error) {
+			calls.Add(1)
+			return &model.Order{OrderUID: uid, Items: []model.Item{{Name: "item"}}}, nil
+		},
+	}
+	svc := newTestService(t, repo, 0)
+
+	first, err := svc.GetOrderInfo(context.Background(), "u1")
+	if err != nil {
+		t.Fatalf("DB path: %v", err)
+	}
+	// заказ, отданный вызывающему, не должен быть связан с закэшированным
+	first.Items[0].Name = "mutated"
+
+	second, err := svc.GetOrderInfo(context.Background(), "u1")
+	if err != nil {
+		t.Fatalf("cache path: %v", err)
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("repository called %d times, want 1", calls.Load())
+	}
+	if second.Items[0].Name != "item" {
+		t.Fatalf("cached order was mutated through returned pointer: %q", second.Items[0].Name)
+	}
+}
+
+func TestAddNewOrder_ThenCacheHit(t *testing.T) {
+	var lookups atomic.Int32
+	repo := &fakeRepo{
+		GetOrderInfoFunc: func(ctx context.Context, uid string) (*model.Order, error) {
+			lookups.Add(1)
+			return nil, gorm.ErrRecordNotFound
+		},
+	}
+	svc := newTestService(t, repo, time.Minute)
+
+	order := mocks.GenerateMockOrder()
+	raw, err := json.Marshal(order)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	svc.AddNewOrder(context.Background(), &messaging.Message{Value: raw})
+
+	got, err := svc.GetOrderInfo(context.Background(), order.OrderUID)
+	if err != nil {
+		t.Fatalf("ingested order must be served from cache: %v", err)
+	}
+	if got.OrderUID != order.OrderUID || len(got.Items) != len(order.Items) {
+		t.Fatalf("got %+v", got)
+	}
+	if lookups.Load() != 0 { // дубликаты отсекает БД при записи, чтения перед записью нет
+		t.Fatalf("repository lookups = %d, want 0", lookups.Load())
+	}
+}
+
+func TestAddNewOrder_SignedOrderAccepted(t *testing.T) {
+	var saved atomic.Int32
+	repo := &fakeRepo{
+		AddNewOrderFunc: func(ctx context.Context, o *model.Order) error {
+			saved.Add(1)
+			return nil
+		},
+	}
+	keys := signature.Keys{"WBIL": {bytes.Repeat([]byte{7}, 32)}}
+	svc := newTestService(t, repo, 0)
+	svc.signatures = signature.NewVerifier(keys)
+
+	order := mocks.GenerateMockOrder()
+	if err := mocks.SignOrder(order, keys); err != nil {
+		t.Fatalf("SignOrder: %v", err)
+	}
+	if order.Entry != "WBIL" {
+		t.Fatalf("generated order must be moved to configured entry, got %q", order.Entry)
+	}
+	raw, err := json.Marshal(order)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	svc.AddNewOrder(context.Background(), &messaging.Message{Value: raw})
+
+	if saved.Load() != 1 {
+		t.Fatalf("signed order must be saved, saves = %d", saved.Load())
+	}
+}
+
+// failingSink - брокер недоступен
+func TestAddNewOrder_BadSignatureToDLQ(t *testing.T) {
+	var saved atomic.Int32
+	repo := &fakeRepo{
+		AddNewOrderFunc: func(ctx context.Context, o *model.Order) error {
+			saved.Add(1)
+			return nil
+		},
+	}
+	b := messaging.NewBroker()
+	if err := b.CreateTopic("orders-dlq", 1); err != nil {
+		t.Fatal(err)
+	}
+	mapa, err := cache.NewOrderMap(repo, cache.Config{Size: 10})
+	if err != nil {
+		t.Fatalf("NewOrderMap: %v", err)
+	}
+	keys := signature.Keys{"WBIL": {bytes.Repeat([]byte{7}, 32)}}
+	svc := NewOrderService(repo, mapa, Config{DLQ: b.Sink("orders-dlq"), Signatures: signature.NewVerifier(keys)})
+
+	order := mocks.GenerateMockOrder()
+	order.Delivery.Name = "Tom & Jerry <Ltd>"
+	if err := mocks.SignOrder(order, keys); err != nil {
+		t.Fatalf("SignOrder: %v", err)
+	}
+	// подписанный заказ с & и < в данных принимается
+	raw, err := json.Marshal(order)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	svc.AddNewOrder(context.Background(), &messaging.Message{Value: raw})
+	if saved.Load() != 1 || len(b.Messages("orders-dlq")) != 0 {
+		t.Fatalf("signed order must be saved, saves = %d", saved.Load())
+	}
+
+	// измененный после подписи заказ уходит в DLQ
+	forged := *order
+	forged.OrderUID += "-forged"
+	forged.Payment.Amount++
+	raw, err = json.Marshal(&forged)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	svc.AddNewOrder(context.Background(), &messaging.Message{Value: raw})
+	dlq := b.Messages("orders-dlq")
+	if saved.Load() != 1 || len(dlq) != 1 {
+		t.Fatalf("forged order must not be saved, saves = %d, DLQ messages = %d", saved.Load(), len(dlq))
+	}
+	if reason, _ := dlq[0].Header(DLQReasonHeader); string(reason) != "signature" {
+		t.Errorf("DLQ reason = %q, want signature", reason)
+	}
+}
+
+type failingSink struct {
+	attempts atomic.Int32
+}
+
+func (s *failingSink) Topic() string { return "orders-dlq" }
+
+func (s *failingSink) Publish(ctx context.Context, msgs ...messaging.Message) error {
+	s.attempts.Add(1)
+	return errors.New("broker is unavailable")
+}
+
+func (s *failingSink) Close() error { return nil }
+
+func TestPushToDLQ_StopsRetryingOnShutdown(t *testing.T) {
+	interval := publishRetryInterval
+	publishRetryInterval = 10 * time.Millisecond
+	t.Cleanup(func() { publishRetryInterval = interval })
+
+	sink := &failingSink{}
+	svc := newTestService(t, &fakeRepo{}, 0)
+	svc.DLQ = sink
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		svc.AddNewOrder(ctx, &messaging.Message{Value: []byte(`not json`)})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("DLQ write must be abandoned when the message context is cancelled")
+	}
+	if sink.attempts.Load() < 2 {
+		t.Fatalf("DLQ write must be retried before shutdown, attempts = %d", sink.attempts.Load())
+	}
+}
+
+// flakyRegistry отвечает ошибкой failures раз, затем отдает JSON-схему
+type flakyRegistry struct {
+	failures int32
+	calls    atomic.Int32
+}
+
+func (r *flakyRegistry) Schema(ctx context.Context, id int) (*codec.Schema, error) {
+	if r.calls.Add(1) <= r.failures {
+		return nil, fmt.Errorf("%w: answered 503 Service Unavailable", codec.ErrRegistryUnavailable)
+	}
+	return &codec.Schema{ID: id, Type: codec.SchemaJSON, Definition: "{}"}, nil
+}
+
+func TestAddNewOrder_RetriesUnavailableRegistry(t *testing.T) {
+	interval := registryRetryInterval
+	registryRetryInterval = 5 * time.Millisecond
+	t.Cleanup(func() { registryRetryInterval = interval })
+
+	raw, err := json.Marshal(mocks.GenerateMockOrder())
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	// Confluent wire format: нулевой байт и ID схемы
+	framed := append([]byte{0, 0, 0, 0, 1}, raw...)
+
+	newService := func(registry codec.Registry) (*orderService, *messaging.Broker, *atomic.Int32) {
+		var saved atomic.Int32
+		repo := &fakeRepo{AddNewOrderFunc: func(ctx context.Context, o *model.Order) error {
+			saved.Add(1)
+			return nil
+		}}
+		mapa, err := cache.NewOrderMap(repo, cache.Config{Size: 10})
+		if err != nil {
+			t.Fatalf("NewOrderMap: %v", err)
+		}
+		b := messaging.NewBroker()
+		if err := b.CreateTopic("orders-dlq", 1); err != nil {
+			t.Fatalf("CreateTopic: %v", err)
+		}
+		svc := NewOrderService(repo, mapa, Config{DLQ: b.Sink("orders-dlq"), Decoder: codec.NewDecoder(registry)}).(*orderService)
+		return svc, b, &saved
+	}
+
+	// сбой реестра не делает сообщение битым: после восстановления реестра заказ сохраняется
+	registry := &flakyRegistry{failures: 3}
+	svc, b, saved := newService(registry)
+	svc.AddNewOrder(context.Background(), &messaging.Message{Value: framed})
+	if saved.Load() != 1 || len(b.Messages("orders-dlq")) != 0 || registry.calls.Load() != 4 {
+		t.Fatalf("order must be saved after registry recovers, saves = %d, DLQ messages = %d, registry calls = %d",
+			saved.Load(), len(b.Messages("orders-dlq")), registry.calls.Load())
+	}
+
+	// реестр так и не ответил до остановки - сообщение не уходит в DLQ, чтобы его доставили снова
+	svc, b, saved = newService(&flakyRegistry{failures: 1 << 30})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	svc.AddNewOrder(ctx, &messaging.Message{Value: framed})
+	if saved.Load() != 0 || len(b.Messages("orders-dlq")) != 0 {
+		t.Fatalf("message must be left for redelivery, saves = %d, DLQ messages = %d", saved.Load(), len(b.Messages("orders-dlq")))
+	}
+
+	// неизвестная схема - ошибка сообщения, а не реестра
+	svc, b, _ = newService(codecRegistryFunc(func(ctx context.Context, id int) (*codec.Schema, error) {
+		return nil, fmt.Errorf("%w: id %d", codec.ErrSchemaNotFound, id)
+	}))
+	svc.AddNewOrder(context.Background(), &messaging.Message{Value: framed})
+	dlq := b.Messages("orders-dlq")
+	if len(dlq) != 1 {
+		t.Fatalf("message with unknown schema must go to DLQ, DLQ messages = %d", len(dlq))
+	}
+	if reason, _ := dlq[0].Header(DLQReasonHeader); string(reason) != "decode" {
+		t.Errorf("DLQ reason = %q, want decode", reason)
+	}
+
+	// отказ реестра(неверные учетные данные) повторами не лечится - сообщение уходит в DLQ с отдельной причиной
+	registry = &flakyRegistry{}
+	svc, b, _ = newService(codecRegistryFunc(func(ctx context.Context, id int) (*codec.Schema, error) {
+		registry.calls.Add(1)
+		return nil, fmt.Errorf("%w: answered 401 Unauthorized", codec.ErrRegistryRejected)
+	}))
+	svc.AddNewOrder(context.Background(), &messaging.Message{Value: framed})
+	dlq = b.Messages("orders-dlq")
+	if len(dlq) != 1 || registry.calls.Load() != 1 {
+		t.Fatalf("rejected request must not be retried, DLQ messages = %d, registry calls = %d", len(dlq), registry.calls.Load())
+	}
+	if reason, _ := dlq[0].Header(DLQReasonHeader); string(reason) != "schema_registry" {
+		t.Errorf("DLQ reason = %q, want schema_registry", reason)
+	}
+}
+
+type codecRegistryFunc func(ctx context.Context, id int) (*codec.Schema, error)
+
+func (f codecRegistryFunc) Schema(ctx context.Context, id int) (*codec.Schema, error) {
+	return f(ctx, id)
+}
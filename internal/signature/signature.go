@@ -0,0 +1,155 @@
+// Package signature - HMAC-SHA256 signatures of orders in internal_signature: canonical serialization,
+// signing and verification with keys selected by order's Entry(producer)
+package signature
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"orderservice/internal/model"
+)
+
+var (
+	ErrUnsigned     = errors.New("order is not signed")
+	ErrUnknownEntry = errors.New("no signing key for entry")
+	ErrMismatch     = errors.New("signature mismatch")
+)
+
+// Keys - secrets by Entry; several keys of one entry are all accepted, so a producer can rotate its key
+// without downtime, the first one is used for signing
+type Keys map[string][][]byte
+
+// ParseKeys parses comma-separated "entry:base64secret" pairs, an entry may be repeated for rotation
+func ParseKeys(s string) (Keys, error) {
+	keys := Keys{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		entry, secret, ok := strings.Cut(pair, ":")
+		if !ok || entry == "" {
+			return nil, fmt.Errorf("signing key %q: expected entry:base64secret", pair)
+		}
+		key, err := base64.StdEncoding.DecodeString(secret)
+		if err != nil {
+			return nil, fmt.Errorf("signing key of entry %q: %w", entry, err)
+		}
+		if len(key) < 32 {
+			return nil, fmt.Errorf("signing key of entry %q must be at least 32 bytes", entry)
+		}
+		keys[entry] = append(keys[entry], key)
+	}
+	return keys, nil
+}
+
+// Entries returns entries having keys in sorted order
+func (k Keys) Entries() []string {
+	entries := make([]string, 0, len(k))
+	for e := range k {
+		entries = append(entries, e)
+	}
+	sort.Strings(entries)
+	return entries
+}
+
+// Canonical returns the signed form of order: compact JSON of every field of the order model(fields absent from
+// the message are present with zero values) except internal_signature and order_uid duplicates of nested objects,
+// with object keys sorted at every level and without HTML escaping of &, < and >.
+// Такую форму легко воспроизвести на стороне продюсера на любом языке, и она не зависит от формата сообщения
+func Canonical(o *model.Order) ([]byte, error) {
+	raw, err := json.Marshal(o)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber() // числа переносятся как есть, без округления через float64
+	var m map[string]any
+	if err := dec.Decode(&m); err != nil {
+		return nil, err
+	}
+
+	delete(m, "internal_signature")
+	// внешние ключи вложенных структур не приходят в сообщении и заполняются сервисом
+	for _, k := range []string{"delivery", "payment"} {
+		if nested, ok := m[k].(map[string]any); ok {
+			delete(nested, "OrderUID")
+		}
+	}
+	if items, ok := m["items"].([]any); ok {
+		for _, it := range items {
+			if item, ok := it.(map[string]any); ok {
+				delete(item, "OrderUID")
+			}
+		}
+	}
+	// encoding/json сортирует ключи map при сериализации
+	return marshalUnescaped(m)
+}
+
+// marshalUnescaped - json.Marshal без замены &, < и > на \u0026 и т.п., которой не делают сериализаторы других языков
+func marshalUnescaped(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// Sign returns hex-encoded HMAC-SHA256 of the canonical form of order
+func Sign(o *model.Order, key []byte) (string, error) {
+	canonical, err := Canonical(o)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(canonical)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Verifier checks internal_signature of incoming orders
+type Verifier struct {
+	keys Keys
+}
+
+// NewVerifier - orders of entries absent in keys are rejected
+func NewVerifier(keys Keys) *Verifier {
+	return &Verifier{keys: keys}
+}
+
+// Verify returns nil if internal_signature matches any key of the order's Entry
+func (v *Verifier) Verify(o *model.Order) error {
+	if o.InternalSignature == "" {
+		return ErrUnsigned
+	}
+	keys := v.keys[o.Entry]
+	if len(keys) == 0 {
+		return fmt.Errorf("%w %q", ErrUnknownEntry, o.Entry)
+	}
+	got, err := hex.DecodeString(o.InternalSignature)
+	if err != nil {
+		return fmt.Errorf("%w: not a hex string", ErrMismatch)
+	}
+	canonical, err := Canonical(o)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(canonical)
+		if hmac.Equal(got, mac.Sum(nil)) {
+			return nil
+		}
+	}
+	return ErrMismatch
+}
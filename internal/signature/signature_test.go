@@ -0,0 +1,117 @@
+package signature
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+
+	"orderservice/internal/model"
+)
+
+func testOrder() *model.Order {
+	return &model.Order{
+		OrderUID: "b563feb7b2b84b6test", TrackNumber: "WBILMTESTTRACK", Entry: "WBIL",
+		Delivery: model.Delivery{OrderUID: "b563feb7b2b84b6test", Name: "Test Testov", Email: "test@gmail.com"},
+		Payment:  model.Payment{OrderUID: "b563feb7b2b84b6test", Amount: 1817, PaymentDT: 1637907727},
+		Items:    []model.Item{{OrderUID: "b563feb7b2b84b6test", ChrtID: 9934930, Price: 453}},
+	}
+}
+
+func TestCanonical(t *testing.T) {
+	o := testOrder()
+	canonical, err := Canonical(o)
+	if err != nil {
+		t.Fatalf("Canonical: %v", err)
+	}
+	if bytes.Contains(canonical, []byte("internal_signature")) || bytes.Contains(canonical, []byte("OrderUID")) {
+		t.Errorf("canonical form must not contain signature and nested order uids: %s", canonical)
+	}
+	if !bytes.HasPrefix(canonical, []byte(`{"customer_id":`)) || !bytes.Contains(canonical, []byte(`"payment_dt":1637907727`)) {
+		t.Errorf("keys must be sorted and numbers kept as is: %s", canonical)
+	}
+
+	// подпись и внешние ключи вложенных структур на каноническую форму не влияют
+	o.InternalSignature = "abc"
+	o.Delivery.OrderUID = ""
+	again, _ := Canonical(o)
+	if !bytes.Equal(canonical, again) {
+		t.Errorf("canonical form changed:\n%s\n%s", canonical, again)
+	}
+}
+
+func TestCanonical_ProducerForm(t *testing.T) {
+	// продюсер подписывает ровно эти байты: все поля модели, отсутствующие - с нулевыми значениями, & < > без экранирования
+	o := &model.Order{
+		OrderUID: "u1", Entry: "WBIL",
+		Delivery: model.Delivery{Name: "Tom & Jerry <Ltd>", City: "Москва"},
+		Items:    []model.Item{{ChrtID: 1}},
+	}
+	want := `{"customer_id":"","date_created":"","delivery":{"address":"","city":"Москва","email":"","name":"Tom & Jerry <Ltd>","phone":"","region":"","zip":""},` +
+		`"delivery_service":"","entry":"WBIL","items":[{"brand":"","chrt_id":1,"name":"","nm_id":0,"price":0,"rid":"","sale":0,"size":"","status":0,"total_price":0,"track_number":""}],` +
+		`"locale":"","oof_shard":"","order_uid":"u1","payment":{"amount":0,"bank":"","currency":"","custom_fee":0,"delivery_cost":0,"goods_total":0,"payment_dt":0,"provider":"","request_id":"","transaction":""},` +
+		`"shardkey":"","sm_id":0,"track_number":""}`
+	got, err := Canonical(o)
+	if err != nil {
+		t.Fatalf("Canonical: %v", err)
+	}
+	if string(got) != want {
+		t.Errorf("canonical form:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	oldKey, newKey := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	v := NewVerifier(Keys{"WBIL": {newKey, oldKey}})
+
+	o := testOrder()
+	if err := v.Verify(o); !errors.Is(err, ErrUnsigned) {
+		t.Errorf("unsigned order: %v", err)
+	}
+
+	// подпись прежним ключом принимается, пока он не удален из конфигурации
+	o.InternalSignature, _ = Sign(o, oldKey)
+	if err := v.Verify(o); err != nil {
+		t.Fatalf("order signed with old key: %v", err)
+	}
+
+	o.Payment.Amount++
+	if err := v.Verify(o); !errors.Is(err, ErrMismatch) {
+		t.Errorf("tampered order: %v", err)
+	}
+	o.Payment.Amount--
+
+	o.InternalSignature = "not-hex"
+	if err := v.Verify(o); !errors.Is(err, ErrMismatch) {
+		t.Errorf("malformed signature: %v", err)
+	}
+
+	// ключ другого продюсера не подходит
+	o.Entry = "WBX"
+	o.InternalSignature, _ = Sign(o, newKey)
+	if err := v.Verify(o); !errors.Is(err, ErrUnknownEntry) {
+		t.Errorf("unknown entry: %v", err)
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	k1 := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	k2 := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))
+	keys, err := ParseKeys("WBIL:" + k1 + ", WBX:" + k2 + ",WBIL:" + k2)
+	if err != nil {
+		t.Fatalf("ParseKeys: %v", err)
+	}
+	if len(keys["WBIL"]) != 2 || len(keys["WBX"]) != 1 || strings.Join(keys.Entries(), ",") != "WBIL,WBX" {
+		t.Errorf("unexpected keys %v", keys.Entries())
+	}
+	if keys, err := ParseKeys(""); err != nil || len(keys) != 0 {
+		t.Errorf("empty value = %v, %v", keys, err)
+	}
+
+	for _, bad := range []string{"WBIL", ":" + k1, "WBIL:***", "WBIL:" + base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := ParseKeys(bad); err == nil {
+			t.Errorf("ParseKeys(%q) must fail", bad)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package tracing
+
+import (
+	"context"
+
+	"orderservice/internal/messaging"
+
+	"go.opentelemetry.io/otel"
+)
+
+// HeaderCarrier adapts Kafka message headers to propagation.TextMapCarrier
+type HeaderCarrier struct {
+	Headers *[]messaging.Header
+}
+
+// Get returns the value of the first header with the given key
+func (c HeaderCarrier) Get(key string) string {
+	for _, h := range *c.Headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+// Set replaces header with the given key or appends a new one
+func (c HeaderCarrier) Set(key, value string) {
+	for i, h := range *c.Headers {
+		if h.Key == key {
+			(*c.Headers)[i].Value = []byte(value)
+			return
+		}
+	}
+	*c.Headers = append(*c.Headers, messaging.Header{Key: key, Value: []byte(value)})
+}
+
+// Keys lists header keys
+func (c HeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(*c.Headers))
+	for _, h := range *c.Headers {
+		keys = append(keys, h.Key)
+	}
+	return keys
+}
+
+// ExtractKafka returns ctx with remote span context taken from message headers (if producer sent any)
+func ExtractKafka(ctx context.Context, msg *messaging.Message) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, HeaderCarrier{Headers: &msg.Headers})
+}
+
+// InjectKafka writes span context from ctx into message headers
+func InjectKafka(ctx context.Context, msg *messaging.Message) {
+	otel.GetTextMapPropagator().Inject(ctx, HeaderCarrier{Headers: &msg.Headers})
+}
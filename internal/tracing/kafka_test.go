@@ -0,0 +1,37 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"orderservice/internal/messaging"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestKafkaPropagation(t *testing.T) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	tp := sdktrace.NewTracerProvider()
+	defer func() { _ = tp.Shutdown(context.Background()) }()
+
+	ctx, span := tp.Tracer("test").Start(context.Background(), "produce")
+	defer span.End()
+
+	msg := messaging.Message{Headers: []messaging.Header{{Key: "traceparent", Value: []byte("stale")}, {Key: "other", Value: []byte("v")}}}
+	InjectKafka(ctx, &msg)
+
+	if len(msg.Headers) != 2 {
+		t.Fatalf("expected traceparent header to be replaced, got %v", msg.Headers)
+	}
+
+	got := trace.SpanContextFromContext(ExtractKafka(context.Background(), &msg))
+	if got.TraceID() != span.SpanContext().TraceID() || got.SpanID() != span.SpanContext().SpanID() {
+		t.Fatalf("extracted span context %v, want %v", got, span.SpanContext())
+	}
+	if !got.IsRemote() {
+		t.Errorf("extracted span context must be remote")
+	}
+}